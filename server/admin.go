@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"caro_chess_server/api"
+	"caro_chess_server/db"
+)
+
+// gameControl lets moderators see and stop the matchmaker's live games.
+type gameControl struct {
+	mm *Matchmaker
+}
+
+func (g gameControl) LiveGames() []api.LiveGame {
+	games := []api.LiveGame{}
+	for _, session := range g.mm.liveGames() {
+		st := session.state()
+		session.Lock()
+		game := api.LiveGame{
+			ID:      session.ID,
+			Code:    session.Code,
+			PlayerX: st.PlayerX,
+			PlayerO: st.PlayerO,
+			Rule:    string(st.Rule),
+			Moves:   len(st.History),
+			ArenaID: session.ArenaID,
+		}
+		session.Unlock()
+		games = append(games, game)
+	}
+	sort.Slice(games, func(i, j int) bool { return games[i].ID < games[j].ID })
+	return games
+}
+
+func (g gameControl) EndGame(id, winner string) error {
+	session, ok := g.mm.liveGame(id)
+	if !ok || !g.mm.conclude(session, winner, &GameOverMessage{Reason: "adjudicated"}, nil) {
+		return api.ErrGameNotFound
+	}
+	return nil
+}
+
+func (g gameControl) AbortGame(id string) error {
+	session, ok := g.mm.liveGame(id)
+	if !ok || !g.mm.abort(session, "aborted") {
+		return api.ErrGameNotFound
+	}
+	return nil
+}
+
+// grantAdmin makes the user with the given username an admin, so the
+// first admin can be set up from the command line.
+func grantAdmin(store Store, username string) error {
+	cred, err := store.GetCredentialByUsername(username)
+	if err != nil {
+		return fmt.Errorf("user %q: %w", username, err)
+	}
+	if err := store.SetUserRole(cred.UserID, db.RoleAdmin); err != nil {
+		return err
+	}
+	return store.RecordAudit(&db.AuditEntry{
+		ActorID:  "cli",
+		Action:   "user.role",
+		TargetID: cred.UserID,
+		Reason:   "granted from the command line",
+		Details:  "role=" + string(db.RoleAdmin),
+	})
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"caro_chess_server/api"
+	"caro_chess_server/db"
+	"caro_chess_server/elo"
+	"github.com/gorilla/websocket"
+)
+
+// startLiveGame matches alice and bob and returns their connections, X
+// first, and the game's ID.
+func startLiveGame(t *testing.T, repo db.UserRepository) (gameControl, *websocket.Conn, *websocket.Conn, string) {
+	hub := newHub()
+	go hub.run()
+	mm := newMatchmaker(repo)
+	go mm.run()
+	rm := newRoomManager()
+	go rm.run()
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveWs(hub, mm, rm, w, r, r.URL.Query().Get("id"))
+	}))
+	t.Cleanup(s.Close)
+	u := "ws" + strings.TrimPrefix(s.URL, "http")
+
+	alice, bob := dialAs(t, u, "alice"), dialAs(t, u, "bob")
+	t.Cleanup(func() { alice.Close(); bob.Close() })
+	sendJSON(t, alice, map[string]interface{}{"type": "FIND_MATCH"})
+	sendJSON(t, bob, map[string]interface{}{"type": "FIND_MATCH"})
+	x, o := alice, bob
+	if readType(t, alice, "MATCH_FOUND")["color"] != "X" {
+		x, o = bob, alice
+	}
+	readType(t, bob, "MATCH_FOUND")
+
+	games := gameControl{mm: mm}
+	live := games.LiveGames()
+	if len(live) != 1 {
+		t.Fatalf("LiveGames = %v, want the one game", live)
+	}
+	return games, x, o, live[0].ID
+}
+
+func TestAdminAbortGame(t *testing.T) {
+	repo := db.NewMemoryUserRepository()
+	games, x, o, id := startLiveGame(t, repo)
+
+	if err := games.AbortGame(id); err != nil {
+		t.Fatalf("AbortGame: %v", err)
+	}
+	for _, c := range []*websocket.Conn{x, o} {
+		if over := readType(t, c, "GAME_OVER"); over["reason"] != "aborted" || over["winner"] != "" {
+			t.Errorf("GAME_OVER = %v, want aborted with no winner", over)
+		}
+	}
+	if err := games.AbortGame(id); !errors.Is(err, api.ErrGameNotFound) {
+		t.Errorf("Aborting again = %v, want ErrGameNotFound", err)
+	}
+	if live := games.LiveGames(); len(live) != 0 {
+		t.Errorf("LiveGames after abort = %v, want none", live)
+	}
+	for _, id := range []string{"alice", "bob"} {
+		if user, _ := repo.GetUser(id); user != nil && (user.ELO != elo.DefaultRating || user.GamesPlayed != 0) {
+			t.Errorf("%s after abort = %+v, want unrated", id, user)
+		}
+	}
+}
+
+func TestAdminEndGame(t *testing.T) {
+	repo := db.NewMemoryUserRepository()
+	games, x, o, id := startLiveGame(t, repo)
+
+	if err := games.EndGame(id, "O"); err != nil {
+		t.Fatalf("EndGame: %v", err)
+	}
+	for _, c := range []*websocket.Conn{x, o} {
+		if over := readType(t, c, "GAME_OVER"); over["reason"] != "adjudicated" || over["winner"] != "O" {
+			t.Errorf("GAME_OVER = %v, want adjudicated to O", over)
+		}
+	}
+	if err := games.EndGame(id, "X"); !errors.Is(err, api.ErrGameNotFound) {
+		t.Errorf("Ending again = %v, want ErrGameNotFound", err)
+	}
+}
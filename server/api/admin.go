@@ -0,0 +1,425 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"caro_chess_server/auth"
+	"caro_chess_server/db"
+)
+
+// LiveGame is a game in progress, as moderators see it.
+type LiveGame struct {
+	ID      string `json:"id"`
+	Code    string `json:"code,omitempty"` // Room games only
+	PlayerX string `json:"player_x"`
+	PlayerO string `json:"player_o"`
+	Rule    string `json:"rule"`
+	Moves   int    `json:"moves"`
+	ArenaID string `json:"arena_id,omitempty"`
+}
+
+var ErrGameNotFound = errors.New("game not found")
+
+// GameControl lets moderators see and stop live games.
+type GameControl interface {
+	LiveGames() []LiveGame
+	// EndGame ends a game with a result, rated as usual. winner is "X", "O"
+	// or "" for a draw.
+	EndGame(id, winner string) error
+	// AbortGame ends a game with no result and no rating changes.
+	AbortGame(id string) error
+}
+
+// SanctionEnforcer applies a new sanction to its user's live connections.
+type SanctionEnforcer interface {
+	Enforce(s *db.Sanction)
+}
+
+// AdminRequest is the body of every admin action. Reason is required and
+// goes in the audit log; the other fields depend on the action.
+type AdminRequest struct {
+	Reason   string          `json:"reason"`
+	Winner   string          `json:"winner"`   // games/{id}/end
+	Kind     db.SanctionKind `json:"kind"`     // users/{id}/sanctions
+	Duration int             `json:"duration"` // users/{id}/sanctions, in seconds; 0 until lifted
+	Note     string          `json:"note"`     // sanctions/{id}/appeal
+	Amount   int             `json:"amount"`   // users/{id}/coins
+	Role     db.Role         `json:"role"`     // users/{id}/role
+}
+
+type AdminHandler struct {
+	Repo     db.UserRepository
+	Store    db.AdminRepository
+	Games    GameControl
+	Enforcer SanctionEnforcer
+	Tokens   *auth.Tokens
+}
+
+func NewAdminHandler(repo db.UserRepository, admin db.AdminRepository, games GameControl, enforcer SanctionEnforcer, tokens *auth.Tokens) *AdminHandler {
+	return &AdminHandler{Repo: repo, Store: admin, Games: games, Enforcer: enforcer, Tokens: tokens}
+}
+
+// Admin serves /admin/. Moderators may use:
+//
+//	GET  /admin/games                  live games
+//	POST /admin/games/{id}/end         end with a result: {"winner": "X"|"O"|"", "reason"}
+//	POST /admin/games/{id}/abort       end with no result: {"reason"}
+//	GET  /admin/users/{id}/sanctions   a user's sanctions
+//	POST /admin/users/{id}/sanctions   sanction: {"kind": "ban"|"suspend"|"mute", "duration", "reason"}
+//	POST /admin/sanctions/{id}/appeal  note the user's appeal: {"note", "reason"}
+//	POST /admin/sanctions/{id}/lift    lift a sanction: {"reason"}
+//
+// and admins as well:
+//
+//	POST /admin/users/{id}/coins       add or take coins: {"amount", "reason"}
+//	POST /admin/users/{id}/role        set the role, logging the user out: {"role", "reason"}
+//	POST /admin/users/{id}/migration   a token to hand a user from before passwords: {"reason"}
+//	GET  /admin/audit                  the audit log; ?target= and ?limit= filter it
+//
+// Every action is recorded in the audit log.
+func (h *AdminHandler) Admin(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin"), "/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "games" && r.Method == http.MethodGet:
+		writeJSON(w, h.Games.LiveGames())
+	case len(parts) == 3 && parts[0] == "games" && r.Method == http.MethodPost:
+		h.gameAction(w, r, parts[1], parts[2])
+	case len(parts) == 3 && parts[0] == "users" && parts[2] == "sanctions":
+		if r.Method == http.MethodGet {
+			h.listSanctions(w, parts[1])
+		} else if r.Method == http.MethodPost {
+			h.sanction(w, r, parts[1])
+		} else {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	case len(parts) == 3 && parts[0] == "sanctions" && parts[2] == "lift" && r.Method == http.MethodPost:
+		h.liftSanction(w, r, parts[1])
+	case len(parts) == 3 && parts[0] == "sanctions" && parts[2] == "appeal" && r.Method == http.MethodPost:
+		h.noteAppeal(w, r, parts[1])
+	case len(parts) == 3 && parts[0] == "users" && parts[2] == "coins" && r.Method == http.MethodPost:
+		if requireAdmin(w, r) {
+			h.adjustCoins(w, r, parts[1])
+		}
+	case len(parts) == 3 && parts[0] == "users" && parts[2] == "role" && r.Method == http.MethodPost:
+		if requireAdmin(w, r) {
+			h.setRole(w, r, parts[1])
+		}
+	case len(parts) == 3 && parts[0] == "users" && parts[2] == "migration" && r.Method == http.MethodPost:
+		if requireAdmin(w, r) {
+			h.migrationToken(w, r, parts[1])
+		}
+	case len(parts) == 1 && parts[0] == "audit" && r.Method == http.MethodGet:
+		if requireAdmin(w, r) {
+			h.listAudit(w, r)
+		}
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
+
+func (h *AdminHandler) gameAction(w http.ResponseWriter, r *http.Request, id, action string) {
+	req, ok := decodeAdminRequest(w, r)
+	if !ok {
+		return
+	}
+	var err error
+	details := ""
+	switch action {
+	case "end":
+		if req.Winner != "X" && req.Winner != "O" && req.Winner != "" {
+			http.Error(w, "Winner must be X, O or empty for a draw", http.StatusBadRequest)
+			return
+		}
+		err = h.Games.EndGame(id, req.Winner)
+		details = "winner=" + req.Winner
+	case "abort":
+		err = h.Games.AbortGame(id)
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, ErrGameNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to stop game", http.StatusInternalServerError)
+		return
+	}
+	h.audit(r, "game."+action, id, req.Reason, details)
+	writeJSON(w, map[string]string{"status": "ok"})
+}
+
+func (h *AdminHandler) listSanctions(w http.ResponseWriter, userID string) {
+	sanctions, err := h.Store.ListSanctions(userID)
+	if err != nil {
+		http.Error(w, "Failed to fetch sanctions", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, sanctions)
+}
+
+func (h *AdminHandler) sanction(w http.ResponseWriter, r *http.Request, userID string) {
+	req, ok := decodeAdminRequest(w, r)
+	if !ok {
+		return
+	}
+	if req.Kind != db.SanctionBan && req.Kind != db.SanctionSuspend && req.Kind != db.SanctionMute {
+		http.Error(w, "Kind must be ban, suspend or mute", http.StatusBadRequest)
+		return
+	}
+	if req.Duration < 0 {
+		http.Error(w, "Duration must not be negative", http.StatusBadRequest)
+		return
+	}
+	if !h.outranks(w, r, userID) {
+		return
+	}
+
+	actor, _ := auth.UserID(r.Context())
+	sanction := &db.Sanction{UserID: userID, Kind: req.Kind, Reason: req.Reason, IssuedBy: actor}
+	if req.Duration > 0 {
+		sanction.ExpiresAt = time.Now().Add(time.Duration(req.Duration) * time.Second)
+	}
+	if err := h.Store.CreateSanction(sanction); err != nil {
+		http.Error(w, "Failed to save sanction", http.StatusInternalServerError)
+		return
+	}
+	h.Enforcer.Enforce(sanction)
+	if req.Kind == db.SanctionBan {
+		// Log them out everywhere.
+		if err := h.Tokens.RevokeUser(userID); err != nil {
+			log.Printf("Revoking sessions of banned user %s: %v", userID, err)
+		}
+	}
+	details := fmt.Sprintf("sanction=%d", sanction.ID)
+	if req.Duration > 0 {
+		details += fmt.Sprintf(" duration=%ds", req.Duration)
+	}
+	h.audit(r, "sanction."+string(req.Kind), userID, req.Reason, details)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(sanction)
+}
+
+func (h *AdminHandler) liftSanction(w http.ResponseWriter, r *http.Request, idParam string) {
+	id, err := strconv.ParseInt(idParam, 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid sanction ID", http.StatusBadRequest)
+		return
+	}
+	req, ok := decodeAdminRequest(w, r)
+	if !ok {
+		return
+	}
+	sanction, err := h.Store.GetSanction(id)
+	if errors.Is(err, db.ErrNotFound) {
+		http.Error(w, "Sanction not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch sanction", http.StatusInternalServerError)
+		return
+	}
+
+	actor, _ := auth.UserID(r.Context())
+	err = h.Store.LiftSanction(id, actor)
+	if errors.Is(err, db.ErrNotFound) {
+		http.Error(w, "Sanction already lifted", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to lift sanction", http.StatusInternalServerError)
+		return
+	}
+	h.audit(r, "sanction.lift", sanction.UserID, req.Reason, fmt.Sprintf("sanction=%d", id))
+	writeJSON(w, map[string]string{"status": "lifted"})
+}
+
+func (h *AdminHandler) noteAppeal(w http.ResponseWriter, r *http.Request, idParam string) {
+	id, err := strconv.ParseInt(idParam, 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid sanction ID", http.StatusBadRequest)
+		return
+	}
+	req, ok := decodeAdminRequest(w, r)
+	if !ok {
+		return
+	}
+	if strings.TrimSpace(req.Note) == "" {
+		http.Error(w, "A note is required", http.StatusBadRequest)
+		return
+	}
+	sanction, err := h.Store.GetSanction(id)
+	if errors.Is(err, db.ErrNotFound) {
+		http.Error(w, "Sanction not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch sanction", http.StatusInternalServerError)
+		return
+	}
+	if err := h.Store.SetAppealNote(id, req.Note); err != nil {
+		http.Error(w, "Failed to save appeal note", http.StatusInternalServerError)
+		return
+	}
+	h.audit(r, "sanction.appeal", sanction.UserID, req.Reason, fmt.Sprintf("sanction=%d", id))
+	writeJSON(w, map[string]string{"status": "ok"})
+}
+
+func (h *AdminHandler) adjustCoins(w http.ResponseWriter, r *http.Request, userID string) {
+	req, ok := decodeAdminRequest(w, r)
+	if !ok {
+		return
+	}
+	if req.Amount == 0 {
+		http.Error(w, "Amount must not be zero", http.StatusBadRequest)
+		return
+	}
+	err := h.Repo.UpdateUserCoins(userID, req.Amount)
+	if errors.Is(err, db.ErrNotFound) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, db.ErrInsufficientCoins) {
+		http.Error(w, "Balance can't go below zero", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to update coins", http.StatusInternalServerError)
+		return
+	}
+	user, err := h.Repo.FindUser(userID)
+	if err != nil {
+		http.Error(w, "Failed to fetch balance", http.StatusInternalServerError)
+		return
+	}
+	balance := user.Coins
+	h.audit(r, "coins.adjust", userID, req.Reason, fmt.Sprintf("amount=%+d balance=%d", req.Amount, balance))
+	writeJSON(w, map[string]interface{}{"status": "success", "new_balance": balance})
+}
+
+func (h *AdminHandler) setRole(w http.ResponseWriter, r *http.Request, userID string) {
+	req, ok := decodeAdminRequest(w, r)
+	if !ok {
+		return
+	}
+	if !req.Role.Valid() {
+		http.Error(w, "Role must be player, moderator or admin", http.StatusBadRequest)
+		return
+	}
+	err := h.Store.SetUserRole(userID, req.Role)
+	if errors.Is(err, db.ErrNotFound) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to set role", http.StatusInternalServerError)
+		return
+	}
+	// Tokens carry the role from when they were issued, so log the user
+	// out everywhere; they get the new role when they log back in.
+	if err := h.Tokens.RevokeUser(userID); err != nil {
+		log.Printf("Revoking sessions of user %s after a role change: %v", userID, err)
+	}
+	h.audit(r, "user.role", userID, req.Reason, "role="+string(req.Role))
+	writeJSON(w, map[string]string{"status": "ok"})
+}
+
+// migrationToken issues the token a user from before passwords existed
+// logs in by ID with to set one. The admin hands it to the user.
+func (h *AdminHandler) migrationToken(w http.ResponseWriter, r *http.Request, userID string) {
+	req, ok := decodeAdminRequest(w, r)
+	if !ok {
+		return
+	}
+	if _, err := h.Repo.FindUser(userID); err != nil || db.IsGuestID(userID) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	token, err := h.Tokens.Migration(userID)
+	if err != nil {
+		http.Error(w, "Failed to issue token", http.StatusInternalServerError)
+		return
+	}
+	h.audit(r, "user.migration", userID, req.Reason, "")
+	writeJSON(w, map[string]string{"migration_token": token})
+}
+
+func (h *AdminHandler) listAudit(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	if l := r.URL.Query().Get("limit"); l != "" {
+		if n, err := strconv.Atoi(l); err == nil && n > 0 && n <= 1000 {
+			limit = n
+		}
+	}
+	entries, err := h.Store.ListAudit(r.URL.Query().Get("target"), limit)
+	if err != nil {
+		http.Error(w, "Failed to fetch audit log", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, entries)
+}
+
+// outranks refuses the request unless its user outranks userID, so
+// moderators can't sanction each other or admins.
+func (h *AdminHandler) outranks(w http.ResponseWriter, r *http.Request, userID string) bool {
+	target, err := h.Repo.FindUser(userID)
+	if errors.Is(err, db.ErrNotFound) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return false
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch user", http.StatusInternalServerError)
+		return false
+	}
+	role := auth.UserRole(r.Context())
+	if target.Role.AtLeast(role) && target.Role.AtLeast(db.RoleModerator) {
+		http.Error(w, "Cannot sanction staff of equal or higher rank", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// audit records an action by the request's user. The action has already
+// happened, so a failure is only logged.
+func (h *AdminHandler) audit(r *http.Request, action, targetID, reason, details string) {
+	actor, _ := auth.UserID(r.Context())
+	entry := &db.AuditEntry{ActorID: actor, Action: action, TargetID: targetID, Reason: reason, Details: details}
+	if err := h.Store.RecordAudit(entry); err != nil {
+		log.Printf("Audit: failed to record %s on %s by %s: %v", action, targetID, actor, err)
+	}
+}
+
+func decodeAdminRequest(w http.ResponseWriter, r *http.Request) (*AdminRequest, bool) {
+	var req AdminRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return nil, false
+	}
+	if strings.TrimSpace(req.Reason) == "" {
+		http.Error(w, "A reason is required", http.StatusBadRequest)
+		return nil, false
+	}
+	return &req, true
+}
+
+func requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if !auth.UserRole(r.Context()).AtLeast(db.RoleAdmin) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,137 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"caro_chess_server/db"
+	"caro_chess_server/tournament"
+)
+
+type ArenaHandler struct {
+	Repo    db.UserRepository
+	Manager *tournament.ArenaManager
+}
+
+func NewArenaHandler(repo db.UserRepository, manager *tournament.ArenaManager) *ArenaHandler {
+	return &ArenaHandler{Repo: repo, Manager: manager}
+}
+
+type CreateArenaRequest struct {
+	Name     string              `json:"name"`
+	Duration int                 `json:"duration"` // seconds
+	Settings tournament.Settings `json:"settings"`
+}
+
+// Arenas serves /arenas: GET lists arenas, POST creates one.
+func (h *ArenaHandler) Arenas(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(h.Manager.List())
+	case http.MethodPost:
+		userID, ok := actingUser(w, r, "")
+		if !ok {
+			return
+		}
+		var req CreateArenaRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		a, err := h.Manager.Create(userID, req.Name, time.Duration(req.Duration)*time.Second, req.Settings)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(a)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Arena serves /arenas/{id}, /arenas/{id}/join and /arenas/{id}/start.
+func (h *ArenaHandler) Arena(w http.ResponseWriter, r *http.Request) {
+	pathParts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	// Expected path: /arenas/{id}[/action]
+	if len(pathParts) < 2 || pathParts[1] == "" {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	id := pathParts[1]
+	action := ""
+	if len(pathParts) > 2 {
+		action = pathParts[2]
+	}
+
+	switch action {
+	case "":
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		a, err := h.Manager.Get(id)
+		if errors.Is(err, tournament.ErrNotFound) {
+			// Arenas from before a restart only survive as persisted results.
+			results, err := h.Repo.GetTournamentResults(id)
+			if err != nil || len(results) == 0 {
+				http.Error(w, "Arena not found", http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{"id": id, "status": tournament.StatusFinished, "results": results})
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(a)
+	case "join":
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req RegisterTournamentRequest
+		if err := decodeOptional(r, &req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		userID, ok := actingUser(w, r, req.UserID)
+		if !ok {
+			return
+		}
+		user, err := h.Repo.GetUser(userID)
+		if err != nil || user == nil {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		if err := h.Manager.Join(id, user.ID, user.ELO); err != nil {
+			writeTournamentError(w, err)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"status": "joined"})
+	case "start":
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		a, err := h.Manager.Get(id)
+		if err != nil {
+			writeTournamentError(w, err)
+			return
+		}
+		if !canManage(w, r, a.CreatedBy) {
+			return
+		}
+		if err := h.Manager.Start(id); err != nil {
+			writeTournamentError(w, err)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"status": "started"})
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
@@ -0,0 +1,50 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"caro_chess_server/auth"
+	"caro_chess_server/db"
+)
+
+// actingUser returns the authenticated user a request acts as, or refuses
+// it. claimed is a user ID named in the request, which older clients still
+// send; if set it must be the same user.
+func actingUser(w http.ResponseWriter, r *http.Request, claimed string) (string, bool) {
+	id, ok := auth.UserID(r.Context())
+	if !ok {
+		http.Error(w, "Authentication required", http.StatusUnauthorized)
+		return "", false
+	}
+	if claimed != "" && claimed != id {
+		http.Error(w, "Cannot act as another user", http.StatusForbidden)
+		return "", false
+	}
+	return id, true
+}
+
+// canManage reports whether the authenticated user of r may start an event
+// created by createdBy: only its creator and moderators may. It refuses the
+// request if not.
+func canManage(w http.ResponseWriter, r *http.Request, createdBy string) bool {
+	userID, ok := actingUser(w, r, "")
+	if !ok {
+		return false
+	}
+	if userID != createdBy && !auth.UserRole(r.Context()).AtLeast(db.RoleModerator) {
+		http.Error(w, "Only the creator or a moderator can do this", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// decodeOptional decodes a JSON body that may be empty.
+func decodeOptional(r *http.Request, v interface{}) error {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	return nil
+}
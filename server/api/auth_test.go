@@ -0,0 +1,155 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"caro_chess_server/auth"
+	"caro_chess_server/db"
+	"caro_chess_server/db/sqlite"
+	"caro_chess_server/tournament"
+)
+
+// serveAs sends a POST with body to handler as userID with role.
+func serveAs(handler http.HandlerFunc, path, userID string, role db.Role, body interface{}) *httptest.ResponseRecorder {
+	data, _ := json.Marshal(body)
+	req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(data))
+	req = req.WithContext(auth.WithRole(auth.WithUserID(req.Context(), userID), role))
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	return rec
+}
+
+func TestOnlyCreatorOrModeratorStartsEvents(t *testing.T) {
+	repo := db.NewMemoryUserRepository()
+	tournaments := NewTournamentHandler(repo, tournament.NewManager(nil, nil))
+	brackets := NewBracketHandler(repo, tournament.NewKnockoutManager(nil, nil))
+	arenas := NewArenaHandler(repo, tournament.NewArenaManager(nil, nil))
+
+	events := []struct {
+		name           string
+		create, manage http.HandlerFunc
+		path           string
+		body           interface{}
+	}{
+		{"tournament", tournaments.Tournaments, tournaments.Tournament, "/tournaments", CreateTournamentRequest{Name: "Open", Rounds: 3}},
+		{"bracket", brackets.Brackets, brackets.Bracket, "/brackets", map[string]string{"name": "Cup"}},
+		{"arena", arenas.Arenas, arenas.Arena, "/arenas", CreateArenaRequest{Name: "Blitz", Duration: 600}},
+	}
+	for _, e := range events {
+		rec := serveAs(e.create, e.path, "alice", db.RolePlayer, e.body)
+		var created struct {
+			ID        string `json:"id"`
+			CreatedBy string `json:"created_by"`
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&created); err != nil || rec.Code != http.StatusCreated || created.CreatedBy != "alice" {
+			t.Fatalf("Creating a %s = %d, %+v", e.name, rec.Code, created)
+		}
+		start := e.path + "/" + created.ID + "/start"
+
+		for _, stranger := range []string{"mallory", db.GuestIDPrefix + "1"} {
+			if rec := serveAs(e.manage, start, stranger, db.RolePlayer, nil); rec.Code != http.StatusForbidden {
+				t.Errorf("%s started by %s = %d, want 403", e.name, stranger, rec.Code)
+			}
+		}
+		// Starting may still fail for want of players, but not for lack of rights.
+		if rec := serveAs(e.manage, start, "mod", db.RoleModerator, nil); rec.Code == http.StatusForbidden {
+			t.Errorf("%s started by a moderator = 403", e.name)
+		}
+	}
+
+	rec := serveAs(arenas.Arenas, "/arenas", "alice", db.RolePlayer, CreateArenaRequest{Name: "Bullet", Duration: 600})
+	var arena struct{ ID string }
+	json.NewDecoder(rec.Body).Decode(&arena)
+	if rec := serveAs(arenas.Arena, "/arenas/"+arena.ID+"/start", "alice", db.RolePlayer, nil); rec.Code != http.StatusOK {
+		t.Errorf("Arena started by its creator = %d, want 200", rec.Code)
+	}
+}
+
+func TestAdminIssuesMigrationTokens(t *testing.T) {
+	store, err := sqlite.NewSQLiteStore(filepath.Join(t.TempDir(), "admin.db"))
+	if err != nil {
+		t.Fatalf("NewSQLiteStore: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	tokens, err := auth.NewTokens(nil, store, time.Minute, time.Hour)
+	if err != nil {
+		t.Fatalf("NewTokens: %v", err)
+	}
+	admin := NewAdminHandler(store, store, nil, nil, tokens)
+	store.SaveUser(&db.User{ID: "legacy", ELO: 1500})
+	body := AdminRequest{Reason: "Verified by email"}
+
+	if rec := serveAs(admin.Admin, "/admin/users/legacy/migration", "mod", db.RoleModerator, body); rec.Code != http.StatusForbidden {
+		t.Errorf("Moderator issuing a migration token = %d, want 403", rec.Code)
+	}
+	if rec := serveAs(admin.Admin, "/admin/users/nobody/migration", "root", db.RoleAdmin, body); rec.Code != http.StatusNotFound {
+		t.Errorf("Migration token for an unknown user = %d, want 404", rec.Code)
+	}
+	rec := serveAs(admin.Admin, "/admin/users/legacy/migration", "root", db.RoleAdmin, body)
+	var issued struct {
+		MigrationToken string `json:"migration_token"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&issued); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("Migration token = %d, %v", rec.Code, err)
+	}
+
+	login := auth.NewAuthHandler(store, store, tokens)
+	rec = serveAs(login.Login, "/login", "", "", auth.LoginRequest{ID: "legacy", MigrationToken: issued.MigrationToken})
+	var resp auth.TokenResponse
+	json.NewDecoder(rec.Body).Decode(&resp)
+	if rec.Code != http.StatusOK || !resp.SetPasswordRequired || resp.ID != "legacy" {
+		t.Errorf("Legacy login with the issued token = %d, %+v", rec.Code, resp)
+	}
+}
+
+func TestAdminUserChanges(t *testing.T) {
+	store, err := sqlite.NewSQLiteStore(filepath.Join(t.TempDir(), "admin.db"))
+	if err != nil {
+		t.Fatalf("NewSQLiteStore: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	tokens, err := auth.NewTokens(nil, store, time.Minute, time.Hour)
+	if err != nil {
+		t.Fatalf("NewTokens: %v", err)
+	}
+	admin := NewAdminHandler(store, store, nil, nil, tokens)
+	store.SaveUser(&db.User{ID: "alice", ELO: 1200, Coins: 100})
+
+	if rec := serveAs(admin.Admin, "/admin/users/nobody/coins", "root", db.RoleAdmin, AdminRequest{Amount: 50, Reason: "typo"}); rec.Code != http.StatusNotFound {
+		t.Errorf("Coins for an unknown user = %d, want 404", rec.Code)
+	}
+	if _, err := store.FindUser("nobody"); err == nil {
+		t.Error("Adjusting the coins of an unknown user created it")
+	}
+	if rec := serveAs(admin.Admin, "/admin/users/alice/coins", "root", db.RoleAdmin, AdminRequest{Amount: -101, Reason: "refund"}); rec.Code != http.StatusBadRequest {
+		t.Errorf("Overdrawing = %d, want 400", rec.Code)
+	}
+	rec := serveAs(admin.Admin, "/admin/users/alice/coins", "root", db.RoleAdmin, AdminRequest{Amount: -40, Reason: "refund"})
+	var adjusted struct {
+		NewBalance int `json:"new_balance"`
+	}
+	if json.NewDecoder(rec.Body).Decode(&adjusted); rec.Code != http.StatusOK || adjusted.NewBalance != 60 {
+		t.Errorf("Taking 40 coins = %d, balance %d; want 60", rec.Code, adjusted.NewBalance)
+	}
+
+	// A role change logs the user out, so their tokens don't keep the old one.
+	pair, err := tokens.Issue("alice")
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+	if rec := serveAs(admin.Admin, "/admin/users/alice/role", "root", db.RoleAdmin, AdminRequest{Role: db.RoleModerator, Reason: "helper"}); rec.Code != http.StatusOK {
+		t.Fatalf("Setting the role = %d", rec.Code)
+	}
+	if _, err := tokens.Validate(pair.Access); err == nil {
+		t.Error("A token from before the role change is still valid")
+	}
+	if rec := serveAs(admin.Admin, "/admin/users/nobody/sanctions", "mod", db.RoleModerator, AdminRequest{Kind: db.SanctionMute, Reason: "spam"}); rec.Code != http.StatusNotFound {
+		t.Errorf("Sanctioning an unknown user = %d, want 404", rec.Code)
+	}
+}
@@ -0,0 +1,135 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"caro_chess_server/db"
+	"caro_chess_server/tournament"
+)
+
+type BracketHandler struct {
+	Repo    db.UserRepository
+	Manager *tournament.KnockoutManager
+}
+
+func NewBracketHandler(repo db.UserRepository, manager *tournament.KnockoutManager) *BracketHandler {
+	return &BracketHandler{Repo: repo, Manager: manager}
+}
+
+type CreateBracketRequest struct {
+	Name     string                   `json:"name"`
+	Format   tournament.BracketFormat `json:"format"`
+	BestOf   int                      `json:"best_of"`
+	TieBreak tournament.TieBreak      `json:"tie_break"`
+	Settings tournament.Settings      `json:"settings"`
+}
+
+// Brackets serves /brackets: GET lists brackets, POST creates one.
+func (h *BracketHandler) Brackets(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(h.Manager.List())
+	case http.MethodPost:
+		userID, ok := actingUser(w, r, "")
+		if !ok {
+			return
+		}
+		req := CreateBracketRequest{
+			Format:   tournament.SingleElimination,
+			BestOf:   1,
+			TieBreak: tournament.TieBreakArmageddon,
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		b, err := h.Manager.Create(userID, req.Name, req.Format, req.BestOf, req.TieBreak, req.Settings)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(b)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Bracket serves /brackets/{id}, /brackets/{id}/register and
+// /brackets/{id}/start.
+func (h *BracketHandler) Bracket(w http.ResponseWriter, r *http.Request) {
+	pathParts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	// Expected path: /brackets/{id}[/action]
+	if len(pathParts) < 2 || pathParts[1] == "" {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	id := pathParts[1]
+	action := ""
+	if len(pathParts) > 2 {
+		action = pathParts[2]
+	}
+
+	switch action {
+	case "":
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		b, err := h.Manager.Get(id)
+		if err != nil {
+			writeTournamentError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(b)
+	case "register":
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req RegisterTournamentRequest
+		if err := decodeOptional(r, &req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		userID, ok := actingUser(w, r, req.UserID)
+		if !ok {
+			return
+		}
+		user, err := h.Repo.GetUser(userID)
+		if err != nil || user == nil {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		if err := h.Manager.Register(id, user.ID, user.ELO); err != nil {
+			writeTournamentError(w, err)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"status": "registered"})
+	case "start":
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		b, err := h.Manager.Get(id)
+		if err != nil {
+			writeTournamentError(w, err)
+			return
+		}
+		if !canManage(w, r, b.CreatedBy) {
+			return
+		}
+		if err := h.Manager.Start(id); err != nil {
+			writeTournamentError(w, err)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"status": "started"})
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
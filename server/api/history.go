@@ -75,3 +75,50 @@ func (h *HistoryHandler) GetMatch(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(match)
 }
+
+// RatingPoint is a user's rating at the end of a day.
+type RatingPoint struct {
+	Date   string `json:"date"` // YYYY-MM-DD (UTC)
+	Rating int    `json:"rating"`
+	Games  int    `json:"games"`
+}
+
+func (h *HistoryHandler) GetRatingHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	pathParts := strings.Split(r.URL.Path, "/")
+	// Expected path: /users/{id}/rating-history
+	if len(pathParts) < 3 {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	userID := pathParts[2]
+
+	changes, err := h.Repo.GetRatingHistory(userID)
+	if err != nil {
+		http.Error(w, "Failed to fetch rating history", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(dailyRatingPoints(changes))
+}
+
+// dailyRatingPoints collapses chronologically ordered rating changes into one
+// point per day holding the rating after that day's last game.
+func dailyRatingPoints(changes []*db.RatingChange) []RatingPoint {
+	points := []RatingPoint{}
+	for _, c := range changes {
+		date := c.Timestamp.UTC().Format("2006-01-02")
+		if n := len(points); n > 0 && points[n-1].Date == date {
+			points[n-1].Rating = c.After
+			points[n-1].Games++
+			continue
+		}
+		points = append(points, RatingPoint{Date: date, Rating: c.After, Games: 1})
+	}
+	return points
+}
@@ -0,0 +1,62 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Room states in the public lobby.
+const (
+	RoomWaiting = "waiting" // Waiting for an opponent
+	RoomPlaying = "playing" // Live game open to spectators
+	// Not listed
+	RoomFinished = "finished"
+	RoomClosed   = "closed"
+)
+
+// RoomInfo describes a public room in the lobby.
+type RoomInfo struct {
+	Code       string  `json:"code"`
+	State      string  `json:"state"`
+	Rule       string  `json:"rule"`
+	TotalTime  float64 `json:"total_time"` // seconds
+	Increment  float64 `json:"increment"`
+	TurnLimit  float64 `json:"turn_limit"`
+	PlayerX    string  `json:"player_x"`
+	PlayerO    string  `json:"player_o,omitempty"`
+	RatingX    int     `json:"rating_x,omitempty"`
+	RatingO    int     `json:"rating_o,omitempty"`
+	Spectators int     `json:"spectators"`
+}
+
+// RoomLister lists the public rooms.
+type RoomLister interface {
+	PublicRooms() []RoomInfo
+}
+
+type RoomHandler struct {
+	Rooms RoomLister
+}
+
+func NewRoomHandler(rooms RoomLister) *RoomHandler {
+	return &RoomHandler{Rooms: rooms}
+}
+
+// ListRooms serves /rooms. ?state=waiting or ?state=playing filters the list.
+func (h *RoomHandler) ListRooms(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	state := r.URL.Query().Get("state")
+	rooms := []RoomInfo{}
+	for _, room := range h.Rooms.PublicRooms() {
+		if state == "" || room.State == state {
+			rooms = append(rooms, room)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rooms)
+}
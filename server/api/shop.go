@@ -2,6 +2,7 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 
 	"caro_chess_server/db"
@@ -70,7 +71,7 @@ func (h *ShopHandler) GetShopItems(w http.ResponseWriter, r *http.Request) {
 }
 
 type BuyRequest struct {
-	UserID string `json:"user_id"`
+	UserID string `json:"user_id"` // Optional; must be the authenticated user
 	ItemID string `json:"item_id"`
 }
 
@@ -85,9 +86,13 @@ func (h *ShopHandler) BuyItem(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
+	userID, ok := actingUser(w, r, req.UserID)
+	if !ok {
+		return
+	}
 
 	// 1. Check if user has enough coins
-	user, err := h.Repo.GetUser(req.UserID)
+	user, err := h.Repo.GetUser(userID)
 	if err != nil || user == nil {
 		http.Error(w, "User not found", http.StatusNotFound)
 		return
@@ -115,20 +120,26 @@ func (h *ShopHandler) BuyItem(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// 2. Deduct coins and add to inventory
-	if err := h.Repo.UpdateUserCoins(req.UserID, -cost); err != nil {
+	err = h.Repo.UpdateUserCoins(userID, -cost)
+	if errors.Is(err, db.ErrInsufficientCoins) {
+		// Spent elsewhere since the check above.
+		http.Error(w, "Insufficient funds", http.StatusPaymentRequired)
+		return
+	}
+	if err != nil {
 		http.Error(w, "Failed to process payment", http.StatusInternalServerError)
 		return
 	}
 
-	if err := h.Repo.AddToInventory(req.UserID, req.ItemID); err != nil {
+	if err := h.Repo.AddToInventory(userID, req.ItemID); err != nil {
 		// Rollback coins
-		h.Repo.UpdateUserCoins(req.UserID, cost)
+		h.Repo.UpdateUserCoins(userID, cost)
 		http.Error(w, "Failed to add item to inventory", http.StatusInternalServerError)
 		return
 	}
 
 	// Get updated balance
-	updatedUser, err := h.Repo.GetUser(req.UserID)
+	updatedUser, err := h.Repo.GetUser(userID)
 	newBalance := 0
 	if err == nil && updatedUser != nil {
 		newBalance = updatedUser.Coins
@@ -148,9 +159,8 @@ func (h *ShopHandler) GetUserInventory(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	userID := r.URL.Query().Get("user_id")
-	if userID == "" {
-		http.Error(w, "Missing user_id", http.StatusBadRequest)
+	userID, ok := actingUser(w, r, r.URL.Query().Get("user_id"))
+	if !ok {
 		return
 	}
 
@@ -0,0 +1,152 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"caro_chess_server/db"
+	"caro_chess_server/tournament"
+)
+
+type TournamentHandler struct {
+	Repo    db.UserRepository
+	Manager *tournament.Manager
+}
+
+func NewTournamentHandler(repo db.UserRepository, manager *tournament.Manager) *TournamentHandler {
+	return &TournamentHandler{Repo: repo, Manager: manager}
+}
+
+type CreateTournamentRequest struct {
+	Name     string              `json:"name"`
+	Format   tournament.Format   `json:"format"`
+	Rounds   int                 `json:"rounds"`
+	Settings tournament.Settings `json:"settings"`
+}
+
+type RegisterTournamentRequest struct {
+	UserID string `json:"user_id"` // Optional; must be the authenticated user
+}
+
+// tournamentView is a tournament together with its current standings.
+type tournamentView struct {
+	*tournament.Tournament
+	Standings []tournament.Standing `json:"standings"`
+}
+
+// Tournaments serves /tournaments: GET lists tournaments, POST creates one.
+func (h *TournamentHandler) Tournaments(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(h.Manager.List())
+	case http.MethodPost:
+		userID, ok := actingUser(w, r, "")
+		if !ok {
+			return
+		}
+		var req CreateTournamentRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if req.Format == "" {
+			req.Format = tournament.FormatSwiss
+		}
+		t, err := h.Manager.Create(userID, req.Name, req.Format, req.Rounds, req.Settings)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(t)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Tournament serves /tournaments/{id}, /tournaments/{id}/register and
+// /tournaments/{id}/start.
+func (h *TournamentHandler) Tournament(w http.ResponseWriter, r *http.Request) {
+	pathParts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	// Expected path: /tournaments/{id}[/action]
+	if len(pathParts) < 2 || pathParts[1] == "" {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	id := pathParts[1]
+	action := ""
+	if len(pathParts) > 2 {
+		action = pathParts[2]
+	}
+
+	switch action {
+	case "":
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		t, err := h.Manager.Get(id)
+		if err != nil {
+			writeTournamentError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(tournamentView{Tournament: t, Standings: t.Standings()})
+	case "register":
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req RegisterTournamentRequest
+		if err := decodeOptional(r, &req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		userID, ok := actingUser(w, r, req.UserID)
+		if !ok {
+			return
+		}
+		user, err := h.Repo.GetUser(userID)
+		if err != nil || user == nil {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		if err := h.Manager.Register(id, user.ID, user.ELO); err != nil {
+			writeTournamentError(w, err)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"status": "registered"})
+	case "start":
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		t, err := h.Manager.Get(id)
+		if err != nil {
+			writeTournamentError(w, err)
+			return
+		}
+		if !canManage(w, r, t.CreatedBy) {
+			return
+		}
+		if err := h.Manager.Start(id); err != nil && !errors.Is(err, tournament.ErrNoPairing) {
+			writeTournamentError(w, err)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"status": "started"})
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
+
+func writeTournamentError(w http.ResponseWriter, err error) {
+	if errors.Is(err, tournament.ErrNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusConflict)
+}
@@ -2,114 +2,427 @@ package auth
 
 import (
 	"encoding/json"
+	"errors"
+	"log"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"caro_chess_server/db"
+	"caro_chess_server/ratelimit"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
 )
 
-var SecretKey = []byte("your-secret-key-should-be-in-env") // TODO: Move to Config
+// ScopeSetPassword marks a token that is only good for setting a password.
+// Users from before passwords existed get one when they log in by ID.
+const ScopeSetPassword = "set_password"
+
+// ScopeMigrate marks a token an admin issues to a user from before
+// passwords existed. IDs are public, so logging in by ID takes one.
+const ScopeMigrate = "migrate"
+
+// ScopeGuest marks a guest's token. It is accepted wherever an access token
+// is, and by Signup to turn the guest into an account.
+const ScopeGuest = "guest"
+
+const (
+	setPasswordTokenTTL = 15 * time.Minute
+	migrationTokenTTL   = 7 * 24 * time.Hour
+	guestTokenTTL       = 30 * 24 * time.Hour
+)
 
 type Claims struct {
-	UserID string `json:"user_id"`
+	UserID    string  `json:"user_id"`
+	SessionID string  `json:"sid,omitempty"`   // Empty for scoped tokens
+	Scope     string  `json:"scope,omitempty"` // Empty for full access
+	Role      db.Role `json:"role,omitempty"`  // As of when the token was issued
 	jwt.RegisteredClaims
 }
 
 type AuthHandler struct {
-	Repo db.UserRepository
+	Repo        db.UserRepository
+	Credentials db.CredentialRepository
+	Tokens      *Tokens
+	attempts    *ratelimit.Limiter // Signups and logins per client address
 }
 
 // SignupRequest structure
 type SignupRequest struct {
-	ID string `json:"id"`
+	Username string `json:"username"`
+	Password string `json:"password"`
 }
 
-// LoginRequest structure (simplified for now, usually needs password)
+// LoginRequest logs in with a username and password. ID and a migration
+// token are accepted instead only from users who haven't set a password
+// yet; see SetPassword.
 type LoginRequest struct {
-	ID string `json:"id"`
+	Username       string `json:"username"`
+	Password       string `json:"password"`
+	ID             string `json:"id"`
+	MigrationToken string `json:"migration_token"`
+}
+
+// SetPasswordRequest sets the username and password of a user who logged
+// in by ID, or changes the password of one who has them.
+type SetPasswordRequest struct {
+	Username        string `json:"username"`
+	Password        string `json:"password"`
+	CurrentPassword string `json:"current_password"`
+}
+
+// RefreshRequest carries a refresh token to /token/refresh or /logout.
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
 }
 
-func NewAuthHandler(repo db.UserRepository) *AuthHandler {
-	return &AuthHandler{Repo: repo}
+// TokenResponse is returned by Signup, Login, SetPassword, Refresh and
+// Guest.
+// Token is the access token, valid for ExpiresIn seconds.
+type TokenResponse struct {
+	Token               string `json:"token"`
+	RefreshToken        string `json:"refresh_token,omitempty"`
+	ExpiresIn           int    `json:"expires_in,omitempty"`
+	ID                  string `json:"id"`
+	Username            string `json:"username,omitempty"`
+	SetPasswordRequired bool   `json:"set_password_required,omitempty"`
 }
 
+func NewAuthHandler(repo db.UserRepository, credentials db.CredentialRepository, tokens *Tokens) *AuthHandler {
+	return &AuthHandler{
+		Repo:        repo,
+		Credentials: credentials,
+		Tokens:      tokens,
+		attempts:    ratelimit.New(attemptBurst, attemptInterval),
+	}
+}
+
+// Signup creates a user with a new ID and the given username and password.
+// With a guest's bearer token, the guest's games, coins and items move to
+// the new account.
 func (h *AuthHandler) Signup(w http.ResponseWriter, r *http.Request) {
-	// Ideally accept password, hash it, store it.
-	// For now, simpler: register ID if not exists.
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.attempts.Allow(clientAddr(r)) {
+		tooManyAttempts(w, attemptInterval)
+		return
+	}
+	guestID := ""
+	if r.Header.Get("Authorization") != "" {
+		claims, err := h.bearer(r, ScopeGuest)
+		if err != nil {
+			http.Error(w, "Invalid Token", http.StatusUnauthorized)
+			return
+		}
+		if !db.IsGuestID(claims.UserID) {
+			http.Error(w, "Already signed up", http.StatusConflict)
+			return
+		}
+		guestID = claims.UserID
+	}
 	var req SignupRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid request", http.StatusBadRequest)
 		return
 	}
+	if err := ValidateUsername(req.Username); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := ValidatePassword(req.Password); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	// Check if user exists
-	_, err := h.Repo.GetUser(req.ID)
-	if err == nil {
-		// Exists (or mock created it, but in real DB it would exist)
-		// With SQLiteStore, GetUser auto-creates if missing?
-		// Let's rely on CreateUser explicitly if we want strict Signup.
-		// But our SQLite implementation auto-creates on Get.
-		// So effectively Signup is "Ensure User Exists".
+	hash, err := HashPassword(req.Password)
+	if err != nil {
+		http.Error(w, "Error creating account", http.StatusInternalServerError)
+		return
 	}
+	user := &db.User{ID: uuid.New().String(), ELO: 1200}
+	credential := &db.Credential{UserID: user.ID, Username: req.Username, PasswordHash: hash}
+	err = h.Credentials.CreateAccount(user, credential, guestID)
+	if errors.Is(err, db.ErrUsernameTaken) {
+		http.Error(w, "Username already taken", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Creating account %s (guest %q): %v", user.ID, guestID, err)
+		http.Error(w, "Error creating account", http.StatusInternalServerError)
+		return
+	}
+
+	h.sendToken(w, user.ID, req.Username)
+}
 
-	// Generate Token
-	token, err := GenerateToken(req.ID)
+// Guest gives a new guest a token, to play with and later sign up with.
+func (h *AuthHandler) Guest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.attempts.Allow(clientAddr(r)) {
+		tooManyAttempts(w, attemptInterval)
+		return
+	}
+	pair, err := h.Tokens.Guest()
 	if err != nil {
 		http.Error(w, "Error generating token", http.StatusInternalServerError)
 		return
 	}
-
-	json.NewEncoder(w).Encode(map[string]string{"token": token, "id": req.ID})
+	json.NewEncoder(w).Encode(tokenResponse(pair, ""))
 }
 
+// Login checks a username and password. Accounts are locked for a while
+// after maxFailedLogins wrong passwords in a row.
 func (h *AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
+	if !h.attempts.Allow(clientAddr(r)) {
+		tooManyAttempts(w, attemptInterval)
+		return
+	}
 	var req LoginRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid request", http.StatusBadRequest)
 		return
 	}
+	if req.Username == "" && req.ID != "" && !db.IsGuestID(req.ID) {
+		h.legacyLogin(w, req.ID, req.MigrationToken)
+		return
+	}
+
+	cred, err := h.Credentials.GetCredentialByUsername(req.Username)
+	if errors.Is(err, db.ErrNotFound) {
+		VerifyPassword(req.Password, dummyHash) // Take as long as a real check
+		http.Error(w, "Invalid username or password", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error logging in", http.StatusInternalServerError)
+		return
+	}
+	if wait := time.Until(cred.LockedUntil); wait > 0 {
+		tooManyAttempts(w, wait)
+		return
+	}
+
+	ok, err := VerifyPassword(req.Password, cred.PasswordHash)
+	if err != nil {
+		log.Printf("Login for %s: %v", cred.UserID, err)
+	}
+	if !ok {
+		cred.FailedLogins++
+		if cred.FailedLogins >= maxFailedLogins {
+			cred.FailedLogins = 0
+			cred.LockedUntil = time.Now().Add(lockoutDuration)
+			log.Printf("Locking %s after %d failed logins", cred.UserID, maxFailedLogins)
+		}
+		h.Credentials.UpdateCredential(cred)
+		http.Error(w, "Invalid username or password", http.StatusUnauthorized)
+		return
+	}
+	if cred.FailedLogins > 0 || !cred.LockedUntil.IsZero() {
+		cred.FailedLogins, cred.LockedUntil = 0, time.Time{}
+		h.Credentials.UpdateCredential(cred)
+	}
+
+	h.sendToken(w, cred.UserID, cred.Username)
+}
+
+// legacyLogin lets a user from before passwords existed, who only has an
+// ID, log in once more to choose a username and password. Anyone can see
+// an ID, so it also takes the migration token an admin issued the user.
+// The token it returns is only accepted by SetPassword.
+func (h *AuthHandler) legacyLogin(w http.ResponseWriter, userID, migrationToken string) {
+	claims, err := h.Tokens.parse(migrationToken)
+	if err != nil || claims.Scope != ScopeMigrate || claims.UserID != userID {
+		http.Error(w, "Migration token required", http.StatusUnauthorized)
+		return
+	}
+	if _, err := h.Repo.FindUser(userID); errors.Is(err, db.ErrNotFound) {
+		http.Error(w, "Unknown user", http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		http.Error(w, "Error logging in", http.StatusInternalServerError)
+		return
+	}
+
+	_, err = h.Credentials.GetCredentialByUserID(userID)
+	if err == nil {
+		http.Error(w, "Password required", http.StatusUnauthorized)
+		return
+	}
+	if !errors.Is(err, db.ErrNotFound) {
+		http.Error(w, "Error logging in", http.StatusInternalServerError)
+		return
+	}
+
+	token, err := h.Tokens.scoped(userID, ScopeSetPassword, setPasswordTokenTTL)
+	if err != nil {
+		http.Error(w, "Error generating token", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(TokenResponse{Token: token, ID: userID, SetPasswordRequired: true})
+}
+
+// SetPassword gives the user of the bearer token a username and password,
+// or changes their password if they already have one.
+func (h *AuthHandler) SetPassword(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	claims, err := h.bearer(r, ScopeSetPassword)
+	if err != nil {
+		http.Error(w, "Invalid Token", http.StatusUnauthorized)
+		return
+	}
+	var req SetPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if err := ValidatePassword(req.Password); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	hash, err := HashPassword(req.Password)
+	if err != nil {
+		http.Error(w, "Error setting password", http.StatusInternalServerError)
+		return
+	}
 
-	// Validate User exists
-	_, err := h.Repo.GetUser(req.ID)
+	cred, err := h.Credentials.GetCredentialByUserID(claims.UserID)
+	switch {
+	case errors.Is(err, db.ErrNotFound):
+		if err := ValidateUsername(req.Username); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		cred = &db.Credential{UserID: claims.UserID, Username: req.Username, PasswordHash: hash}
+		err = h.Credentials.CreateCredential(cred)
+		if errors.Is(err, db.ErrUsernameTaken) {
+			http.Error(w, "Username already taken", http.StatusConflict)
+			return
+		}
+		if errors.Is(err, db.ErrCredentialExists) {
+			http.Error(w, "Password already set", http.StatusConflict)
+			return
+		}
+	case err == nil:
+		// Changing a password takes the current one, and a full token.
+		if claims.Scope != "" {
+			http.Error(w, "Password already set", http.StatusConflict)
+			return
+		}
+		if ok, _ := VerifyPassword(req.CurrentPassword, cred.PasswordHash); !ok {
+			http.Error(w, "Invalid current password", http.StatusUnauthorized)
+			return
+		}
+		cred.PasswordHash = hash
+		err = h.Credentials.UpdateCredential(cred)
+	}
 	if err != nil {
-		http.Error(w, "User not found", http.StatusUnauthorized)
+		http.Error(w, "Error setting password", http.StatusInternalServerError)
 		return
 	}
 
-	// Generate Token
-	token, err := GenerateToken(req.ID)
+	h.sendToken(w, cred.UserID, cred.Username)
+}
+
+// Refresh exchanges a refresh token for a new access and refresh token.
+func (h *AuthHandler) Refresh(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req RefreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	pair, err := h.Tokens.Refresh(req.RefreshToken)
+	if errors.Is(err, ErrInvalidToken) {
+		http.Error(w, "Invalid Token", http.StatusUnauthorized)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Error generating token", http.StatusInternalServerError)
 		return
 	}
+	json.NewEncoder(w).Encode(tokenResponse(pair, ""))
+}
 
-	json.NewEncoder(w).Encode(map[string]string{"token": token, "id": req.ID})
+// Logout ends the session of the refresh token in the body, or else of the
+// bearer token. Access tokens for the session stop working at once.
+func (h *AuthHandler) Logout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req RefreshRequest
+	json.NewDecoder(r.Body).Decode(&req) // The body is optional
+
+	var err error
+	if req.RefreshToken != "" {
+		err = h.Tokens.RevokeRefresh(req.RefreshToken)
+	} else if claims, bearerErr := h.bearer(r, ""); bearerErr == nil {
+		err = h.Tokens.Revoke(claims.SessionID)
+	} else {
+		err = ErrInvalidToken
+	}
+	if errors.Is(err, ErrInvalidToken) {
+		http.Error(w, "Invalid Token", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error logging out", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// sendToken starts a session for userID and sends its tokens.
+func (h *AuthHandler) sendToken(w http.ResponseWriter, userID, username string) {
+	pair, err := h.Tokens.Issue(userID)
+	if err != nil {
+		http.Error(w, "Error generating token", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(tokenResponse(pair, username))
 }
 
-func GenerateToken(userID string) (string, error) {
-	claims := &Claims{
-		UserID: userID,
-		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(24 * time.Hour)),
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
-		},
+func tokenResponse(pair *TokenPair, username string) TokenResponse {
+	return TokenResponse{
+		Token:        pair.Access,
+		RefreshToken: pair.Refresh,
+		ExpiresIn:    int(pair.ExpiresIn.Seconds()),
+		ID:           pair.UserID,
+		Username:     username,
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(SecretKey)
 }
 
-func ValidateToken(tokenString string) (*Claims, error) {
-	claims := &Claims{}
-	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-		return SecretKey, nil
-	})
+func tooManyAttempts(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+	http.Error(w, "Too many attempts, try again later", http.StatusTooManyRequests)
+}
+
+// bearer checks the request's bearer token. A token for scope is accepted
+// as well as a full-access one.
+func (h *AuthHandler) bearer(r *http.Request, scope string) (*Claims, error) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+	claims, err := h.Tokens.parse(token)
 	if err != nil {
 		return nil, err
 	}
-	if !token.Valid {
-		return nil, jwt.ErrSignatureInvalid
+	if scope != "" && claims.Scope == scope {
+		return claims, nil
 	}
-	return claims, nil
+	return h.Tokens.Validate(token)
 }
@@ -0,0 +1,412 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"caro_chess_server/config"
+	"caro_chess_server/db"
+	"caro_chess_server/db/sqlite"
+)
+
+func newTestHandler(t *testing.T) (*AuthHandler, *sqlite.SQLiteStore) {
+	store, err := sqlite.NewSQLiteStore(filepath.Join(t.TempDir(), "auth.db"))
+	if err != nil {
+		t.Fatalf("NewSQLiteStore: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	tokens, err := NewTokens(testKeys("k1"), store, time.Minute, time.Hour)
+	if err != nil {
+		t.Fatalf("NewTokens: %v", err)
+	}
+	return NewAuthHandler(store, store, tokens), store
+}
+
+// testKeys returns a signing key for each ID, the first active.
+func testKeys(ids ...string) []config.SigningKey {
+	var keys []config.SigningKey
+	for _, id := range ids {
+		keys = append(keys, config.SigningKey{ID: id, Secret: []byte(id + "-0123456789abcdef0123456789abcdef")})
+	}
+	return keys
+}
+
+// call posts body to handler and decodes a successful response.
+func call(t *testing.T, handler http.HandlerFunc, token string, body any) (int, TokenResponse) {
+	t.Helper()
+	data, _ := json.Marshal(body)
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(data))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+
+	var resp TokenResponse
+	if rec.Code == http.StatusOK {
+		if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+			t.Fatalf("decode response: %v", err)
+		}
+	}
+	return rec.Code, resp
+}
+
+func TestHashPassword(t *testing.T) {
+	hash, err := HashPassword("correct horse")
+	if err != nil {
+		t.Fatalf("HashPassword: %v", err)
+	}
+	if ok, err := VerifyPassword("correct horse", hash); !ok || err != nil {
+		t.Errorf("VerifyPassword(right) = %v, %v", ok, err)
+	}
+	if ok, _ := VerifyPassword("wrong horse", hash); ok {
+		t.Error("VerifyPassword accepted a wrong password")
+	}
+	if other, _ := HashPassword("correct horse"); other == hash {
+		t.Error("Two hashes of the same password are equal; salt not random")
+	}
+	if _, err := VerifyPassword("x", "$argon2id$garbage"); err == nil {
+		t.Error("VerifyPassword accepted a malformed hash")
+	}
+}
+
+func TestSignupAndLogin(t *testing.T) {
+	h, store := newTestHandler(t)
+
+	code, signup := call(t, h.Signup, "", SignupRequest{Username: "alice", Password: "hunter2hunter2"})
+	if code != http.StatusOK || signup.Token == "" || signup.ID == "" {
+		t.Fatalf("Signup = %d %+v", code, signup)
+	}
+	if code, _ := call(t, h.Signup, "", SignupRequest{Username: "ALICE", Password: "something-else"}); code != http.StatusConflict {
+		t.Errorf("Signup with a taken username (other case) = %d, want 409", code)
+	}
+	if users, _ := store.GetLeaderboard(10); len(users) != 1 {
+		t.Errorf("Users after a refused signup = %d, want only alice", len(users))
+	}
+	rec := httptest.NewRecorder()
+	h.Signup(rec, httptest.NewRequest(http.MethodGet, "/signup", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /signup = %d, want 405", rec.Code)
+	}
+	if code, _ := call(t, h.Signup, "", SignupRequest{Username: "bob", Password: "short"}); code != http.StatusBadRequest {
+		t.Errorf("Signup with a short password = %d, want 400", code)
+	}
+
+	code, login := call(t, h.Login, "", LoginRequest{Username: "Alice", Password: "hunter2hunter2"})
+	if code != http.StatusOK || login.ID != signup.ID {
+		t.Fatalf("Login = %d %+v, want ID %s", code, login, signup.ID)
+	}
+	if claims, err := h.Tokens.Validate(login.Token); err != nil || claims.UserID != signup.ID {
+		t.Errorf("Validate(login token) = %+v, %v", claims, err)
+	}
+	if code, _ := call(t, h.Login, "", LoginRequest{Username: "alice", Password: "wrong password"}); code != http.StatusUnauthorized {
+		t.Errorf("Login with a wrong password = %d, want 401", code)
+	}
+	if code, _ := call(t, h.Login, "", LoginRequest{Username: "nobody", Password: "hunter2hunter2"}); code != http.StatusUnauthorized {
+		t.Errorf("Login as an unknown user = %d, want 401", code)
+	}
+	// A user with a password can't log in by ID alone.
+	if code, _ := call(t, h.Login, "", LoginRequest{ID: signup.ID}); code != http.StatusUnauthorized {
+		t.Errorf("Login by ID with a password set = %d, want 401", code)
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	h, store := newTestHandler(t)
+	call(t, h.Signup, "", SignupRequest{Username: "carol", Password: "hunter2hunter2"})
+
+	for i := 0; i < maxFailedLogins; i++ {
+		if code, _ := call(t, h.Login, "", LoginRequest{Username: "carol", Password: "wrong password"}); code != http.StatusUnauthorized {
+			t.Fatalf("Failed login %d = %d, want 401", i+1, code)
+		}
+	}
+	if code, _ := call(t, h.Login, "", LoginRequest{Username: "carol", Password: "hunter2hunter2"}); code != http.StatusTooManyRequests {
+		t.Errorf("Login while locked = %d, want 429", code)
+	}
+
+	// Once the lockout ends the right password works again.
+	cred, _ := store.GetCredentialByUsername("carol")
+	cred.LockedUntil = cred.LockedUntil.Add(-2 * lockoutDuration)
+	store.UpdateCredential(cred)
+	if code, _ := call(t, h.Login, "", LoginRequest{Username: "carol", Password: "hunter2hunter2"}); code != http.StatusOK {
+		t.Errorf("Login after the lockout = %d, want 200", code)
+	}
+}
+
+func TestSetPasswordForLegacyUser(t *testing.T) {
+	h, store := newTestHandler(t)
+	store.SaveUser(&db.User{ID: "legacy", ELO: 1300})
+
+	migration, err := h.Tokens.Migration("legacy")
+	if err != nil {
+		t.Fatalf("Migration: %v", err)
+	}
+	code, login := call(t, h.Login, "", LoginRequest{ID: "legacy", MigrationToken: migration})
+	if code != http.StatusOK || !login.SetPasswordRequired {
+		t.Fatalf("Legacy login = %d %+v, want a set-password token", code, login)
+	}
+	if _, err := h.Tokens.Validate(login.Token); err == nil {
+		t.Error("Validate accepted a set-password token")
+	}
+
+	code, set := call(t, h.SetPassword, login.Token, SetPasswordRequest{Username: "dave", Password: "hunter2hunter2"})
+	if code != http.StatusOK || set.ID != "legacy" {
+		t.Fatalf("SetPassword = %d %+v", code, set)
+	}
+	if _, err := h.Tokens.Validate(set.Token); err != nil {
+		t.Errorf("Validate(SetPassword token): %v", err)
+	}
+	// The set-password token is spent once a password exists.
+	if code, _ := call(t, h.SetPassword, login.Token, SetPasswordRequest{Username: "dave2", Password: "another-pass"}); code != http.StatusConflict {
+		t.Errorf("Reusing the set-password token = %d, want 409", code)
+	}
+
+	// So is the migration token.
+	if code, _ := call(t, h.Login, "", LoginRequest{ID: "legacy", MigrationToken: migration}); code != http.StatusUnauthorized {
+		t.Errorf("Legacy login after SetPassword = %d, want 401", code)
+	}
+
+	code, relogin := call(t, h.Login, "", LoginRequest{Username: "dave", Password: "hunter2hunter2"})
+	if code != http.StatusOK || relogin.ID != "legacy" {
+		t.Errorf("Login after SetPassword = %d %+v", code, relogin)
+	}
+
+	// Changing the password takes the current one.
+	if code, _ := call(t, h.SetPassword, set.Token, SetPasswordRequest{Password: "new-password", CurrentPassword: "wrong"}); code != http.StatusUnauthorized {
+		t.Errorf("Change with a wrong current password = %d, want 401", code)
+	}
+	if code, _ := call(t, h.SetPassword, set.Token, SetPasswordRequest{Password: "new-password", CurrentPassword: "hunter2hunter2"}); code != http.StatusOK {
+		t.Errorf("Change password = %d, want 200", code)
+	}
+	if code, _ := call(t, h.Login, "", LoginRequest{Username: "dave", Password: "new-password"}); code != http.StatusOK {
+		t.Errorf("Login with the new password = %d, want 200", code)
+	}
+}
+
+func TestLegacyLoginNeedsMigrationToken(t *testing.T) {
+	h, store := newTestHandler(t)
+	store.SaveUser(&db.User{ID: "champion", ELO: 2400})
+
+	// A stranger who knows the ID from the leaderboard can't claim it.
+	if code, _ := call(t, h.Login, "", LoginRequest{ID: "champion"}); code != http.StatusUnauthorized {
+		t.Errorf("Legacy login without a migration token = %d, want 401", code)
+	}
+	theirs, _ := h.Tokens.Migration("stranger")
+	if code, _ := call(t, h.Login, "", LoginRequest{ID: "champion", MigrationToken: theirs}); code != http.StatusUnauthorized {
+		t.Errorf("Legacy login with another user's migration token = %d, want 401", code)
+	}
+	guest, _ := h.Tokens.Guest()
+	if code, _ := call(t, h.Login, "", LoginRequest{ID: "champion", MigrationToken: guest.Access}); code != http.StatusUnauthorized {
+		t.Errorf("Legacy login with a guest token = %d, want 401", code)
+	}
+	if _, err := store.GetCredentialByUserID("champion"); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("Credential after failed legacy logins: err = %v, want ErrNotFound", err)
+	}
+
+	// Unknown IDs are refused, not created.
+	if code, _ := call(t, h.Login, "", LoginRequest{ID: "nobody", MigrationToken: theirs}); code != http.StatusUnauthorized {
+		t.Errorf("Legacy login of an unknown ID = %d, want 401", code)
+	}
+	if code, _ := call(t, h.Login, "", LoginRequest{ID: "stranger", MigrationToken: theirs}); code != http.StatusUnauthorized {
+		t.Errorf("Legacy login of an unknown ID with its own token = %d, want 401", code)
+	}
+	if _, err := store.FindUser("stranger"); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("FindUser after an unknown legacy login: err = %v, want ErrNotFound", err)
+	}
+}
+
+func TestRefreshAndLogout(t *testing.T) {
+	h, _ := newTestHandler(t)
+	_, signup := call(t, h.Signup, "", SignupRequest{Username: "erin", Password: "hunter2hunter2"})
+	if signup.RefreshToken == "" || signup.ExpiresIn != 60 {
+		t.Fatalf("Signup = %+v, want a refresh token and a 60s access token", signup)
+	}
+
+	code, refreshed := call(t, h.Refresh, "", RefreshRequest{RefreshToken: signup.RefreshToken})
+	if code != http.StatusOK || refreshed.ID != signup.ID || refreshed.RefreshToken == signup.RefreshToken {
+		t.Fatalf("Refresh = %d %+v, want a new refresh token for %s", code, refreshed, signup.ID)
+	}
+	if code, _ := call(t, h.Refresh, "", RefreshRequest{RefreshToken: signup.RefreshToken}); code != http.StatusUnauthorized {
+		t.Errorf("Refresh with a replaced refresh token = %d, want 401", code)
+	}
+
+	// Logging out revokes every access token of the session at once.
+	if code, _ := call(t, h.Logout, refreshed.Token, nil); code != http.StatusNoContent {
+		t.Fatalf("Logout = %d, want 204", code)
+	}
+	for _, token := range []string{signup.Token, refreshed.Token} {
+		if _, err := h.Tokens.Validate(token); err == nil {
+			t.Error("Validate accepted an access token after logout")
+		}
+	}
+	if code, _ := call(t, h.Refresh, "", RefreshRequest{RefreshToken: refreshed.RefreshToken}); code != http.StatusUnauthorized {
+		t.Errorf("Refresh after logout = %d, want 401", code)
+	}
+
+	// Other sessions of the same user are unaffected.
+	_, login := call(t, h.Login, "", LoginRequest{Username: "erin", Password: "hunter2hunter2"})
+	if code, _ := call(t, h.Logout, "", RefreshRequest{RefreshToken: "nonsense"}); code != http.StatusUnauthorized {
+		t.Errorf("Logout with an unknown refresh token = %d, want 401", code)
+	}
+	if _, err := h.Tokens.Validate(login.Token); err != nil {
+		t.Errorf("Validate(other session): %v", err)
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	h, store := newTestHandler(t)
+	_, signup := call(t, h.Signup, "", SignupRequest{Username: "frank", Password: "hunter2hunter2"})
+
+	// A new active key still accepts tokens signed by the old one.
+	rotated, err := NewTokens(testKeys("k2", "k1"), store, time.Minute, time.Hour)
+	if err != nil {
+		t.Fatalf("NewTokens: %v", err)
+	}
+	if _, err := rotated.Validate(signup.Token); err != nil {
+		t.Errorf("Validate(old key) after rotation: %v", err)
+	}
+	pair, err := rotated.Refresh(signup.RefreshToken)
+	if err != nil {
+		t.Fatalf("Refresh after rotation: %v", err)
+	}
+
+	// Once the old key is dropped, only tokens signed by the new one pass.
+	retired, _ := NewTokens(testKeys("k2"), store, time.Minute, time.Hour)
+	if _, err := retired.Validate(signup.Token); err == nil {
+		t.Error("Validate accepted a token signed by a retired key")
+	}
+	if _, err := retired.Validate(pair.Access); err != nil {
+		t.Errorf("Validate(new key): %v", err)
+	}
+
+	if _, err := NewTokens([]config.SigningKey{{ID: "short", Secret: []byte("too short")}}, store, time.Minute, time.Hour); err == nil {
+		t.Error("NewTokens accepted a short secret")
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	h, _ := newTestHandler(t)
+	_, signup := call(t, h.Signup, "", SignupRequest{Username: "grace", Password: "hunter2hunter2"})
+
+	var seen string
+	handler := h.Tokens.Authenticate(RequireUser(func(w http.ResponseWriter, r *http.Request) {
+		seen, _ = UserID(r.Context())
+	}))
+	serve := func(header, query string) int {
+		req := httptest.NewRequest(http.MethodGet, "/"+query, nil)
+		if header != "" {
+			req.Header.Set("Authorization", "Bearer "+header)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := serve(signup.Token, ""); code != http.StatusOK || seen != signup.ID {
+		t.Errorf("Bearer token = %d as %q, want 200 as %s", code, seen, signup.ID)
+	}
+	seen = ""
+	if code := serve("", "?token="+signup.Token); code != http.StatusOK || seen != signup.ID {
+		t.Errorf("Token parameter = %d as %q, want 200 as %s", code, seen, signup.ID)
+	}
+	if code := serve("", ""); code != http.StatusUnauthorized {
+		t.Errorf("Anonymous request = %d, want 401", code)
+	}
+	if code := serve("not-a-token", ""); code != http.StatusUnauthorized {
+		t.Errorf("Invalid token = %d, want 401", code)
+	}
+
+	if a, b := NewGuestID(), NewGuestID(); a == b || !db.IsGuestID(a) || db.IsGuestID(signup.ID) {
+		t.Errorf("Guest IDs %q and %q should be distinct guests, unlike %q", a, b, signup.ID)
+	}
+}
+
+func TestGuestSignup(t *testing.T) {
+	h, store := newTestHandler(t)
+
+	code, guest := call(t, h.Guest, "", nil)
+	if code != http.StatusOK || !db.IsGuestID(guest.ID) || guest.RefreshToken != "" {
+		t.Fatalf("Guest = %d %+v, want a guest token", code, guest)
+	}
+	if claims, err := h.Tokens.identify(guest.Token); err != nil || claims.UserID != guest.ID {
+		t.Errorf("identify(guest token) = %+v, %v", claims, err)
+	}
+	if _, err := h.Tokens.Validate(guest.Token); err == nil {
+		t.Error("Validate accepted a guest token as an access token")
+	}
+
+	// The guest plays a game and earns coins.
+	store.SaveUser(&db.User{ID: guest.ID, ELO: 1216, GamesPlayed: 1, Wins: 1, Coins: 300})
+	winner := guest.ID
+	store.SaveMatch(&db.Match{ID: "m1", PlayerXID: guest.ID, PlayerOID: "rival", WinnerID: &winner, Timestamp: time.Now()})
+
+	code, signup := call(t, h.Signup, guest.Token, SignupRequest{Username: "heidi", Password: "hunter2hunter2"})
+	if code != http.StatusOK || signup.ID == guest.ID {
+		t.Fatalf("Signup as a guest = %d %+v", code, signup)
+	}
+	user, _ := store.GetUser(signup.ID)
+	if user.Coins != 300 || user.Wins != 1 || user.ELO != 1216 {
+		t.Errorf("Signed up user = %+v, want the guest's coins, wins and rating", user)
+	}
+	if matches, _ := store.GetMatchesByUserID(signup.ID, 10); len(matches) != 1 || *matches[0].WinnerID != signup.ID {
+		t.Errorf("Signed up user's matches = %v, want the guest's win", matches)
+	}
+
+	// A user's own token can't sign up again.
+	if code, _ := call(t, h.Signup, signup.Token, SignupRequest{Username: "heidi2", Password: "hunter2hunter2"}); code != http.StatusConflict {
+		t.Errorf("Signup with an access token = %d, want 409", code)
+	}
+	// Guests can't be claimed by ID.
+	if code, _ := call(t, h.Login, "", LoginRequest{ID: guest.ID}); code == http.StatusOK {
+		t.Errorf("Legacy login as a guest = %d, want a refusal", code)
+	}
+}
+
+func TestRequireRole(t *testing.T) {
+	h, store := newTestHandler(t)
+	_, signup := call(t, h.Signup, "", SignupRequest{Username: "mallory", Password: "hunter2hunter2"})
+
+	handler := h.Tokens.Authenticate(RequireRole(db.RoleModerator, func(w http.ResponseWriter, r *http.Request) {}))
+	serve := func(token string) int {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := serve(""); code != http.StatusUnauthorized {
+		t.Errorf("Anonymous request = %d, want 401", code)
+	}
+	if code := serve(signup.Token); code != http.StatusForbidden {
+		t.Errorf("Player = %d, want 403", code)
+	}
+
+	// A new role comes with the next token.
+	if err := store.SetUserRole(signup.ID, db.RoleAdmin); err != nil {
+		t.Fatalf("SetUserRole: %v", err)
+	}
+	_, refreshed := call(t, h.Refresh, "", RefreshRequest{RefreshToken: signup.RefreshToken})
+	if code := serve(refreshed.Token); code != http.StatusOK {
+		t.Errorf("Admin = %d, want 200", code)
+	}
+
+	// Revoking a user's sessions logs them out everywhere.
+	_, login := call(t, h.Login, "", LoginRequest{Username: "mallory", Password: "hunter2hunter2"})
+	if err := h.Tokens.RevokeUser(signup.ID); err != nil {
+		t.Fatalf("RevokeUser: %v", err)
+	}
+	for _, token := range []string{refreshed.Token, login.Token} {
+		if code := serve(token); code != http.StatusUnauthorized {
+			t.Errorf("Revoked token = %d, want 401", code)
+		}
+	}
+}
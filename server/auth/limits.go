@@ -0,0 +1,25 @@
+package auth
+
+import (
+	"net"
+	"net/http"
+	"time"
+)
+
+// Login attempts are limited per client address, and an account is locked
+// for a while after repeated wrong passwords, whoever sends them.
+const (
+	attemptBurst    = 10
+	attemptInterval = 6 * time.Second // One more attempt every 6s, 10 a minute
+	maxFailedLogins = 5
+	lockoutDuration = 15 * time.Minute
+)
+
+// clientAddr returns the address requests are limited by.
+func clientAddr(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
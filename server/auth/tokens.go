@@ -0,0 +1,261 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"caro_chess_server/config"
+	"caro_chess_server/db"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+// minSecretLength is the shortest signing secret accepted: HS256 keys
+// should be at least as long as the hash.
+const minSecretLength = 32
+
+var ErrInvalidToken = errors.New("invalid token")
+
+// Tokens issues and checks tokens. An access token is a short-lived JWT
+// naming a session; a refresh token is an opaque string, stored hashed in
+// the session, that is exchanged for a new pair before the access token
+// expires. Each refresh replaces the refresh token, and logging out
+// revokes the session along with every access token issued for it.
+type Tokens struct {
+	keys       []config.SigningKey // The first signs; all are accepted
+	store      TokenStore
+	accessTTL  time.Duration
+	refreshTTL time.Duration
+}
+
+// TokenStore keeps sessions and has the users whose roles access tokens
+// carry.
+type TokenStore interface {
+	db.SessionRepository
+	GetUser(id string) (*db.User, error)
+}
+
+// TokenPair is what a client gets when it logs in or refreshes.
+type TokenPair struct {
+	Access    string
+	Refresh   string
+	ExpiresIn time.Duration // Of the access token
+	UserID    string
+}
+
+// NewTokens signs with the first of keys. With no keys it makes up a
+// random one, so tokens don't survive a restart.
+func NewTokens(keys []config.SigningKey, store TokenStore, accessTTL, refreshTTL time.Duration) (*Tokens, error) {
+	if len(keys) == 0 {
+		secret := make([]byte, minSecretLength)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+		keys = []config.SigningKey{{ID: "ephemeral", Secret: secret}}
+	}
+	for _, k := range keys {
+		if len(k.Secret) < minSecretLength {
+			return nil, fmt.Errorf("JWT key %q is shorter than %d bytes", k.ID, minSecretLength)
+		}
+	}
+	return &Tokens{keys: keys, store: store, accessTTL: accessTTL, refreshTTL: refreshTTL}, nil
+}
+
+// Issue starts a session for userID.
+func (t *Tokens) Issue(userID string) (*TokenPair, error) {
+	refresh, hash, err := newRefreshToken()
+	if err != nil {
+		return nil, err
+	}
+	session := &db.Session{
+		ID:          uuid.New().String(),
+		UserID:      userID,
+		RefreshHash: hash,
+		ExpiresAt:   time.Now().Add(t.refreshTTL),
+	}
+	if err := t.store.CreateSession(session); err != nil {
+		return nil, err
+	}
+	return t.pair(session, refresh)
+}
+
+// Refresh exchanges a refresh token for a new pair. The old refresh token
+// stops working.
+func (t *Tokens) Refresh(refresh string) (*TokenPair, error) {
+	session, err := t.store.GetSessionByRefreshHash(hashRefreshToken(refresh))
+	if errors.Is(err, db.ErrNotFound) {
+		return nil, ErrInvalidToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	if session.Revoked || time.Now().After(session.ExpiresAt) {
+		return nil, ErrInvalidToken
+	}
+
+	refresh, session.RefreshHash, err = newRefreshToken()
+	if err != nil {
+		return nil, err
+	}
+	session.ExpiresAt = time.Now().Add(t.refreshTTL)
+	if err := t.store.UpdateSession(session); err != nil {
+		return nil, err
+	}
+	return t.pair(session, refresh)
+}
+
+// RevokeRefresh ends the session of a refresh token.
+func (t *Tokens) RevokeRefresh(refresh string) error {
+	session, err := t.store.GetSessionByRefreshHash(hashRefreshToken(refresh))
+	if errors.Is(err, db.ErrNotFound) {
+		return ErrInvalidToken
+	}
+	if err != nil {
+		return err
+	}
+	return t.revoke(session)
+}
+
+// RevokeUser ends every session of a user.
+func (t *Tokens) RevokeUser(userID string) error {
+	return t.store.RevokeUserSessions(userID)
+}
+
+// Revoke ends a session.
+func (t *Tokens) Revoke(sessionID string) error {
+	session, err := t.store.GetSession(sessionID)
+	if errors.Is(err, db.ErrNotFound) {
+		return ErrInvalidToken
+	}
+	if err != nil {
+		return err
+	}
+	return t.revoke(session)
+}
+
+func (t *Tokens) revoke(session *db.Session) error {
+	if session.Revoked {
+		return nil
+	}
+	session.Revoked = true
+	return t.store.UpdateSession(session)
+}
+
+// Validate checks a full-access token, including that its session hasn't
+// been revoked.
+func (t *Tokens) Validate(tokenString string) (*Claims, error) {
+	claims, err := t.parse(tokenString)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Scope != "" || claims.SessionID == "" {
+		return nil, ErrInvalidToken
+	}
+	session, err := t.store.GetSession(claims.SessionID)
+	if errors.Is(err, db.ErrNotFound) {
+		return nil, ErrInvalidToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	if session.Revoked || session.UserID != claims.UserID {
+		return nil, ErrInvalidToken
+	}
+	return claims, nil
+}
+
+// Guest returns a token for a new guest. Guest tokens belong to no session
+// and can't be revoked, but they only ever stand for a guest.
+func (t *Tokens) Guest() (*TokenPair, error) {
+	id := NewGuestID()
+	token, err := t.scoped(id, ScopeGuest, guestTokenTTL)
+	if err != nil {
+		return nil, err
+	}
+	return &TokenPair{Access: token, ExpiresIn: guestTokenTTL, UserID: id}, nil
+}
+
+// Migration returns a token with which userID, a user from before
+// passwords existed, can log in by ID to set a password. It stops working
+// once the user has one.
+func (t *Tokens) Migration(userID string) (string, error) {
+	return t.scoped(userID, ScopeMigrate, migrationTokenTTL)
+}
+
+// identify checks an access token or a guest token.
+func (t *Tokens) identify(tokenString string) (*Claims, error) {
+	claims, err := t.parse(tokenString)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Scope == ScopeGuest && db.IsGuestID(claims.UserID) {
+		return claims, nil
+	}
+	return t.Validate(tokenString)
+}
+
+// scoped returns a token good only for scope. It belongs to no session.
+func (t *Tokens) scoped(userID, scope string, ttl time.Duration) (string, error) {
+	return t.sign(&Claims{UserID: userID, Scope: scope}, ttl)
+}
+
+// pair returns tokens for session, with the user's current role.
+func (t *Tokens) pair(session *db.Session, refresh string) (*TokenPair, error) {
+	user, err := t.store.GetUser(session.UserID)
+	if err != nil {
+		return nil, err
+	}
+	access, err := t.sign(&Claims{UserID: session.UserID, SessionID: session.ID, Role: user.Role}, t.accessTTL)
+	if err != nil {
+		return nil, err
+	}
+	return &TokenPair{Access: access, Refresh: refresh, ExpiresIn: t.accessTTL, UserID: session.UserID}, nil
+}
+
+func (t *Tokens) sign(claims *Claims, ttl time.Duration) (string, error) {
+	now := time.Now()
+	claims.IssuedAt = jwt.NewNumericDate(now)
+	claims.ExpiresAt = jwt.NewNumericDate(now.Add(ttl))
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token.Header["kid"] = t.keys[0].ID
+	return token.SignedString(t.keys[0].Secret)
+}
+
+// parse checks a token's signature, by the key its kid names, and expiry.
+func (t *Tokens) parse(tokenString string) (*Claims, error) {
+	claims := &Claims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		for _, k := range t.keys {
+			if k.ID == kid {
+				return k.Secret, nil
+			}
+		}
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Name}))
+	if err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// newRefreshToken returns a random refresh token and its hash.
+func newRefreshToken() (token, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token = base64.RawURLEncoding.EncodeToString(b)
+	return token, hashRefreshToken(token), nil
+}
+
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
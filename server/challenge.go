@@ -0,0 +1,204 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"caro_chess_server/engine"
+)
+
+const (
+	// challengeTimeout is how long an online user has to answer a challenge.
+	challengeTimeout = time.Minute
+	// offlineChallengeTTL is how long a challenge to an offline user waits
+	// for them to connect and answer.
+	offlineChallengeTTL = 24 * time.Hour
+)
+
+var (
+	errChallengeNotFound  = errors.New("challenge not found")
+	errChallengeSelf      = errors.New("cannot challenge yourself")
+	errTargetOffline      = errors.New("user is offline")
+	errChallengerOffline  = errors.New("challenger is no longer online")
+	errChallengeDuplicate = errors.New("challenge already pending")
+)
+
+// Challenge is a game offer from one user to another.
+type Challenge struct {
+	ID        string
+	FromID    string
+	ToID      string
+	Rule      engine.GameRule
+	TotalTime time.Duration
+	Increment time.Duration
+	TurnLimit time.Duration
+	ExpiresAt time.Time
+
+	timer *time.Timer
+}
+
+// ChallengeManager keeps pending challenges until they are answered or
+// expire. Accepted challenges are played in a reserved room.
+type ChallengeManager struct {
+	mu         sync.Mutex
+	challenges map[string]*Challenge
+	hub        *Hub
+	rm         *RoomManager
+	mm         *Matchmaker
+}
+
+func newChallengeManager(hub *Hub, rm *RoomManager, mm *Matchmaker) *ChallengeManager {
+	return &ChallengeManager{
+		challenges: make(map[string]*Challenge),
+		hub:        hub,
+		rm:         rm,
+		mm:         mm,
+	}
+}
+
+// create sends a challenge to ch.ToID. If the target is offline the challenge
+// is kept for later when store is set, otherwise it is rejected.
+func (cm *ChallengeManager) create(ch *Challenge, store bool) error {
+	if ch.ToID == "" || ch.ToID == ch.FromID {
+		return errChallengeSelf
+	}
+
+	online := cm.hub.IsOnline(ch.ToID)
+	if !online && !store {
+		return errTargetOffline
+	}
+	ttl := challengeTimeout
+	if !online {
+		ttl = offlineChallengeTTL
+	}
+
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	for _, other := range cm.challenges {
+		if other.FromID == ch.FromID && other.ToID == ch.ToID {
+			return errChallengeDuplicate
+		}
+	}
+
+	ch.ID = uuid.New().String()
+	ch.ExpiresAt = time.Now().Add(ttl)
+	id := ch.ID
+	ch.timer = time.AfterFunc(ttl, func() { cm.expire(id) })
+	cm.challenges[ch.ID] = ch
+
+	if online {
+		cm.notify(ch.ToID, incomingChallenge(ch))
+	}
+	return nil
+}
+
+// deliverPending sends every challenge waiting for userID, e.g. after they
+// connect.
+func (cm *ChallengeManager) deliverPending(userID string) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	for _, ch := range cm.challenges {
+		if ch.ToID == userID {
+			cm.notify(userID, incomingChallenge(ch))
+		}
+	}
+}
+
+// accept creates the game for a challenge addressed to c. The acceptor is
+// seated as O straight away; the challenger joins with the room code.
+func (cm *ChallengeManager) accept(id string, c *Client) (string, error) {
+	ch, err := cm.take(id, func(ch *Challenge) bool { return ch.ToID == c.ID })
+	if err != nil {
+		return "", err
+	}
+	if !cm.hub.IsOnline(ch.FromID) {
+		cm.notify(ch.FromID, ChallengeEventMessage{Type: MsgChallengeExpired, ChallengeID: ch.ID})
+		return "", errChallengerOffline
+	}
+
+	code, session := cm.rm.createReservedRoom(ch.FromID, ch.ToID, ch.TotalTime, ch.Increment, ch.TurnLimit, ch.Rule)
+	if err := cm.rm.joinRoom(code, c); err != nil {
+		return "", err
+	}
+	cm.mm.RegisterSession(session)
+	session.StartDisconnectTimer(true, noShowTimeout, func() {
+		cm.mm.forfeit(session, true, "no_show")
+	})
+
+	for _, side := range []struct{ id, color, opponent string }{
+		{ch.FromID, "X", ch.ToID},
+		{ch.ToID, "O", ch.FromID},
+	} {
+		cm.notify(side.id, ChallengeAcceptedMessage{
+			Type:        MsgChallengeAccepted,
+			ChallengeID: ch.ID,
+			RoomCode:    code,
+			Color:       side.color,
+			Opponent:    side.opponent,
+		})
+	}
+	return code, nil
+}
+
+// decline rejects a challenge addressed to c.
+func (cm *ChallengeManager) decline(id string, c *Client) error {
+	ch, err := cm.take(id, func(ch *Challenge) bool { return ch.ToID == c.ID })
+	if err != nil {
+		return err
+	}
+	cm.notify(ch.FromID, ChallengeEventMessage{Type: MsgChallengeDeclined, ChallengeID: ch.ID})
+	return nil
+}
+
+// cancel withdraws a challenge sent by c.
+func (cm *ChallengeManager) cancel(id string, c *Client) error {
+	ch, err := cm.take(id, func(ch *Challenge) bool { return ch.FromID == c.ID })
+	if err != nil {
+		return err
+	}
+	cm.notify(ch.ToID, ChallengeEventMessage{Type: MsgChallengeCancelled, ChallengeID: ch.ID})
+	return nil
+}
+
+func (cm *ChallengeManager) expire(id string) {
+	ch, err := cm.take(id, func(*Challenge) bool { return true })
+	if err != nil {
+		return // Already answered
+	}
+	msg := ChallengeEventMessage{Type: MsgChallengeExpired, ChallengeID: ch.ID}
+	cm.notify(ch.FromID, msg)
+	cm.notify(ch.ToID, msg)
+}
+
+// take removes and returns a pending challenge if allowed reports true for it.
+func (cm *ChallengeManager) take(id string, allowed func(*Challenge) bool) (*Challenge, error) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	ch, ok := cm.challenges[id]
+	if !ok || !allowed(ch) {
+		return nil, errChallengeNotFound
+	}
+	delete(cm.challenges, id)
+	ch.timer.Stop()
+	return ch, nil
+}
+
+func (cm *ChallengeManager) notify(userID string, msg interface{}) {
+	cm.hub.SendToUser(userID, msg)
+}
+
+func incomingChallenge(ch *Challenge) IncomingChallengeMessage {
+	return IncomingChallengeMessage{
+		Type:        MsgIncomingChallenge,
+		ChallengeID: ch.ID,
+		From:        ch.FromID,
+		Rule:        ch.Rule,
+		TotalTime:   ch.TotalTime.Seconds(),
+		Increment:   ch.Increment.Seconds(),
+		TurnLimit:   ch.TurnLimit.Seconds(),
+		ExpiresAt:   ch.ExpiresAt,
+	}
+}
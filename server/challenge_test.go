@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"caro_chess_server/db"
+	"github.com/gorilla/websocket"
+)
+
+func newTestServer() (string, func()) {
+	repo := db.NewMemoryUserRepository()
+
+	hub := newHub()
+	go hub.run()
+	mm := newMatchmaker(repo)
+	go mm.run()
+	rm := newRoomManager()
+	go rm.run()
+	rm.lobby = newLobby(rm, repo)
+	rm.mm = mm
+	mm.challenges = newChallengeManager(hub, rm, mm)
+
+	streams := newEventStreams(hub, mm, rm)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		streams.Events(w, r, r.URL.Query().Get("id"))
+	})
+	mux.HandleFunc("/actions", streams.Actions)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		serveWs(hub, mm, rm, w, r, r.URL.Query().Get("id"))
+	})
+	s := httptest.NewServer(mux)
+	return "ws" + strings.TrimPrefix(s.URL, "http"), s.Close
+}
+
+func dialAs(t *testing.T, u, id string) *websocket.Conn {
+	c, _, err := websocket.DefaultDialer.Dial(u+"?id="+id, nil)
+	if err != nil {
+		t.Fatalf("dial %s: %v", id, err)
+	}
+	return c
+}
+
+func sendJSON(t *testing.T, c *websocket.Conn, msg map[string]interface{}) {
+	data, _ := json.Marshal(msg)
+	if err := c.WriteMessage(websocket.TextMessage, data); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+}
+
+// readType reads messages until one of the given type arrives.
+func readType(t *testing.T, c *websocket.Conn, typ string) map[string]interface{} {
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	defer c.SetReadDeadline(time.Time{})
+	for {
+		_, data, err := c.ReadMessage()
+		if err != nil {
+			t.Fatalf("waiting for %s: %v", typ, err)
+		}
+		var msg map[string]interface{}
+		json.Unmarshal(data, &msg)
+		if msg["type"] == typ {
+			return msg
+		}
+	}
+}
+
+func TestChallengeAccept(t *testing.T) {
+	u, cleanup := newTestServer()
+	defer cleanup()
+
+	alice := dialAs(t, u, "alice")
+	defer alice.Close()
+	bob := dialAs(t, u, "bob")
+	defer bob.Close()
+	time.Sleep(20 * time.Millisecond)
+
+	sendJSON(t, alice, map[string]interface{}{"type": "CHALLENGE", "target_id": "bob", "rule": "caro", "total_time": 180})
+	sent := readType(t, alice, "CHALLENGE_SENT")
+
+	incoming := readType(t, bob, "INCOMING_CHALLENGE")
+	if incoming["from"] != "alice" || incoming["challenge_id"] != sent["challenge_id"] || incoming["total_time"] != 180.0 {
+		t.Fatalf("unexpected challenge %v", incoming)
+	}
+
+	sendJSON(t, bob, map[string]interface{}{"type": "CHALLENGE_ACCEPT", "challenge_id": incoming["challenge_id"]})
+	accepted := readType(t, alice, "CHALLENGE_ACCEPTED")
+	if accepted["color"] != "X" || accepted["opponent"] != "bob" {
+		t.Fatalf("unexpected acceptance %v", accepted)
+	}
+	readType(t, bob, "CHALLENGE_ACCEPTED")
+
+	sendJSON(t, alice, map[string]interface{}{"type": "JOIN_ROOM", "code": accepted["room_code"]})
+	readType(t, alice, "MATCH_FOUND")
+	if found := readType(t, bob, "MATCH_FOUND"); found["color"] != "O" || found["total_time"] != 180.0 {
+		t.Errorf("unexpected MATCH_FOUND for bob %v", found)
+	}
+}
+
+func TestChallengeDeclineAndOffline(t *testing.T) {
+	u, cleanup := newTestServer()
+	defer cleanup()
+
+	alice := dialAs(t, u, "alice")
+	defer alice.Close()
+	time.Sleep(20 * time.Millisecond)
+
+	// Offline targets are rejected unless the challenge is stored.
+	sendJSON(t, alice, map[string]interface{}{"type": "CHALLENGE", "target_id": "bob"})
+	if resp := readType(t, alice, "ERROR"); resp["message"] != errTargetOffline.Error() {
+		t.Fatalf("expected offline error, got %v", resp)
+	}
+	sendJSON(t, alice, map[string]interface{}{"type": "CHALLENGE", "target_id": "bob", "store": true})
+	sent := readType(t, alice, "CHALLENGE_SENT")
+
+	// Bob gets the stored challenge on connecting.
+	bob := dialAs(t, u, "bob")
+	defer bob.Close()
+	incoming := readType(t, bob, "INCOMING_CHALLENGE")
+	if incoming["challenge_id"] != sent["challenge_id"] {
+		t.Fatalf("unexpected challenge %v", incoming)
+	}
+
+	sendJSON(t, bob, map[string]interface{}{"type": "CHALLENGE_DECLINE", "challenge_id": incoming["challenge_id"]})
+	if resp := readType(t, alice, "CHALLENGE_DECLINED"); resp["challenge_id"] != sent["challenge_id"] {
+		t.Errorf("unexpected decline %v", resp)
+	}
+
+	// A declined challenge can no longer be accepted.
+	sendJSON(t, bob, map[string]interface{}{"type": "CHALLENGE_ACCEPT", "challenge_id": incoming["challenge_id"]})
+	if resp := readType(t, bob, "ERROR"); resp["message"] != errChallengeNotFound.Error() {
+		t.Errorf("expected not found, got %v", resp)
+	}
+}
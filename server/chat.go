@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"caro_chess_server/db"
+)
+
+// Chat channels.
+const (
+	ChannelRoom   = "room"
+	ChannelLobby  = "lobby"
+	ChannelDirect = "direct"
+)
+
+const (
+	maxChatLength = 300 // characters
+	// Lobby chat reaches everyone online, so each user, or each address
+	// guests connect from, gets a small burst and then one message per
+	// lobbyChatInterval.
+	lobbyChatBurst    = 5
+	lobbyChatInterval = 2 * time.Second
+)
+
+var (
+	errChatTooLong = errors.New("chat message is too long")
+	errNotInRoom   = errors.New("not in that room")
+	errRateLimited = errors.New("sending too fast, slow down")
+)
+
+// lobbyChatKey is who c's lobby messages count against. A guest gets a new
+// ID on every connection, so guests are limited by the address they
+// connect from instead.
+func (c *Client) lobbyChatKey() string {
+	if !db.IsGuestID(c.ID) || c.conn == nil {
+		return c.ID
+	}
+	addr := c.conn.remoteAddr()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	return "addr:" + addr
+}
@@ -4,7 +4,6 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
-	"os"
 	"strings"
 	"testing"
 	"time"
@@ -14,8 +13,7 @@ import (
 )
 
 func TestChat(t *testing.T) {
-	repo := db.NewFileUserRepository("test_chat.json")
-	defer os.Remove("test_chat.json")
+	repo := db.NewMemoryUserRepository()
 	
 	hub := newHub()
 	go hub.run()
@@ -36,10 +34,12 @@ func TestChat(t *testing.T) {
 	c2, _, _ := websocket.DefaultDialer.Dial(u, nil)
 	defer c2.Close()
 
+	// The sender is stamped by the server, whatever the payload claims.
 	msg, _ := json.Marshal(map[string]interface{}{
 		"type": "CHAT_MESSAGE",
+		"channel": "lobby",
 		"text": "Hello",
-		"sender_id": "user1",
+		"sender_id": "admin",
 	})
 	c1.WriteMessage(websocket.TextMessage, msg)
 
@@ -50,11 +50,60 @@ func TestChat(t *testing.T) {
 	if resp["type"] != "CHAT_MESSAGE" || resp["text"] != "Hello" {
 		t.Errorf("Expected chat message, got %v", resp)
 	}
+	if resp["sender_id"] != "user1" || resp["channel"] != "lobby" {
+		t.Errorf("Expected lobby message from user1, got %v", resp)
+	}
+}
+
+func TestChatChannels(t *testing.T) {
+	u, cleanup := newTestServer()
+	defer cleanup()
+
+	alice := dialAs(t, u, "alice")
+	defer alice.Close()
+	bob := dialAs(t, u, "bob")
+	defer bob.Close()
+	carol := dialAs(t, u, "carol")
+	defer carol.Close()
+	time.Sleep(20 * time.Millisecond)
+
+	// Chat without a channel is no longer broadcast to everyone.
+	sendJSON(t, alice, map[string]interface{}{"type": "CHAT_MESSAGE", "text": "hi all"})
+	if resp := readType(t, alice, "ERROR"); resp["code"] != CodeBadRequest {
+		t.Errorf("expected %s, got %v", CodeBadRequest, resp)
+	}
+
+	sendJSON(t, alice, map[string]interface{}{"type": "CHAT_MESSAGE", "to": "bob", "text": "psst"})
+	if resp := readType(t, bob, "CHAT_MESSAGE"); resp["channel"] != "direct" || resp["sender_id"] != "alice" {
+		t.Errorf("unexpected direct message %v", resp)
+	}
+
+	// Room chat needs membership in the room.
+	sendJSON(t, alice, map[string]interface{}{"type": "CREATE_ROOM"})
+	code := readType(t, alice, "ROOM_CREATED")["code"]
+	sendJSON(t, carol, map[string]interface{}{"type": "CHAT_MESSAGE", "room_id": code, "text": "let me in"})
+	if resp := readType(t, carol, "ERROR"); resp["code"] != CodeNotAllowed {
+		t.Errorf("expected %s, got %v", CodeNotAllowed, resp)
+	}
+
+	for i := 0; i < lobbyChatBurst; i++ {
+		sendJSON(t, bob, map[string]interface{}{"type": "CHAT_MESSAGE", "channel": "lobby", "text": "spam"})
+	}
+	sendJSON(t, bob, map[string]interface{}{"type": "CHAT_MESSAGE", "channel": "lobby", "text": "spam"})
+	if resp := readType(t, bob, "ERROR"); resp["code"] != CodeRateLimited {
+		t.Errorf("expected %s, got %v", CodeRateLimited, resp)
+	}
+
+	// Carol saw the lobby messages but never the direct one.
+	for i := 0; i < lobbyChatBurst; i++ {
+		if resp := readType(t, carol, "CHAT_MESSAGE"); resp["channel"] != "lobby" {
+			t.Errorf("carol received a non-lobby message %v", resp)
+		}
+	}
 }
 
 func TestRoomChatIsolation(t *testing.T) {
-	repo := db.NewFileUserRepository("test_chat_iso.json")
-	defer os.Remove("test_chat_iso.json")
+	repo := db.NewMemoryUserRepository()
 	
 	hub := newHub()
 	go hub.run()
@@ -114,4 +163,23 @@ func TestRoomChatIsolation(t *testing.T) {
 	if err == nil {
 		t.Errorf("C3 received isolated room chat")
 	}
-}
\ No newline at end of file
+}
+func TestGuestLobbyChatLimitSurvivesReconnecting(t *testing.T) {
+	u, stop := newTestServer()
+	defer stop()
+
+	first := dialAs(t, u, db.GuestIDPrefix+"1")
+	for i := 0; i < lobbyChatBurst; i++ {
+		sendJSON(t, first, map[string]interface{}{"type": "CHAT_MESSAGE", "channel": "lobby", "text": "spam"})
+		readType(t, first, "CHAT_MESSAGE")
+	}
+	first.Close()
+
+	// A new guest from the same address picks up where the first left off.
+	second := dialAs(t, u, db.GuestIDPrefix+"2")
+	defer second.Close()
+	sendJSON(t, second, map[string]interface{}{"type": "CHAT_MESSAGE", "channel": "lobby", "text": "spam"})
+	if resp := readType(t, second, "ERROR"); resp["code"] != CodeRateLimited {
+		t.Errorf("expected %s, got %v", CodeRateLimited, resp)
+	}
+}
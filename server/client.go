@@ -2,405 +2,246 @@ package main
 
 import (
 	"caro_chess_server/engine"
-	"encoding/json"
 	"log"
-	"net/http"
+	"sync"
 	"time"
-
-	"github.com/gorilla/websocket"
-)
-
-const (
-	writeWait      = 10 * time.Second
-	pongWait       = 60 * time.Second
-	pingPeriod     = (pongWait * 9) / 10
-	maxMessageSize = 512
 )
 
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-	CheckOrigin:     func(r *http.Request) bool { return true },
+// transport is the connection a client is attached through: a WebSocket
+// (websocket.go) or an event stream (sse.go). Everything else about a
+// client is the same whichever it uses.
+type transport interface {
+	remoteAddr() string
+	close() // Drops the connection; the transport then calls disconnect
 }
 
 type Client struct {
-	ID            string
-	hub           *Hub
-	mm            *Matchmaker
-	rm            *RoomManager
-	conn          *websocket.Conn
-	recv          chan []byte
-	send          chan []byte
+	ID       string
+	hub      *Hub
+	mm       *Matchmaker
+	rm       *RoomManager
+	conn     transport
+	recv     chan []byte
+	send     chan *wireMessage // Written through enqueue and sendEvent; see sendqueue.go
+	wake     chan struct{}     // Tells the pump a snapshot is owed
+	slowOnce sync.Once
+	Version  int           // Protocol version from HELLO, 0 if not sent
+	done     chan struct{} // Closed when the connection goes away
+
+	// The game and queue are set by other goroutines as well, e.g. when a
+	// room is closed, so use the accessors below.
+	mu            sync.Mutex
 	Session       *GameSession
 	PreferredRule engine.GameRule // Track preferred rule for matchmaking
+	ArenaID       string          // Arena the client is queued in, if any
+	resync        *GameSession    // Game whose events were coalesced; see sendEvent
 }
 
-func (c *Client) readPump() {
-	defer func() {
-		// Clean up session reference logic
-		// Clean up session reference logic
-		if c.Session != nil {
-			isX := (c.Session.PlayerXID == c.ID)
-
-			// Start Timer
-			c.Session.StartDisconnectTimer(isX, 2*time.Minute, func() {
-				// Time's up! Forfeit game.
-				// We need to notify the OTHER player if they are still connected.
-				// Or just end game via Matchmaker?
-				// But we are in a background goroutine here.
-				// c.mm.endGame needs winner. If this timer fires, existing player WINS.
-
-				// Need access to Matchmaker or Session methods.
-				// But this callback runs on a Timer thread.
-				// Let's call a safe cleanup function.
-				// Note: c.Session might be modified by other thread?
-				// But we hold pointer.
-
-				// Let's implement timeout handling in Matchmaker for safety/centralization?
-				// Or just:
-				otherClient := c.Session.ClientO
-				if !isX {
-					otherClient = c.Session.ClientX
-				}
-
-				if otherClient != nil {
-					// Notify winner?
-					log.Printf("Session Abandoned by %s. Forfeiting...", c.ID)
-					// Actually, we should trigger endGame with winner = otherClient
-					// But do we have access to Matchmaker instance?
-					// c.mm is available via closure if we use it?
-					// c.mm is available via closure if we use it?
-					// Yes, c is available.
-					c.mm.endGame(c.Session, otherClient)
-
-					// Broadcast Game Over Abandoned?
-					// endGame updates ELO but doesn't broadcast "Game Over" message usually?
-					// In client.go validation logic, we send GAME_OVER.
-					// We should mimic that.
-
-					msg, _ := json.Marshal(map[string]interface{}{
-						"type":        "GAME_OVER",
-						"winner":      "OPPONENT_ABANDONED", // or UserID
-						"winningLine": nil,
-					})
-					otherClient.send <- msg
-				} else {
-					// Both disconnected? Just log.
-					log.Printf("Session %s fully abandoned.", c.Session.PlayerXID)
-				}
-			})
-
-			if c.Session.ClientX == c {
-				c.Session.ClientX = nil
-			}
-			if c.Session.ClientO == c {
-				c.Session.ClientO = nil
-			}
-		}
-		c.hub.unregister <- c
-		c.mm.removeClient <- c // Notify Matchmaker
-		c.conn.Close()
-	}()
-	c.conn.SetReadLimit(maxMessageSize)
-	c.conn.SetReadDeadline(time.Now().Add(pongWait))
-	c.conn.SetPongHandler(func(string) error { c.conn.SetReadDeadline(time.Now().Add(pongWait)); return nil })
-	for {
-		_, message, err := c.conn.ReadMessage()
-		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("error: %v", err)
-			}
-			break
-		}
-
-		var msg map[string]interface{}
-		if err := json.Unmarshal(message, &msg); err == nil {
-			if msg["type"] == "MOVE" {
-				if c.Session == nil || c.Session.Engine == nil {
-					continue
-				}
-
-				xFloat, okX := msg["x"].(float64)
-				yFloat, okY := msg["y"].(float64)
-				if !okX || !okY {
-					continue
-				}
-				x, y := int(xFloat), int(yFloat)
-
-				// Validate turn
-				isPlayerX := c == c.Session.ClientX
-				isPlayerO := c == c.Session.ClientO
-
-				currentTurn := c.Session.Engine.CurrentPlayer
-
-				isMyTurn := (isPlayerX && currentTurn == engine.PlayerX) || (isPlayerO && currentTurn == engine.PlayerO)
-
-				if !isMyTurn {
-					// Send error? Or just ignore.
-					continue
-				}
-
-				if success := c.Session.MakeMove(x, y); success {
-					resp, _ := json.Marshal(map[string]interface{}{
-						"type":   "MOVE_MADE",
-						"x":      x,
-						"y":      y,
-						"time_x": c.Session.TotalTimeX.Seconds(),
-						"time_o": c.Session.TotalTimeO.Seconds(),
-					})
-
-					// Send only to players in session
-					if c.Session.ClientX != nil {
-						c.Session.ClientX.send <- resp
-					}
-					if c.Session.ClientO != nil {
-						c.Session.ClientO.send <- resp
-					}
-
-					// Check Game Over
-					if c.Session.Engine.IsGameOver {
-						var winner *Client
-						if c.Session.Engine.Winner != nil {
-							if *c.Session.Engine.Winner == engine.PlayerX {
-								winner = c.Session.ClientX
-							} else {
-								winner = c.Session.ClientO
-							}
-						}
-
-						// Broadcast GAME_OVER
-						resp, _ := json.Marshal(map[string]interface{}{
-							"type": "GAME_OVER",
-							"winner": func() string {
-								if c.Session.Engine.Winner == nil {
-									return "DRAW"
-								}
-								return string(*c.Session.Engine.Winner)
-							}(),
-							"winningLine": c.Session.Engine.WinningLine,
-						})
-
-						if c.Session.ClientX != nil {
-							c.Session.ClientX.send <- resp
-						}
-						if c.Session.ClientO != nil {
-							c.Session.ClientO.send <- resp
-						}
-
-						// Call endGame to record match and update ELO
-						c.mm.endGame(c.Session, winner)
-					}
-				}
-			} else if msg["type"] == "WIN_CLAIM" {
-				c.mm.endGame(c.Session, c)
-			} else if msg["type"] == "FIND_MATCH" {
-				// Parse Rule
-				rule := engine.RuleStandard
-				if r, ok := msg["rule"].(string); ok && r != "" {
-					rule = engine.GameRule(r)
-				}
-				c.PreferredRule = rule
-				c.mm.addClient <- c
-			} else if msg["type"] == "CREATE_ROOM" {
-				// Default defaults
-				totalTime := 5 * time.Minute
-				increment := 5 * time.Second
-				turnLimit := 30 * time.Second
-				rule := engine.RuleStandard
-
-				if t, ok := msg["total_time"].(float64); ok {
-					totalTime = time.Duration(t) * time.Second
-				}
-				if i, ok := msg["increment"].(float64); ok {
-					increment = time.Duration(i) * time.Second
-				}
-				if l, ok := msg["turn_limit"].(float64); ok {
-					turnLimit = time.Duration(l) * time.Second
-				}
-				if r, ok := msg["rule"].(string); ok {
-					rule = engine.GameRule(r)
-				}
-
-				code, _ := c.rm.createRoom(c, totalTime, increment, turnLimit, rule)
-				resp, _ := json.Marshal(map[string]interface{}{
-					"type":       "ROOM_CREATED",
-					"code":       code,
-					"total_time": totalTime.Seconds(),
-					"increment":  increment.Seconds(),
-					"turn_limit": turnLimit.Seconds(),
-				})
-				c.send <- resp
-			} else if msg["type"] == "JOIN_ROOM" {
-				code := msg["code"].(string)
-				err := c.rm.joinRoom(code, c)
-				if err != nil {
-					resp, _ := json.Marshal(map[string]string{"type": "ERROR", "message": err.Error()})
-					c.send <- resp
-				} else {
-					session, _ := c.rm.getRoom(code)
-
-					// Register with matchmaker to track session/ELO
-					c.mm.RegisterSession(session)
-
-					// Check state
-					if len(session.Engine.History) > 0 {
-						sendGameSync(c, session)
-					} else {
-						// New game or start
-						if session.ClientX != nil && session.ClientO != nil {
-							session.StartGame() // Start Timers
-							sendMatchFound(session)
-						}
-					}
-				}
-			} else if msg["type"] == "LEAVE_ROOM" {
-				log.Printf("Received LEAVE_ROOM from Client %s", c.ID)
-				// Player explicitly leaving. Forfeit game.
-				if c.Session != nil {
-					log.Printf("Client %s has valid session. Processing forfeit.", c.ID)
-					var opponent *Client
-					var winnerStr string
-					var winner *Client
+// newClient creates a client for userID connected through t. Call connect
+// once the transport is ready to pump messages.
+func newClient(id string, hub *Hub, mm *Matchmaker, rm *RoomManager, t transport) *Client {
+	return &Client{
+		ID:   id,
+		hub:  hub,
+		mm:   mm,
+		rm:   rm,
+		conn: t,
+		send: make(chan *wireMessage, sendBufferSize),
+		wake: make(chan struct{}, 1),
+		done: make(chan struct{}),
+	}
+}
 
-					if c == c.Session.ClientX {
-						opponent = c.Session.ClientO
-						winnerStr = "O"
-						winner = c.Session.ClientO
-					} else {
-						opponent = c.Session.ClientX
-						winnerStr = "X"
-						winner = c.Session.ClientX
-					}
+// connect makes the client reachable and hands it anything addressed to
+// its user while they were away.
+func (c *Client) connect() {
+	c.hub.register <- c
+	if c.mm.challenges != nil {
+		c.mm.challenges.deliverPending(c.ID)
+	}
+}
 
-					if opponent != nil {
-						log.Printf("Opponent found: %s. Sending GAME_OVER.", opponent.ID)
-						// Broadcast GAME_OVER to opponent
-						resp, _ := json.Marshal(map[string]interface{}{
-							"type":        "GAME_OVER",
-							"winner":      winnerStr,
-							"winningLine": nil,
-							"reason":      "opponent_left",
-						})
-						opponent.send <- resp
+// disconnect cleans up after a client whose connection has gone away. The
+// transport calls it exactly once.
+func (c *Client) disconnect() {
+	if c.done != nil {
+		close(c.done)
+	}
+	// Spectators just stop watching
+	c.stopWatching()
+	if c.rm.lobby != nil {
+		c.rm.lobby.unsubscribe(c)
+	}
 
-						// Record verification and end session
-						c.mm.endGame(c.Session, winner)
-					} else {
-						log.Println("Opponent is nil. Cannot notify.")
-					}
-				} else {
-					log.Println("Client Session is nil. Ignoring LEAVE_ROOM.")
-				}
-			} else if msg["type"] == "CHAT_MESSAGE" {
-				if roomID, ok := msg["room_id"].(string); ok && roomID != "" {
-					c.rm.broadcast(roomID, message)
-				} else {
-					c.hub.broadcast <- message
-				}
-			} else {
-				c.hub.broadcast <- message
-			}
+	// Players get a while to come back before forfeiting.
+	if session := c.session(); session != nil {
+		if isX, ok := session.unseat(c); ok {
+			c.startAbandonTimer(session, isX)
 		}
 	}
+	c.hub.unregister <- c
+	c.mm.removeClient <- c // Notify Matchmaker
+	c.conn.close()
 }
 
-func (c *Client) writePump() {
-	ticker := time.NewTicker(pingPeriod)
-	defer func() {
-		ticker.Stop()
-		c.conn.Close()
-	}()
+// pump writes the client's messages with write until the client goes away
+// or write fails, calling keepAlive whenever it has been idle for period.
+func (c *Client) pump(write func(*wireMessage) error, keepAlive func() error, period time.Duration) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
 	for {
 		select {
-		case message, ok := <-c.send:
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if !ok {
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
-				return
+		case <-c.done:
+			return
+		case message := <-c.send:
+			if message == kickMessage {
+				return // Kicked; see kick
 			}
-
-			w, err := c.conn.NextWriter(websocket.TextMessage)
-			if err != nil {
-				return
-			}
-			w.Write(message)
-
-			// n := len(c.send)
-			// for i := 0; i < n; i++ {
-			// 	w.Write(<-c.send)
-			// }
-
-			if err := w.Close(); err != nil {
+			if err := write(message); err != nil {
 				return
 			}
+		case <-c.wake:
 		case <-ticker.C:
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+			if err := keepAlive(); err != nil {
 				return
 			}
 		}
+
+		// A snapshot replaces the events a slow client missed, so it goes
+		// out after everything queued before them.
+		if len(c.send) == 0 {
+			if snapshot := c.takeResync(); snapshot != nil {
+				if err := write(snapshot); err != nil {
+					return
+				}
+			}
+		}
 	}
 }
 
-func serveWs(hub *Hub, mm *Matchmaker, rm *RoomManager, w http.ResponseWriter, r *http.Request, id string) {
-	conn, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Println(err)
-		return
-	}
-	client := &Client{ID: id, hub: hub, mm: mm, rm: rm, conn: conn, send: make(chan []byte, 256)}
-	client.hub.register <- client
+// kickMessage is queued after a kicked client's last message to drop the
+// connection.
+var kickMessage = &wireMessage{}
 
-	go client.writePump()
-	go client.readPump()
+// kick sends msg and then drops the connection.
+func (c *Client) kick(msg interface{}) {
+	c.sendMessage(msg)
+	c.enqueue(kickMessage, closeIfFull)
 }
 
-func sendMatchFound(session *GameSession) {
-	msg1, _ := json.Marshal(map[string]interface{}{
-		"type":       "MATCH_FOUND",
-		"color":      "X",
-		"total_time": session.TotalTimeX.Seconds(),
-		"turn_limit": session.MoveTimeLimit.Seconds(),
-	})
-	if session.ClientX != nil {
-		session.ClientX.send <- msg1
-	}
+// session returns the game c is playing or watching, if any.
+func (c *Client) session() *GameSession {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Session
+}
 
-	msg2, _ := json.Marshal(map[string]interface{}{
-		"type":       "MATCH_FOUND",
-		"color":      "O",
-		"total_time": session.TotalTimeO.Seconds(),
-		"turn_limit": session.MoveTimeLimit.Seconds(),
-	})
-	if session.ClientO != nil {
-		session.ClientO.send <- msg2
-	}
+func (c *Client) setSession(s *GameSession) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Session = s
+}
 
+// leaveSession clears c's game if it is still s, so a client that has moved
+// on to another game keeps it.
+func (c *Client) leaveSession(s *GameSession) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.Session == s {
+		c.Session = nil
+	}
 }
 
-func sendGameSync(c *Client, session *GameSession) {
-	// Reconstruct board for sync? Or simply send history and let client replay?
-	// Sending history is robust.
-	// But client might want full state.
-	// For now, let's send Board State + History.
+// queue returns the rule and arena c is queued for.
+func (c *Client) queue() (engine.GameRule, string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.PreferredRule, c.ArenaID
+}
 
-	// Convert Engine Board to persistable format if needed, OR just send moves.
-	// Sending moves is easiest for client to replay.
+func (c *Client) setQueue(rule engine.GameRule, arenaID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.PreferredRule, c.ArenaID = rule, arenaID
+}
 
-	var myColor string
-	if c == session.ClientX {
-		myColor = "X"
-	} else {
-		myColor = "O"
+// closed reports whether the client's connection has gone away.
+func (c *Client) closed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
 	}
+}
 
-	resp, _ := json.Marshal(map[string]interface{}{
-		"type":       "GAME_SYNC",
-		"color":      myColor,
-		"history":    session.Engine.History,
-		"turn":       session.Engine.CurrentPlayer,
-		"turn_limit": session.MoveTimeLimit.Seconds(),
+// startAbandonTimer forfeits the game of a player who left it unless they
+// come back in time.
+func (c *Client) startAbandonTimer(session *GameSession, isX bool) {
+	session.StartDisconnectTimer(isX, 2*time.Minute, func() {
+		// Time's up! Forfeit game if the other player is still there.
+		x, o := session.players()
+		winner, opponent := "O", o
+		if !isX {
+			winner, opponent = "X", x
+		}
+		if opponent == nil {
+			// Both disconnected? Just log.
+			log.Printf("Session %s fully abandoned.", session.PlayerXID)
+			return
+		}
+		log.Printf("Session Abandoned by %s. Forfeiting...", c.ID)
+		c.mm.conclude(session, winner, &GameOverMessage{
+			Winner: "OPPONENT_ABANDONED", // or UserID
+		}, nil)
 	})
+}
+
+func sendMatchFound(session *GameSession) {
+	x, o := session.players()
+	st := session.state()
+	if x != nil {
+		x.sendMessage(MatchFoundMessage{
+			Type:      MsgMatchFound,
+			Color:     "X",
+			TotalTime: st.TimeX.Seconds(),
+			TurnLimit: st.TurnLimit.Seconds(),
+			ArenaID:   session.ArenaID,
+		})
+	}
+	if o != nil {
+		o.sendMessage(MatchFoundMessage{
+			Type:      MsgMatchFound,
+			Color:     "O",
+			TotalTime: st.TimeO.Seconds(),
+			TurnLimit: st.TurnLimit.Seconds(),
+			ArenaID:   session.ArenaID,
+		})
+	}
+}
 
-	c.send <- resp
+// gameSync describes a game in progress to a player rejoining it. The client
+// replays the move history to rebuild the board.
+func gameSync(c *Client, session *GameSession) *GameSyncMessage {
+	myColor := session.colorOf(c) // Empty when spectating
+	st := session.state()
+	history, turn := st.History, st.Turn
+	seq, result := session.lastEvent()
+	if myColor == "" {
+		history, turn, seq, result = session.spectatorSnapshot()
+	}
+	timeX, timeO := session.clocks()
+	return &GameSyncMessage{
+		Type:      MsgGameSync,
+		Color:     myColor,
+		PlayerX:   st.PlayerX,
+		PlayerO:   st.PlayerO,
+		History:   history,
+		Turn:      turn,
+		TurnLimit: st.TurnLimit.Seconds(),
+		TimeX:     timeX.Seconds(),
+		TimeO:     timeO.Seconds(),
+		Seq:       seq,
+		Result:    result,
+	}
 }
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// WebSocket subprotocols selecting the wire encoding. Clients that don't
+// ask for one get JSON.
+const (
+	SubprotocolJSON    = "caro.json"
+	SubprotocolMsgpack = "caro.msgpack"
+)
+
+// subprotocols lists the encodings the server speaks, preferred first.
+var subprotocols = []string{SubprotocolMsgpack, SubprotocolJSON}
+
+// codec is a wire encoding. Server messages are wrapped by encode and each
+// codec sends them in its own encoding; client messages are
+// converted to JSON, which is what the rest of the server works with. A
+// message is the same in every encoding: the same fields under the same
+// names, as described in the API docs.
+type codec interface {
+	frameType() int                // websocket.TextMessage or websocket.BinaryMessage
+	frame(msg *wireMessage) []byte // msg in this encoding
+	decode(frame []byte) ([]byte, error)
+}
+
+// codecFor returns the codec for the negotiated subprotocol.
+func codecFor(subprotocol string) codec {
+	if subprotocol == SubprotocolMsgpack {
+		return msgpackCodec{}
+	}
+	return jsonCodec{}
+}
+
+// wireMessage is a server message, shared by every client it goes to. Each
+// encoding is marshalled once, when the first client needing it sends it,
+// so messages no msgpack client receives are never packed.
+type wireMessage struct {
+	msg interface{}
+
+	jsonOnce    sync.Once
+	json        []byte
+	msgpackOnce sync.Once
+	msgpack     []byte
+}
+
+// encode wraps a server message for sending. Callers may change msg once
+// it is sent, e.g. to reply with it after publishing it, so the struct a
+// pointer points to is copied.
+func encode(msg interface{}) *wireMessage {
+	if v := reflect.ValueOf(msg); v.Kind() == reflect.Pointer && !v.IsNil() {
+		c := reflect.New(v.Elem().Type())
+		c.Elem().Set(v.Elem())
+		msg = c.Interface()
+	}
+	return &wireMessage{msg: msg}
+}
+
+// jsonBytes returns the message as JSON. Server messages are plain structs,
+// so failures are programming errors; they are logged and yield nil.
+func (m *wireMessage) jsonBytes() []byte {
+	m.jsonOnce.Do(func() {
+		if m.json != nil {
+			return
+		}
+		var err error
+		if m.json, err = json.Marshal(m.msg); err != nil {
+			log.Printf("Encoding %T as JSON: %v", m.msg, err)
+		}
+	})
+	return m.json
+}
+
+// msgpackBytes returns the message as MessagePack, as jsonBytes does JSON.
+func (m *wireMessage) msgpackBytes() []byte {
+	m.msgpackOnce.Do(func() {
+		if m.msgpack != nil {
+			return
+		}
+		var err error
+		if m.msgpack, err = marshalMsgpack(m.msg); err != nil {
+			log.Printf("Encoding %T as msgpack: %v", m.msg, err)
+		}
+	})
+	return m.msgpack
+}
+
+// marshalMsgpack encodes msg as a MessagePack map using the msgpack struct
+// tags, or the json ones for types from other packages, so that fields
+// have the same names as in JSON. Whole numbers are sent as integers and
+// everything else as floats.
+func marshalMsgpack(msg interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := msgpack.GetEncoder()
+	defer msgpack.PutEncoder(enc)
+	enc.Reset(&buf)
+	enc.SetCustomStructTag("json")
+	enc.UseCompactInts(true)
+	enc.UseCompactFloats(true)
+	if err := enc.Encode(msg); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func init() {
+	// Times are RFC 3339 strings, as in JSON, rather than MessagePack
+	// timestamps.
+	msgpack.Register(time.Time{}, func(enc *msgpack.Encoder, v reflect.Value) error {
+		return enc.EncodeString(v.Interface().(time.Time).Format(time.RFC3339Nano))
+	}, nil)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) frameType() int                      { return websocket.TextMessage }
+func (jsonCodec) frame(msg *wireMessage) []byte       { return msg.jsonBytes() }
+func (jsonCodec) decode(frame []byte) ([]byte, error) { return frame, nil }
+
+// msgpackCodec sends each message as a MessagePack map.
+type msgpackCodec struct{}
+
+func (msgpackCodec) frameType() int                { return websocket.BinaryMessage }
+func (msgpackCodec) frame(msg *wireMessage) []byte { return msg.msgpackBytes() }
+
+func (msgpackCodec) decode(frame []byte) ([]byte, error) {
+	var v interface{}
+	if err := msgpack.Unmarshal(frame, &v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
@@ -2,9 +2,13 @@
 package config
 
 import (
+	"errors"
 	"flag"
+	"fmt"
 	"os"
+	"slices"
 	"strconv"
+	"strings"
 )
 
 // Config holds all server configuration values.
@@ -14,8 +18,11 @@ type Config struct {
 	ServerHost string
 	ServerPort int
 
-	// Database configuration
-	UsersDBPath string
+	// Database configuration. DBDriver is "sqlite", with DBDSN the path of
+	// the database file, or "postgres", with DBDSN a connection string;
+	// servers sharing a Postgres database can run side by side.
+	DBDriver string
+	DBDSN    string
 
 	// Game configuration
 	BoardRows    int
@@ -28,19 +35,44 @@ type Config struct {
 	// WebSocket configuration
 	PingInterval int // seconds
 	PingTimeout  int // seconds
+
+	// Token configuration. JWTKeys lists signing keys as "kid:secret"
+	// pairs separated by commas; JWTKeysFile holds one pair per line.
+	// Tokens are signed with JWTActiveKeyID, or the first key listed, and
+	// accepted from any listed key, so keys can be rotated.
+	JWTKeys         string
+	JWTKeysFile     string
+	JWTActiveKeyID  string
+	AccessTokenTTL  int // seconds
+	RefreshTokenTTL int // seconds
+}
+
+// SigningKey is a JWT signing secret and the key ID tokens name it by.
+type SigningKey struct {
+	ID     string
+	Secret []byte
 }
 
 // Default configuration values
 const (
-	DefaultServerHost      = "0.0.0.0"
-	DefaultServerPort      = 8080
-	DefaultUsersDBPath     = "users.json"
-	DefaultBoardRows       = 15
-	DefaultBoardColumns    = 15
-	DefaultEloRange        = 200
+	DefaultServerHost         = "0.0.0.0"
+	DefaultServerPort         = 8080
+	DefaultDBDriver           = DriverSQLite
+	DefaultDBDSN              = "caro.db"
+	DefaultBoardRows          = 15
+	DefaultBoardColumns       = 15
+	DefaultEloRange           = 200
 	DefaultMatchmakingTimeout = 30
-	DefaultPingInterval    = 30
-	DefaultPingTimeout     = 60
+	DefaultPingInterval       = 30
+	DefaultPingTimeout        = 60
+	DefaultAccessTokenTTL     = 15 * 60
+	DefaultRefreshTokenTTL    = 30 * 24 * 60 * 60
+)
+
+// Database drivers
+const (
+	DriverSQLite   = "sqlite"
+	DriverPostgres = "postgres"
 )
 
 var cfg *Config
@@ -53,16 +85,22 @@ func Load() *Config {
 	}
 
 	cfg = &Config{
-		ServerAddr:          os.Getenv("CARO_CHESS_ADDR"),
-		ServerHost:          os.Getenv("CARO_CHESS_HOST"),
-		ServerPort:          intEnvVar("CARO_CHESS_PORT", DefaultServerPort),
-		UsersDBPath:         stringEnvVar("CARO_CHESS_USERS_DB", DefaultUsersDBPath),
-		BoardRows:           intEnvVar("CARO_CHESS_BOARD_ROWS", DefaultBoardRows),
-		BoardColumns:        intEnvVar("CARO_CHESS_BOARD_COLUMNS", DefaultBoardColumns),
-		EloRange:            intEnvVar("CARO_CHESS_ELO_RANGE", DefaultEloRange),
-		MatchmakingTimeout:  intEnvVar("CARO_CHESS_MATCHMAKING_TIMEOUT", DefaultMatchmakingTimeout),
-		PingInterval:        intEnvVar("CARO_CHESS_PING_INTERVAL", DefaultPingInterval),
-		PingTimeout:         intEnvVar("CARO_CHESS_PING_TIMEOUT", DefaultPingTimeout),
+		ServerAddr:         os.Getenv("CARO_CHESS_ADDR"),
+		ServerHost:         os.Getenv("CARO_CHESS_HOST"),
+		ServerPort:         intEnvVar("CARO_CHESS_PORT", DefaultServerPort),
+		DBDriver:           stringEnvVar("CARO_CHESS_DB_DRIVER", DefaultDBDriver),
+		DBDSN:              stringEnvVar("CARO_CHESS_DB_DSN", DefaultDBDSN),
+		BoardRows:          intEnvVar("CARO_CHESS_BOARD_ROWS", DefaultBoardRows),
+		BoardColumns:       intEnvVar("CARO_CHESS_BOARD_COLUMNS", DefaultBoardColumns),
+		EloRange:           intEnvVar("CARO_CHESS_ELO_RANGE", DefaultEloRange),
+		MatchmakingTimeout: intEnvVar("CARO_CHESS_MATCHMAKING_TIMEOUT", DefaultMatchmakingTimeout),
+		PingInterval:       intEnvVar("CARO_CHESS_PING_INTERVAL", DefaultPingInterval),
+		PingTimeout:        intEnvVar("CARO_CHESS_PING_TIMEOUT", DefaultPingTimeout),
+		JWTKeys:            os.Getenv("CARO_CHESS_JWT_KEYS"),
+		JWTKeysFile:        os.Getenv("CARO_CHESS_JWT_KEYS_FILE"),
+		JWTActiveKeyID:     os.Getenv("CARO_CHESS_JWT_ACTIVE_KEY"),
+		AccessTokenTTL:     intEnvVar("CARO_CHESS_ACCESS_TOKEN_TTL", DefaultAccessTokenTTL),
+		RefreshTokenTTL:    intEnvVar("CARO_CHESS_REFRESH_TOKEN_TTL", DefaultRefreshTokenTTL),
 	}
 
 	// Construct ServerAddr from Host and Port if not set
@@ -75,8 +113,10 @@ func Load() *Config {
 
 	// Allow command line flag overrides
 	flag.StringVar(&cfg.ServerAddr, "addr", cfg.ServerAddr, "http service address")
-	flag.StringVar(&cfg.UsersDBPath, "users-db", cfg.UsersDBPath, "user database path")
+	flag.StringVar(&cfg.DBDriver, "db-driver", cfg.DBDriver, "database driver, sqlite or postgres")
+	flag.StringVar(&cfg.DBDSN, "db-dsn", cfg.DBDSN, "database file for sqlite or connection string for postgres")
 	flag.IntVar(&cfg.ServerPort, "port", cfg.ServerPort, "server port")
+	flag.StringVar(&cfg.JWTKeysFile, "jwt-keys", cfg.JWTKeysFile, "file of JWT signing keys, one kid:secret per line")
 	flag.Parse()
 
 	return cfg
@@ -91,6 +131,46 @@ func Get() *Config {
 	return cfg
 }
 
+// SigningKeys returns the configured JWT signing keys, the active one
+// first. It returns no keys if none are configured.
+func (c *Config) SigningKeys() ([]SigningKey, error) {
+	spec := strings.ReplaceAll(c.JWTKeys, ",", "\n")
+	if c.JWTKeysFile != "" {
+		data, err := os.ReadFile(c.JWTKeysFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading JWT keys: %w", err)
+		}
+		spec += "\n" + string(data)
+	}
+
+	var keys []SigningKey
+	seen := make(map[string]bool)
+	for _, line := range strings.Split(spec, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		id, secret, ok := strings.Cut(line, ":")
+		if !ok || id == "" || secret == "" {
+			return nil, errors.New("JWT keys must be kid:secret pairs") // Don't log a secret
+		}
+		if seen[id] {
+			return nil, fmt.Errorf("JWT key %q listed twice", id)
+		}
+		seen[id] = true
+		keys = append(keys, SigningKey{ID: id, Secret: []byte(secret)})
+	}
+
+	if c.JWTActiveKeyID != "" {
+		i := slices.IndexFunc(keys, func(k SigningKey) bool { return k.ID == c.JWTActiveKeyID })
+		if i < 0 {
+			return nil, fmt.Errorf("active JWT key %q is not configured", c.JWTActiveKeyID)
+		}
+		keys[0], keys[i] = keys[i], keys[0]
+	}
+	return keys, nil
+}
+
 // Helper functions for environment variable parsing
 
 func intEnvVar(key string, defaultValue int) int {
@@ -0,0 +1,88 @@
+package db
+
+import "time"
+
+// Role is what a user may do beyond playing.
+type Role string
+
+const (
+	RolePlayer    Role = "player"
+	RoleModerator Role = "moderator" // Manages live games and sanctions
+	RoleAdmin     Role = "admin"     // Also adjusts coins and roles
+)
+
+var roleRanks = map[Role]int{RolePlayer: 0, RoleModerator: 1, RoleAdmin: 2}
+
+// Valid reports whether r is a known role.
+func (r Role) Valid() bool {
+	_, ok := roleRanks[r]
+	return ok
+}
+
+// AtLeast reports whether r may do everything min may. The empty role is
+// a player.
+func (r Role) AtLeast(min Role) bool {
+	return roleRanks[r] >= roleRanks[min]
+}
+
+// SanctionKind is what a sanction stops a user doing.
+type SanctionKind string
+
+const (
+	SanctionBan     SanctionKind = "ban"     // Can't connect, play or buy
+	SanctionSuspend SanctionKind = "suspend" // Can't queue for games or buy
+	SanctionMute    SanctionKind = "mute"    // Can't chat or buy
+)
+
+// Sanction is a moderator's ban, suspension or mute of a user. It stays in
+// force until it expires or is lifted.
+type Sanction struct {
+	ID         int64        `json:"id"`
+	UserID     string       `json:"user_id"`
+	Kind       SanctionKind `json:"kind"`
+	Reason     string       `json:"reason"`
+	IssuedBy   string       `json:"issued_by"`
+	CreatedAt  time.Time    `json:"created_at"`
+	ExpiresAt  time.Time    `json:"expires_at,omitzero"` // Zero to last until lifted
+	AppealNote string       `json:"appeal_note,omitempty"`
+	LiftedBy   string       `json:"lifted_by,omitempty"`
+	LiftedAt   time.Time    `json:"lifted_at,omitzero"`
+}
+
+// Active reports whether the sanction is in force.
+func (s *Sanction) Active() bool {
+	return s.LiftedAt.IsZero() && (s.ExpiresAt.IsZero() || time.Now().Before(s.ExpiresAt))
+}
+
+// AuditEntry records one moderator or admin action.
+type AuditEntry struct {
+	ID        int64     `json:"id"`
+	ActorID   string    `json:"actor_id"`
+	Action    string    `json:"action"`
+	TargetID  string    `json:"target_id"` // A user, game or sanction
+	Reason    string    `json:"reason,omitempty"`
+	Details   string    `json:"details,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// AdminRepository stores roles, sanctions and the audit log.
+type AdminRepository interface {
+	SetUserRole(userID string, role Role) error
+	// CreateSanction sets s.ID and s.CreatedAt.
+	CreateSanction(s *Sanction) error
+	// GetSanction fails with ErrNotFound.
+	GetSanction(id int64) (*Sanction, error)
+	// ListSanctions returns a user's sanctions, newest first.
+	ListSanctions(userID string) ([]*Sanction, error)
+	// ActiveSanctions returns the user's sanctions in force, newest first.
+	ActiveSanctions(userID string) ([]*Sanction, error)
+	// SetAppealNote fails with ErrNotFound.
+	SetAppealNote(id int64, note string) error
+	// LiftSanction fails with ErrNotFound unless the sanction is in force.
+	LiftSanction(id int64, liftedBy string) error
+	// RecordAudit sets e.ID and e.CreatedAt.
+	RecordAudit(e *AuditEntry) error
+	// ListAudit returns the newest entries first, only those about
+	// targetID if it is set.
+	ListAudit(targetID string, limit int) ([]*AuditEntry, error)
+}
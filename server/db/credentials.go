@@ -0,0 +1,41 @@
+package db
+
+import (
+	"errors"
+	"time"
+)
+
+// Credential is how a user logs in: a username, unique regardless of case
+// and separate from the internal user ID, and a password hash.
+type Credential struct {
+	UserID       string
+	Username     string
+	PasswordHash string // Encoded by auth.HashPassword
+
+	// Consecutive failed logins, and when the lockout they caused ends.
+	FailedLogins int
+	LockedUntil  time.Time
+}
+
+var (
+	ErrNotFound         = errors.New("not found")
+	ErrUsernameTaken    = errors.New("username already taken")
+	ErrCredentialExists = errors.New("user already has a password")
+)
+
+// CredentialRepository stores login credentials.
+type CredentialRepository interface {
+	// CreateCredential fails with ErrUsernameTaken or ErrCredentialExists.
+	CreateCredential(c *Credential) error
+	// CreateAccount adds a new user and their credential together and, if
+	// guestID is set, merges the guest's records into the user (see
+	// UserRepository.MergeUsers). If it fails, with ErrUsernameTaken or
+	// otherwise, nothing is changed.
+	CreateAccount(u *User, c *Credential, guestID string) error
+	// GetCredentialByUsername and GetCredentialByUserID fail with
+	// ErrNotFound.
+	GetCredentialByUsername(username string) (*Credential, error)
+	GetCredentialByUserID(userID string) (*Credential, error)
+	// UpdateCredential saves the hash and the lockout state.
+	UpdateCredential(c *Credential) error
+}
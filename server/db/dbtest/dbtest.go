@@ -0,0 +1,301 @@
+// Package dbtest checks that an implementation of db.UserRepository behaves
+// like the others, so the server works the same whatever stores its data.
+package dbtest
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"caro_chess_server/db"
+)
+
+// RunUserRepository runs the contract of db.UserRepository against the
+// repositories returned by open, which must be new and empty for each call.
+func RunUserRepository(t *testing.T, open func(t *testing.T) db.UserRepository) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, repo db.UserRepository)
+	}{
+		{"NewUser", testNewUser},
+		{"SaveUser", testSaveUser},
+		{"Coins", testCoins},
+		{"Inventory", testInventory},
+		{"Matches", testMatches},
+		{"Ratings", testRatings},
+		{"Leaderboard", testLeaderboard},
+		{"TournamentResults", testTournamentResults},
+		{"MergeUsers", testMergeUsers},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t, open(t))
+		})
+	}
+}
+
+// start is when the matches of the tests are played. It is whole seconds
+// so every store keeps it exactly.
+var start = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+func testNewUser(t *testing.T, repo db.UserRepository) {
+	user, err := repo.GetUser("alice")
+	if err != nil {
+		t.Fatalf("GetUser of a new user: %v", err)
+	}
+	if user.ID != "alice" || user.ELO != 1200 || user.GamesPlayed != 0 || user.Coins != 0 {
+		t.Errorf("New user = %+v, want alice rated 1200 with nothing else", user)
+	}
+
+	if user, err := repo.FindUser("alice"); err != nil || user.ID != "alice" {
+		t.Errorf("FindUser of a known user = %+v, %v", user, err)
+	}
+	if _, err := repo.FindUser("bob"); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("FindUser of an unknown user: err = %v, want ErrNotFound", err)
+	}
+	if leaders, _ := repo.GetLeaderboard(10); len(leaders) != 1 {
+		t.Errorf("FindUser created a user: leaderboard has %d users, want 1", len(leaders))
+	}
+}
+
+func testSaveUser(t *testing.T, repo db.UserRepository) {
+	want := db.User{ID: "alice", ELO: 1310, GamesPlayed: 6, Wins: 3, Losses: 2, Draws: 1, Coins: 700}
+	saved := want
+	if err := repo.SaveUser(&saved); err != nil {
+		t.Fatalf("SaveUser: %v", err)
+	}
+	if user, err := repo.GetUser("alice"); err != nil || !sameStats(user, &want) {
+		t.Errorf("GetUser = %+v, %v; want %+v", user, err, want)
+	}
+
+	want.ELO, want.GamesPlayed, want.Losses = 1295, 7, 3
+	saved = want
+	repo.SaveUser(&saved)
+	if user, _ := repo.GetUser("alice"); !sameStats(user, &want) {
+		t.Errorf("GetUser after saving again = %+v, want %+v", user, want)
+	}
+}
+
+// sameStats reports whether a and b are the same user with the same rating,
+// record and coins.
+func sameStats(a, b *db.User) bool {
+	return a.ID == b.ID && a.ELO == b.ELO && a.GamesPlayed == b.GamesPlayed && a.Wins == b.Wins &&
+		a.Losses == b.Losses && a.Draws == b.Draws && a.Coins == b.Coins
+}
+
+func testCoins(t *testing.T, repo db.UserRepository) {
+	repo.SaveUser(&db.User{ID: "alice", ELO: 1200, Coins: 100})
+	if err := repo.UpdateUserCoins("alice", 50); err != nil {
+		t.Fatalf("UpdateUserCoins: %v", err)
+	}
+	repo.UpdateUserCoins("alice", -120)
+	if user, _ := repo.GetUser("alice"); user.Coins != 30 || user.ELO != 1200 {
+		t.Errorf("alice = %+v, want 30 coins and her rating kept", user)
+	}
+	if err := repo.UpdateUserCoins("alice", -31); !errors.Is(err, db.ErrInsufficientCoins) {
+		t.Errorf("Overdrawing = %v, want ErrInsufficientCoins", err)
+	}
+	if user, _ := repo.GetUser("alice"); user.Coins != 30 {
+		t.Errorf("alice has %d coins after a refused withdrawal, want 30", user.Coins)
+	}
+	if err := repo.UpdateUserCoins("nobody", 10); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("UpdateUserCoins of an unknown user = %v, want ErrNotFound", err)
+	}
+}
+
+func testInventory(t *testing.T, repo db.UserRepository) {
+	for _, item := range []string{"neon_piece", "board_ice", "neon_piece"} {
+		if err := repo.AddToInventory("alice", item); err != nil {
+			t.Fatalf("AddToInventory(%q): %v", item, err)
+		}
+	}
+	items, err := repo.GetInventory("alice")
+	slices.Sort(items)
+	if err != nil || !slices.Equal(items, []string{"board_ice", "neon_piece"}) {
+		t.Errorf("GetInventory = %v, %v; want each item once", items, err)
+	}
+	if items, _ := repo.GetInventory("bob"); len(items) != 0 {
+		t.Errorf("Inventory of bob = %v, want none", items)
+	}
+}
+
+func testMatches(t *testing.T, repo db.UserRepository) {
+	alice := "alice"
+	first := &db.Match{ID: "m1", PlayerXID: "alice", PlayerOID: "bob", WinnerID: &alice, Timestamp: start,
+		Moves: []db.Move{{X: 7, Y: 7, Player: "X", Order: 0}, {X: 7, Y: 8, Player: "O", Order: 1}, {X: 8, Y: 8, Player: "X", Order: 2}}}
+	second := &db.Match{ID: "m2", PlayerXID: "bob", PlayerOID: "alice", Timestamp: start.Add(time.Hour)}
+	third := &db.Match{ID: "m3", PlayerXID: "carol", PlayerOID: "alice", Timestamp: start.Add(2 * time.Hour)}
+	other := &db.Match{ID: "m4", PlayerXID: "bob", PlayerOID: "carol", Timestamp: start.Add(3 * time.Hour)}
+	for _, m := range []*db.Match{first, second, third, other} {
+		if err := repo.SaveMatch(m); err != nil {
+			t.Fatalf("SaveMatch(%s): %v", m.ID, err)
+		}
+	}
+
+	got, err := repo.GetMatch("m1")
+	if err != nil || got == nil {
+		t.Fatalf("GetMatch = %v, %v", got, err)
+	}
+	if got.PlayerXID != "alice" || got.PlayerOID != "bob" || got.WinnerID == nil || *got.WinnerID != "alice" ||
+		!got.Timestamp.Equal(start) || !slices.Equal(got.Moves, first.Moves) {
+		t.Errorf("GetMatch = %+v, want %+v", got, first)
+	}
+	if got, _ := repo.GetMatch("m2"); got == nil || got.WinnerID != nil || len(got.Moves) != 0 {
+		t.Errorf("GetMatch of a draw without moves = %+v", got)
+	}
+	if got, err := repo.GetMatch("missing"); got != nil || err != nil {
+		t.Errorf("GetMatch of a missing match = %+v, %v; want nil, nil", got, err)
+	}
+
+	recent, err := repo.GetMatchesByUserID("alice", 2)
+	if err != nil || len(recent) != 2 || recent[0].ID != "m3" || recent[1].ID != "m2" {
+		t.Errorf("GetMatchesByUserID = %v, %v; want m3 and m2, newest first", matchIDs(recent), err)
+	}
+	all, err := repo.GetAllMatches()
+	if ids := matchIDs(all); err != nil || !slices.Equal(ids, []string{"m1", "m2", "m3", "m4"}) {
+		t.Errorf("GetAllMatches = %v, %v; want every match, oldest first", ids, err)
+	}
+}
+
+func matchIDs(matches []*db.Match) []string {
+	ids := make([]string, len(matches))
+	for i, m := range matches {
+		ids[i] = m.ID
+	}
+	return ids
+}
+
+func testRatings(t *testing.T, repo db.UserRepository) {
+	// A match from before ratings were recorded is left out of the history.
+	repo.SaveMatch(&db.Match{ID: "old", PlayerXID: "alice", PlayerOID: "bob", Timestamp: start})
+	repo.SaveMatch(&db.Match{ID: "m1", PlayerXID: "alice", PlayerOID: "bob", Timestamp: start.Add(time.Hour),
+		PlayerXRatingBefore: 1200, PlayerXRatingAfter: 1216, PlayerORatingBefore: 1200, PlayerORatingAfter: 1184})
+	repo.SaveMatch(&db.Match{ID: "m2", PlayerXID: "bob", PlayerOID: "alice", Timestamp: start.Add(2 * time.Hour)})
+	if err := repo.UpdateMatchRatings(&db.Match{ID: "m2",
+		PlayerXRatingBefore: 1184, PlayerXRatingAfter: 1170, PlayerORatingBefore: 1216, PlayerORatingAfter: 1230}); err != nil {
+		t.Fatalf("UpdateMatchRatings: %v", err)
+	}
+
+	history, err := repo.GetRatingHistory("alice")
+	if err != nil || len(history) != 2 {
+		t.Fatalf("GetRatingHistory = %v, %v; want 2 changes", history, err)
+	}
+	if c := history[0]; c.MatchID != "m1" || c.Before != 1200 || c.After != 1216 || !c.Timestamp.Equal(start.Add(time.Hour)) {
+		t.Errorf("First change = %+v, want m1 from 1200 to 1216", c)
+	}
+	if c := history[1]; c.MatchID != "m2" || c.Before != 1216 || c.After != 1230 {
+		t.Errorf("Second change = %+v, want m2 from 1216 to 1230 as O", c)
+	}
+	if m, _ := repo.GetMatch("m2"); m.PlayerXRatingAfter != 1170 || m.PlayerORatingBefore != 1216 {
+		t.Errorf("m2 after UpdateMatchRatings = %+v", m)
+	}
+}
+
+func testLeaderboard(t *testing.T, repo db.UserRepository) {
+	repo.SaveUser(&db.User{ID: "alice", ELO: 1250, Wins: 4})
+	repo.SaveUser(&db.User{ID: "bob", ELO: 1180})
+	repo.SaveUser(&db.User{ID: "carol", ELO: 1320})
+	repo.SaveUser(&db.User{ID: db.GuestIDPrefix + "1", ELO: 1500})
+
+	top, err := repo.GetLeaderboard(2)
+	if err != nil || len(top) != 2 || top[0].ID != "carol" || top[1].ID != "alice" {
+		t.Fatalf("GetLeaderboard(2) = %v, %v; want carol and alice", top, err)
+	}
+	if top[1].ELO != 1250 || top[1].Wins != 4 {
+		t.Errorf("Leaderboard entry = %+v, want alice's rating and record", top[1])
+	}
+	if all, _ := repo.GetLeaderboard(10); len(all) != 3 {
+		t.Errorf("GetLeaderboard(10) has %d users, want the 3 who aren't guests", len(all))
+	}
+}
+
+func testTournamentResults(t *testing.T, repo db.UserRepository) {
+	finished := start.Add(time.Hour)
+	err := repo.SaveTournamentResults([]*db.TournamentResult{
+		{TournamentID: "t1", Name: "Spring", Format: "swiss", UserID: "bob", Rank: 2, Score: 1.5, Games: 3, FinishedAt: finished},
+		{TournamentID: "t1", Name: "Spring", Format: "swiss", UserID: "alice", Rank: 1, Score: 2.5, Games: 3, FinishedAt: finished},
+		{TournamentID: "t2", Name: "Summer", Format: "arena", UserID: "alice", Rank: 1, Score: 9, Games: 5, FinishedAt: finished},
+	})
+	if err != nil {
+		t.Fatalf("SaveTournamentResults: %v", err)
+	}
+
+	results, err := repo.GetTournamentResults("t1")
+	if err != nil || len(results) != 2 {
+		t.Fatalf("GetTournamentResults = %v, %v; want 2 results", results, err)
+	}
+	want := db.TournamentResult{TournamentID: "t1", Name: "Spring", Format: "swiss", UserID: "alice", Rank: 1, Score: 2.5, Games: 3}
+	got := *results[0]
+	if !got.FinishedAt.Equal(finished) {
+		t.Errorf("FinishedAt = %v, want %v", got.FinishedAt, finished)
+	}
+	got.FinishedAt = time.Time{}
+	if got != want || results[1].UserID != "bob" {
+		t.Errorf("Results = %+v, %+v; want alice first then bob", got, *results[1])
+	}
+
+	// Saving a result again replaces it.
+	repo.SaveTournamentResults([]*db.TournamentResult{
+		{TournamentID: "t1", Name: "Spring", Format: "swiss", UserID: "bob", Rank: 2, Score: 2, Games: 4, FinishedAt: finished},
+	})
+	results, _ = repo.GetTournamentResults("t1")
+	if len(results) != 2 || results[1].UserID != "bob" || results[1].Score != 2 || results[1].Games != 4 {
+		t.Errorf("Results after saving bob's again = %v, want bob's new result", results)
+	}
+	if results, _ := repo.GetTournamentResults("missing"); len(results) != 0 {
+		t.Errorf("Results of a missing tournament = %v, want none", results)
+	}
+}
+
+func testMergeUsers(t *testing.T, repo db.UserRepository) {
+	guest := db.GuestIDPrefix + "1"
+	repo.SaveUser(&db.User{ID: guest, ELO: 1230, GamesPlayed: 3, Wins: 2, Losses: 1, Coins: 400})
+	repo.SaveUser(&db.User{ID: "alice", ELO: 1200, Coins: 50})
+	repo.SaveMatch(&db.Match{ID: "m1", PlayerXID: guest, PlayerOID: "bob", WinnerID: &guest, Timestamp: start})
+	repo.SaveMatch(&db.Match{ID: "m2", PlayerXID: "bob", PlayerOID: guest, Timestamp: start.Add(time.Hour)})
+	repo.SaveMatch(&db.Match{ID: "m3", PlayerXID: "alice", PlayerOID: guest, Timestamp: start.Add(2 * time.Hour),
+		Moves: []db.Move{{X: 7, Y: 7, Player: "X"}}})
+	repo.AddToInventory(guest, "neon_piece")
+	repo.AddToInventory(guest, "board_ice")
+	repo.AddToInventory("alice", "neon_piece")
+	repo.SaveTournamentResults([]*db.TournamentResult{
+		{TournamentID: "t1", UserID: guest, Rank: 1, FinishedAt: start},
+		{TournamentID: "t2", UserID: guest, Rank: 3, FinishedAt: start},
+		{TournamentID: "t2", UserID: "alice", Rank: 2, FinishedAt: start},
+	})
+
+	if err := repo.MergeUsers(guest, "alice"); err != nil {
+		t.Fatalf("MergeUsers: %v", err)
+	}
+
+	user, _ := repo.GetUser("alice")
+	if user.GamesPlayed != 3 || user.Wins != 2 || user.Losses != 1 || user.Coins != 450 || user.ELO != 1230 {
+		t.Errorf("Merged user = %+v, want the guest's record and rating and both users' coins", user)
+	}
+	matches, _ := repo.GetMatchesByUserID("alice", 10)
+	if len(matches) != 2 || matches[1].PlayerXID != "alice" || matches[1].WinnerID == nil || *matches[1].WinnerID != "alice" {
+		t.Errorf("Matches of the merged user = %v, want the guest's two against bob, won by alice", matchIDs(matches))
+	}
+	items, _ := repo.GetInventory("alice")
+	slices.Sort(items)
+	if !slices.Equal(items, []string{"board_ice", "neon_piece"}) {
+		t.Errorf("Inventory of the merged user = %v", items)
+	}
+	if results, _ := repo.GetTournamentResults("t1"); len(results) != 1 || results[0].UserID != "alice" {
+		t.Errorf("t1 results = %v, want alice's", results)
+	}
+	if results, _ := repo.GetTournamentResults("t2"); len(results) != 1 || results[0].Rank != 2 {
+		t.Errorf("t2 results = %v, want alice's own result kept", results)
+	}
+
+	if matches, _ := repo.GetMatchesByUserID(guest, 10); len(matches) != 0 {
+		t.Errorf("Guest still has %d matches", len(matches))
+	}
+	if items, _ := repo.GetInventory(guest); len(items) != 0 {
+		t.Errorf("Guest still has items %v", items)
+	}
+	if g, _ := repo.GetUser(guest); g.Coins != 0 || g.GamesPlayed != 0 {
+		t.Errorf("Guest not removed: %+v", g)
+	}
+}
@@ -0,0 +1,351 @@
+package db
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// MemoryUserRepository keeps everything in memory and behaves like the
+// database stores, for tests. It is safe for concurrent use.
+type MemoryUserRepository struct {
+	mu          sync.Mutex
+	users       map[string]*User
+	matches     []*Match // In the order saved
+	inventory   map[string]map[string]bool
+	tournaments map[string][]*TournamentResult
+}
+
+func NewMemoryUserRepository() *MemoryUserRepository {
+	return &MemoryUserRepository{
+		users:       make(map[string]*User),
+		inventory:   make(map[string]map[string]bool),
+		tournaments: make(map[string][]*TournamentResult),
+	}
+}
+
+func (r *MemoryUserRepository) SaveUser(user *User) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	saved := *user
+	saved.Role = RolePlayer // Roles are only set by AdminRepository.SetUserRole
+	if old, ok := r.users[user.ID]; ok {
+		saved.Role = old.Role
+	}
+	r.users[user.ID] = &saved
+	return nil
+}
+
+// GetUser returns the user, created if unknown.
+func (r *MemoryUserRepository) GetUser(id string) (*User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	u, ok := r.users[id]
+	if !ok {
+		u = &User{ID: id, ELO: 1200, Role: RolePlayer}
+		r.users[id] = u
+	}
+	user := *u
+	return &user, nil
+}
+
+func (r *MemoryUserRepository) FindUser(id string) (*User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	u, ok := r.users[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	user := *u
+	return &user, nil
+}
+
+func (r *MemoryUserRepository) SaveMatch(match *Match) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.findMatch(match.ID) != nil {
+		return fmt.Errorf("match %s already exists", match.ID)
+	}
+	r.matches = append(r.matches, copyMatch(match, true))
+	return nil
+}
+
+func (r *MemoryUserRepository) findMatch(id string) *Match {
+	for _, m := range r.matches {
+		if m.ID == id {
+			return m
+		}
+	}
+	return nil
+}
+
+// copyMatch returns a copy of m that shares nothing with it, with its
+// moves only if withMoves is set.
+func copyMatch(m *Match, withMoves bool) *Match {
+	c := *m
+	c.Moves = nil
+	if withMoves {
+		c.Moves = append([]Move(nil), m.Moves...)
+	}
+	if m.WinnerID != nil {
+		winnerID := *m.WinnerID
+		c.WinnerID = &winnerID
+	}
+	return &c
+}
+
+// sortedMatches returns copies of the matches keep selects, without moves,
+// oldest first.
+func (r *MemoryUserRepository) sortedMatches(keep func(m *Match) bool) []*Match {
+	var matches []*Match
+	for _, m := range r.matches {
+		if keep(m) {
+			matches = append(matches, copyMatch(m, false))
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].Timestamp.Before(matches[j].Timestamp)
+	})
+	return matches
+}
+
+func (r *MemoryUserRepository) GetMatchesByUserID(userID string, limit int) ([]*Match, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	played := r.sortedMatches(func(m *Match) bool { return m.PlayerXID == userID || m.PlayerOID == userID })
+	var matches []*Match
+	for i := len(played) - 1; i >= 0 && len(matches) < limit; i-- {
+		matches = append(matches, played[i])
+	}
+	return matches, nil
+}
+
+// GetMatch returns the match with its moves, or nil if there is none.
+func (r *MemoryUserRepository) GetMatch(matchID string) (*Match, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	m := r.findMatch(matchID)
+	if m == nil {
+		return nil, nil
+	}
+	return copyMatch(m, true), nil
+}
+
+// GetAllMatches returns every match without moves, oldest first.
+func (r *MemoryUserRepository) GetAllMatches() ([]*Match, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.sortedMatches(func(*Match) bool { return true }), nil
+}
+
+// UpdateMatchRatings overwrites the recorded before/after ratings of a match.
+func (r *MemoryUserRepository) UpdateMatchRatings(match *Match) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if m := r.findMatch(match.ID); m != nil {
+		m.PlayerXRatingBefore, m.PlayerXRatingAfter = match.PlayerXRatingBefore, match.PlayerXRatingAfter
+		m.PlayerORatingBefore, m.PlayerORatingAfter = match.PlayerORatingBefore, match.PlayerORatingAfter
+	}
+	return nil
+}
+
+// GetRatingHistory returns the user's rating changes, oldest first.
+// Matches recorded before ratings were tracked are skipped.
+func (r *MemoryUserRepository) GetRatingHistory(userID string) ([]*RatingChange, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var changes []*RatingChange
+	for _, m := range r.sortedMatches(func(m *Match) bool { return m.PlayerXID == userID || m.PlayerOID == userID }) {
+		c := &RatingChange{MatchID: m.ID, Timestamp: m.Timestamp, Before: m.PlayerORatingBefore, After: m.PlayerORatingAfter}
+		if m.PlayerXID == userID {
+			c.Before, c.After = m.PlayerXRatingBefore, m.PlayerXRatingAfter
+		}
+		if c.After == 0 {
+			continue
+		}
+		changes = append(changes, c)
+	}
+	return changes, nil
+}
+
+// GetLeaderboard returns the highest rated users, leaving out guests.
+func (r *MemoryUserRepository) GetLeaderboard(limit int) ([]*User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var users []*User
+	for _, u := range r.users {
+		if !IsGuestID(u.ID) {
+			user := *u
+			users = append(users, &user)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool {
+		if users[i].ELO != users[j].ELO {
+			return users[i].ELO > users[j].ELO
+		}
+		return users[i].ID < users[j].ID
+	})
+	if len(users) > limit {
+		users = users[:limit]
+	}
+	return users, nil
+}
+
+func (r *MemoryUserRepository) UpdateUserCoins(userID string, amount int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	u, ok := r.users[userID]
+	if !ok {
+		return ErrNotFound
+	}
+	if u.Coins+amount < 0 {
+		return ErrInsufficientCoins
+	}
+	u.Coins += amount
+	return nil
+}
+
+func (r *MemoryUserRepository) AddToInventory(userID string, itemID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.inventory[userID] == nil {
+		r.inventory[userID] = make(map[string]bool)
+	}
+	r.inventory[userID][itemID] = true
+	return nil
+}
+
+func (r *MemoryUserRepository) GetInventory(userID string) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var items []string
+	for itemID := range r.inventory[userID] {
+		items = append(items, itemID)
+	}
+	sort.Strings(items)
+	return items, nil
+}
+
+// SaveTournamentResults saves the results, replacing any earlier result of
+// the same player in the same tournament.
+func (r *MemoryUserRepository) SaveTournamentResults(results []*TournamentResult) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, result := range results {
+		saved := *result
+		r.saveResult(&saved)
+	}
+	return nil
+}
+
+func (r *MemoryUserRepository) saveResult(result *TournamentResult) {
+	results := r.tournaments[result.TournamentID]
+	for i, old := range results {
+		if old.UserID == result.UserID {
+			results[i] = result
+			return
+		}
+	}
+	r.tournaments[result.TournamentID] = append(results, result)
+}
+
+// GetTournamentResults returns the results of a tournament by rank.
+func (r *MemoryUserRepository) GetTournamentResults(tournamentID string) ([]*TournamentResult, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var results []*TournamentResult
+	for _, result := range r.tournaments[tournamentID] {
+		saved := *result
+		results = append(results, &saved)
+	}
+	sort.SliceStable(results, func(i, j int) bool { return results[i].Rank < results[j].Rank })
+	return results, nil
+}
+
+func (r *MemoryUserRepository) MergeUsers(fromID, intoID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if from, ok := r.users[fromID]; ok {
+		into, ok := r.users[intoID]
+		if !ok {
+			into = &User{ID: intoID, ELO: 1200, Role: RolePlayer}
+			r.users[intoID] = into
+		}
+		if into.GamesPlayed == 0 {
+			into.ELO = from.ELO
+		}
+		into.GamesPlayed += from.GamesPlayed
+		into.Wins += from.Wins
+		into.Losses += from.Losses
+		into.Draws += from.Draws
+		into.Coins += from.Coins
+		delete(r.users, fromID)
+	}
+
+	// A game between the two would become one against themselves.
+	kept := r.matches[:0]
+	for _, m := range r.matches {
+		if (m.PlayerXID == fromID && m.PlayerOID == intoID) || (m.PlayerXID == intoID && m.PlayerOID == fromID) {
+			continue
+		}
+		kept = append(kept, m)
+	}
+	r.matches = kept
+
+	for _, m := range r.matches {
+		if m.PlayerXID == fromID {
+			m.PlayerXID = intoID
+		}
+		if m.PlayerOID == fromID {
+			m.PlayerOID = intoID
+		}
+		if m.WinnerID != nil && *m.WinnerID == fromID {
+			winnerID := intoID
+			m.WinnerID = &winnerID
+		}
+	}
+
+	for itemID := range r.inventory[fromID] {
+		if r.inventory[intoID] == nil {
+			r.inventory[intoID] = make(map[string]bool)
+		}
+		r.inventory[intoID][itemID] = true
+	}
+	delete(r.inventory, fromID)
+
+	// A tournament both played in keeps intoID's result.
+	for tournamentID, results := range r.tournaments {
+		var kept []*TournamentResult
+		hasInto := false
+		for _, result := range results {
+			hasInto = hasInto || result.UserID == intoID
+		}
+		for _, result := range results {
+			if result.UserID == fromID {
+				if hasInto {
+					continue
+				}
+				result.UserID = intoID
+			}
+			kept = append(kept, result)
+		}
+		r.tournaments[tournamentID] = kept
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package db_test
+
+import (
+	"sync"
+	"testing"
+
+	"caro_chess_server/db"
+	"caro_chess_server/db/dbtest"
+)
+
+func TestMemoryUserRepositoryContract(t *testing.T) {
+	dbtest.RunUserRepository(t, func(t *testing.T) db.UserRepository {
+		return db.NewMemoryUserRepository()
+	})
+}
+
+func TestMemoryUserRepositoryConcurrentUse(t *testing.T) {
+	repo := db.NewMemoryUserRepository()
+	repo.SaveUser(&db.User{ID: "alice", ELO: 1200})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				repo.UpdateUserCoins("alice", 1)
+				repo.AddToInventory("alice", "neon_piece")
+				repo.GetLeaderboard(10)
+			}
+		}()
+	}
+	wg.Wait()
+	if user, _ := repo.GetUser("alice"); user.Coins != 800 {
+		t.Errorf("Coins = %d, want 800", user.Coins)
+	}
+}
+
+// A user's record returned by the repository is theirs to change.
+func TestMemoryUserRepositoryCopies(t *testing.T) {
+	repo := db.NewMemoryUserRepository()
+	user := &db.User{ID: "alice", ELO: 1200}
+	repo.SaveUser(user)
+	user.ELO = 2000
+	got, _ := repo.GetUser("alice")
+	got.Coins = 500
+	if again, _ := repo.GetUser("alice"); again.ELO != 1200 || again.Coins != 0 {
+		t.Errorf("alice = %+v, changed through a pointer", again)
+	}
+}
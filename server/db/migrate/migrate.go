@@ -0,0 +1,196 @@
+// Package migrate applies versioned schema migrations to a database.
+//
+// Migrations are files named NNNN_description.sql, applied in order of
+// NNNN. Each runs in a transaction with its entry in schema_migrations, so
+// it is applied entirely or not at all. Never edit one that has been
+// released; add another.
+package migrate
+
+import (
+	"database/sql"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Migration is one step of a schema.
+type Migration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+// Load reads the migrations in dir of fsys, in order. Versions must be 1,
+// 2, 3 and so on.
+func Load(fsys fs.FS, dir string) ([]Migration, error) {
+	names, err := fs.Glob(fsys, path.Join(dir, "*.sql"))
+	if err != nil {
+		return nil, err
+	}
+	var migrations []Migration
+	for _, name := range names {
+		base := strings.TrimSuffix(path.Base(name), ".sql")
+		num, desc, ok := strings.Cut(base, "_")
+		version, err := strconv.Atoi(num)
+		if !ok || err != nil || version <= 0 {
+			return nil, fmt.Errorf("migration %s is not named NNNN_description.sql", name)
+		}
+		body, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, Migration{Version: version, Name: desc, SQL: string(body)})
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			return nil, fmt.Errorf("migration %d is missing or duplicated", i+1)
+		}
+	}
+	return migrations, nil
+}
+
+// Runner applies Migrations to DB.
+type Runner struct {
+	DB         *sql.DB
+	Migrations []Migration
+
+	// Placeholder returns the driver's nth query parameter; nil for "?".
+	Placeholder func(n int) string
+	// Lock, if set, runs first in each transaction changing the schema,
+	// e.g. to keep other servers from migrating at the same time.
+	Lock func(tx *sql.Tx) error
+	// After runs in the transaction of the migration of the same version,
+	// after its SQL, for what SQL alone can't do.
+	After map[int]func(tx *sql.Tx) error
+	// HasTable reports whether the named table exists; nil asks
+	// information_schema, which SQLite lacks.
+	HasTable func(name string) (bool, error)
+}
+
+// Version returns the version of the schema, 0 if no migration has been
+// applied. It only reads, so a database never migrated is left untouched.
+func (r *Runner) Version() (int, error) {
+	exists, err := r.hasTable("schema_migrations")
+	if err != nil || !exists {
+		return 0, err
+	}
+	var version int
+	err = r.DB.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version)
+	return version, err
+}
+
+func (r *Runner) hasTable(name string) (bool, error) {
+	if r.HasTable != nil {
+		return r.HasTable(name)
+	}
+	var exists bool
+	err := r.DB.QueryRow(`SELECT EXISTS (SELECT 1 FROM information_schema.tables
+            WHERE table_schema = current_schema() AND table_name = `+r.param(1)+`)`, name).Scan(&exists)
+	return exists, err
+}
+
+// createTable creates schema_migrations if it doesn't exist yet, under
+// Lock as servers creating it at the same time may clash.
+func (r *Runner) createTable() error {
+	tx, err := r.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // No-op once committed
+
+	if r.Lock != nil {
+		if err := r.Lock(tx); err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+        version INTEGER PRIMARY KEY,
+        name TEXT NOT NULL,
+        applied_at TIMESTAMP NOT NULL
+    )`)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Pending returns the migrations not yet applied. It fails if the schema
+// is newer than the migrations.
+func (r *Runner) Pending() ([]Migration, error) {
+	version, err := r.Version()
+	if err != nil {
+		return nil, err
+	}
+	if version > len(r.Migrations) {
+		return nil, fmt.Errorf("database schema is at version %d, newer than this server's %d", version, len(r.Migrations))
+	}
+	return r.Migrations[version:], nil
+}
+
+// Migrate applies the pending migrations, in order, and returns those it
+// applied.
+func (r *Runner) Migrate() ([]Migration, error) {
+	if err := r.createTable(); err != nil {
+		return nil, err
+	}
+	pending, err := r.Pending()
+	if err != nil {
+		return nil, err
+	}
+	for i, m := range pending {
+		if err := r.apply(m); err != nil {
+			return pending[:i], fmt.Errorf("migration %04d_%s: %w", m.Version, m.Name, err)
+		}
+	}
+	return pending, nil
+}
+
+func (r *Runner) apply(m Migration) error {
+	tx, err := r.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // No-op once committed
+
+	if r.Lock != nil {
+		if err := r.Lock(tx); err != nil {
+			return err
+		}
+	}
+	// Another server may have got here first.
+	var applied bool
+	err = tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version = `+r.param(1)+`)`, m.Version).Scan(&applied)
+	if err != nil {
+		return err
+	}
+	if applied {
+		return nil
+	}
+
+	if _, err := tx.Exec(m.SQL); err != nil {
+		return err
+	}
+	if after := r.After[m.Version]; after != nil {
+		if err := after(tx); err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec(`INSERT INTO schema_migrations (version, name, applied_at) VALUES (`+
+		r.param(1)+`, `+r.param(2)+`, `+r.param(3)+`)`, m.Version, m.Name, time.Now())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (r *Runner) param(n int) string {
+	if r.Placeholder == nil {
+		return "?"
+	}
+	return r.Placeholder(n)
+}
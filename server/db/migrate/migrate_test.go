@@ -0,0 +1,27 @@
+package migrate
+
+import (
+	"testing"
+	"testing/fstest"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	fsys := fstest.MapFS{
+		"migrations/0002_second.sql": {Data: []byte("SELECT 2")},
+		"migrations/0001_first.sql":  {Data: []byte("SELECT 1")},
+	}
+	migrations, err := Load(fsys, "migrations")
+	if err != nil || len(migrations) != 2 || migrations[0].Name != "first" || migrations[1].SQL != "SELECT 2" {
+		t.Fatalf("Load = %+v, %v", migrations, err)
+	}
+
+	fsys["migrations/0004_gap.sql"] = &fstest.MapFile{Data: []byte("SELECT 4")}
+	if _, err := Load(fsys, "migrations"); err == nil {
+		t.Error("Load accepted a missing version")
+	}
+	delete(fsys, "migrations/0004_gap.sql")
+	fsys["migrations/notes.sql"] = &fstest.MapFile{Data: []byte("")}
+	if _, err := Load(fsys, "migrations"); err == nil {
+		t.Error("Load accepted a badly named file")
+	}
+}
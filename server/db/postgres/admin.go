@@ -0,0 +1,148 @@
+package postgres
+
+import (
+	"database/sql"
+	"strconv"
+	"time"
+
+	"caro_chess_server/db"
+)
+
+func (s *PostgresStore) SetUserRole(userID string, role db.Role) error {
+	res, err := s.db.Exec(`UPDATE users SET role = $1 WHERE id = $2`, role, userID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return db.ErrNotFound
+	}
+	return nil
+}
+
+func (s *PostgresStore) CreateSanction(sanction *db.Sanction) error {
+	sanction.CreatedAt = time.Now()
+	var expiresAt sql.NullTime
+	if !sanction.ExpiresAt.IsZero() {
+		expiresAt = sql.NullTime{Time: sanction.ExpiresAt, Valid: true}
+	}
+	return s.db.QueryRow(`INSERT INTO sanctions (user_id, kind, reason, issued_by, created_at, expires_at)
+            VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`,
+		sanction.UserID, sanction.Kind, sanction.Reason, sanction.IssuedBy, sanction.CreatedAt, expiresAt).Scan(&sanction.ID)
+}
+
+func (s *PostgresStore) GetSanction(id int64) (*db.Sanction, error) {
+	return scanSanction(s.db.QueryRow(`SELECT `+sanctionColumns+` FROM sanctions WHERE id = $1`, id))
+}
+
+func (s *PostgresStore) ListSanctions(userID string) ([]*db.Sanction, error) {
+	return s.querySanctions(`SELECT `+sanctionColumns+` FROM sanctions WHERE user_id = $1 ORDER BY id DESC`, userID)
+}
+
+func (s *PostgresStore) ActiveSanctions(userID string) ([]*db.Sanction, error) {
+	// Compared with this server's clock, as by Sanction.Active.
+	return s.querySanctions(`SELECT `+sanctionColumns+` FROM sanctions
+            WHERE user_id = $1 AND lifted_at IS NULL AND (expires_at IS NULL OR expires_at > $2)
+            ORDER BY id DESC`, userID, time.Now())
+}
+
+func (s *PostgresStore) querySanctions(query string, args ...any) ([]*db.Sanction, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sanctions []*db.Sanction
+	for rows.Next() {
+		sanction, err := scanSanction(rows)
+		if err != nil {
+			return nil, err
+		}
+		sanctions = append(sanctions, sanction)
+	}
+	return sanctions, rows.Err()
+}
+
+func (s *PostgresStore) LiftSanction(id int64, liftedBy string) error {
+	res, err := s.db.Exec(`UPDATE sanctions SET lifted_by = $1, lifted_at = $2 WHERE id = $3 AND lifted_at IS NULL`,
+		liftedBy, time.Now(), id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return db.ErrNotFound
+	}
+	return nil
+}
+
+func (s *PostgresStore) SetAppealNote(id int64, note string) error {
+	res, err := s.db.Exec(`UPDATE sanctions SET appeal_note = $1 WHERE id = $2`, note, id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return db.ErrNotFound
+	}
+	return nil
+}
+
+// sanctionColumns lists the sanctions columns read by scanSanction, in
+// order.
+const sanctionColumns = `id, user_id, kind, reason, issued_by, created_at, expires_at, appeal_note, lifted_by, lifted_at`
+
+func scanSanction(row scanner) (*db.Sanction, error) {
+	var sanction db.Sanction
+	var appealNote, liftedBy sql.NullString
+	var expiresAt, liftedAt sql.NullTime
+	err := row.Scan(&sanction.ID, &sanction.UserID, &sanction.Kind, &sanction.Reason, &sanction.IssuedBy,
+		&sanction.CreatedAt, &expiresAt, &appealNote, &liftedBy, &liftedAt)
+	if err == sql.ErrNoRows {
+		return nil, db.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	sanction.AppealNote, sanction.LiftedBy = appealNote.String, liftedBy.String
+	if expiresAt.Valid {
+		sanction.ExpiresAt = expiresAt.Time
+	}
+	if liftedAt.Valid {
+		sanction.LiftedAt = liftedAt.Time
+	}
+	return &sanction, nil
+}
+
+func (s *PostgresStore) RecordAudit(e *db.AuditEntry) error {
+	e.CreatedAt = time.Now()
+	return s.db.QueryRow(`INSERT INTO audit_log (actor_id, action, target_id, reason, details, created_at)
+            VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`,
+		e.ActorID, e.Action, e.TargetID, e.Reason, e.Details, e.CreatedAt).Scan(&e.ID)
+}
+
+func (s *PostgresStore) ListAudit(targetID string, limit int) ([]*db.AuditEntry, error) {
+	query := `SELECT id, actor_id, action, target_id, reason, details, created_at FROM audit_log`
+	args := []any{}
+	if targetID != "" {
+		query += ` WHERE target_id = $1`
+		args = append(args, targetID)
+	}
+	args = append(args, limit)
+	query += ` ORDER BY id DESC LIMIT $` + strconv.Itoa(len(args))
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []*db.AuditEntry
+	for rows.Next() {
+		var e db.AuditEntry
+		var reason, details sql.NullString
+		if err := rows.Scan(&e.ID, &e.ActorID, &e.Action, &e.TargetID, &reason, &details, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		e.Reason, e.Details = reason.String, details.String
+		entries = append(entries, &e)
+	}
+	return entries, rows.Err()
+}
@@ -0,0 +1,100 @@
+package postgres
+
+import (
+	"database/sql"
+	"errors"
+
+	"caro_chess_server/db"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// uniqueViolation is the SQLSTATE of a duplicate key.
+const uniqueViolation = "23505"
+
+// execer is a *sql.DB or a *sql.Tx.
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+func (s *PostgresStore) CreateCredential(c *db.Credential) error {
+	return createCredential(s.db, c)
+}
+
+func createCredential(ex execer, c *db.Credential) error {
+	_, err := ex.Exec(`INSERT INTO credentials (user_id, username, password_hash) VALUES ($1, $2, $3)`,
+		c.UserID, c.Username, c.PasswordHash)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == uniqueViolation {
+		if pgErr.ConstraintName == "credentials_username" {
+			return db.ErrUsernameTaken
+		}
+		return db.ErrCredentialExists
+	}
+	return err
+}
+
+func (s *PostgresStore) CreateAccount(u *db.User, c *db.Credential, guestID string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // No-op once committed
+
+	if _, err := tx.Exec(`INSERT INTO users (id, elo, coins) VALUES ($1, $2, $3)`, u.ID, u.ELO, u.Coins); err != nil {
+		return err
+	}
+	if err := createCredential(tx, c); err != nil {
+		return err
+	}
+	if guestID != "" {
+		if err := mergeUsers(tx, guestID, u.ID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *PostgresStore) GetCredentialByUsername(username string) (*db.Credential, error) {
+	return scanCredential(s.db.QueryRow(`SELECT `+credentialColumns+` FROM credentials WHERE lower(username) = lower($1)`, username))
+}
+
+func (s *PostgresStore) GetCredentialByUserID(userID string) (*db.Credential, error) {
+	return scanCredential(s.db.QueryRow(`SELECT `+credentialColumns+` FROM credentials WHERE user_id = $1`, userID))
+}
+
+func (s *PostgresStore) UpdateCredential(c *db.Credential) error {
+	var lockedUntil sql.NullTime
+	if !c.LockedUntil.IsZero() {
+		lockedUntil = sql.NullTime{Time: c.LockedUntil, Valid: true}
+	}
+	res, err := s.db.Exec(`UPDATE credentials SET password_hash = $1, failed_logins = $2, locked_until = $3 WHERE user_id = $4`,
+		c.PasswordHash, c.FailedLogins, lockedUntil, c.UserID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return db.ErrNotFound
+	}
+	return nil
+}
+
+// credentialColumns lists the credentials columns read by scanCredential,
+// in order.
+const credentialColumns = `user_id, username, password_hash, failed_logins, locked_until`
+
+func scanCredential(row scanner) (*db.Credential, error) {
+	var c db.Credential
+	var lockedUntil sql.NullTime
+	err := row.Scan(&c.UserID, &c.Username, &c.PasswordHash, &c.FailedLogins, &lockedUntil)
+	if err == sql.ErrNoRows {
+		return nil, db.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if lockedUntil.Valid {
+		c.LockedUntil = lockedUntil.Time
+	}
+	return &c, nil
+}
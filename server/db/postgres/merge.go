@@ -0,0 +1,58 @@
+package postgres
+
+import "database/sql"
+
+// MergeUsers moves a user's records to another in one transaction. It is
+// how a guest keeps their games and coins when they sign up.
+func (s *PostgresStore) MergeUsers(fromID, intoID string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // No-op once committed
+
+	if err := mergeUsers(tx, fromID, intoID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func mergeUsers(tx *sql.Tx, fromID, intoID string) error {
+	statements := []struct {
+		query string
+		args  []any
+	}{
+		// Lock both users so no other server saves them meanwhile.
+		{`SELECT id FROM users WHERE id IN ($1, $2) ORDER BY id FOR UPDATE`, []any{fromID, intoID}},
+		{`UPDATE users SET
+                elo = CASE WHEN users.games_played = 0 THEN f.elo ELSE users.elo END,
+                games_played = users.games_played + f.games_played,
+                wins = users.wins + f.wins,
+                losses = users.losses + f.losses,
+                draws = users.draws + f.draws,
+                coins = users.coins + f.coins
+            FROM (SELECT * FROM users WHERE id = $1) AS f
+            WHERE users.id = $2`, []any{fromID, intoID}},
+		// A game between the two would become one against themselves; its
+		// moves go with it.
+		{`DELETE FROM matches
+            WHERE (player_x_id = $1 AND player_o_id = $2) OR (player_x_id = $2 AND player_o_id = $1)`, []any{fromID, intoID}},
+		{`UPDATE matches SET player_x_id = $1 WHERE player_x_id = $2`, []any{intoID, fromID}},
+		{`UPDATE matches SET player_o_id = $1 WHERE player_o_id = $2`, []any{intoID, fromID}},
+		{`UPDATE matches SET winner_id = $1 WHERE winner_id = $2`, []any{intoID, fromID}},
+		{`INSERT INTO inventory (user_id, item_id) SELECT $1::text, item_id FROM inventory WHERE user_id = $2
+            ON CONFLICT DO NOTHING`, []any{intoID, fromID}},
+		{`DELETE FROM inventory WHERE user_id = $1`, []any{fromID}},
+		// A tournament both played in keeps intoID's result.
+		{`UPDATE tournament_results SET user_id = $1 WHERE user_id = $2
+            AND tournament_id NOT IN (SELECT tournament_id FROM tournament_results WHERE user_id = $1)`, []any{intoID, fromID}},
+		{`DELETE FROM tournament_results WHERE user_id = $1`, []any{fromID}},
+		{`DELETE FROM users WHERE id = $1`, []any{fromID}},
+	}
+	for _, st := range statements {
+		if _, err := tx.Exec(st.query, st.args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+-- The schema of db.UserRepository and the other repositories, matching
+-- the SQLite store's.
+CREATE TABLE users (
+    id TEXT PRIMARY KEY,
+    elo INTEGER NOT NULL DEFAULT 1200,
+    games_played INTEGER NOT NULL DEFAULT 0,
+    wins INTEGER NOT NULL DEFAULT 0,
+    losses INTEGER NOT NULL DEFAULT 0,
+    draws INTEGER NOT NULL DEFAULT 0,
+    coins INTEGER NOT NULL DEFAULT 0,
+    role TEXT NOT NULL DEFAULT 'player',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX users_elo ON users (elo DESC);
+
+CREATE TABLE matches (
+    id TEXT PRIMARY KEY,
+    seq BIGINT GENERATED ALWAYS AS IDENTITY, -- Order of recording, for matches at the same time
+    player_x_id TEXT NOT NULL,
+    player_o_id TEXT NOT NULL,
+    winner_id TEXT,
+    timestamp TIMESTAMPTZ NOT NULL,
+    player_x_rating_before INTEGER,
+    player_x_rating_after INTEGER,
+    player_o_rating_before INTEGER,
+    player_o_rating_after INTEGER
+);
+CREATE INDEX matches_player_x ON matches (player_x_id, timestamp);
+CREATE INDEX matches_player_o ON matches (player_o_id, timestamp);
+CREATE INDEX matches_timestamp ON matches (timestamp, seq);
+
+CREATE TABLE moves (
+    match_id TEXT NOT NULL REFERENCES matches (id) ON DELETE CASCADE,
+    player TEXT NOT NULL,
+    x INTEGER NOT NULL,
+    y INTEGER NOT NULL,
+    move_order INTEGER NOT NULL
+);
+CREATE INDEX moves_match ON moves (match_id, move_order);
+
+CREATE TABLE inventory (
+    user_id TEXT NOT NULL,
+    item_id TEXT NOT NULL,
+    PRIMARY KEY (user_id, item_id)
+);
+
+CREATE TABLE tournament_results (
+    tournament_id TEXT NOT NULL,
+    name TEXT NOT NULL,
+    format TEXT NOT NULL,
+    user_id TEXT NOT NULL,
+    rank INTEGER NOT NULL,
+    score DOUBLE PRECISION NOT NULL,
+    games INTEGER NOT NULL,
+    finished_at TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (tournament_id, user_id)
+);
+CREATE INDEX tournament_results_user ON tournament_results (user_id);
+
+CREATE TABLE credentials (
+    user_id TEXT PRIMARY KEY,
+    username TEXT NOT NULL,
+    password_hash TEXT NOT NULL,
+    failed_logins INTEGER NOT NULL DEFAULT 0,
+    locked_until TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+-- Usernames are unique regardless of case.
+CREATE UNIQUE INDEX credentials_username ON credentials (lower(username));
+
+CREATE TABLE sessions (
+    id TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL,
+    refresh_hash TEXT NOT NULL UNIQUE,
+    expires_at TIMESTAMPTZ NOT NULL,
+    revoked BOOLEAN NOT NULL DEFAULT false,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX sessions_user ON sessions (user_id);
+
+CREATE TABLE sanctions (
+    id BIGINT GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    user_id TEXT NOT NULL,
+    kind TEXT NOT NULL,
+    reason TEXT NOT NULL,
+    issued_by TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL,
+    expires_at TIMESTAMPTZ,
+    appeal_note TEXT,
+    lifted_by TEXT,
+    lifted_at TIMESTAMPTZ
+);
+CREATE INDEX sanctions_user ON sanctions (user_id);
+
+CREATE TABLE audit_log (
+    id BIGINT GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    actor_id TEXT NOT NULL,
+    action TEXT NOT NULL,
+    target_id TEXT NOT NULL,
+    reason TEXT,
+    details TEXT,
+    created_at TIMESTAMPTZ NOT NULL
+);
+CREATE INDEX audit_log_target ON audit_log (target_id, id);
@@ -0,0 +1,53 @@
+package postgres
+
+import (
+	"database/sql"
+
+	"caro_chess_server/db"
+)
+
+func (s *PostgresStore) CreateSession(session *db.Session) error {
+	_, err := s.db.Exec(`INSERT INTO sessions (id, user_id, refresh_hash, expires_at, revoked) VALUES ($1, $2, $3, $4, $5)`,
+		session.ID, session.UserID, session.RefreshHash, session.ExpiresAt, session.Revoked)
+	return err
+}
+
+func (s *PostgresStore) GetSession(id string) (*db.Session, error) {
+	return scanSession(s.db.QueryRow(`SELECT `+sessionColumns+` FROM sessions WHERE id = $1`, id))
+}
+
+func (s *PostgresStore) GetSessionByRefreshHash(hash string) (*db.Session, error) {
+	return scanSession(s.db.QueryRow(`SELECT `+sessionColumns+` FROM sessions WHERE refresh_hash = $1`, hash))
+}
+
+func (s *PostgresStore) UpdateSession(session *db.Session) error {
+	res, err := s.db.Exec(`UPDATE sessions SET refresh_hash = $1, expires_at = $2, revoked = $3 WHERE id = $4`,
+		session.RefreshHash, session.ExpiresAt, session.Revoked, session.ID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return db.ErrNotFound
+	}
+	return nil
+}
+
+func (s *PostgresStore) RevokeUserSessions(userID string) error {
+	_, err := s.db.Exec(`UPDATE sessions SET revoked = true WHERE user_id = $1`, userID)
+	return err
+}
+
+// sessionColumns lists the sessions columns read by scanSession, in order.
+const sessionColumns = `id, user_id, refresh_hash, expires_at, revoked`
+
+func scanSession(row scanner) (*db.Session, error) {
+	var session db.Session
+	err := row.Scan(&session.ID, &session.UserID, &session.RefreshHash, &session.ExpiresAt, &session.Revoked)
+	if err == sql.ErrNoRows {
+		return nil, db.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
@@ -0,0 +1,400 @@
+// Package postgres stores users, matches and everything else of the server
+// in PostgreSQL, so several servers can share one database.
+package postgres
+
+import (
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"caro_chess_server/db"
+	"caro_chess_server/db/migrate"
+
+	_ "github.com/jackc/pgx/v5/stdlib" // Import driver
+)
+
+type PostgresStore struct {
+	db *sql.DB
+}
+
+// NewPostgresStore connects to the database at dsn and applies any pending
+// migrations.
+func NewPostgresStore(dsn string) (*PostgresStore, error) {
+	store, err := Open(dsn)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := store.Migrate(); err != nil {
+		store.Close()
+		return nil, fmt.Errorf("failed to migrate database: %w", err)
+	}
+	return store, nil
+}
+
+// Open connects to the database at dsn as it is. See Pending and Migrate.
+func Open(dsn string) (*PostgresStore, error) {
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to ping database: %w", err)
+	}
+
+	return &PostgresStore{db: db}, nil
+}
+
+// Close closes the database connection
+func (s *PostgresStore) Close() error {
+	return s.db.Close()
+}
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+func (s *PostgresStore) runner(migrations []migrate.Migration) *migrate.Runner {
+	return &migrate.Runner{
+		DB:          s.db,
+		Migrations:  migrations,
+		Placeholder: func(n int) string { return "$" + strconv.Itoa(n) },
+		// Servers starting together migrate one at a time.
+		Lock: func(tx *sql.Tx) error {
+			_, err := tx.Exec(`SELECT pg_advisory_xact_lock(hashtext('caro_chess_migrations'))`)
+			return err
+		},
+	}
+}
+
+func (s *PostgresStore) embeddedRunner() (*migrate.Runner, error) {
+	migrations, err := migrate.Load(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	return s.runner(migrations), nil
+}
+
+// Version returns the version of the database's schema, 0 if no migration
+// has been applied.
+func (s *PostgresStore) Version() (int, error) {
+	return s.runner(nil).Version()
+}
+
+// Pending returns the migrations not yet applied. It fails if the database
+// is newer than this server.
+func (s *PostgresStore) Pending() ([]migrate.Migration, error) {
+	r, err := s.embeddedRunner()
+	if err != nil {
+		return nil, err
+	}
+	return r.Pending()
+}
+
+// Migrate applies the pending migrations, in order, and returns them.
+func (s *PostgresStore) Migrate() ([]migrate.Migration, error) {
+	r, err := s.embeddedRunner()
+	if err != nil {
+		return nil, err
+	}
+	return r.Migrate()
+}
+
+// Empty reports whether the schema has no tables but schema_migrations.
+func (s *PostgresStore) Empty() (bool, error) {
+	var tables int
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM information_schema.tables
+            WHERE table_schema = current_schema() AND table_name <> 'schema_migrations'`).Scan(&tables)
+	return tables == 0, err
+}
+
+func (s *PostgresStore) GetUser(id string) (*db.User, error) {
+	// Unknown users are created, as by the other stores.
+	if _, err := s.db.Exec(`INSERT INTO users (id) VALUES ($1) ON CONFLICT (id) DO NOTHING`, id); err != nil {
+		return nil, err
+	}
+	var user db.User
+	err := s.db.QueryRow(`SELECT id, elo, games_played, wins, losses, draws, coins, role FROM users WHERE id = $1`, id).
+		Scan(&user.ID, &user.ELO, &user.GamesPlayed, &user.Wins, &user.Losses, &user.Draws, &user.Coins, &user.Role)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (s *PostgresStore) FindUser(id string) (*db.User, error) {
+	var user db.User
+	err := s.db.QueryRow(`SELECT id, elo, games_played, wins, losses, draws, coins, role FROM users WHERE id = $1`, id).
+		Scan(&user.ID, &user.ELO, &user.GamesPlayed, &user.Wins, &user.Losses, &user.Draws, &user.Coins, &user.Role)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, db.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (s *PostgresStore) SaveUser(u *db.User) error {
+	_, err := s.db.Exec(`INSERT INTO users (id, elo, games_played, wins, losses, draws, coins) VALUES ($1, $2, $3, $4, $5, $6, $7)
+            ON CONFLICT (id) DO UPDATE SET elo = excluded.elo, games_played = excluded.games_played, wins = excluded.wins,
+                losses = excluded.losses, draws = excluded.draws, coins = excluded.coins`,
+		u.ID, u.ELO, u.GamesPlayed, u.Wins, u.Losses, u.Draws, u.Coins)
+	return err
+}
+
+func (s *PostgresStore) SaveMatch(match *db.Match) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // No-op once committed
+
+	_, err = tx.Exec(`INSERT INTO matches (id, player_x_id, player_o_id, winner_id, timestamp,
+            player_x_rating_before, player_x_rating_after, player_o_rating_before, player_o_rating_after)
+            VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+		match.ID, match.PlayerXID, match.PlayerOID, match.WinnerID, match.Timestamp,
+		match.PlayerXRatingBefore, match.PlayerXRatingAfter, match.PlayerORatingBefore, match.PlayerORatingAfter)
+	if err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare(`INSERT INTO moves (match_id, player, x, y, move_order) VALUES ($1, $2, $3, $4, $5)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, move := range match.Moves {
+		if _, err := stmt.Exec(match.ID, move.Player, move.X, move.Y, move.Order); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// matchColumns lists the matches columns read by scanMatch, in order.
+const matchColumns = `id, player_x_id, player_o_id, winner_id, timestamp,
+        player_x_rating_before, player_x_rating_after, player_o_rating_before, player_o_rating_after`
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanMatch(row scanner) (*db.Match, error) {
+	var m db.Match
+	var winnerID sql.NullString
+	var xBefore, xAfter, oBefore, oAfter sql.NullInt64
+	err := row.Scan(&m.ID, &m.PlayerXID, &m.PlayerOID, &winnerID, &m.Timestamp,
+		&xBefore, &xAfter, &oBefore, &oAfter)
+	if err != nil {
+		return nil, err
+	}
+	if winnerID.Valid {
+		m.WinnerID = &winnerID.String
+	}
+	m.PlayerXRatingBefore = int(xBefore.Int64)
+	m.PlayerXRatingAfter = int(xAfter.Int64)
+	m.PlayerORatingBefore = int(oBefore.Int64)
+	m.PlayerORatingAfter = int(oAfter.Int64)
+	return &m, nil
+}
+
+func (s *PostgresStore) queryMatches(query string, args ...any) ([]*db.Match, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var matches []*db.Match
+	for rows.Next() {
+		m, err := scanMatch(rows)
+		if err != nil {
+			return nil, err
+		}
+		matches = append(matches, m)
+	}
+	return matches, rows.Err()
+}
+
+func (s *PostgresStore) GetMatchesByUserID(userID string, limit int) ([]*db.Match, error) {
+	return s.queryMatches(`SELECT `+matchColumns+` FROM matches
+            WHERE player_x_id = $1 OR player_o_id = $1
+            ORDER BY timestamp DESC, seq DESC
+            LIMIT $2`, userID, limit)
+}
+
+// GetMatch returns the match with its moves, or nil if there is none.
+func (s *PostgresStore) GetMatch(matchID string) (*db.Match, error) {
+	m, err := scanMatch(s.db.QueryRow(`SELECT `+matchColumns+` FROM matches WHERE id = $1`, matchID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.Query(`SELECT x, y, player, move_order FROM moves WHERE match_id = $1 ORDER BY move_order ASC`, matchID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var mv db.Move
+		if err := rows.Scan(&mv.X, &mv.Y, &mv.Player, &mv.Order); err != nil {
+			return nil, err
+		}
+		m.Moves = append(m.Moves, mv)
+	}
+	return m, rows.Err()
+}
+
+// GetAllMatches returns every match without moves, oldest first.
+func (s *PostgresStore) GetAllMatches() ([]*db.Match, error) {
+	return s.queryMatches(`SELECT ` + matchColumns + ` FROM matches ORDER BY timestamp ASC, seq ASC`)
+}
+
+// UpdateMatchRatings overwrites the recorded before/after ratings of a match.
+func (s *PostgresStore) UpdateMatchRatings(match *db.Match) error {
+	_, err := s.db.Exec(`UPDATE matches SET player_x_rating_before = $1, player_x_rating_after = $2,
+            player_o_rating_before = $3, player_o_rating_after = $4 WHERE id = $5`,
+		match.PlayerXRatingBefore, match.PlayerXRatingAfter, match.PlayerORatingBefore, match.PlayerORatingAfter, match.ID)
+	return err
+}
+
+// GetRatingHistory returns the user's rating changes, oldest first.
+// Matches recorded before ratings were tracked are skipped.
+func (s *PostgresStore) GetRatingHistory(userID string) ([]*db.RatingChange, error) {
+	rows, err := s.db.Query(`
+        SELECT id, timestamp,
+            CASE WHEN player_x_id = $1 THEN player_x_rating_before ELSE player_o_rating_before END,
+            CASE WHEN player_x_id = $1 THEN player_x_rating_after ELSE player_o_rating_after END
+        FROM matches
+        WHERE player_x_id = $1 OR player_o_id = $1
+        ORDER BY timestamp ASC, seq ASC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var changes []*db.RatingChange
+	for rows.Next() {
+		var c db.RatingChange
+		var before, after sql.NullInt64
+		if err := rows.Scan(&c.MatchID, &c.Timestamp, &before, &after); err != nil {
+			return nil, err
+		}
+		if !after.Valid || after.Int64 == 0 {
+			continue
+		}
+		c.Before = int(before.Int64)
+		c.After = int(after.Int64)
+		changes = append(changes, &c)
+	}
+	return changes, rows.Err()
+}
+
+func (s *PostgresStore) GetLeaderboard(limit int) ([]*db.User, error) {
+	rows, err := s.db.Query(`SELECT id, elo, games_played, wins, losses, draws FROM users
+            WHERE NOT starts_with(id, $1)
+            ORDER BY elo DESC, id ASC
+            LIMIT $2`, db.GuestIDPrefix, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []*db.User
+	for rows.Next() {
+		var u db.User
+		if err := rows.Scan(&u.ID, &u.ELO, &u.GamesPlayed, &u.Wins, &u.Losses, &u.Draws); err != nil {
+			return nil, err
+		}
+		users = append(users, &u)
+	}
+	return users, rows.Err()
+}
+
+func (s *PostgresStore) UpdateUserCoins(userID string, amount int) error {
+	// The balance is checked in the UPDATE so that concurrent spending
+	// can't overdraw it.
+	res, err := s.db.Exec(`UPDATE users SET coins = coins + $1 WHERE id = $2 AND coins + $1 >= 0`, amount, userID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n > 0 {
+		return err
+	}
+	if _, err := s.FindUser(userID); err != nil {
+		return err
+	}
+	return db.ErrInsufficientCoins
+}
+
+func (s *PostgresStore) AddToInventory(userID string, itemID string) error {
+	_, err := s.db.Exec(`INSERT INTO inventory (user_id, item_id) VALUES ($1, $2) ON CONFLICT DO NOTHING`, userID, itemID)
+	return err
+}
+
+func (s *PostgresStore) GetInventory(userID string) ([]string, error) {
+	rows, err := s.db.Query(`SELECT item_id FROM inventory WHERE user_id = $1 ORDER BY item_id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []string
+	for rows.Next() {
+		var itemID string
+		if err := rows.Scan(&itemID); err != nil {
+			return nil, err
+		}
+		items = append(items, itemID)
+	}
+	return items, rows.Err()
+}
+
+func (s *PostgresStore) SaveTournamentResults(results []*db.TournamentResult) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // No-op once committed
+
+	stmt, err := tx.Prepare(`INSERT INTO tournament_results
+            (tournament_id, name, format, user_id, rank, score, games, finished_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+            ON CONFLICT (tournament_id, user_id) DO UPDATE SET name = excluded.name, format = excluded.format,
+                rank = excluded.rank, score = excluded.score, games = excluded.games, finished_at = excluded.finished_at`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, r := range results {
+		if _, err := stmt.Exec(r.TournamentID, r.Name, r.Format, r.UserID, r.Rank, r.Score, r.Games, r.FinishedAt); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *PostgresStore) GetTournamentResults(tournamentID string) ([]*db.TournamentResult, error) {
+	rows, err := s.db.Query(`SELECT tournament_id, name, format, user_id, rank, score, games, finished_at
+            FROM tournament_results WHERE tournament_id = $1 ORDER BY rank ASC`, tournamentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []*db.TournamentResult
+	for rows.Next() {
+		var r db.TournamentResult
+		if err := rows.Scan(&r.TournamentID, &r.Name, &r.Format, &r.UserID, &r.Rank, &r.Score, &r.Games, &r.FinishedAt); err != nil {
+			return nil, err
+		}
+		results = append(results, &r)
+	}
+	return results, rows.Err()
+}
@@ -0,0 +1,189 @@
+package postgres
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"caro_chess_server/db"
+	"caro_chess_server/db/dbtest"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/stdlib"
+)
+
+// newTestStore returns a store in a schema of its own in the database at
+// CARO_CHESS_TEST_POSTGRES_DSN, dropped after the test. Without a database
+// the test is skipped.
+func newTestStore(t *testing.T) *PostgresStore {
+	t.Helper()
+	dsn := os.Getenv("CARO_CHESS_TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("CARO_CHESS_TEST_POSTGRES_DSN not set")
+	}
+	admin, err := Open(dsn)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	t.Cleanup(func() { admin.Close() })
+	schema := fmt.Sprintf("test_%d", time.Now().UnixNano())
+	if _, err := admin.db.Exec(`CREATE SCHEMA ` + schema); err != nil {
+		t.Fatalf("creating schema: %v", err)
+	}
+	t.Cleanup(func() { admin.db.Exec(`DROP SCHEMA ` + schema + ` CASCADE`) })
+	return openInSchema(t, dsn, schema)
+}
+
+// openInSchema returns another store using the same schema, like another
+// server sharing the database.
+func openInSchema(t *testing.T, dsn, schema string) *PostgresStore {
+	t.Helper()
+	config, err := pgx.ParseConfig(dsn)
+	if err != nil {
+		t.Fatalf("ParseConfig: %v", err)
+	}
+	config.RuntimeParams["search_path"] = schema
+	store := &PostgresStore{db: stdlib.OpenDB(*config)}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func newMigratedStore(t *testing.T) *PostgresStore {
+	store := newTestStore(t)
+	if _, err := store.Migrate(); err != nil {
+		t.Fatalf("Migrate: %v", err)
+	}
+	return store
+}
+
+func TestUserRepositoryContract(t *testing.T) {
+	dbtest.RunUserRepository(t, func(t *testing.T) db.UserRepository {
+		return newMigratedStore(t)
+	})
+}
+
+func TestMigrateConcurrently(t *testing.T) {
+	store := newTestStore(t)
+	if empty, err := store.Empty(); err != nil || !empty {
+		t.Fatalf("Empty = %v, %v; want true", empty, err)
+	}
+
+	// Servers starting together against the same database.
+	var wg sync.WaitGroup
+	errs := make([]error, 4)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = store.Migrate()
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Errorf("Migrate: %v", err)
+		}
+	}
+	if pending, err := store.Pending(); err != nil || len(pending) != 0 {
+		t.Errorf("Pending = %v, %v; want nothing", pending, err)
+	}
+	if empty, _ := store.Empty(); empty {
+		t.Error("Empty = true after migrating")
+	}
+}
+
+func TestCredentials(t *testing.T) {
+	store := newMigratedStore(t)
+	if err := store.CreateCredential(&db.Credential{UserID: "u1", Username: "Alice", PasswordHash: "h"}); err != nil {
+		t.Fatalf("CreateCredential: %v", err)
+	}
+	if err := store.CreateCredential(&db.Credential{UserID: "u2", Username: "alice", PasswordHash: "h"}); !errors.Is(err, db.ErrUsernameTaken) {
+		t.Errorf("Same username in another case = %v, want ErrUsernameTaken", err)
+	}
+	if err := store.CreateCredential(&db.Credential{UserID: "u1", Username: "bob", PasswordHash: "h"}); !errors.Is(err, db.ErrCredentialExists) {
+		t.Errorf("Second credential of a user = %v, want ErrCredentialExists", err)
+	}
+
+	c, err := store.GetCredentialByUsername("ALICE")
+	if err != nil || c.UserID != "u1" {
+		t.Fatalf("GetCredentialByUsername = %+v, %v", c, err)
+	}
+	c.FailedLogins, c.LockedUntil = 3, time.Now().Add(time.Minute)
+	if err := store.UpdateCredential(c); err != nil {
+		t.Fatalf("UpdateCredential: %v", err)
+	}
+	if c, _ := store.GetCredentialByUserID("u1"); c.FailedLogins != 3 || c.LockedUntil.IsZero() {
+		t.Errorf("Credential after update = %+v", c)
+	}
+	if _, err := store.GetCredentialByUserID("nobody"); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("GetCredentialByUserID of nobody = %v, want ErrNotFound", err)
+	}
+}
+
+func TestSessionsAndSanctions(t *testing.T) {
+	store := newMigratedStore(t)
+	session := &db.Session{ID: "s1", UserID: "alice", RefreshHash: "r1", ExpiresAt: time.Now().Add(time.Hour)}
+	if err := store.CreateSession(session); err != nil {
+		t.Fatalf("CreateSession: %v", err)
+	}
+	if err := store.RevokeUserSessions("alice"); err != nil {
+		t.Fatalf("RevokeUserSessions: %v", err)
+	}
+	if got, err := store.GetSessionByRefreshHash("r1"); err != nil || !got.Revoked {
+		t.Errorf("Session after revoking = %+v, %v", got, err)
+	}
+
+	expired := &db.Sanction{UserID: "bob", Kind: db.SanctionMute, Reason: "spam", IssuedBy: "mod", ExpiresAt: time.Now().Add(-time.Minute)}
+	ban := &db.Sanction{UserID: "bob", Kind: db.SanctionBan, Reason: "cheating", IssuedBy: "mod"}
+	for _, s := range []*db.Sanction{expired, ban} {
+		if err := store.CreateSanction(s); err != nil || s.ID == 0 {
+			t.Fatalf("CreateSanction = %v, giving %+v", err, s)
+		}
+	}
+	if active, err := store.ActiveSanctions("bob"); err != nil || len(active) != 1 || active[0].ID != ban.ID {
+		t.Errorf("ActiveSanctions = %v, %v; want the ban", active, err)
+	}
+	store.LiftSanction(ban.ID, "mod")
+	if active, _ := store.ActiveSanctions("bob"); len(active) != 0 {
+		t.Errorf("ActiveSanctions after lifting = %v", active)
+	}
+
+	store.RecordAudit(&db.AuditEntry{ActorID: "mod", Action: "ban", TargetID: "bob"})
+	store.RecordAudit(&db.AuditEntry{ActorID: "mod", Action: "mute", TargetID: "carol"})
+	if entries, err := store.ListAudit("bob", 10); err != nil || len(entries) != 1 || entries[0].Action != "ban" {
+		t.Errorf("ListAudit(bob) = %v, %v", entries, err)
+	}
+	if entries, _ := store.ListAudit("", 10); len(entries) != 2 || entries[0].Action != "mute" {
+		t.Errorf("ListAudit() = %v, want both, newest first", entries)
+	}
+}
+
+// TestConcurrentServers checks that stores sharing a database see each
+// other's writes and don't lose concurrent ones.
+func TestConcurrentServers(t *testing.T) {
+	one := newMigratedStore(t)
+	var schema string
+	if err := one.db.QueryRow(`SELECT current_schema()`).Scan(&schema); err != nil {
+		t.Fatalf("current_schema: %v", err)
+	}
+	two := openInSchema(t, os.Getenv("CARO_CHESS_TEST_POSTGRES_DSN"), schema)
+
+	one.SaveUser(&db.User{ID: "alice", ELO: 1200})
+	var wg sync.WaitGroup
+	for _, store := range []*PostgresStore{one, two} {
+		wg.Add(1)
+		go func(store *PostgresStore) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				store.UpdateUserCoins("alice", 1)
+			}
+		}(store)
+	}
+	wg.Wait()
+	if user, _ := two.GetUser("alice"); user.Coins != 100 {
+		t.Errorf("Coins = %d, want 100", user.Coins)
+	}
+}
@@ -1,12 +1,14 @@
 package db
 
 import (
-	"encoding/json"
-	"os"
-	"sync"
+	"errors"
+	"strings"
 	"time"
 )
 
+// ErrInsufficientCoins is returned when spending more coins than a user has.
+var ErrInsufficientCoins = errors.New("not enough coins")
+
 type User struct {
 	ID          string `json:"id"`
 	ELO         int    `json:"elo"`
@@ -15,6 +17,18 @@ type User struct {
 	Losses      int    `json:"losses"`
 	Draws       int    `json:"draws"`
 	Coins       int    `json:"coins"`
+	Role        Role   `json:"role,omitempty"` // Set by AdminRepository.SetUserRole
+}
+
+// GuestIDPrefix starts the ID of every guest. Guests play and earn coins
+// like anyone else, but their rating is their own: it is left off the
+// leaderboard and games against them don't move a registered player's.
+// Their records are merged into the account they sign up for.
+const GuestIDPrefix = "guest-"
+
+// IsGuestID reports whether id is a guest's.
+func IsGuestID(id string) bool {
+	return strings.HasPrefix(id, GuestIDPrefix)
 }
 
 type Match struct {
@@ -24,6 +38,21 @@ type Match struct {
 	WinnerID  *string   `json:"winner_id"` // null if draw
 	Moves     []Move    `json:"moves"`
 	Timestamp time.Time `json:"timestamp"`
+
+	// Ratings before and after the game. Zero for matches recorded
+	// before ratings were tracked per match.
+	PlayerXRatingBefore int `json:"player_x_rating_before,omitempty"`
+	PlayerXRatingAfter  int `json:"player_x_rating_after,omitempty"`
+	PlayerORatingBefore int `json:"player_o_rating_before,omitempty"`
+	PlayerORatingAfter  int `json:"player_o_rating_after,omitempty"`
+}
+
+// RatingChange is a single rating update for one player caused by a match.
+type RatingChange struct {
+	MatchID   string    `json:"match_id"`
+	Before    int       `json:"before"`
+	After     int       `json:"after"`
+	Timestamp time.Time `json:"timestamp"`
 }
 
 type Move struct {
@@ -33,96 +62,42 @@ type Move struct {
 	Order  int    `json:"order"`
 }
 
+// TournamentResult is a player's final placing in a finished tournament.
+type TournamentResult struct {
+	TournamentID string    `json:"tournament_id"`
+	Name         string    `json:"name"`
+	Format       string    `json:"format"`
+	UserID       string    `json:"user_id"`
+	Rank         int       `json:"rank"`
+	Score        float64   `json:"score"`
+	Games        int       `json:"games"`
+	FinishedAt   time.Time `json:"finished_at"`
+}
+
 type UserRepository interface {
 	SaveUser(user *User) error
+	// GetUser returns the user, created if unknown.
 	GetUser(id string) (*User, error)
+	// FindUser is GetUser for users that exist already; it fails with
+	// ErrNotFound rather than create one.
+	FindUser(id string) (*User, error)
 	SaveMatch(match *Match) error
 	GetMatchesByUserID(userID string, limit int) ([]*Match, error)
 	GetMatch(matchID string) (*Match, error)
 	GetLeaderboard(limit int) ([]*User, error)
+	// UpdateUserCoins adds amount, which may be negative, to a user's
+	// coins. It fails with ErrInsufficientCoins, changing nothing, if the
+	// balance would go below zero, and with ErrNotFound for unknown users.
 	UpdateUserCoins(userID string, amount int) error
 	AddToInventory(userID string, itemID string) error
 	GetInventory(userID string) ([]string, error)
-}
-
-type FileUserRepository struct {
-	filename string
-	users    map[string]*User
-	mu       sync.RWMutex
-}
-
-func NewFileUserRepository(filename string) *FileUserRepository {
-	repo := &FileUserRepository{
-		filename: filename,
-		users:    make(map[string]*User),
-	}
-	repo.load()
-	return repo
-}
-
-func (r *FileUserRepository) load() error {
-	r.mu.Lock()
-	defer r.mu.Unlock()
-
-	data, err := os.ReadFile(r.filename)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return nil
-		}
-		return err
-	}
-
-	return json.Unmarshal(data, &r.users)
-}
-
-func (r *FileUserRepository) SaveUser(user *User) error {
-	r.mu.Lock()
-	r.users[user.ID] = user
-	data, err := json.MarshalIndent(r.users, "", "  ")
-	r.mu.Unlock()
-
-	if err != nil {
-		return err
-	}
-	return os.WriteFile(r.filename, data, 0644)
-}
-
-func (r *FileUserRepository) GetUser(id string) (*User, error) {
-	r.mu.RLock()
-	defer r.mu.RUnlock()
-
-	if u, ok := r.users[id]; ok {
-		copy := *u
-		return &copy, nil
-	}
-
-	return &User{ID: id, ELO: 1200}, nil
-}
-
-func (r *FileUserRepository) SaveMatch(match *Match) error {
-	return nil
-}
-
-func (r *FileUserRepository) GetMatchesByUserID(userID string, limit int) ([]*Match, error) {
-	return []*Match{}, nil
-}
-
-func (r *FileUserRepository) GetLeaderboard(limit int) ([]*User, error) {
-	return []*User{}, nil
-}
-
-func (r *FileUserRepository) UpdateUserCoins(userID string, amount int) error {
-	return nil
-}
-
-func (r *FileUserRepository) AddToInventory(userID string, itemID string) error {
-	return nil
-}
-
-func (r *FileUserRepository) GetInventory(userID string) ([]string, error) {
-	return []string{}, nil
-}
-
-func (r *FileUserRepository) GetMatch(matchID string) (*Match, error) {
-	return nil, nil // Or error not found
+	GetRatingHistory(userID string) ([]*RatingChange, error)
+	GetAllMatches() ([]*Match, error)
+	UpdateMatchRatings(match *Match) error
+	SaveTournamentResults(results []*TournamentResult) error
+	GetTournamentResults(tournamentID string) ([]*TournamentResult, error)
+	// MergeUsers moves everything of fromID's, its stats, coins, matches,
+	// inventory and tournament results, to intoID and deletes fromID.
+	// intoID takes fromID's rating if it hasn't played yet.
+	MergeUsers(fromID, intoID string) error
 }
@@ -0,0 +1,26 @@
+package db
+
+import "time"
+
+// Session is a login: it starts when a user logs in and lasts, refreshed,
+// until they log out or stop refreshing it. Access tokens name the session
+// they belong to, so revoking a session revokes them as well.
+type Session struct {
+	ID          string
+	UserID      string
+	RefreshHash string // SHA-256 of the current refresh token, hex encoded
+	ExpiresAt   time.Time
+	Revoked     bool
+}
+
+// SessionRepository stores sessions.
+type SessionRepository interface {
+	CreateSession(s *Session) error
+	// GetSession and GetSessionByRefreshHash fail with ErrNotFound.
+	GetSession(id string) (*Session, error)
+	GetSessionByRefreshHash(hash string) (*Session, error)
+	// UpdateSession saves the refresh hash, expiry and revocation.
+	UpdateSession(s *Session) error
+	// RevokeUserSessions revokes every session of a user.
+	RevokeUserSessions(userID string) error
+}
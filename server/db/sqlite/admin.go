@@ -0,0 +1,163 @@
+package sqlite
+
+import (
+	"database/sql"
+	"time"
+
+	"caro_chess_server/db"
+)
+
+func (s *SQLiteStore) SetUserRole(userID string, role db.Role) error {
+	res, err := s.db.Exec(`UPDATE users SET role = ? WHERE id = ?`, role, userID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return db.ErrNotFound
+	}
+	return nil
+}
+
+func (s *SQLiteStore) CreateSanction(sanction *db.Sanction) error {
+	sanction.CreatedAt = time.Now()
+	var expiresAt sql.NullTime
+	if !sanction.ExpiresAt.IsZero() {
+		expiresAt = sql.NullTime{Time: sanction.ExpiresAt, Valid: true}
+	}
+	res, err := s.db.Exec(`INSERT INTO sanctions (user_id, kind, reason, issued_by, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		sanction.UserID, sanction.Kind, sanction.Reason, sanction.IssuedBy, sanction.CreatedAt, expiresAt)
+	if err != nil {
+		return err
+	}
+	sanction.ID, err = res.LastInsertId()
+	return err
+}
+
+func (s *SQLiteStore) GetSanction(id int64) (*db.Sanction, error) {
+	return scanSanction(s.db.QueryRow(`SELECT `+sanctionColumns+` FROM sanctions WHERE id = ?`, id))
+}
+
+func (s *SQLiteStore) ListSanctions(userID string) ([]*db.Sanction, error) {
+	return s.querySanctions(`SELECT `+sanctionColumns+` FROM sanctions WHERE user_id = ? ORDER BY id DESC`, userID)
+}
+
+func (s *SQLiteStore) ActiveSanctions(userID string) ([]*db.Sanction, error) {
+	unlifted, err := s.querySanctions(`SELECT `+sanctionColumns+` FROM sanctions
+            WHERE user_id = ? AND lifted_at IS NULL ORDER BY id DESC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	// Expiry is checked here rather than by comparing stored times in SQL.
+	var active []*db.Sanction
+	for _, sanction := range unlifted {
+		if sanction.Active() {
+			active = append(active, sanction)
+		}
+	}
+	return active, nil
+}
+
+func (s *SQLiteStore) querySanctions(query string, args ...any) ([]*db.Sanction, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sanctions []*db.Sanction
+	for rows.Next() {
+		sanction, err := scanSanction(rows)
+		if err != nil {
+			return nil, err
+		}
+		sanctions = append(sanctions, sanction)
+	}
+	return sanctions, rows.Err()
+}
+
+func (s *SQLiteStore) LiftSanction(id int64, liftedBy string) error {
+	res, err := s.db.Exec(`UPDATE sanctions SET lifted_by = ?, lifted_at = ? WHERE id = ? AND lifted_at IS NULL`,
+		liftedBy, time.Now(), id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return db.ErrNotFound
+	}
+	return nil
+}
+
+func (s *SQLiteStore) SetAppealNote(id int64, note string) error {
+	res, err := s.db.Exec(`UPDATE sanctions SET appeal_note = ? WHERE id = ?`, note, id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return db.ErrNotFound
+	}
+	return nil
+}
+
+// sanctionColumns lists the sanctions columns read by scanSanction, in
+// order.
+const sanctionColumns = `id, user_id, kind, reason, issued_by, created_at, expires_at, appeal_note, lifted_by, lifted_at`
+
+func scanSanction(row scanner) (*db.Sanction, error) {
+	var sanction db.Sanction
+	var appealNote, liftedBy sql.NullString
+	var expiresAt, liftedAt sql.NullTime
+	err := row.Scan(&sanction.ID, &sanction.UserID, &sanction.Kind, &sanction.Reason, &sanction.IssuedBy,
+		&sanction.CreatedAt, &expiresAt, &appealNote, &liftedBy, &liftedAt)
+	if err == sql.ErrNoRows {
+		return nil, db.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	sanction.AppealNote, sanction.LiftedBy = appealNote.String, liftedBy.String
+	if expiresAt.Valid {
+		sanction.ExpiresAt = expiresAt.Time
+	}
+	if liftedAt.Valid {
+		sanction.LiftedAt = liftedAt.Time
+	}
+	return &sanction, nil
+}
+
+func (s *SQLiteStore) RecordAudit(e *db.AuditEntry) error {
+	e.CreatedAt = time.Now()
+	res, err := s.db.Exec(`INSERT INTO audit_log (actor_id, action, target_id, reason, details, created_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		e.ActorID, e.Action, e.TargetID, e.Reason, e.Details, e.CreatedAt)
+	if err != nil {
+		return err
+	}
+	e.ID, err = res.LastInsertId()
+	return err
+}
+
+func (s *SQLiteStore) ListAudit(targetID string, limit int) ([]*db.AuditEntry, error) {
+	query := `SELECT id, actor_id, action, target_id, reason, details, created_at FROM audit_log`
+	args := []any{}
+	if targetID != "" {
+		query += ` WHERE target_id = ?`
+		args = append(args, targetID)
+	}
+	query += ` ORDER BY id DESC LIMIT ?`
+	rows, err := s.db.Query(query, append(args, limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []*db.AuditEntry
+	for rows.Next() {
+		var e db.AuditEntry
+		var reason, details sql.NullString
+		if err := rows.Scan(&e.ID, &e.ActorID, &e.Action, &e.TargetID, &reason, &details, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		e.Reason, e.Details = reason.String, details.String
+		entries = append(entries, &e)
+	}
+	return entries, rows.Err()
+}
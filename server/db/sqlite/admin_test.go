@@ -0,0 +1,115 @@
+package sqlite
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"caro_chess_server/db"
+)
+
+func TestRolesAndSanctions(t *testing.T) {
+	store := newTestStore(t)
+	store.SaveUser(&db.User{ID: "alice", ELO: 1200})
+
+	if user, _ := store.GetUser("alice"); user.Role != db.RolePlayer {
+		t.Errorf("New user role = %q, want player", user.Role)
+	}
+	if err := store.SetUserRole("alice", db.RoleModerator); err != nil {
+		t.Fatalf("SetUserRole: %v", err)
+	}
+	store.SaveUser(&db.User{ID: "alice", ELO: 1250}) // Doesn't touch the role
+	if user, _ := store.GetUser("alice"); user.Role != db.RoleModerator || user.ELO != 1250 {
+		t.Errorf("alice = %+v, want a moderator rated 1250", user)
+	}
+	if err := store.SetUserRole("nobody", db.RoleAdmin); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("SetUserRole of unknown user = %v, want ErrNotFound", err)
+	}
+
+	ban := &db.Sanction{UserID: "bob", Kind: db.SanctionBan, Reason: "cheating", IssuedBy: "alice"}
+	mute := &db.Sanction{UserID: "bob", Kind: db.SanctionMute, Reason: "spam", IssuedBy: "alice"}
+	for _, s := range []*db.Sanction{ban, mute} {
+		if err := store.CreateSanction(s); err != nil || s.ID == 0 || s.CreatedAt.IsZero() {
+			t.Fatalf("CreateSanction = %v, giving %+v", err, s)
+		}
+	}
+	if err := store.LiftSanction(ban.ID, "alice"); err != nil {
+		t.Fatalf("LiftSanction: %v", err)
+	}
+	if err := store.LiftSanction(ban.ID, "alice"); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("Lifting twice = %v, want ErrNotFound", err)
+	}
+
+	sanctions, err := store.ListSanctions("bob")
+	if err != nil || len(sanctions) != 2 {
+		t.Fatalf("ListSanctions = %v, %v", sanctions, err)
+	}
+	if sanctions[0].ID != mute.ID || !sanctions[0].Active() {
+		t.Errorf("Newest sanction = %+v, want the active mute", sanctions[0])
+	}
+	if sanctions[1].Active() || sanctions[1].LiftedBy != "alice" || sanctions[1].Reason != "cheating" {
+		t.Errorf("Oldest sanction = %+v, want the ban, lifted by alice", sanctions[1])
+	}
+	if _, err := store.GetSanction(999); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("GetSanction of unknown ID = %v, want ErrNotFound", err)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	store := newTestStore(t)
+	for _, e := range []*db.AuditEntry{
+		{ActorID: "alice", Action: "sanction.ban", TargetID: "bob", Reason: "cheating"},
+		{ActorID: "alice", Action: "coins.adjust", TargetID: "carol", Reason: "refund", Details: "amount=+50"},
+		{ActorID: "alice", Action: "sanction.lift", TargetID: "bob", Reason: "appeal"},
+	} {
+		if err := store.RecordAudit(e); err != nil || e.ID == 0 {
+			t.Fatalf("RecordAudit = %v, giving %+v", err, e)
+		}
+	}
+
+	all, err := store.ListAudit("", 10)
+	if err != nil || len(all) != 3 || all[0].Action != "sanction.lift" {
+		t.Fatalf("ListAudit = %v, %v; want 3 entries, newest first", all, err)
+	}
+	bob, _ := store.ListAudit("bob", 10)
+	if len(bob) != 2 || bob[1].Action != "sanction.ban" {
+		t.Errorf("ListAudit(bob) = %v, want his 2 entries", bob)
+	}
+	if limited, _ := store.ListAudit("", 1); len(limited) != 1 {
+		t.Errorf("ListAudit with limit 1 = %d entries", len(limited))
+	}
+	if all[1].Details != "amount=+50" || all[1].CreatedAt.IsZero() {
+		t.Errorf("Coins entry = %+v", all[1])
+	}
+}
+
+func TestActiveSanctions(t *testing.T) {
+	store := newTestStore(t)
+	expired := &db.Sanction{UserID: "bob", Kind: db.SanctionSuspend, Reason: "afk", ExpiresAt: time.Now().Add(-time.Minute)}
+	temporary := &db.Sanction{UserID: "bob", Kind: db.SanctionMute, Reason: "spam", ExpiresAt: time.Now().Add(time.Hour)}
+	lifted := &db.Sanction{UserID: "bob", Kind: db.SanctionBan, Reason: "mistake"}
+	for _, s := range []*db.Sanction{expired, temporary, lifted} {
+		if err := store.CreateSanction(s); err != nil {
+			t.Fatalf("CreateSanction: %v", err)
+		}
+	}
+	store.LiftSanction(lifted.ID, "alice")
+
+	active, err := store.ActiveSanctions("bob")
+	if err != nil || len(active) != 1 || active[0].ID != temporary.ID {
+		t.Fatalf("ActiveSanctions = %v, %v; want only the mute", active, err)
+	}
+	if !active[0].ExpiresAt.Equal(temporary.ExpiresAt) {
+		t.Errorf("ExpiresAt = %v, want %v", active[0].ExpiresAt, temporary.ExpiresAt)
+	}
+
+	if err := store.SetAppealNote(temporary.ID, "says it was a bot"); err != nil {
+		t.Fatalf("SetAppealNote: %v", err)
+	}
+	if s, _ := store.GetSanction(temporary.ID); s.AppealNote != "says it was a bot" {
+		t.Errorf("AppealNote = %q", s.AppealNote)
+	}
+	if err := store.SetAppealNote(999, "note"); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("SetAppealNote of unknown ID = %v, want ErrNotFound", err)
+	}
+}
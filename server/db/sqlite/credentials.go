@@ -0,0 +1,94 @@
+package sqlite
+
+import (
+	"database/sql"
+	"strings"
+
+	"caro_chess_server/db"
+)
+
+// execer is a *sql.DB or a *sql.Tx.
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+func (s *SQLiteStore) CreateCredential(c *db.Credential) error {
+	return createCredential(s.db, c)
+}
+
+func createCredential(ex execer, c *db.Credential) error {
+	_, err := ex.Exec(`INSERT INTO credentials (user_id, username, password_hash) VALUES (?, ?, ?)`,
+		c.UserID, c.Username, c.PasswordHash)
+	if err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed") {
+		if strings.Contains(err.Error(), "credentials.username") {
+			return db.ErrUsernameTaken
+		}
+		return db.ErrCredentialExists
+	}
+	return err
+}
+
+func (s *SQLiteStore) CreateAccount(u *db.User, c *db.Credential, guestID string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // No-op once committed
+
+	if _, err := tx.Exec(`INSERT INTO users (id, elo, coins) VALUES (?, ?, ?)`, u.ID, u.ELO, u.Coins); err != nil {
+		return err
+	}
+	if err := createCredential(tx, c); err != nil {
+		return err
+	}
+	if guestID != "" {
+		if err := mergeUsers(tx, guestID, u.ID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) GetCredentialByUsername(username string) (*db.Credential, error) {
+	return scanCredential(s.db.QueryRow(`SELECT `+credentialColumns+` FROM credentials WHERE username = ?`, username))
+}
+
+func (s *SQLiteStore) GetCredentialByUserID(userID string) (*db.Credential, error) {
+	return scanCredential(s.db.QueryRow(`SELECT `+credentialColumns+` FROM credentials WHERE user_id = ?`, userID))
+}
+
+func (s *SQLiteStore) UpdateCredential(c *db.Credential) error {
+	var lockedUntil interface{}
+	if !c.LockedUntil.IsZero() {
+		lockedUntil = c.LockedUntil
+	}
+	res, err := s.db.Exec(`UPDATE credentials SET password_hash = ?, failed_logins = ?, locked_until = ? WHERE user_id = ?`,
+		c.PasswordHash, c.FailedLogins, lockedUntil, c.UserID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return db.ErrNotFound
+	}
+	return nil
+}
+
+// credentialColumns lists the credentials columns read by scanCredential,
+// in order.
+const credentialColumns = `user_id, username, password_hash, failed_logins, locked_until`
+
+func scanCredential(row scanner) (*db.Credential, error) {
+	var c db.Credential
+	var lockedUntil sql.NullTime
+	err := row.Scan(&c.UserID, &c.Username, &c.PasswordHash, &c.FailedLogins, &lockedUntil)
+	if err == sql.ErrNoRows {
+		return nil, db.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if lockedUntil.Valid {
+		c.LockedUntil = lockedUntil.Time
+	}
+	return &c, nil
+}
@@ -0,0 +1,55 @@
+package sqlite
+
+import "database/sql"
+
+// MergeUsers moves a user's records to another in one transaction. It is
+// how a guest keeps their games and coins when they sign up.
+func (s *SQLiteStore) MergeUsers(fromID, intoID string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // No-op once committed
+
+	if err := mergeUsers(tx, fromID, intoID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func mergeUsers(tx *sql.Tx, fromID, intoID string) error {
+	statements := []struct {
+		query string
+		args  []any
+	}{
+		{`UPDATE users SET
+                elo = CASE WHEN users.games_played = 0 THEN f.elo ELSE users.elo END,
+                games_played = users.games_played + f.games_played,
+                wins = users.wins + f.wins,
+                losses = users.losses + f.losses,
+                draws = users.draws + f.draws,
+                coins = users.coins + f.coins
+            FROM (SELECT * FROM users WHERE id = ?) AS f
+            WHERE users.id = ?`, []any{fromID, intoID}},
+		// A game between the two would become one against themselves.
+		{`DELETE FROM moves WHERE match_id IN (SELECT id FROM matches
+            WHERE (player_x_id = ? AND player_o_id = ?) OR (player_x_id = ? AND player_o_id = ?))`, []any{fromID, intoID, intoID, fromID}},
+		{`DELETE FROM matches
+            WHERE (player_x_id = ? AND player_o_id = ?) OR (player_x_id = ? AND player_o_id = ?)`, []any{fromID, intoID, intoID, fromID}},
+		{`UPDATE matches SET player_x_id = ? WHERE player_x_id = ?`, []any{intoID, fromID}},
+		{`UPDATE matches SET player_o_id = ? WHERE player_o_id = ?`, []any{intoID, fromID}},
+		{`UPDATE matches SET winner_id = ? WHERE winner_id = ?`, []any{intoID, fromID}},
+		{`INSERT OR IGNORE INTO inventory (user_id, item_id) SELECT ?, item_id FROM inventory WHERE user_id = ?`, []any{intoID, fromID}},
+		{`DELETE FROM inventory WHERE user_id = ?`, []any{fromID}},
+		// A tournament both played in keeps intoID's result.
+		{`UPDATE OR IGNORE tournament_results SET user_id = ? WHERE user_id = ?`, []any{intoID, fromID}},
+		{`DELETE FROM tournament_results WHERE user_id = ?`, []any{fromID}},
+		{`DELETE FROM users WHERE id = ?`, []any{fromID}},
+	}
+	for _, st := range statements {
+		if _, err := tx.Exec(st.query, st.args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
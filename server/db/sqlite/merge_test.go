@@ -0,0 +1,105 @@
+package sqlite
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"caro_chess_server/db"
+)
+
+func newTestStore(t *testing.T) *SQLiteStore {
+	store, err := NewSQLiteStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("NewSQLiteStore: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestMergeUsers(t *testing.T) {
+	store := newTestStore(t)
+	guest := db.GuestIDPrefix + "1"
+
+	store.SaveUser(&db.User{ID: guest, ELO: 1230, GamesPlayed: 3, Wins: 2, Losses: 1, Coins: 400})
+	store.SaveUser(&db.User{ID: "rival", ELO: 1170})
+	store.SaveUser(&db.User{ID: "alice", ELO: 1200, Coins: 50})
+	winner := guest
+	store.SaveMatch(&db.Match{ID: "m1", PlayerXID: guest, PlayerOID: "rival", WinnerID: &winner, Timestamp: time.Now()})
+	store.SaveMatch(&db.Match{ID: "m2", PlayerXID: "rival", PlayerOID: guest, Timestamp: time.Now()})
+	store.AddToInventory(guest, "neon_piece")
+	store.AddToInventory(guest, "board_ice")
+	store.AddToInventory("alice", "neon_piece")
+	store.SaveTournamentResults([]*db.TournamentResult{
+		{TournamentID: "t1", UserID: guest, Rank: 1},
+		{TournamentID: "t2", UserID: guest, Rank: 3},
+		{TournamentID: "t2", UserID: "alice", Rank: 2},
+	})
+
+	if err := store.MergeUsers(guest, "alice"); err != nil {
+		t.Fatalf("MergeUsers: %v", err)
+	}
+
+	user, _ := store.GetUser("alice")
+	if user.GamesPlayed != 3 || user.Wins != 2 || user.Coins != 450 || user.ELO != 1230 {
+		t.Errorf("Merged user = %+v, want the guest's stats and rating and both users' coins", user)
+	}
+
+	matches, _ := store.GetMatchesByUserID("alice", 10)
+	if len(matches) != 2 {
+		t.Fatalf("Merged user has %d matches, want 2", len(matches))
+	}
+	m1, _ := store.GetMatch("m1")
+	if m1.PlayerXID != "alice" || *m1.WinnerID != "alice" {
+		t.Errorf("m1 = %+v, want alice as X and the winner", m1)
+	}
+	if left, _ := store.GetMatchesByUserID(guest, 10); len(left) != 0 {
+		t.Errorf("Guest still has %d matches", len(left))
+	}
+
+	if items, _ := store.GetInventory("alice"); len(items) != 2 {
+		t.Errorf("Merged inventory = %v, want neon_piece and board_ice once each", items)
+	}
+
+	results, _ := store.GetTournamentResults("t1")
+	if len(results) != 1 || results[0].UserID != "alice" {
+		t.Errorf("t1 results = %+v, want the guest's result as alice's", results)
+	}
+	results, _ = store.GetTournamentResults("t2")
+	if len(results) != 1 || results[0].Rank != 2 {
+		t.Errorf("t2 results = %+v, want only alice's own result", results)
+	}
+
+	// The guest is gone: looking them up starts afresh.
+	if g, _ := store.GetUser(guest); g.Coins != 0 || g.Wins != 0 {
+		t.Errorf("Guest after merge = %+v, want a fresh user", g)
+	}
+}
+
+func TestMergeUsersKeepsPlayedRating(t *testing.T) {
+	store := newTestStore(t)
+	guest := db.GuestIDPrefix + "1"
+	store.SaveUser(&db.User{ID: guest, ELO: 1300, GamesPlayed: 2})
+	store.SaveUser(&db.User{ID: "veteran", ELO: 1500, GamesPlayed: 40})
+
+	if err := store.MergeUsers(guest, "veteran"); err != nil {
+		t.Fatalf("MergeUsers: %v", err)
+	}
+	if user, _ := store.GetUser("veteran"); user.ELO != 1500 {
+		t.Errorf("Merged rating = %d, want the veteran's 1500 kept", user.ELO)
+	}
+}
+
+func TestLeaderboardLeavesOutGuests(t *testing.T) {
+	store := newTestStore(t)
+	store.SaveUser(&db.User{ID: db.GuestIDPrefix + "1", ELO: 2000})
+	store.SaveUser(&db.User{ID: "alice", ELO: 1300})
+
+	users, err := store.GetLeaderboard(10)
+	if err != nil {
+		t.Fatalf("GetLeaderboard: %v", err)
+	}
+	if len(users) != 1 || users[0].ID != "alice" {
+		t.Errorf("Leaderboard = %v, want only alice", users)
+	}
+}
@@ -0,0 +1,121 @@
+package sqlite
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+
+	"caro_chess_server/db/migrate"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+func (s *SQLiteStore) runner(migrations []migrate.Migration) *migrate.Runner {
+	return &migrate.Runner{
+		DB:         s.db,
+		Migrations: migrations,
+		After:      map[int]func(*sql.Tx) error{1: upgradeLegacy},
+		HasTable:   s.hasTable,
+	}
+}
+
+func (s *SQLiteStore) hasTable(name string) (bool, error) {
+	var tables int
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?`, name).Scan(&tables)
+	return tables > 0, err
+}
+
+func (s *SQLiteStore) embeddedRunner() (*migrate.Runner, error) {
+	migrations, err := migrate.Load(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	return s.runner(migrations), nil
+}
+
+// Version returns the version of the database's schema, 0 if no migration
+// has been applied.
+func (s *SQLiteStore) Version() (int, error) {
+	return s.runner(nil).Version()
+}
+
+// Pending returns the migrations not yet applied. It fails if the database
+// is newer than this server.
+func (s *SQLiteStore) Pending() ([]migrate.Migration, error) {
+	r, err := s.embeddedRunner()
+	if err != nil {
+		return nil, err
+	}
+	return r.Pending()
+}
+
+// Migrate applies the pending migrations, in order, and returns them.
+func (s *SQLiteStore) Migrate() ([]migrate.Migration, error) {
+	r, err := s.embeddedRunner()
+	if err != nil {
+		return nil, err
+	}
+	return r.Migrate()
+}
+
+// Empty reports whether the database has no tables but schema_migrations.
+func (s *SQLiteStore) Empty() (bool, error) {
+	var tables int
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table'
+            AND name NOT IN ('schema_migrations', 'sqlite_sequence')`).Scan(&tables)
+	return tables == 0, err
+}
+
+// upgradeLegacy adds the columns that databases made before migrations may
+// lack: until then they were added at startup as they came along.
+func upgradeLegacy(tx *sql.Tx) error {
+	columns := []struct{ table, column, colType string }{
+		{"matches", "player_x_rating_before", "INTEGER"},
+		{"matches", "player_x_rating_after", "INTEGER"},
+		{"matches", "player_o_rating_before", "INTEGER"},
+		{"matches", "player_o_rating_after", "INTEGER"},
+		{"users", "role", "TEXT NOT NULL DEFAULT 'player'"},
+		{"sanctions", "expires_at", "DATETIME"},
+		{"sanctions", "appeal_note", "TEXT"},
+	}
+	for _, c := range columns {
+		if err := ensureColumn(tx, c.table, c.column, c.colType); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ensureColumn adds a column to an existing table if it is missing.
+func ensureColumn(tx *sql.Tx, table, column, colType string) error {
+	rows, err := tx.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid       int
+			name      string
+			ctype     string
+			notNull   int
+			dfltValue sql.NullString
+			pk        int
+		)
+		if err := rows.Scan(&cid, &name, &ctype, &notNull, &dfltValue, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	_, err = tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, colType))
+	return err
+}
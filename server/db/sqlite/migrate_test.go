@@ -0,0 +1,115 @@
+package sqlite
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"caro_chess_server/db"
+	"caro_chess_server/db/migrate"
+)
+
+func openTestStore(t *testing.T) *SQLiteStore {
+	store, err := Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestMigrateNewDatabase(t *testing.T) {
+	store := openTestStore(t)
+	if empty, err := store.Empty(); err != nil || !empty {
+		t.Fatalf("Empty = %v, %v; want true", empty, err)
+	}
+	all, err := migrate.Load(migrationFiles, "migrations")
+	if err != nil {
+		t.Fatalf("loadMigrations: %v", err)
+	}
+
+	// Checking the status changes nothing.
+	if version, err := store.Version(); err != nil || version != 0 {
+		t.Fatalf("Version = %d, %v; want 0", version, err)
+	}
+	if pending, err := store.Pending(); err != nil || len(pending) != len(all) {
+		t.Fatalf("Pending = %v, %v; want all %d", pending, err, len(all))
+	}
+	if exists, _ := store.hasTable("schema_migrations"); exists {
+		t.Fatal("Checking the version created schema_migrations")
+	}
+
+	applied, err := store.Migrate()
+	if err != nil || len(applied) != len(all) {
+		t.Fatalf("Migrate = %v, %v; want all %d", applied, err, len(all))
+	}
+	if version, _ := store.Version(); version != len(all) {
+		t.Errorf("Version = %d, want %d", version, len(all))
+	}
+	if again, err := store.Migrate(); err != nil || len(again) != 0 {
+		t.Errorf("Migrating again = %v, %v; want nothing to do", again, err)
+	}
+	if user, err := store.GetUser("alice"); err != nil || user.Role != db.RolePlayer {
+		t.Errorf("GetUser after migrating = %+v, %v", user, err)
+	}
+}
+
+func TestMigrateAdoptsOldDatabase(t *testing.T) {
+	store := openTestStore(t)
+	// The schema before per-match ratings and roles, as made at startup.
+	_, err := store.db.Exec(`
+    CREATE TABLE users (id TEXT PRIMARY KEY, elo INTEGER NOT NULL DEFAULT 1200, games_played INTEGER DEFAULT 0,
+        wins INTEGER DEFAULT 0, losses INTEGER DEFAULT 0, draws INTEGER DEFAULT 0, coins INTEGER DEFAULT 0,
+        created_at DATETIME DEFAULT CURRENT_TIMESTAMP);
+    CREATE TABLE matches (id TEXT PRIMARY KEY, player_x_id TEXT, player_o_id TEXT, winner_id TEXT, timestamp DATETIME);
+    INSERT INTO users (id, elo, games_played, coins) VALUES ('alice', 1337, 4, 90);
+    `)
+	if err != nil {
+		t.Fatalf("creating old schema: %v", err)
+	}
+	if empty, _ := store.Empty(); empty {
+		t.Fatal("Empty = true for a database with tables")
+	}
+
+	if _, err := store.Migrate(); err != nil {
+		t.Fatalf("Migrate: %v", err)
+	}
+	user, err := store.GetUser("alice")
+	if err != nil || user.ELO != 1337 || user.Coins != 90 || user.Role != db.RolePlayer {
+		t.Errorf("alice after migrating = %+v, %v; want her data kept and the player role", user, err)
+	}
+	match := &db.Match{ID: "m1", PlayerXID: "alice", PlayerOID: "bob", Timestamp: time.Now(), PlayerXRatingBefore: 1337}
+	if err := store.SaveMatch(match); err != nil {
+		t.Errorf("SaveMatch with ratings after migrating: %v", err)
+	}
+}
+
+func TestMigrationIsAtomic(t *testing.T) {
+	store := openTestStore(t)
+	all, err := migrate.Load(migrationFiles, "migrations")
+	if err != nil {
+		t.Fatalf("loadMigrations: %v", err)
+	}
+	migrations := []migrate.Migration{
+		all[0],
+		{Version: 2, Name: "broken", SQL: `CREATE TABLE half (id TEXT); INSERT INTO nowhere VALUES (1);`},
+	}
+
+	applied, err := store.runner(migrations).Migrate()
+	if err == nil || len(applied) != 1 {
+		t.Fatalf("migrate = %v, %v; want the first applied and the second failed", applied, err)
+	}
+	if version, _ := store.Version(); version != 1 {
+		t.Errorf("Version = %d, want 1", version)
+	}
+	var tables int
+	store.db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE name = 'half'`).Scan(&tables)
+	if tables != 0 {
+		t.Error("The failed migration left its table behind")
+	}
+
+	// A database newer than the server is refused.
+	if _, err := store.runner(migrations[:0]).Pending(); err == nil {
+		t.Error("Pending accepted a database newer than its migrations")
+	}
+}
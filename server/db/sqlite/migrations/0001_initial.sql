@@ -0,0 +1,90 @@
+-- The schema as of when migrations were introduced. It only creates what
+-- is missing, so databases made before then are adopted as they are; see
+-- upgradeLegacy for the columns those may lack.
+CREATE TABLE IF NOT EXISTS users (
+    id TEXT PRIMARY KEY,
+    elo INTEGER NOT NULL DEFAULT 1200,
+    games_played INTEGER DEFAULT 0,
+    wins INTEGER DEFAULT 0,
+    losses INTEGER DEFAULT 0,
+    draws INTEGER DEFAULT 0,
+    coins INTEGER DEFAULT 0,
+    role TEXT NOT NULL DEFAULT 'player',
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+CREATE TABLE IF NOT EXISTS matches (
+    id TEXT PRIMARY KEY,
+    player_x_id TEXT,
+    player_o_id TEXT,
+    winner_id TEXT,
+    timestamp DATETIME,
+    player_x_rating_before INTEGER,
+    player_x_rating_after INTEGER,
+    player_o_rating_before INTEGER,
+    player_o_rating_after INTEGER
+);
+CREATE TABLE IF NOT EXISTS moves (
+    match_id TEXT,
+    player TEXT,
+    x INTEGER,
+    y INTEGER,
+    move_order INTEGER,
+    FOREIGN KEY(match_id) REFERENCES matches(id)
+);
+CREATE TABLE IF NOT EXISTS inventory (
+    user_id TEXT,
+    item_id TEXT,
+    PRIMARY KEY (user_id, item_id),
+    FOREIGN KEY(user_id) REFERENCES users(id)
+);
+CREATE TABLE IF NOT EXISTS tournament_results (
+    tournament_id TEXT,
+    name TEXT,
+    format TEXT,
+    user_id TEXT,
+    rank INTEGER,
+    score REAL,
+    games INTEGER,
+    finished_at DATETIME,
+    PRIMARY KEY (tournament_id, user_id)
+);
+CREATE TABLE IF NOT EXISTS credentials (
+    user_id TEXT PRIMARY KEY,
+    username TEXT NOT NULL UNIQUE COLLATE NOCASE,
+    password_hash TEXT NOT NULL,
+    failed_logins INTEGER NOT NULL DEFAULT 0,
+    locked_until DATETIME,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY(user_id) REFERENCES users(id)
+);
+CREATE TABLE IF NOT EXISTS sessions (
+    id TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL,
+    refresh_hash TEXT NOT NULL UNIQUE,
+    expires_at DATETIME NOT NULL,
+    revoked INTEGER NOT NULL DEFAULT 0,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+CREATE TABLE IF NOT EXISTS sanctions (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id TEXT NOT NULL,
+    kind TEXT NOT NULL,
+    reason TEXT NOT NULL,
+    issued_by TEXT NOT NULL,
+    created_at DATETIME NOT NULL,
+    expires_at DATETIME,
+    appeal_note TEXT,
+    lifted_by TEXT,
+    lifted_at DATETIME
+);
+CREATE INDEX IF NOT EXISTS sanctions_user ON sanctions(user_id);
+CREATE TABLE IF NOT EXISTS audit_log (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    actor_id TEXT NOT NULL,
+    action TEXT NOT NULL,
+    target_id TEXT NOT NULL,
+    reason TEXT,
+    details TEXT,
+    created_at DATETIME NOT NULL
+);
+CREATE INDEX IF NOT EXISTS audit_log_target ON audit_log(target_id);
@@ -0,0 +1,53 @@
+package sqlite
+
+import (
+	"database/sql"
+
+	"caro_chess_server/db"
+)
+
+func (s *SQLiteStore) CreateSession(session *db.Session) error {
+	_, err := s.db.Exec(`INSERT INTO sessions (id, user_id, refresh_hash, expires_at, revoked) VALUES (?, ?, ?, ?, ?)`,
+		session.ID, session.UserID, session.RefreshHash, session.ExpiresAt, session.Revoked)
+	return err
+}
+
+func (s *SQLiteStore) GetSession(id string) (*db.Session, error) {
+	return scanSession(s.db.QueryRow(`SELECT `+sessionColumns+` FROM sessions WHERE id = ?`, id))
+}
+
+func (s *SQLiteStore) GetSessionByRefreshHash(hash string) (*db.Session, error) {
+	return scanSession(s.db.QueryRow(`SELECT `+sessionColumns+` FROM sessions WHERE refresh_hash = ?`, hash))
+}
+
+func (s *SQLiteStore) UpdateSession(session *db.Session) error {
+	res, err := s.db.Exec(`UPDATE sessions SET refresh_hash = ?, expires_at = ?, revoked = ? WHERE id = ?`,
+		session.RefreshHash, session.ExpiresAt, session.Revoked, session.ID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return db.ErrNotFound
+	}
+	return nil
+}
+
+func (s *SQLiteStore) RevokeUserSessions(userID string) error {
+	_, err := s.db.Exec(`UPDATE sessions SET revoked = 1 WHERE user_id = ?`, userID)
+	return err
+}
+
+// sessionColumns lists the sessions columns read by scanSession, in order.
+const sessionColumns = `id, user_id, refresh_hash, expires_at, revoked`
+
+func scanSession(row scanner) (*db.Session, error) {
+	var session db.Session
+	err := row.Scan(&session.ID, &session.UserID, &session.RefreshHash, &session.ExpiresAt, &session.Revoked)
+	if err == sql.ErrNoRows {
+		return nil, db.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
@@ -2,6 +2,7 @@ package sqlite
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 
 	"caro_chess_server/db"
@@ -13,71 +14,51 @@ type SQLiteStore struct {
 	db *sql.DB
 }
 
+// NewSQLiteStore opens the database at dbPath and applies any pending
+// migrations.
 func NewSQLiteStore(dbPath string) (*SQLiteStore, error) {
+	store, err := Open(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := store.Migrate(); err != nil {
+		store.Close()
+		return nil, fmt.Errorf("failed to migrate database: %w", err)
+	}
+	return store, nil
+}
+
+// Open opens the database at dbPath as it is. See Pending and Migrate.
+func Open(dbPath string) (*SQLiteStore, error) {
 	db, err := sql.Open("sqlite", dbPath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
 
 	if err := db.Ping(); err != nil {
-		return nil, fmt.Errorf("failed to ping database: %w", err)
-	}
-
-	store := &SQLiteStore{db: db}
-	if err := store.initSchema(); err != nil {
 		db.Close()
-		return nil, fmt.Errorf("failed to init schema: %w", err)
+		return nil, fmt.Errorf("failed to ping database: %w", err)
 	}
 
-	return store, nil
+	return &SQLiteStore{db: db}, nil
 }
 
-func (s *SQLiteStore) initSchema() error {
-	query := `
-    CREATE TABLE IF NOT EXISTS users (
-        id TEXT PRIMARY KEY,
-        elo INTEGER NOT NULL DEFAULT 1200,
-        games_played INTEGER DEFAULT 0,
-        wins INTEGER DEFAULT 0,
-        losses INTEGER DEFAULT 0,
-        draws INTEGER DEFAULT 0,
-        coins INTEGER DEFAULT 0,
-        created_at DATETIME DEFAULT CURRENT_TIMESTAMP
-    );
-    CREATE TABLE IF NOT EXISTS matches (
-        id TEXT PRIMARY KEY,
-        player_x_id TEXT,
-        player_o_id TEXT,
-        winner_id TEXT,
-        timestamp DATETIME
-    );
-    CREATE TABLE IF NOT EXISTS moves (
-        match_id TEXT,
-        player TEXT,
-        x INTEGER,
-        y INTEGER,
-        move_order INTEGER,
-        FOREIGN KEY(match_id) REFERENCES matches(id)
-    );
-    CREATE TABLE IF NOT EXISTS inventory (
-        user_id TEXT,
-        item_id TEXT,
-        PRIMARY KEY (user_id, item_id),
-        FOREIGN KEY(user_id) REFERENCES users(id)
-    );
-    `
-	_, err := s.db.Exec(query)
-	return err
+func (s *SQLiteStore) GetUser(id string) (*db.User, error) {
+	user, err := s.FindUser(id)
+	if errors.Is(err, db.ErrNotFound) {
+		return s.createUser(id)
+	}
+	return user, err
 }
 
-func (s *SQLiteStore) GetUser(id string) (*db.User, error) {
-	query := `SELECT id, elo, games_played, wins, losses, draws, coins FROM users WHERE id = ?`
+func (s *SQLiteStore) FindUser(id string) (*db.User, error) {
+	query := `SELECT id, elo, games_played, wins, losses, draws, coins, role FROM users WHERE id = ?`
 	row := s.db.QueryRow(query, id)
 
 	var user db.User
-	err := row.Scan(&user.ID, &user.ELO, &user.GamesPlayed, &user.Wins, &user.Losses, &user.Draws, &user.Coins)
+	err := row.Scan(&user.ID, &user.ELO, &user.GamesPlayed, &user.Wins, &user.Losses, &user.Draws, &user.Coins, &user.Role)
 	if err == sql.ErrNoRows {
-		return s.createUser(id)
+		return nil, db.ErrNotFound
 	}
 	if err != nil {
 		return nil, err
@@ -91,13 +72,13 @@ func (s *SQLiteStore) createUser(id string) (*db.User, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &db.User{ID: id, ELO: 1200}, nil
+	return &db.User{ID: id, ELO: 1200, Role: db.RolePlayer}, nil
 }
 
 func (s *SQLiteStore) SaveUser(u *db.User) error {
-	query := `INSERT INTO users (id, elo, wins, losses, draws, coins) VALUES (?, ?, ?, ?, ?, ?) 
-              ON CONFLICT(id) DO UPDATE SET elo=excluded.elo, wins=excluded.wins, losses=excluded.losses, draws=excluded.draws, coins=excluded.coins`
-	_, err := s.db.Exec(query, u.ID, u.ELO, u.Wins, u.Losses, u.Draws, u.Coins)
+	query := `INSERT INTO users (id, elo, games_played, wins, losses, draws, coins) VALUES (?, ?, ?, ?, ?, ?, ?) 
+              ON CONFLICT(id) DO UPDATE SET elo=excluded.elo, games_played=excluded.games_played, wins=excluded.wins, losses=excluded.losses, draws=excluded.draws, coins=excluded.coins`
+	_, err := s.db.Exec(query, u.ID, u.ELO, u.GamesPlayed, u.Wins, u.Losses, u.Draws, u.Coins)
 	return err
 }
 
@@ -108,8 +89,11 @@ func (s *SQLiteStore) SaveMatch(match *db.Match) error {
 	}
 
 	// Save Match
-	_, err = tx.Exec(`INSERT INTO matches (id, player_x_id, player_o_id, winner_id, timestamp) VALUES (?, ?, ?, ?, ?)`,
-		match.ID, match.PlayerXID, match.PlayerOID, match.WinnerID, match.Timestamp)
+	_, err = tx.Exec(`INSERT INTO matches (id, player_x_id, player_o_id, winner_id, timestamp,
+            player_x_rating_before, player_x_rating_after, player_o_rating_before, player_o_rating_after)
+            VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		match.ID, match.PlayerXID, match.PlayerOID, match.WinnerID, match.Timestamp,
+		match.PlayerXRatingBefore, match.PlayerXRatingAfter, match.PlayerORatingBefore, match.PlayerORatingAfter)
 	if err != nil {
 		tx.Rollback()
 		return err
@@ -136,7 +120,7 @@ func (s *SQLiteStore) SaveMatch(match *db.Match) error {
 
 func (s *SQLiteStore) GetMatchesByUserID(userID string, limit int) ([]*db.Match, error) {
 	query := `
-        SELECT id, player_x_id, player_o_id, winner_id, timestamp
+        SELECT ` + matchColumns + `
         FROM matches
         WHERE player_x_id = ? OR player_o_id = ?
         ORDER BY timestamp DESC
@@ -150,37 +134,52 @@ func (s *SQLiteStore) GetMatchesByUserID(userID string, limit int) ([]*db.Match,
 
 	var matches []*db.Match
 	for rows.Next() {
-		var m db.Match
-		var winnerID sql.NullString
-		err := rows.Scan(&m.ID, &m.PlayerXID, &m.PlayerOID, &winnerID, &m.Timestamp)
+		m, err := scanMatch(rows)
 		if err != nil {
 			return nil, err
 		}
-		if winnerID.Valid {
-			m.WinnerID = &winnerID.String
-		}
-		matches = append(matches, &m)
+		matches = append(matches, m)
 	}
 	return matches, nil
 }
 
-func (s *SQLiteStore) GetMatch(matchID string) (*db.Match, error) {
-	// Get Match
-	query := `SELECT id, player_x_id, player_o_id, winner_id, timestamp FROM matches WHERE id = ?`
-	row := s.db.QueryRow(query, matchID)
+// matchColumns lists the matches columns read by scanMatch, in order.
+const matchColumns = `id, player_x_id, player_o_id, winner_id, timestamp,
+        player_x_rating_before, player_x_rating_after, player_o_rating_before, player_o_rating_after`
+
+type scanner interface {
+	Scan(dest ...any) error
+}
 
+func scanMatch(row scanner) (*db.Match, error) {
 	var m db.Match
 	var winnerID sql.NullString
-	err := row.Scan(&m.ID, &m.PlayerXID, &m.PlayerOID, &winnerID, &m.Timestamp)
-	if err == sql.ErrNoRows {
-		return nil, nil // Not Found
-	}
+	var xBefore, xAfter, oBefore, oAfter sql.NullInt64
+	err := row.Scan(&m.ID, &m.PlayerXID, &m.PlayerOID, &winnerID, &m.Timestamp,
+		&xBefore, &xAfter, &oBefore, &oAfter)
 	if err != nil {
 		return nil, err
 	}
 	if winnerID.Valid {
 		m.WinnerID = &winnerID.String
 	}
+	m.PlayerXRatingBefore = int(xBefore.Int64)
+	m.PlayerXRatingAfter = int(xAfter.Int64)
+	m.PlayerORatingBefore = int(oBefore.Int64)
+	m.PlayerORatingAfter = int(oAfter.Int64)
+	return &m, nil
+}
+
+func (s *SQLiteStore) GetMatch(matchID string) (*db.Match, error) {
+	// Get Match
+	query := `SELECT ` + matchColumns + ` FROM matches WHERE id = ?`
+	m, err := scanMatch(s.db.QueryRow(query, matchID))
+	if err == sql.ErrNoRows {
+		return nil, nil // Not Found
+	}
+	if err != nil {
+		return nil, err
+	}
 
 	// Get Moves
 	movesQuery := `SELECT x, y, player, move_order FROM moves WHERE match_id = ? ORDER BY move_order ASC`
@@ -199,17 +198,79 @@ func (s *SQLiteStore) GetMatch(matchID string) (*db.Match, error) {
 		m.Moves = append(m.Moves, mv)
 	}
 
-	return &m, nil
+	return m, nil
+}
+
+// GetAllMatches returns every match without moves, oldest first.
+func (s *SQLiteStore) GetAllMatches() ([]*db.Match, error) {
+	rows, err := s.db.Query(`SELECT ` + matchColumns + ` FROM matches ORDER BY timestamp ASC, rowid ASC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var matches []*db.Match
+	for rows.Next() {
+		m, err := scanMatch(rows)
+		if err != nil {
+			return nil, err
+		}
+		matches = append(matches, m)
+	}
+	return matches, rows.Err()
+}
+
+// UpdateMatchRatings overwrites the recorded before/after ratings of a match.
+func (s *SQLiteStore) UpdateMatchRatings(match *db.Match) error {
+	_, err := s.db.Exec(`UPDATE matches SET player_x_rating_before = ?, player_x_rating_after = ?,
+            player_o_rating_before = ?, player_o_rating_after = ? WHERE id = ?`,
+		match.PlayerXRatingBefore, match.PlayerXRatingAfter, match.PlayerORatingBefore, match.PlayerORatingAfter, match.ID)
+	return err
+}
+
+// GetRatingHistory returns the user's rating changes, oldest first.
+// Matches recorded before ratings were tracked are skipped.
+func (s *SQLiteStore) GetRatingHistory(userID string) ([]*db.RatingChange, error) {
+	query := `
+        SELECT id, timestamp,
+            CASE WHEN player_x_id = ? THEN player_x_rating_before ELSE player_o_rating_before END,
+            CASE WHEN player_x_id = ? THEN player_x_rating_after ELSE player_o_rating_after END
+        FROM matches
+        WHERE player_x_id = ? OR player_o_id = ?
+        ORDER BY timestamp ASC, rowid ASC
+    `
+	rows, err := s.db.Query(query, userID, userID, userID, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var changes []*db.RatingChange
+	for rows.Next() {
+		var c db.RatingChange
+		var before, after sql.NullInt64
+		if err := rows.Scan(&c.MatchID, &c.Timestamp, &before, &after); err != nil {
+			return nil, err
+		}
+		if !after.Valid || after.Int64 == 0 {
+			continue
+		}
+		c.Before = int(before.Int64)
+		c.After = int(after.Int64)
+		changes = append(changes, &c)
+	}
+	return changes, rows.Err()
 }
 
 func (s *SQLiteStore) GetLeaderboard(limit int) ([]*db.User, error) {
 	query := `
         SELECT id, elo, games_played, wins, losses, draws
         FROM users
+        WHERE id NOT LIKE ? || '%'
         ORDER BY elo DESC
         LIMIT ?
     `
-	rows, err := s.db.Query(query, limit)
+	rows, err := s.db.Query(query, db.GuestIDPrefix, limit)
 	if err != nil {
 		return nil, err
 	}
@@ -232,8 +293,19 @@ func (s *SQLiteStore) Close() error {
 }
 
 func (s *SQLiteStore) UpdateUserCoins(userID string, amount int) error {
-	_, err := s.db.Exec(`UPDATE users SET coins = coins + ? WHERE id = ?`, amount, userID)
-	return err
+	// The balance is checked in the UPDATE so that concurrent spending
+	// can't overdraw it.
+	res, err := s.db.Exec(`UPDATE users SET coins = coins + ? WHERE id = ? AND coins + ? >= 0`, amount, userID, amount)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n > 0 {
+		return err
+	}
+	if _, err := s.FindUser(userID); err != nil {
+		return err
+	}
+	return db.ErrInsufficientCoins
 }
 
 func (s *SQLiteStore) AddToInventory(userID string, itemID string) error {
@@ -258,3 +330,47 @@ func (s *SQLiteStore) GetInventory(userID string) ([]string, error) {
 	}
 	return items, nil
 }
+
+func (s *SQLiteStore) SaveTournamentResults(results []*db.TournamentResult) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare(`INSERT OR REPLACE INTO tournament_results
+        (tournament_id, name, format, user_id, rank, score, games, finished_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+
+	for _, r := range results {
+		_, err = stmt.Exec(r.TournamentID, r.Name, r.Format, r.UserID, r.Rank, r.Score, r.Games, r.FinishedAt)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) GetTournamentResults(tournamentID string) ([]*db.TournamentResult, error) {
+	rows, err := s.db.Query(`SELECT tournament_id, name, format, user_id, rank, score, games, finished_at
+        FROM tournament_results WHERE tournament_id = ? ORDER BY rank ASC`, tournamentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []*db.TournamentResult
+	for rows.Next() {
+		var r db.TournamentResult
+		if err := rows.Scan(&r.TournamentID, &r.Name, &r.Format, &r.UserID, &r.Rank, &r.Score, &r.Games, &r.FinishedAt); err != nil {
+			return nil, err
+		}
+		results = append(results, &r)
+	}
+	return results, rows.Err()
+}
@@ -0,0 +1,14 @@
+package sqlite
+
+import (
+	"testing"
+
+	"caro_chess_server/db"
+	"caro_chess_server/db/dbtest"
+)
+
+func TestUserRepositoryContract(t *testing.T) {
+	dbtest.RunUserRepository(t, func(t *testing.T) db.UserRepository {
+		return newTestStore(t)
+	})
+}
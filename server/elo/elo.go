@@ -4,6 +4,9 @@ import "math"
 
 const K = 32
 
+// DefaultRating is the rating every new player starts with.
+const DefaultRating = 1200
+
 // CalculateRatings returns the new ratings for player A and player B.
 // actualScoreA is 1.0 for A win, 0.0 for B win, 0.5 for draw.
 func CalculateRatings(ratingA, ratingB int, actualScoreA float64) (int, int) {
@@ -1,5 +1,13 @@
 package engine
 
+import "errors"
+
+var (
+	ErrGameOver     = errors.New("game is over")
+	ErrOutOfBounds  = errors.New("position is off the board")
+	ErrCellOccupied = errors.New("cell is occupied")
+)
+
 type GameEngine struct {
 	Board         *Board     `json:"board"`
 	CurrentPlayer Player     `json:"currentPlayer"`
@@ -23,19 +31,25 @@ func NewGameEngine(rows, columns int, rule GameRule) *GameEngine {
 }
 
 func (ge *GameEngine) PlacePiece(pos Position) bool {
+	return ge.Place(pos) == nil
+}
+
+// Place plays pos for the current player, returning why the move was
+// rejected if it is not legal.
+func (ge *GameEngine) Place(pos Position) error {
 	if ge.IsGameOver {
-		return false
+		return ErrGameOver
 	}
 	if !ge.IsValidPosition(pos) {
-		return false
+		return ErrOutOfBounds
 	}
 	if !ge.Board.Cells[pos.Y][pos.X].IsEmpty() {
-		return false
+		return ErrCellOccupied
 	}
 
 	ge.applyMove(pos)
 	ge.History = append(ge.History, pos)
-	return true
+	return nil
 }
 
 func (ge *GameEngine) applyMove(pos Position) {
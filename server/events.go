@@ -0,0 +1,175 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// maxSessionEvents bounds the per-session event log used to resume clients.
+// Anyone further behind gets a full snapshot instead.
+const maxSessionEvents = 256
+
+// sequenced is implemented by server messages that belong to a session's
+// event stream.
+type sequenced interface {
+	setSeq(seq uint64)
+}
+
+// seqNo is embedded by session events.
+type seqNo struct {
+	Seq uint64 `json:"seq,omitempty" msgpack:"seq,omitempty"`
+}
+
+func (s *seqNo) setSeq(seq uint64) { s.Seq = seq }
+
+type sessionEvent struct {
+	seq   uint64
+	data  *wireMessage
+	moves int  // Moves made up to and including this event
+	final bool // GAME_OVER
+}
+
+// record stamps msg with the session's next sequence number, appends it to
+// the event log and returns the encoded event.
+func (gs *GameSession) record(msg sequenced) *wireMessage {
+	return gs.recordEvent(msg).data
+}
+
+func (gs *GameSession) recordEvent(msg sequenced) sessionEvent {
+	gs.logMu.Lock()
+	defer gs.logMu.Unlock()
+
+	gs.seq++
+	gs.active = time.Now()
+	msg.setSeq(gs.seq)
+	final := false
+	switch m := msg.(type) {
+	case *MoveMadeMessage:
+		gs.moves++
+	case *GameOverMessage:
+		result := *m
+		gs.result = &result
+		final = true
+	}
+
+	event := sessionEvent{seq: gs.seq, data: encode(msg), moves: gs.moves, final: final}
+	gs.events = append(gs.events, event)
+	if len(gs.events) > maxSessionEvents {
+		gs.events = gs.events[len(gs.events)-maxSessionEvents:]
+	}
+	return event
+}
+
+// publish records msg and sends it to the players and spectators.
+func (gs *GameSession) publish(msg sequenced) {
+	gs.publishExcept(msg, nil)
+}
+
+// publishExcept is publish for events the sender has already been told
+// about, e.g. in a reply.
+func (gs *GameSession) publishExcept(msg sequenced, skip *Client) {
+	gs.broadcast(gs.recordEvent(msg), skip)
+}
+
+// eventsSince returns the events after lastSeq and the latest sequence
+// number. ok is false if some of the events have already been dropped from
+// the log, or lastSeq is not from this session.
+func (gs *GameSession) eventsSince(lastSeq uint64) (events []*wireMessage, seq uint64, ok bool) {
+	return gs.eventsBetween(lastSeq, math.MaxUint64)
+}
+
+// eventsBetween is eventsSince for events up to upTo only.
+func (gs *GameSession) eventsBetween(lastSeq, upTo uint64) (events []*wireMessage, seq uint64, ok bool) {
+	gs.logMu.Lock()
+	defer gs.logMu.Unlock()
+
+	seq = gs.seq
+	if upTo < seq {
+		seq = upTo
+	}
+	if lastSeq > seq {
+		return nil, seq, false
+	}
+	if lastSeq == seq {
+		return nil, seq, true
+	}
+	if len(gs.events) == 0 || gs.events[0].seq > lastSeq+1 {
+		return nil, seq, false
+	}
+	for _, e := range gs.events {
+		if e.seq > lastSeq && e.seq <= seq {
+			events = append(events, e.data)
+		}
+	}
+	return events, seq, true
+}
+
+// lastEvent returns the sequence number of the latest event and the game
+// result, if the game is over.
+func (gs *GameSession) lastEvent() (uint64, *GameOverMessage) {
+	gs.logMu.Lock()
+	defer gs.logMu.Unlock()
+	return gs.seq, gs.result
+}
+
+// touch marks the session as active, e.g. when someone joins.
+func (gs *GameSession) touch() {
+	gs.logMu.Lock()
+	defer gs.logMu.Unlock()
+	gs.active = time.Now()
+}
+
+func (gs *GameSession) lastActive() time.Time {
+	gs.logMu.Lock()
+	defer gs.logMu.Unlock()
+	return gs.active
+}
+
+// roomState returns the session's state as a room: waiting for an opponent,
+// playing, finished or closed by the host or the server.
+func (gs *GameSession) roomState() string {
+	gs.Lock()
+	defer gs.Unlock()
+	return gs.roomStateLocked()
+}
+
+// roomStateLocked is roomState for callers that hold the session lock.
+func (gs *GameSession) roomStateLocked() string {
+	gs.logMu.Lock()
+	defer gs.logMu.Unlock()
+	switch {
+	case gs.closed:
+		return RoomClosed
+	case gs.finished || gs.result != nil:
+		return RoomFinished
+	case gs.PlayerOID == "":
+		return RoomWaiting
+	default:
+		return RoomPlaying
+	}
+}
+
+// clocks returns the time left for each player right now, counting the
+// time the player to move has used so far.
+func (gs *GameSession) clocks() (x, o time.Duration) {
+	gs.Lock()
+	defer gs.Unlock()
+
+	x, o = gs.TotalTimeX, gs.TotalTimeO
+	if gs.TurnTimer == nil {
+		return x, o // Not running
+	}
+	elapsed := time.Since(gs.LastMoveTime)
+	if gs.Turn == "X" {
+		x -= elapsed
+	} else {
+		o -= elapsed
+	}
+	if x < 0 {
+		x = 0
+	}
+	if o < 0 {
+		o = 0
+	}
+	return x, o
+}
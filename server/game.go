@@ -6,14 +6,29 @@ import (
 	"time"
 )
 
+// GameSession is one game, in a room or started by the matchmaker. It is
+// used by both players' connections, the spectators' connections and by
+// timers, so access is locked:
+//
+//   - the embedded mutex guards the seats, the engine, the clocks, the
+//     timers, the callbacks and the room settings;
+//   - spectatorsMu guards the spectators and the spectator feed;
+//   - logMu guards the event log (see events.go).
+//
+// The locks are taken in that order. None of them is held while calling
+// the matchmaker, the lobby or a callback, or while sending to a player.
+// Fields marked "set once" are written before the session is shared and
+// only read afterwards.
 type GameSession struct {
 	sync.Mutex
+	ID        string // Set once, when the game starts; see RegisterSession
 	ClientX   *Client
 	ClientO   *Client
-	PlayerXID string
-	PlayerOID string
+	PlayerXID string // Set once
+	PlayerOID string // Set once the O seat is taken
 	Turn      string
-	Engine    *engine.GameEngine // Engine has its own lock? No, we should protect session
+	Engine    *engine.GameEngine
+	finished  bool // The result has been decided; see finish
 
 	TimerX *time.Timer // For disconnect
 	TimerO *time.Timer // For disconnect
@@ -23,11 +38,49 @@ type GameSession struct {
 	TotalTimeO      time.Duration
 	Increment       time.Duration
 	MoveTimeLimit   time.Duration // Strict limit per move (e.g., 30s)
+	InitialTime     time.Duration // Each player's clock at the start
 	LastMoveTime    time.Time
-	TurnTimer       *time.Timer         // Active timer for the current player's move calculation
-	TimeoutCallback func(winner string) // Callback to end game on timeout
-
-	Spectators map[*Client]bool
+	TurnTimer       *time.Timer           // Active timer for the current player's move calculation
+	TimeoutCallback func(winner string)   // Callback to end game on timeout
+	OnGameEnd       func(winnerID string) // Called after the result is recorded; "" for a draw
+
+	// Rooms only
+	Code         string          // Set once
+	HostID       string          // Set once; player who created the room, empty for reserved rooms
+	Public       bool            // Listed in the lobby
+	lobby        *Lobby          // Set once, if the lobby is enabled
+	passwordHash []byte          // See setPassword
+	kicked       map[string]bool // Users the host removed
+	ratingX      int             // Shown in the lobby; read as X sat down
+	ratingO      int             // Shown in the lobby; read as O sat down
+
+	Spectators   map[*Client]bool // Guarded by spectatorsMu
+	spectatorsMu sync.Mutex
+
+	// Spectators see events only after this long and/or this many further
+	// moves, so they can't feed the players suggestions. 0 is live. These
+	// are guarded by spectatorsMu.
+	SpectatorDelay      time.Duration
+	SpectatorDelayMoves int
+	delayed             []delayedEvent
+	delayTimer          *time.Timer
+	shownSeq            uint64 // Latest event spectators have seen
+	shownMoves          int
+
+	// Event log for resuming clients; see events.go
+	logMu  sync.Mutex
+	seq    uint64
+	moves  int
+	events []sessionEvent
+	result *GameOverMessage
+	active time.Time // Last join or event
+	closed bool
+
+	// Arena games only
+	ArenaID     string // Set once
+	ArenaGameID string // Set once
+	BerserkX    bool
+	BerserkO    bool
 }
 
 func newGameSession(x, o *Client, totalTime, increment, moveLimit time.Duration, rule engine.GameRule) *GameSession {
@@ -43,15 +96,143 @@ func newGameSession(x, o *Client, totalTime, increment, moveLimit time.Duration,
 		TotalTimeO:    totalTime,
 		Increment:     increment,
 		MoveTimeLimit: moveLimit,
+		InitialTime:   totalTime,
 		LastMoveTime:  time.Now(),
 	}
 }
 
+// players returns the connected players.
+func (gs *GameSession) players() (x, o *Client) {
+	gs.Lock()
+	defer gs.Unlock()
+	return gs.ClientX, gs.ClientO
+}
+
+// playerIDs returns the users seated as X and O.
+func (gs *GameSession) playerIDs() (x, o string) {
+	gs.Lock()
+	defer gs.Unlock()
+	return gs.PlayerXID, gs.PlayerOID
+}
+
+// colorOf returns "X" or "O" if c is seated, otherwise "".
+func (gs *GameSession) colorOf(c *Client) string {
+	gs.Lock()
+	defer gs.Unlock()
+	switch c {
+	case gs.ClientX:
+		return "X"
+	case gs.ClientO:
+		return "O"
+	}
+	return ""
+}
+
+// opponentOf returns the connected opponent of c, if any.
+func (gs *GameSession) opponentOf(c *Client) *Client {
+	gs.Lock()
+	defer gs.Unlock()
+	if c == gs.ClientX {
+		return gs.ClientO
+	}
+	return gs.ClientX
+}
+
+// unseat frees c's seat, keeping the player's place in the game. It reports
+// whether c was seated and as which color.
+func (gs *GameSession) unseat(c *Client) (isX, ok bool) {
+	gs.Lock()
+	defer gs.Unlock()
+	switch c {
+	case gs.ClientX:
+		gs.ClientX = nil
+		return true, true
+	case gs.ClientO:
+		gs.ClientO = nil
+		return false, true
+	}
+	return false, false
+}
+
+// sessionState is a consistent copy of the parts of a session that clients
+// are shown.
+type sessionState struct {
+	PlayerX, PlayerO string
+	History          []engine.Position
+	Turn             engine.Player
+	IsGameOver       bool
+	Winner           *engine.Player
+	WinningLine      []engine.Position
+	Rule             engine.GameRule
+	InitialTime      time.Duration
+	Increment        time.Duration
+	TurnLimit        time.Duration
+	TimeX, TimeO     time.Duration // As of the last move
+}
+
+func (gs *GameSession) state() sessionState {
+	gs.Lock()
+	defer gs.Unlock()
+	return sessionState{
+		PlayerX:     gs.PlayerXID,
+		PlayerO:     gs.PlayerOID,
+		History:     append([]engine.Position(nil), gs.Engine.History...),
+		Turn:        gs.Engine.CurrentPlayer,
+		IsGameOver:  gs.Engine.IsGameOver,
+		Winner:      gs.Engine.Winner,
+		WinningLine: gs.Engine.WinningLine,
+		Rule:        gs.Engine.Rule,
+		InitialTime: gs.InitialTime,
+		Increment:   gs.Increment,
+		TurnLimit:   gs.MoveTimeLimit,
+		TimeX:       gs.TotalTimeX,
+		TimeO:       gs.TotalTimeO,
+	}
+}
+
+// visibility reports whether the room is listed and password protected.
+func (gs *GameSession) visibility() (public, hasPassword bool) {
+	gs.Lock()
+	defer gs.Unlock()
+	return gs.Public, gs.passwordHash != nil
+}
+
+// sendPlayers delivers a notice to both connected players. Notices are
+// dropped for players who can't keep up.
+func (gs *GameSession) sendPlayers(msg *wireMessage) {
+	x, o := gs.players()
+	if x != nil {
+		x.enqueue(msg, dropIfFull)
+	}
+	if o != nil {
+		o.enqueue(msg, dropIfFull)
+	}
+}
+
+// finish marks the result as decided and stops the clocks. Only the first
+// caller gets true; everyone else must leave the game alone, so a game that
+// ends in several ways at once, e.g. a timeout during a resignation, is
+// scored once.
+func (gs *GameSession) finish() bool {
+	gs.Lock()
+	defer gs.Unlock()
+	if gs.finished {
+		return false
+	}
+	gs.finished = true
+	gs.stopTimers()
+	gs.touch() // Finished rooms are kept for a while from now
+	return true
+}
+
 // StartDisconnectTimer starts a timer that will forfeit the game if not stopped.
 // callback is the function to run if timeout occurs ( forfeit ).
 func (gs *GameSession) StartDisconnectTimer(isX bool, duration time.Duration, callback func()) {
 	gs.Lock()
 	defer gs.Unlock()
+	if gs.finished {
+		return
+	}
 
 	if isX {
 		if gs.TimerX != nil {
@@ -70,7 +251,10 @@ func (gs *GameSession) StartDisconnectTimer(isX bool, duration time.Duration, ca
 func (gs *GameSession) StopDisconnectTimer(isX bool) {
 	gs.Lock()
 	defer gs.Unlock()
+	gs.stopDisconnectTimer(isX)
+}
 
+func (gs *GameSession) stopDisconnectTimer(isX bool) {
 	if isX {
 		if gs.TimerX != nil {
 			gs.TimerX.Stop()
@@ -87,6 +271,9 @@ func (gs *GameSession) StopDisconnectTimer(isX bool) {
 func (gs *GameSession) StartGame() {
 	gs.Lock()
 	defer gs.Unlock()
+	if gs.finished {
+		return
+	}
 	gs.LastMoveTime = time.Now()
 	gs.startTurnTimer()
 }
@@ -102,25 +289,34 @@ func (gs *GameSession) startTurnTimer() {
 		bank = gs.TotalTimeO
 	}
 
-	// Determine strict limit
+	// Determine strict limit, less what the player has already used this
+	// turn (the timer is re-armed mid-turn when a player berserks).
 	waitDuration := gs.MoveTimeLimit
 	if bank < waitDuration {
 		waitDuration = bank
 	}
+	waitDuration -= time.Since(gs.LastMoveTime)
+	if waitDuration < 0 {
+		waitDuration = 0
+	}
 
+	turn, moves := gs.Turn, len(gs.Engine.History)
 	gs.TurnTimer = time.AfterFunc(waitDuration, func() {
-		gs.handleTimeout(gs.Turn)
+		gs.handleTimeout(turn, moves)
 	})
 }
 
-func (gs *GameSession) handleTimeout(turnWhoTimedOut string) {
+// handleTimeout ends the game if the player to move after the given number
+// of moves still hasn't moved.
+func (gs *GameSession) handleTimeout(turnWhoTimedOut string, moves int) {
 	gs.Lock()
-	defer gs.Unlock()
-
-	// Verify turn hasn't changed (race condition)
-	if gs.Turn != turnWhoTimedOut {
+	// Verify the move hasn't been made since (race condition)
+	if gs.finished || gs.Turn != turnWhoTimedOut || len(gs.Engine.History) != moves {
+		gs.Unlock()
 		return
 	}
+	callback := gs.TimeoutCallback
+	gs.Unlock()
 
 	// Determine winner (Opponent)
 	winnerStr := "O"
@@ -128,15 +324,22 @@ func (gs *GameSession) handleTimeout(turnWhoTimedOut string) {
 		winnerStr = "X"
 	}
 
-	if gs.TimeoutCallback != nil {
-		gs.TimeoutCallback(winnerStr)
+	// Called without the lock: ending the game stops the timers, which
+	// takes it again.
+	if callback != nil {
+		callback(winnerStr)
 	}
 }
 
 func (gs *GameSession) StopGame() {
 	gs.Lock()
 	defer gs.Unlock()
+	gs.stopTimers()
+}
 
+// stopTimers stops the clock and the disconnect timers. Callers hold the
+// lock.
+func (gs *GameSession) stopTimers() {
 	if gs.TurnTimer != nil {
 		gs.TurnTimer.Stop()
 		gs.TurnTimer = nil
@@ -152,49 +355,99 @@ func (gs *GameSession) StopGame() {
 	}
 }
 
-// MakeMove processes a move and updates clocks
-func (gs *GameSession) MakeMove(x, y int) bool {
-
+// MakeMove plays a move for c and updates the clocks. It returns the move
+// as announced to everyone, or why it was rejected.
+func (gs *GameSession) MakeMove(c *Client, x, y int) (*MoveMadeMessage, error) {
 	gs.Lock()
 	defer gs.Unlock()
 
 	current := gs.Engine.CurrentPlayer
-	// 1. Check validity via Engine first (don't update clock if invalid)
-	// NOTE: validation happens in client.go usually, but we should do it here.
-	// However, `PlacePiece` implementation in `engine` does it all.
-	// We need to know IF it was successful.
-
-	// 2. Validate Turn (Engine does this?)
-	// GameEngine.PlacePiece returns true/false.
-
-	success := gs.Engine.PlacePiece(engine.Position{X: x, Y: y})
-
-	// Actually PlacePiece checks validity.
-
-	if success {
-		// 3. Update Clock for the player who JUST moved (current)
-		now := time.Now()
-		elapsed := now.Sub(gs.LastMoveTime)
-
-		if current == engine.PlayerX {
-			gs.TotalTimeX = gs.TotalTimeX - elapsed + gs.Increment
-			if gs.TotalTimeX < 0 {
-				// Should have timed out already, but just in case
-				gs.TotalTimeX = 0
-			}
-		} else {
-			gs.TotalTimeO = gs.TotalTimeO - elapsed + gs.Increment
-			if gs.TotalTimeO < 0 {
-				gs.TotalTimeO = 0
-			}
+	switch {
+	case c != gs.ClientX && c != gs.ClientO:
+		return nil, errNotAPlayer
+	case gs.finished:
+		return nil, engine.ErrGameOver
+	case (c == gs.ClientX) != (current == engine.PlayerX):
+		return nil, errNotYourTurn
+	}
+
+	// The engine rejects illegal moves before the clock is touched.
+	if err := gs.Engine.Place(engine.Position{X: x, Y: y}); err != nil {
+		return nil, err
+	}
+
+	// Update Clock for the player who JUST moved (current)
+	now := time.Now()
+	elapsed := now.Sub(gs.LastMoveTime)
+
+	if current == engine.PlayerX {
+		gs.TotalTimeX = gs.TotalTimeX - elapsed + gs.Increment
+		if gs.TotalTimeX < 0 {
+			// Should have timed out already, but just in case
+			gs.TotalTimeX = 0
 		}
+	} else {
+		gs.TotalTimeO = gs.TotalTimeO - elapsed + gs.Increment
+		if gs.TotalTimeO < 0 {
+			gs.TotalTimeO = 0
+		}
+	}
 
-		gs.LastMoveTime = now
-		gs.Turn = string(gs.Engine.CurrentPlayer) // Update Session Turn
+	gs.LastMoveTime = now
+	gs.Turn = string(gs.Engine.CurrentPlayer) // Update Session Turn
 
-		// 4. Start Timer for Next Player
+	// Start Timer for Next Player
+	if !gs.Engine.IsGameOver {
 		gs.startTurnTimer()
 	}
 
-	return success
+	return &MoveMadeMessage{
+		Type:  MsgMoveMade,
+		X:     x,
+		Y:     y,
+		TimeX: gs.TotalTimeX.Seconds(),
+		TimeO: gs.TotalTimeO.Seconds(),
+	}, nil
+}
+
+// Berserk halves a player's clock. It is only allowed once per player and
+// before that player has made a move. It returns the announcement.
+func (gs *GameSession) Berserk(c *Client) (*BerserkMessage, bool) {
+	gs.Lock()
+	defer gs.Unlock()
+
+	if c != gs.ClientX && c != gs.ClientO {
+		return nil, false
+	}
+	isX := c == gs.ClientX
+
+	moves := len(gs.Engine.History)
+	if isX {
+		if gs.BerserkX || moves >= 1 {
+			return nil, false
+		}
+		gs.BerserkX = true
+		gs.TotalTimeX /= 2
+	} else {
+		if gs.BerserkO || moves >= 2 {
+			return nil, false
+		}
+		gs.BerserkO = true
+		gs.TotalTimeO /= 2
+	}
+
+	// Re-arm the running timer so it respects the smaller bank.
+	color := "O"
+	if isX {
+		color = "X"
+	}
+	if gs.TurnTimer != nil && gs.Turn == color {
+		gs.startTurnTimer()
+	}
+	return &BerserkMessage{
+		Type:  MsgBerserk,
+		Color: color,
+		TimeX: gs.TotalTimeX.Seconds(),
+		TimeO: gs.TotalTimeO.Seconds(),
+	}, true
 }
@@ -0,0 +1,630 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"time"
+	"unicode/utf8"
+
+	"caro_chess_server/db"
+	"caro_chess_server/engine"
+)
+
+var errFeatureDisabled = errors.New("not available on this server")
+
+type handlerFunc func(c *Client, req *request) error
+
+// handlers maps client message types to their handlers. A handler either
+// replies to the request itself or returns an error; requests that carry a
+// request_id and got no reply are acknowledged with ACK.
+var handlers = map[string]handlerFunc{
+	MsgHello:            (*Client).handleHello,
+	MsgFindMatch:        (*Client).handleFindMatch,
+	MsgCreateRoom:       (*Client).handleCreateRoom,
+	MsgJoinRoom:         (*Client).handleJoinRoom,
+	MsgLeaveRoom:        (*Client).handleLeaveRoom,
+	MsgMove:             (*Client).handleMove,
+	MsgWinClaim:         (*Client).handleWinClaim,
+	MsgChat:             (*Client).handleChat,
+	MsgArenaJoin:        (*Client).handleArenaJoin,
+	MsgBerserk:          (*Client).handleBerserk,
+	MsgChallenge:        (*Client).handleChallenge,
+	MsgChallengeAccept:  (*Client).handleChallengeAnswer,
+	MsgChallengeDecline: (*Client).handleChallengeAnswer,
+	MsgChallengeCancel:  (*Client).handleChallengeAnswer,
+	MsgResume:           (*Client).handleResume,
+	MsgLobbySubscribe:   (*Client).handleLobbySubscribe,
+	MsgLobbyUnsubscribe: (*Client).handleLobbyUnsubscribe,
+	MsgUpdateRoom:       (*Client).handleUpdateRoom,
+	MsgKickSpectator:    (*Client).handleKickSpectator,
+	MsgCloseRoom:        (*Client).handleCloseRoom,
+}
+
+// handleMessage decodes one client message and dispatches it.
+func (c *Client) handleMessage(data []byte) {
+	req := &request{raw: data}
+	if err := json.Unmarshal(data, &req.Envelope); err != nil {
+		c.sendError(req, errBadRequest)
+		return
+	}
+	if req.Version > ProtocolVersion {
+		c.sendError(req, errUnsupportedVersion)
+		return
+	}
+
+	handle, ok := handlers[req.Type]
+	if !ok {
+		c.sendError(req, errUnknownType)
+		return
+	}
+	if err := handle(c, req); err != nil {
+		c.sendError(req, err)
+		return
+	}
+	if !req.replied && req.RequestID != "" {
+		c.reply(req, &AckMessage{Type: MsgAck})
+	}
+}
+
+// reply sends the response to req, echoing its request ID.
+func (c *Client) reply(req *request, msg replier) {
+	msg.setRequestID(req.RequestID)
+	req.replied = true
+	c.sendMessage(msg)
+}
+
+func (c *Client) sendError(req *request, err error) {
+	c.reply(req, newErrorMessage(err))
+}
+
+func newErrorMessage(err error) *ErrorMessage {
+	return &ErrorMessage{Type: MsgError, Code: errorCode(err), Message: err.Error()}
+}
+
+// sendMessage sends msg to the client, disconnecting it if it has fallen
+// too far behind to take it.
+func (c *Client) sendMessage(msg interface{}) {
+	c.enqueue(encode(msg), closeIfFull)
+}
+
+func (c *Client) handleHello(req *request) error {
+	var hello HelloRequest
+	if err := req.decode(&hello); err != nil {
+		return err
+	}
+	if hello.Version < 1 || hello.Version > ProtocolVersion {
+		return errUnsupportedVersion
+	}
+	c.Version = hello.Version
+	c.reply(req, &WelcomeMessage{Type: MsgWelcome, Version: ProtocolVersion})
+	return nil
+}
+
+func (c *Client) handleMove(req *request) error {
+	var move MoveRequest
+	if err := req.decode(&move); err != nil {
+		return err
+	}
+	if move.X == nil || move.Y == nil {
+		return errBadRequest
+	}
+	session := c.session()
+	if session == nil {
+		return errNotInGame
+	}
+
+	made, err := session.MakeMove(c, *move.X, *move.Y)
+	if err != nil {
+		return err
+	}
+	session.publishExcept(made, c)
+	c.reply(req, made)
+
+	// Check Game Over
+	if st := session.state(); st.IsGameOver {
+		winnerStr := "DRAW"
+		winnerColor := ""
+		if st.Winner != nil {
+			winnerStr = string(*st.Winner)
+			winnerColor = winnerStr
+		}
+
+		// conclude records the match and updates ELO
+		c.mm.conclude(session, winnerColor, &GameOverMessage{
+			Winner:      winnerStr,
+			WinningLine: st.WinningLine,
+		}, nil)
+	}
+	return nil
+}
+
+// handleWinClaim ends the game only if the engine agrees the claimant has
+// won. Wins are normally ended as soon as the winning move is played.
+func (c *Client) handleWinClaim(req *request) error {
+	session := c.session()
+	if session == nil {
+		return errNotInGame
+	}
+	color := session.colorOf(c)
+	if color == "" {
+		return errNotAPlayer
+	}
+	if st := session.state(); !st.IsGameOver || st.Winner == nil || string(*st.Winner) != color {
+		return errNoWin
+	}
+	c.mm.endGame(session, c)
+	return nil
+}
+
+func (c *Client) handleFindMatch(req *request) error {
+	var find FindMatchRequest
+	if err := req.decode(&find); err != nil {
+		return err
+	}
+	if err := c.mm.sanctions.check(c.ID, db.SanctionBan, db.SanctionSuspend); err != nil {
+		return err
+	}
+	rule := find.Rule
+	if rule == "" {
+		rule = engine.RuleStandard
+	}
+	c.stopWatching()
+	c.setQueue(rule, "")
+	c.mm.addClient <- c
+	return nil
+}
+
+func (c *Client) handleArenaJoin(req *request) error {
+	var join ArenaJoinRequest
+	if err := req.decode(&join); err != nil {
+		return err
+	}
+	if join.ArenaID == "" {
+		return errBadRequest
+	}
+	if c.mm.arenas == nil {
+		return errFeatureDisabled
+	}
+	if err := c.mm.sanctions.check(c.ID, db.SanctionBan, db.SanctionSuspend); err != nil {
+		return err
+	}
+	if err := c.mm.arenas.CanPair(join.ArenaID, c.ID); err != nil {
+		return err
+	}
+	rule, _ := c.queue()
+	c.setQueue(rule, join.ArenaID)
+	c.mm.addClient <- c
+	return nil
+}
+
+func (c *Client) handleBerserk(req *request) error {
+	session := c.session()
+	if session == nil {
+		return errNotInGame
+	}
+	if session.ArenaID == "" {
+		return errBerserkNotAllowed
+	}
+	berserk, ok := session.Berserk(c)
+	if !ok {
+		return errBerserkNotAllowed
+	}
+	if err := c.mm.arenas.Berserk(session.ArenaID, session.ArenaGameID, c.ID); err != nil {
+		log.Printf("Arena %s: berserk by %s not recorded: %v", session.ArenaID, c.ID, err)
+	}
+	session.publish(berserk)
+	return nil
+}
+
+func (c *Client) handleCreateRoom(req *request) error {
+	var create CreateRoomRequest
+	if err := req.decode(&create); err != nil {
+		return err
+	}
+	totalTime, increment, turnLimit, rule := create.resolve()
+	if create.SpectatorDelay < 0 || create.SpectatorDelayMoves < 0 {
+		return errBadRequest
+	}
+	switch create.Visibility {
+	case "":
+		create.Visibility = VisibilityPrivate
+	case VisibilityPrivate:
+	case VisibilityPublic:
+		if c.rm.lobby == nil {
+			return errFeatureDisabled
+		}
+		if create.Password != "" {
+			return errBadRequest // Only private rooms have passwords
+		}
+	default:
+		return errBadRequest
+	}
+
+	c.stopWatching()
+	_, err := c.rm.createRoom(c, totalTime, increment, turnLimit, rule)
+	if err != nil {
+		return err
+	}
+	session := c.session()
+	session.setSpectatorDelay(time.Duration(create.SpectatorDelay*float64(time.Second)), create.SpectatorDelayMoves)
+	session.Lock()
+	session.Public = create.Visibility == VisibilityPublic
+	session.setPassword(create.Password)
+	session.Unlock()
+	session.listingChanged()
+	c.reply(req, roomSettings(MsgRoomCreated, session))
+	return nil
+}
+
+// roomSettings describes a room's settings for ROOM_CREATED and
+// ROOM_UPDATED.
+func roomSettings(typ string, session *GameSession) *RoomCreatedMessage {
+	public, hasPassword := session.visibility()
+	visibility := VisibilityPrivate
+	if public {
+		visibility = VisibilityPublic
+	}
+	st := session.state()
+	delay, delayMoves := session.spectatorDelay()
+	return &RoomCreatedMessage{
+		Type:                typ,
+		Code:                session.Code,
+		Visibility:          visibility,
+		HasPassword:         hasPassword,
+		Rule:                st.Rule,
+		TotalTime:           st.InitialTime.Seconds(),
+		Increment:           st.Increment.Seconds(),
+		TurnLimit:           st.TurnLimit.Seconds(),
+		SpectatorDelay:      delay.Seconds(),
+		SpectatorDelayMoves: delayMoves,
+	}
+}
+
+// handleUpdateRoom lets the host change the settings of a room nobody has
+// joined yet.
+func (c *Client) handleUpdateRoom(req *request) error {
+	var update UpdateRoomRequest
+	if err := req.decode(&update); err != nil {
+		return err
+	}
+	session, err := c.hostedRoom()
+	if err != nil {
+		return err
+	}
+	if (update.SpectatorDelay != nil && *update.SpectatorDelay < 0) || (update.SpectatorDelayMoves != nil && *update.SpectatorDelayMoves < 0) {
+		return errBadRequest
+	}
+	if update.Visibility == VisibilityPublic && c.rm.lobby == nil {
+		return errFeatureDisabled
+	}
+	if update.Visibility != "" && update.Visibility != VisibilityPrivate && update.Visibility != VisibilityPublic {
+		return errBadRequest
+	}
+
+	seconds := func(v *float64, current time.Duration) time.Duration {
+		if v == nil {
+			return current
+		}
+		return time.Duration(*v * float64(time.Second))
+	}
+
+	// The checks and the update happen under one lock so nobody can join
+	// in between.
+	session.Lock()
+	if session.roomStateLocked() != RoomWaiting {
+		session.Unlock()
+		return errRoomStarted
+	}
+	wasPublic := session.Public
+	public := wasPublic
+	if update.Visibility != "" {
+		public = update.Visibility == VisibilityPublic
+	}
+	hasPassword := session.passwordHash != nil
+	if update.Password != nil {
+		hasPassword = *update.Password != ""
+	}
+	if public && hasPassword {
+		session.Unlock()
+		return errBadRequest // Only private rooms have passwords
+	}
+	session.InitialTime = seconds(update.TotalTime, session.InitialTime)
+	session.TotalTimeX, session.TotalTimeO = session.InitialTime, session.InitialTime
+	session.Increment = seconds(update.Increment, session.Increment)
+	session.MoveTimeLimit = seconds(update.TurnLimit, session.MoveTimeLimit)
+	if update.Rule != "" {
+		session.Engine = engine.NewGameEngine(15, 15, update.Rule)
+	}
+	if update.Password != nil {
+		session.setPassword(*update.Password)
+	}
+	session.Public = public
+	session.Unlock()
+
+	delay, delayMoves := session.spectatorDelay()
+	if update.SpectatorDelayMoves != nil {
+		delayMoves = *update.SpectatorDelayMoves
+	}
+	session.setSpectatorDelay(seconds(update.SpectatorDelay, delay), delayMoves)
+
+	// listingChanged ignores private rooms, so a room going private is
+	// taken out of the lobby here.
+	if wasPublic && !public {
+		c.rm.lobby.roomChanged(session)
+	}
+	session.listingChanged()
+	session.touch()
+
+	updated := roomSettings(MsgRoomUpdated, session)
+	c.reply(req, updated)
+	session.sendSpectators(encode(updated))
+	return nil
+}
+
+func (c *Client) handleKickSpectator(req *request) error {
+	var kick KickSpectatorRequest
+	if err := req.decode(&kick); err != nil {
+		return err
+	}
+	if kick.UserID == "" {
+		return errBadRequest
+	}
+	return c.rm.kick(c, kick.UserID)
+}
+
+func (c *Client) handleCloseRoom(req *request) error {
+	return c.rm.close(c)
+}
+
+func (c *Client) handleJoinRoom(req *request) error {
+	var join JoinRoomRequest
+	if err := req.decode(&join); err != nil {
+		return err
+	}
+	if join.Code == "" || (join.Role != "" && join.Role != RolePlayer && join.Role != RoleSpectator) {
+		return errBadRequest
+	}
+
+	c.stopWatching()
+	session, spectating, err := c.rm.joinRoomAs(join.Code, c, join.Role, join.Password)
+	if err != nil {
+		return err
+	}
+	if spectating {
+		c.startWatching(req, session)
+		return nil
+	}
+
+	// Register with matchmaker to track session/ELO
+	c.mm.RegisterSession(session)
+
+	// Check state
+	if len(session.state().History) > 0 {
+		c.reply(req, gameSync(c, session))
+	} else if x, o := session.players(); x != nil && o != nil {
+		// New game or start
+		session.StartGame() // Start Timers
+		sendMatchFound(session)
+	}
+	return nil
+}
+
+// handleResume puts a reconnecting client back in its room and replays the
+// events it missed, or sends a snapshot if they are no longer in the log.
+func (c *Client) handleResume(req *request) error {
+	var resume ResumeRequest
+	if err := req.decode(&resume); err != nil {
+		return err
+	}
+	if resume.Room == "" {
+		return errBadRequest
+	}
+
+	c.stopWatching()
+	session, spectating, err := c.rm.joinRoomAs(resume.Room, c, "", resume.Password)
+	if err != nil {
+		return err
+	}
+	if spectating {
+		session.sendPlayers(encode(SpectatorCountMessage{Type: MsgSpectatorCount, Spectators: session.spectatorCount()}))
+	} else if _, result := session.lastEvent(); result != nil {
+		c.leaveSession(session) // Nothing left to play
+	} else {
+		c.mm.RegisterSession(session)
+	}
+
+	var events []*wireMessage
+	var seq uint64
+	ok := false
+	if resume.LastSeq != nil {
+		upTo := uint64(math.MaxUint64)
+		if spectating {
+			upTo, _ = session.spectatorView() // Don't skip the spectator delay
+		}
+		events, seq, ok = session.eventsBetween(*resume.LastSeq, upTo)
+	}
+	if !ok {
+		c.reply(req, gameSync(c, session))
+		return nil
+	}
+
+	for _, event := range events {
+		c.sendEvent(session, event)
+	}
+	timeX, timeO := session.clocks()
+	c.reply(req, &ResumedMessage{
+		Type:     MsgResumed,
+		Room:     resume.Room,
+		Seq:      seq,
+		Replayed: len(events),
+		TimeX:    timeX.Seconds(),
+		TimeO:    timeO.Seconds(),
+	})
+	return nil
+}
+
+func (c *Client) handleLeaveRoom(req *request) error {
+	log.Printf("Received LEAVE_ROOM from Client %s", c.ID)
+	// Player explicitly leaving. Forfeit game.
+	session := c.session()
+	if session == nil {
+		return errNotInGame
+	}
+	if session.isSpectator(c) {
+		c.stopWatching()
+		return nil
+	}
+	if session, err := c.hostedRoom(); err == nil && session.roomState() == RoomWaiting {
+		c.rm.remove(session, closeHostLeft) // Nobody to forfeit to
+		return nil
+	}
+
+	opponent := session.opponentOf(c)
+	winnerStr := "X"
+	if session.colorOf(c) == "X" {
+		winnerStr = "O"
+	}
+
+	if opponent == nil {
+		log.Println("Opponent is nil. Cannot notify.")
+		return nil
+	}
+	log.Printf("Opponent found: %s. Sending GAME_OVER.", opponent.ID)
+	// Broadcast GAME_OVER to opponent, record the result and end session
+	c.mm.conclude(session, winnerStr, &GameOverMessage{Reason: "opponent_left"}, c)
+	return nil
+}
+
+func (c *Client) handleChat(req *request) error {
+	var chat ChatRequest
+	if err := req.decode(&chat); err != nil {
+		return err
+	}
+	if chat.Text == "" {
+		return errBadRequest
+	}
+	if utf8.RuneCountInString(chat.Text) > maxChatLength {
+		return errChatTooLong
+	}
+	if err := c.mm.sanctions.check(c.ID, db.SanctionBan, db.SanctionMute); err != nil {
+		return err
+	}
+	channel := chat.Channel
+	if channel == "" {
+		if chat.RoomID != "" {
+			channel = ChannelRoom
+		} else if chat.To != "" {
+			channel = ChannelDirect
+		}
+	}
+
+	msg := ChatMessage{
+		Type:      MsgChat,
+		Channel:   channel,
+		SenderID:  c.ID,
+		Text:      chat.Text,
+		Timestamp: time.Now(),
+	}
+	switch channel {
+	case ChannelRoom:
+		session, ok := c.rm.getRoom(chat.RoomID)
+		if !ok {
+			return errRoomNotFound
+		}
+		if c.session() != session {
+			return errNotInRoom
+		}
+		msg.RoomID = chat.RoomID
+		session.publish(&msg)
+	case ChannelLobby:
+		if !c.hub.lobbyLimit.Allow(c.lobbyChatKey()) {
+			return errRateLimited
+		}
+		c.hub.broadcast <- encode(msg)
+	case ChannelDirect:
+		if chat.To == "" || chat.To == c.ID {
+			return errBadRequest
+		}
+		if !c.hub.IsOnline(chat.To) {
+			return errTargetOffline
+		}
+		c.hub.SendToUser(chat.To, msg)
+	default:
+		return errBadRequest
+	}
+	return nil
+}
+
+func (c *Client) handleChallenge(req *request) error {
+	var challenge ChallengeRequest
+	if err := req.decode(&challenge); err != nil {
+		return err
+	}
+	if challenge.TargetID == "" {
+		return errBadRequest
+	}
+	if c.mm.challenges == nil {
+		return errFeatureDisabled
+	}
+
+	totalTime, increment, turnLimit, rule := challenge.resolve()
+	ch := &Challenge{
+		FromID:    c.ID,
+		ToID:      challenge.TargetID,
+		Rule:      rule,
+		TotalTime: totalTime,
+		Increment: increment,
+		TurnLimit: turnLimit,
+	}
+	if err := c.mm.challenges.create(ch, challenge.Store); err != nil {
+		return err
+	}
+	c.reply(req, &ChallengeSentMessage{
+		Type:        MsgChallengeSent,
+		ChallengeID: ch.ID,
+		TargetID:    ch.ToID,
+		ExpiresAt:   ch.ExpiresAt,
+	})
+	return nil
+}
+
+func (c *Client) handleChallengeAnswer(req *request) error {
+	var answer ChallengeAnswerRequest
+	if err := req.decode(&answer); err != nil {
+		return err
+	}
+	if answer.ChallengeID == "" {
+		return errBadRequest
+	}
+	if c.mm.challenges == nil {
+		return errFeatureDisabled
+	}
+
+	switch req.Type {
+	case MsgChallengeAccept:
+		_, err := c.mm.challenges.accept(answer.ChallengeID, c)
+		return err
+	case MsgChallengeDecline:
+		return c.mm.challenges.decline(answer.ChallengeID, c)
+	default:
+		return c.mm.challenges.cancel(answer.ChallengeID, c)
+	}
+}
+
+func (c *Client) handleLobbySubscribe(req *request) error {
+	if c.rm.lobby == nil {
+		return errFeatureDisabled
+	}
+	c.rm.lobby.subscribe(c)
+	c.reply(req, &LobbyRoomsMessage{Type: MsgLobbyRooms, Rooms: c.rm.lobby.PublicRooms()})
+	return nil
+}
+
+func (c *Client) handleLobbyUnsubscribe(req *request) error {
+	if c.rm.lobby != nil {
+		c.rm.lobby.unsubscribe(c)
+	}
+	return nil
+}
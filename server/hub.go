@@ -1,40 +1,118 @@
 package main
 
+import "caro_chess_server/ratelimit"
+
 type Hub struct {
 	clients map[*Client]bool
-	broadcast chan []byte
+	broadcast chan *wireMessage
 	register chan *Client
 	unregister chan *Client
+	direct chan *directMessage
+	online chan *onlineQuery
+	users chan *usersQuery
+	count chan chan int
+
+	lobbyLimit *ratelimit.Limiter // Lobby chat messages per user
+}
+
+// directMessage is a message addressed to every connection of one user.
+type directMessage struct {
+	userID string
+	msg    *wireMessage
+}
+
+// onlineQuery asks the hub whether a user has at least one connection.
+type onlineQuery struct {
+	userID string
+	reply  chan bool
+}
+
+// usersQuery asks the hub for every connection of one user.
+type usersQuery struct {
+	userID string
+	reply  chan []*Client
 }
 
 func newHub() *Hub {
 	return &Hub{
-		broadcast:  make(chan []byte),
+		broadcast:  make(chan *wireMessage),
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
+		direct:     make(chan *directMessage),
+		online:     make(chan *onlineQuery),
+		users:      make(chan *usersQuery),
+		count:      make(chan chan int),
 		clients:    make(map[*Client]bool),
+		lobbyLimit: ratelimit.New(lobbyChatBurst, lobbyChatInterval),
 	}
 }
 
+// SendToUser encodes msg and delivers it to every connection of userID.
+// Users that are not connected are skipped.
+func (h *Hub) SendToUser(userID string, msg interface{}) {
+	h.direct <- &directMessage{userID: userID, msg: encode(msg)}
+}
+
+// IsOnline reports whether userID currently has a connection.
+func (h *Hub) IsOnline(userID string) bool {
+	q := &onlineQuery{userID: userID, reply: make(chan bool, 1)}
+	h.online <- q
+	return <-q.reply
+}
+
+// userClients returns every connection of userID.
+func (h *Hub) userClients(userID string) []*Client {
+	q := &usersQuery{userID: userID, reply: make(chan []*Client, 1)}
+	h.users <- q
+	return <-q.reply
+}
+
+// clientCount returns the number of connections.
+func (h *Hub) clientCount() int {
+	reply := make(chan int, 1)
+	h.count <- reply
+	return <-reply
+}
+
 func (h *Hub) run() {
 	for {
 		select {
 		case client := <-h.register:
 			h.clients[client] = true
 		case client := <-h.unregister:
-			if _, ok := h.clients[client]; ok {
-				delete(h.clients, client)
-				close(client.send)
-			}
+			delete(h.clients, client)
 		case message := <-h.broadcast:
 			for client := range h.clients {
-				select {
-				case client.send <- message:
-				default:
-					close(client.send)
-					delete(h.clients, client)
+				client.enqueue(message, dropIfFull)
+			}
+		case dm := <-h.direct:
+			for client := range h.clients {
+				if client.ID != dm.userID {
+					continue
+				}
+				// A lost challenge or pairing is worse than a reconnect,
+				// which delivers pending challenges again.
+				client.enqueue(dm.msg, closeIfFull)
+			}
+		case q := <-h.online:
+			found := false
+			for client := range h.clients {
+				if client.ID == q.userID {
+					found = true
+					break
+				}
+			}
+			q.reply <- found
+		case q := <-h.users:
+			var clients []*Client
+			for client := range h.clients {
+				if client.ID == q.userID {
+					clients = append(clients, client)
 				}
 			}
+			q.reply <- clients
+		case reply := <-h.count:
+			reply <- len(h.clients)
 		}
 	}
 }
@@ -12,7 +12,7 @@ import (
 )
 
 func TestFullGameLoop(t *testing.T) {
-	repo := db.NewFileUserRepository("test_game_loop.json")
+	repo := db.NewMemoryUserRepository()
 	
 	hub := newHub()
 	go hub.run()
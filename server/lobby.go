@@ -0,0 +1,121 @@
+package main
+
+import (
+	"sort"
+	"sync"
+
+	"caro_chess_server/api"
+	"caro_chess_server/db"
+)
+
+// Lobby lists public rooms and keeps subscribed clients up to date as rooms
+// are created, filled, finished and closed.
+type Lobby struct {
+	rm   *RoomManager
+	repo db.UserRepository
+
+	mu          sync.Mutex
+	subscribers map[*Client]bool
+}
+
+func newLobby(rm *RoomManager, repo db.UserRepository) *Lobby {
+	return &Lobby{rm: rm, repo: repo, subscribers: make(map[*Client]bool)}
+}
+
+// PublicRooms returns the public rooms that are waiting for an opponent or
+// being played, ordered by code.
+func (l *Lobby) PublicRooms() []api.RoomInfo {
+	l.rm.mu.RLock()
+	defer l.rm.mu.RUnlock()
+
+	rooms := []api.RoomInfo{}
+	for _, session := range l.rm.rooms {
+		if info, ok := l.info(session); ok {
+			rooms = append(rooms, info)
+		}
+	}
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i].Code < rooms[j].Code })
+	return rooms
+}
+
+// info describes session for the lobby. ok is false if it isn't listed.
+func (l *Lobby) info(session *GameSession) (api.RoomInfo, bool) {
+	state := session.roomState()
+	if public, _ := session.visibility(); !public || (state != RoomWaiting && state != RoomPlaying) {
+		return api.RoomInfo{}, false
+	}
+
+	st := session.state()
+	session.Lock()
+	ratingX, ratingO := session.ratingX, session.ratingO
+	session.Unlock()
+	info := api.RoomInfo{
+		Code:       session.Code,
+		State:      state,
+		Rule:       string(st.Rule),
+		TotalTime:  st.InitialTime.Seconds(),
+		Increment:  st.Increment.Seconds(),
+		TurnLimit:  st.TurnLimit.Seconds(),
+		PlayerX:    st.PlayerX,
+		PlayerO:    st.PlayerO,
+		Spectators: session.spectatorCount(),
+	}
+	if st.PlayerX != "" {
+		info.RatingX = ratingX
+	}
+	if st.PlayerO != "" {
+		info.RatingO = ratingO
+	}
+	return info, true
+}
+
+// rating reads a player's rating, 0 for guests and unknown users, for the
+// room they sit down in to show. info is called with rm.mu held, so it
+// doesn't read the database itself.
+func (l *Lobby) rating(userID string) int {
+	if userID == "" || db.IsGuestID(userID) {
+		return 0
+	}
+	user, err := l.repo.FindUser(userID)
+	if err != nil {
+		return 0
+	}
+	return user.ELO
+}
+
+func (l *Lobby) subscribe(c *Client) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.subscribers[c] = true
+}
+
+func (l *Lobby) unsubscribe(c *Client) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.subscribers, c)
+}
+
+// roomChanged tells the subscribers about a change to session: an update
+// while it is listed, otherwise its removal.
+func (l *Lobby) roomChanged(session *GameSession) {
+	var msg *wireMessage
+	if info, ok := l.info(session); ok {
+		msg = encode(LobbyRoomMessage{Type: MsgLobbyRoom, Room: info})
+	} else {
+		msg = encode(LobbyRoomRemovedMessage{Type: MsgLobbyRoomRemoved, Code: session.Code})
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for client := range l.subscribers {
+		client.enqueue(msg, dropIfFull)
+	}
+}
+
+// listingChanged tells the lobby that something it shows about gs has
+// changed. It does nothing for rooms the lobby doesn't know about.
+func (gs *GameSession) listingChanged() {
+	if public, _ := gs.visibility(); gs.lobby != nil && public {
+		gs.lobby.roomChanged(gs)
+	}
+}
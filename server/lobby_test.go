@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"caro_chess_server/api"
+	"caro_chess_server/db"
+	"caro_chess_server/engine"
+)
+
+func TestLobbyListing(t *testing.T) {
+	repo := db.NewMemoryUserRepository()
+	repo.SaveUser(&db.User{ID: "p1", ELO: 1350})
+
+	rm := newRoomManager()
+	rm.lobby = newLobby(rm, repo)
+	host := &Client{ID: "p1", send: make(chan *wireMessage, 10)}
+	code, _ := rm.createRoom(host, 3*time.Minute, 2*time.Second, 30*time.Second, engine.RuleFreeStyle)
+	host.session().Public = true
+	rm.createRoom(&Client{ID: "p2", send: make(chan *wireMessage, 10)}, time.Minute, 0, 0, engine.RuleStandard) // Private
+
+	w := httptest.NewRecorder()
+	api.NewRoomHandler(rm.lobby).ListRooms(w, httptest.NewRequest("GET", "/rooms", nil))
+	var rooms []api.RoomInfo
+	json.NewDecoder(w.Body).Decode(&rooms)
+	if len(rooms) != 1 {
+		t.Fatalf("expected only the public room, got %v", rooms)
+	}
+	want := api.RoomInfo{Code: code, State: api.RoomWaiting, Rule: string(engine.RuleFreeStyle), TotalTime: 180, Increment: 2, TurnLimit: 30, PlayerX: "p1", RatingX: 1350}
+	if rooms[0] != want {
+		t.Errorf("expected %+v, got %+v", want, rooms[0])
+	}
+	if _, err := repo.FindUser("p2"); err == nil {
+		t.Errorf("expected reading the ratings not to create unknown players")
+	}
+
+	w = httptest.NewRecorder()
+	api.NewRoomHandler(rm.lobby).ListRooms(w, httptest.NewRequest("GET", "/rooms?state=playing", nil))
+	if body := w.Body.String(); body != "[]\n" {
+		t.Errorf("expected no live games, got %s", body)
+	}
+}
+
+func TestLobbySubscribe(t *testing.T) {
+	u, cleanup := newTestServer()
+	defer cleanup()
+
+	watcher := dialAs(t, u, "watcher")
+	defer watcher.Close()
+	sendJSON(t, watcher, map[string]interface{}{"type": "LOBBY_SUBSCRIBE"})
+	if rooms, _ := readType(t, watcher, "LOBBY_ROOMS")["rooms"].([]interface{}); len(rooms) != 0 {
+		t.Fatalf("expected an empty lobby, got %v", rooms)
+	}
+
+	host := dialAs(t, u, "p1")
+	defer host.Close()
+	sendJSON(t, host, map[string]interface{}{"type": "CREATE_ROOM"}) // Private
+	readType(t, host, "ROOM_CREATED")
+	sendJSON(t, host, map[string]interface{}{"type": "CREATE_ROOM", "visibility": "public"})
+	code := readType(t, host, "ROOM_CREATED")["code"]
+
+	room := readType(t, watcher, "LOBBY_ROOM")["room"].(map[string]interface{})
+	if room["code"] != code || room["state"] != "waiting" {
+		t.Fatalf("expected the public room to be announced, got %v", room)
+	}
+
+	guest := dialAs(t, u, "p2")
+	defer guest.Close()
+	sendJSON(t, guest, map[string]interface{}{"type": "JOIN_ROOM", "code": code})
+	room = readType(t, watcher, "LOBBY_ROOM")["room"].(map[string]interface{})
+	if room["state"] != "playing" || room["player_o"] != "p2" {
+		t.Errorf("expected the room to be playing, got %v", room)
+	}
+
+	sendJSON(t, watcher, map[string]interface{}{"type": "JOIN_ROOM", "code": code, "role": "spectator"})
+	room = readType(t, watcher, "LOBBY_ROOM")["room"].(map[string]interface{})
+	if room["spectators"] != 1.0 {
+		t.Errorf("expected 1 spectator, got %v", room)
+	}
+
+	sendJSON(t, host, map[string]interface{}{"type": "LEAVE_ROOM"})
+	if removed := readType(t, watcher, "LOBBY_ROOM_REMOVED"); removed["code"] != code {
+		t.Errorf("expected the finished game to leave the lobby, got %v", removed)
+	}
+}
@@ -1,18 +1,25 @@
 package main
 
 import (
+	"expvar"
 	"flag"
 	"log"
 	"net/http"
 	"strings"
+	"time"
 
 	"caro_chess_server/api"
 	"caro_chess_server/auth"
 	"caro_chess_server/config"
-	"caro_chess_server/db/sqlite"
+	"caro_chess_server/db"
 	"caro_chess_server/middleware"
+	"caro_chess_server/tournament"
 )
 
+var rebuildRatingsFlag = flag.Bool("rebuild-ratings", false, "replay all matches to rebuild ratings, then exit")
+var grantAdminFlag = flag.String("grant-admin", "", "make the user with this username an admin, then exit")
+var migrateFlag = flag.String("migrate", "", `"status" to list pending database migrations or "up" to apply them, then exit`)
+
 func main() {
 	// Load configuration
 	cfg := config.Load()
@@ -21,14 +28,35 @@ func main() {
 	flag.Parse()
 
 	// Initialize repositories
-	// Initialize repositories
-	// repo := db.NewFileUserRepository(cfg.UsersDBPath)
-	repo, err := sqlite.NewSQLiteStore("caro.db")
+	repo, err := openStore(cfg)
 	if err != nil {
 		log.Fatal("Failed to init DB:", err)
 	}
 	defer repo.Close()
 
+	if *migrateFlag != "" {
+		if err := runMigrations(repo, *migrateFlag); err != nil {
+			log.Fatal("Migrations failed:", err)
+		}
+		return
+	}
+	if err := checkSchema(repo); err != nil {
+		log.Fatal(err)
+	}
+
+	if *rebuildRatingsFlag {
+		if err := rebuildRatings(repo); err != nil {
+			log.Fatal("Failed to rebuild ratings:", err)
+		}
+		return
+	}
+	if *grantAdminFlag != "" {
+		if err := grantAdmin(repo, *grantAdminFlag); err != nil {
+			log.Fatal("Failed to grant admin:", err)
+		}
+		return
+	}
+
 	// Initialize WebSocket hub
 	hub := newHub()
 	go hub.run()
@@ -37,16 +65,42 @@ func main() {
 	matchmaker := newMatchmaker(repo)
 	go matchmaker.run()
 
+	// Bans, suspensions and mutes apply across the WebSocket and REST APIs
+	sanctions := newSanctions(repo, hub, matchmaker)
+	matchmaker.sanctions = sanctions
+
 	// Initialize room manager
 	roomManager := newRoomManager()
+	roomManager.lobby = newLobby(roomManager, repo)
+	roomManager.mm = matchmaker
+	go roomManager.run()
 
 	// Create a new ServeMux for API routes
 	mux := http.NewServeMux()
 
 	// Initialize auth handler
-	authHandler := auth.NewAuthHandler(repo)
+	keys, err := cfg.SigningKeys()
+	if err != nil {
+		log.Fatal("Failed to load JWT keys:", err)
+	}
+	if len(keys) == 0 {
+		log.Printf("No JWT keys configured; tokens won't survive a restart")
+	}
+	tokens, err := auth.NewTokens(keys, repo,
+		time.Duration(cfg.AccessTokenTTL)*time.Second, time.Duration(cfg.RefreshTokenTTL)*time.Second)
+	if err != nil {
+		log.Fatal("Failed to init tokens:", err)
+	}
+	authHandler := auth.NewAuthHandler(repo, repo, tokens)
 	mux.HandleFunc("/signup", authHandler.Signup)
 	mux.HandleFunc("/login", authHandler.Login)
+	mux.HandleFunc("/password", authHandler.SetPassword)
+	mux.HandleFunc("/token/refresh", authHandler.Refresh)
+	mux.HandleFunc("/logout", authHandler.Logout)
+	mux.HandleFunc("/guest", authHandler.Guest)
+
+	// Routes that act as a user take it from their token, never the request
+	authed := tokens.Authenticate
 
 	// Initialize leaderboard handler
 	leaderboardHandler := api.NewLeaderboardHandler(repo)
@@ -55,13 +109,15 @@ func main() {
 	// Initialize shop handler
 	shopHandler := api.NewShopHandler(repo)
 	mux.HandleFunc("/shop", shopHandler.GetShopItems)
-	mux.HandleFunc("/shop/buy", shopHandler.BuyItem)
-	mux.HandleFunc("/inventory", shopHandler.GetUserInventory)
+	mux.Handle("/shop/buy", authed(auth.RequireUser(sanctions.Block(shopHandler.BuyItem))))
+	mux.Handle("/inventory", authed(auth.RequireUser(shopHandler.GetUserInventory)))
 
 	// Initialize history handler
 	historyHandler := api.NewHistoryHandler(repo)
 	mux.HandleFunc("/users/", func(w http.ResponseWriter, r *http.Request) {
-		if strings.Contains(r.URL.Path, "/matches") {
+		if strings.HasSuffix(r.URL.Path, "/rating-history") {
+			historyHandler.GetRatingHistory(w, r)
+		} else if strings.Contains(r.URL.Path, "/matches") {
 			historyHandler.GetUserMatches(w, r)
 		} else {
 			// Assume /users/{id} for profile
@@ -70,48 +126,52 @@ func main() {
 	})
 	mux.HandleFunc("/matches/", historyHandler.GetMatch)
 
+	// Public rooms waiting for an opponent or open to spectators
+	roomHandler := api.NewRoomHandler(roomManager.lobby)
+	mux.HandleFunc("/rooms", roomHandler.ListRooms)
+
+	// Initialize tournaments; games are played in reserved rooms
+	gameStarter := &roomGameStarter{rm: roomManager, mm: matchmaker}
+	tournaments := tournament.NewManager(gameStarter, hub)
+	tournamentHandler := api.NewTournamentHandler(repo, tournaments)
+	mux.Handle("/tournaments", authed(http.HandlerFunc(tournamentHandler.Tournaments)))
+	mux.Handle("/tournaments/", authed(http.HandlerFunc(tournamentHandler.Tournament)))
+
+	// Knockout brackets share the reserved-room game starter
+	brackets := tournament.NewKnockoutManager(gameStarter, hub)
+	bracketHandler := api.NewBracketHandler(repo, brackets)
+	mux.Handle("/brackets", authed(http.HandlerFunc(bracketHandler.Brackets)))
+	mux.Handle("/brackets/", authed(http.HandlerFunc(bracketHandler.Bracket)))
+
+	// Arenas pair their participants through the matchmaker
+	arenas := tournament.NewArenaManager(hub, repo)
+	matchmaker.arenas = arenas
+	arenaHandler := api.NewArenaHandler(repo, arenas)
+	mux.Handle("/arenas", authed(http.HandlerFunc(arenaHandler.Arenas)))
+	mux.Handle("/arenas/", authed(http.HandlerFunc(arenaHandler.Arena)))
+
+	// Direct challenges are played in reserved rooms as well
+	matchmaker.challenges = newChallengeManager(hub, roomManager, matchmaker)
+
+	// Moderation; api/admin.go has the finer permissions
+	adminHandler := api.NewAdminHandler(repo, repo, gameControl{mm: matchmaker}, sanctions, tokens)
+	mux.Handle("/admin/", authed(auth.RequireRole(db.RoleModerator, adminHandler.Admin)))
+
+	// Runtime and slow-consumer metrics, which include the command line, for
+	// admins only
+	mux.Handle("/debug/vars", authed(auth.RequireRole(db.RoleAdmin, expvar.Handler().ServeHTTP)))
+
 	// Setup WebSocket handler
-	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
-		id := r.URL.Query().Get("id")
-		token := r.URL.Query().Get("token")
-		if id == "" {
-			// If token provided, validate it to get ID
-			if token != "" {
-				claims, err := auth.ValidateToken(token)
-				if err == nil {
-					id = claims.UserID
-				}
-			} else {
-				id = "guest"
-			}
-		}
-		// Ideally we REQUIRE token now?
-		// Let's make it optional for backward compatibility or strict?
-		// Plan says: "Update WebSocket connection to require/validate Token."
-		// Let's Enforce it!
-
-		if token != "" {
-			claims, err := auth.ValidateToken(token)
-			if err == nil {
-				id = claims.UserID
-			} else {
-				http.Error(w, "Invalid Token", http.StatusUnauthorized)
-				return
-			}
-		} else {
-			// Allow legacy "id" param for now? Or guest?
-			// "guest" is fine for unauthenticated play if supported.
-			// But if we want Auth, we should favor Token.
-			// Let's allow fallback to ID for test scripts but warn?
-			// For strict mode:
-			/*
-			   http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			   return
-			*/
-		}
+	mux.Handle("/ws", authed(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveWs(hub, matchmaker, roomManager, w, r, connectionUserID(r))
+	})))
 
-		serveWs(hub, matchmaker, roomManager, w, r, id)
-	})
+	// Event stream fallback for networks that block WebSockets
+	streams := newEventStreams(hub, matchmaker, roomManager)
+	mux.Handle("/events", authed(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		streams.Events(w, r, connectionUserID(r))
+	})))
+	mux.Handle("/actions", authed(http.HandlerFunc(streams.Actions)))
 
 	// Start server with CORS middleware
 	log.Printf("Server starting on %s", cfg.ServerAddr)
@@ -122,3 +182,12 @@ func main() {
 		log.Fatal("ListenAndServe: ", err)
 	}
 }
+
+// connectionUserID returns the user a /ws or /events connection is for:
+// the authenticated user, or a new guest for an anonymous connection.
+func connectionUserID(r *http.Request) string {
+	if id, ok := auth.UserID(r.Context()); ok {
+		return id
+	}
+	return auth.NewGuestID()
+}
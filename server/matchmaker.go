@@ -1,8 +1,8 @@
 package main
 
 import (
-	"encoding/json"
 	"log"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
@@ -10,13 +10,21 @@ import (
 	"caro_chess_server/db"
 	"caro_chess_server/elo"
 	"caro_chess_server/engine"
+	"caro_chess_server/tournament"
 )
 
+// Matchmaker pairs waiting players. Its queues are owned by run; starting
+// and ending games is safe from any goroutine.
 type Matchmaker struct {
 	repo         db.UserRepository
 	addClient    chan *Client
-	removeClient chan *Client // New channel
-	sessions     map[*Client]*GameSession
+	removeClient chan *Client             // New channel
+	arenas       *tournament.ArenaManager // Optional; enables arena queues
+	challenges   *ChallengeManager        // Optional; enables direct challenges
+	sanctions    *Sanctions               // Optional; enforces bans, suspensions and mutes
+
+	liveMu sync.Mutex
+	live   map[string]*GameSession // Games in progress by ID, for moderators
 }
 
 func newMatchmaker(repo db.UserRepository) *Matchmaker {
@@ -24,18 +32,25 @@ func newMatchmaker(repo db.UserRepository) *Matchmaker {
 		repo:         repo,
 		addClient:    make(chan *Client),
 		removeClient: make(chan *Client), // Initialize
-		sessions:     make(map[*Client]*GameSession),
+		live:         make(map[string]*GameSession),
 	}
 }
 
 func (m *Matchmaker) run() {
 	// Map of pending clients keyed by GameRule
 	pendingClients := make(map[engine.GameRule]*Client)
+	// Arena participants waiting for their next game, keyed by arena ID
+	arenaQueues := make(map[string][]*Client)
 
 	for {
 		select {
 		case client := <-m.addClient:
-			rule := client.PreferredRule
+			rule, arenaID := client.queue()
+			if arenaID != "" {
+				m.queueArena(arenaQueues, client, arenaID)
+				continue
+			}
+
 			if rule == "" {
 				rule = engine.RuleStandard
 			}
@@ -50,7 +65,16 @@ func (m *Matchmaker) run() {
 
 		case client := <-m.removeClient:
 			// If client disconnects while waiting, remove from queue
-			rule := client.PreferredRule
+			rule, arenaID := client.queue()
+			if arenaID != "" {
+				queue := arenaQueues[arenaID]
+				for i, pending := range queue {
+					if pending == client {
+						arenaQueues[arenaID] = append(queue[:i:i], queue[i+1:]...)
+						break
+					}
+				}
+			}
 			if pending, ok := pendingClients[rule]; ok && pending == client {
 				delete(pendingClients, rule)
 			}
@@ -68,84 +92,277 @@ func (m *Matchmaker) startGame(c1, c2 *Client, rule engine.GameRule) {
 	// Start Timer
 	session.StartGame()
 
-	msg1, _ := json.Marshal(map[string]string{"type": "MATCH_FOUND", "color": "X"})
-	c1.send <- msg1
-
-	msg2, _ := json.Marshal(map[string]string{"type": "MATCH_FOUND", "color": "O"})
-	c2.send <- msg2
+	sendMatchFound(session)
 
 	addr1 := "unknown"
 	if c1.conn != nil {
-		addr1 = c1.conn.RemoteAddr().String()
+		addr1 = c1.conn.remoteAddr()
 	}
 	addr2 := "unknown"
 	if c2.conn != nil {
-		addr2 = c2.conn.RemoteAddr().String()
+		addr2 = c2.conn.remoteAddr()
 	}
 	log.Printf("Started game between %s and %s", addr1, addr2)
 }
 
-func (m *Matchmaker) RegisterSession(session *GameSession) {
-	if session.ClientX != nil {
-		m.sessions[session.ClientX] = session
-		session.ClientX.Session = session
+// queueArena pairs an arena participant with the longest-waiting player of
+// the same arena, skipping their previous opponent, or queues them.
+func (m *Matchmaker) queueArena(queues map[string][]*Client, client *Client, arenaID string) {
+	if m.arenas == nil || client.closed() {
+		return
 	}
-	if session.ClientO != nil {
-		m.sessions[session.ClientO] = session
-		session.ClientO.Session = session
+	if err := m.arenas.CanPair(arenaID, client.ID); err != nil {
+		if err == tournament.ErrArenaClosed {
+			delete(queues, arenaID)
+		}
+		return
 	}
 
-	// Set Timeout Callback
-	session.TimeoutCallback = func(winnerStr string) {
-		var winner *Client
-		if winnerStr == "X" {
-			winner = session.ClientX
-		} else {
-			winner = session.ClientO
+	queue := queues[arenaID]
+	avoid := m.arenas.AvoidOpponent(arenaID, client.ID)
+	for i, pending := range queue {
+		if pending == client {
+			return // Already waiting
 		}
+		if pending.ID == client.ID || pending.ID == avoid || pending.closed() {
+			continue
+		}
+		queues[arenaID] = append(queue[:i:i], queue[i+1:]...)
+		m.startArenaGame(arenaID, pending, client)
+		return
+	}
+	queues[arenaID] = append(queue, client)
+}
+
+func (m *Matchmaker) startArenaGame(arenaID string, c1, c2 *Client) {
+	game, settings, err := m.arenas.Pair(arenaID, c1.ID, c2.ID)
+	if err != nil {
+		log.Printf("Arena %s: cannot pair %s and %s: %v", arenaID, c1.ID, c2.ID, err)
+		return
+	}
+
+	x, o := c1, c2
+	if game.PlayerX != c1.ID {
+		x, o = c2, c1
+	}
 
-		// Broadcast GAME_OVER (Timeout)
-		msg, _ := json.Marshal(map[string]interface{}{
-			"type":   "GAME_OVER",
-			"winner": winnerStr,
-			"reason": "timeout",
-		})
-		if session.ClientX != nil {
-			session.ClientX.send <- msg
+	rule := settings.Rule
+	if rule == "" {
+		rule = engine.RuleStandard
+	}
+	session := newGameSession(x, o,
+		secondsOr(settings.TotalTime, 5*time.Minute),
+		secondsOr(settings.Increment, 5*time.Second),
+		secondsOr(settings.TurnLimit, 30*time.Second),
+		rule)
+	session.ArenaID = arenaID
+	session.ArenaGameID = game.ID
+	session.OnGameEnd = func(winnerID string) {
+		if err := m.arenas.ReportResult(arenaID, game.ID, winnerID); err != nil {
+			log.Printf("Arena %s: ignoring result: %v", arenaID, err)
 		}
-		if session.ClientO != nil {
-			session.ClientO.send <- msg
+		// Put both players straight back into the arena queue, unless they
+		// were suspended or banned during the game.
+		for _, c := range []*Client{x, o} {
+			if _, queued := c.queue(); queued != arenaID || c.closed() {
+				continue
+			}
+			if err := m.sanctions.check(c.ID, db.SanctionBan, db.SanctionSuspend); err != nil {
+				c.setQueue("", "")
+				continue
+			}
+			go func(c *Client) { m.addClient <- c }(c)
 		}
+	}
+
+	m.RegisterSession(session)
+	session.StartGame()
+	sendMatchFound(session)
+	log.Printf("Arena %s: started game between %s and %s", arenaID, x.ID, o.ID)
+}
 
-		m.endGame(session, winner)
+// RegisterSession points the seated players at session and has the game end
+// when a clock runs out.
+func (m *Matchmaker) RegisterSession(session *GameSession) {
+	session.Lock()
+	x, o := session.ClientX, session.ClientO
+	session.TimeoutCallback = func(winnerStr string) {
+		m.conclude(session, winnerStr, &GameOverMessage{Reason: "timeout"}, nil)
+	}
+	if session.ID == "" {
+		session.ID = uuid.New().String()
+	}
+	id := session.ID
+	session.Unlock()
+
+	m.liveMu.Lock()
+	m.live[id] = session
+	m.liveMu.Unlock()
+
+	if x != nil {
+		x.setSession(session)
+	}
+	if o != nil {
+		o.setSession(session)
 	}
 }
 
+// endGame ends the game in favour of winner, or as a draw if winner is nil,
+// without announcing it.
 func (m *Matchmaker) endGame(session *GameSession, winner *Client) {
 	if session == nil {
 		return
 	}
-	session.StopGame() // Stop all timers
-
-	// Determine Loser (if any)
+	winnerColor := ""
 	if winner != nil {
-		// Logic to identify loser if needed
-	} else {
-		// Draw
+		winnerColor = session.colorOf(winner)
 	}
+	m.conclude(session, winnerColor, nil, nil)
+}
 
-	u1, _ := m.repo.GetUser(session.PlayerXID)
-	u2, _ := m.repo.GetUser(session.PlayerOID) // Assumes O exists
+// forfeit ends the game against a player who failed to show up or came back
+// too late, whether or not the opponent is connected.
+func (m *Matchmaker) forfeit(session *GameSession, loserIsX bool, reason string) {
+	winnerColor := "X"
+	if loserIsX {
+		winnerColor = "O"
+	}
+	m.conclude(session, winnerColor, &GameOverMessage{Reason: reason}, nil)
+}
+
+// conclude ends the game unless it has already ended: it publishes over,
+// if given, to everyone but skip and records the result. winnerColor is
+// "X", "O" or "" for a draw. over's type and, if empty, winner are filled in.
+// It reports whether this call ended the game.
+func (m *Matchmaker) conclude(session *GameSession, winnerColor string, over *GameOverMessage, skip *Client) bool {
+	if !session.finish() {
+		return false
+	}
+	m.forget(session)
+	if over != nil {
+		over.Type = MsgGameOver
+		if over.Winner == "" {
+			over.Winner = winnerColor
+		}
+		session.publishExcept(over, skip)
+	}
+	m.finishGame(session, winnerColor)
+	session.listingChanged() // Finished games leave the lobby
+	return true
+}
+
+// abort ends the game unless it has already ended, with no result:
+// nothing is recorded and ratings don't change. Tournaments count it as a
+// draw. It reports whether this call ended the game.
+func (m *Matchmaker) abort(session *GameSession, reason string) bool {
+	if !session.finish() {
+		return false
+	}
+	m.forget(session)
+	session.publishExcept(&GameOverMessage{Type: MsgGameOver, Reason: reason}, nil)
+
+	x, o := session.players()
+	if x != nil {
+		x.leaveSession(session)
+	}
+	if o != nil {
+		o.leaveSession(session)
+	}
+	session.Lock()
+	onGameEnd := session.OnGameEnd
+	session.Unlock()
+	if onGameEnd != nil {
+		onGameEnd("")
+	}
+	session.listingChanged()
+	return true
+}
+
+// forget drops an ended game from the live games.
+func (m *Matchmaker) forget(session *GameSession) {
+	session.Lock()
+	id := session.ID
+	session.Unlock()
+	m.liveMu.Lock()
+	delete(m.live, id)
+	m.liveMu.Unlock()
+}
+
+// liveGames returns the games in progress.
+func (m *Matchmaker) liveGames() []*GameSession {
+	m.liveMu.Lock()
+	defer m.liveMu.Unlock()
+	games := make([]*GameSession, 0, len(m.live))
+	for _, session := range m.live {
+		games = append(games, session)
+	}
+	return games
+}
+
+// liveGame returns the game in progress with the given ID.
+func (m *Matchmaker) liveGame(id string) (*GameSession, bool) {
+	m.liveMu.Lock()
+	defer m.liveMu.Unlock()
+	session, ok := m.live[id]
+	return session, ok
+}
+
+// finishGame records the result, updates ratings and coins and releases the
+// players. winnerColor is "X", "O" or "" for a draw. Use conclude rather
+// than calling this directly.
+func (m *Matchmaker) finishGame(session *GameSession, winnerColor string) {
+	st := session.state()
+	winnerID := ""
+	if winnerColor == "X" {
+		winnerID = st.PlayerX
+	} else if winnerColor == "O" {
+		winnerID = st.PlayerO
+	}
+	u1, u2 := m.recordResult(st, winnerColor)
+
+	// Notify clients of new Rank and Coins
+	x, o := session.players()
+	if x != nil {
+		x.sendMessage(UpdateRankMessage{Type: MsgUpdateRank, ELO: u1.ELO, Coins: u1.Coins})
+		x.leaveSession(session)
+	}
+	if o != nil {
+		o.sendMessage(UpdateRankMessage{Type: MsgUpdateRank, ELO: u2.ELO, Coins: u2.Coins})
+		o.leaveSession(session)
+	}
+
+	session.Lock()
+	onGameEnd := session.OnGameEnd
+	session.Unlock()
+	if onGameEnd != nil {
+		onGameEnd(winnerID)
+	}
+}
+
+// recordResult saves the match and the players' new ratings, stats and
+// coins, returning the updated players.
+func (m *Matchmaker) recordResult(st sessionState, winnerColor string) (*db.User, *db.User) {
+	u1, _ := m.repo.GetUser(st.PlayerX)
+	u2, _ := m.repo.GetUser(st.PlayerO) // Assumes O exists
 
 	// Calculate ELO
 	var scoreX float64 = 0.5
-	if winner == session.ClientX {
+	if winnerColor == "X" {
 		scoreX = 1.0
-	} else if winner == session.ClientO {
+	} else if winnerColor == "O" {
 		scoreX = 0.0
 	}
 
+	xBefore, oBefore := u1.ELO, u2.ELO
 	r1, r2 := elo.CalculateRatings(u1.ELO, u2.ELO, scoreX)
+	// Guests are rated among themselves: playing one moves only the
+	// guest's rating, which is kept off the leaderboard.
+	if db.IsGuestID(st.PlayerO) && !db.IsGuestID(st.PlayerX) {
+		r1 = u1.ELO
+	}
+	if db.IsGuestID(st.PlayerX) && !db.IsGuestID(st.PlayerO) {
+		r2 = u2.ELO
+	}
 
 	u1.ELO = r1
 	u2.ELO = r2
@@ -175,8 +392,8 @@ func (m *Matchmaker) endGame(session *GameSession, winner *Client) {
 	m.repo.SaveUser(u2)
 
 	// Save Match to DB
-	moves := make([]db.Move, len(session.Engine.History))
-	for i, mv := range session.Engine.History {
+	moves := make([]db.Move, len(st.History))
+	for i, mv := range st.History {
 		p := "X"
 		if i%2 != 0 {
 			p = "O"
@@ -190,46 +407,25 @@ func (m *Matchmaker) endGame(session *GameSession, winner *Client) {
 	}
 
 	var winnerID *string
-	if winner != nil {
-		wid := winner.ID
-		winnerID = &wid
+	if winnerColor == "X" {
+		winnerID = &st.PlayerX
+	} else if winnerColor == "O" {
+		winnerID = &st.PlayerO
 	}
 
 	match := &db.Match{
 		ID:        uuid.New().String(),
-		PlayerXID: session.PlayerXID,
-		PlayerOID: session.PlayerOID,
+		PlayerXID: st.PlayerX,
+		PlayerOID: st.PlayerO,
 		WinnerID:  winnerID,
 		Moves:     moves,
 		Timestamp: time.Now(),
-	}
-	m.repo.SaveMatch(match)
 
-	// Notify clients of new Rank and Coins
-	if session.ClientX != nil {
-		msg, _ := json.Marshal(map[string]interface{}{
-			"type":  "UPDATE_RANK",
-			"elo":   u1.ELO,
-			"coins": u1.Coins,
-		})
-		session.ClientX.send <- msg
-	}
-	if session.ClientO != nil {
-		msg, _ := json.Marshal(map[string]interface{}{
-			"type":  "UPDATE_RANK",
-			"elo":   u2.ELO,
-			"coins": u2.Coins,
-		})
-		session.ClientO.send <- msg
-	}
-
-	// Cleanup session
-	if session.ClientX != nil {
-		delete(m.sessions, session.ClientX)
-		session.ClientX.Session = nil
-	}
-	if session.ClientO != nil {
-		delete(m.sessions, session.ClientO)
-		session.ClientO.Session = nil
+		PlayerXRatingBefore: xBefore,
+		PlayerXRatingAfter:  r1,
+		PlayerORatingBefore: oBefore,
+		PlayerORatingAfter:  r2,
 	}
+	m.repo.SaveMatch(match)
+	return u1, u2
 }
@@ -1,22 +1,23 @@
 package main
 
 import (
-	"os"
 	"testing"
 	"time"
 	
+	"caro_chess_server/auth"
 	"caro_chess_server/db"
+	"caro_chess_server/engine"
+	"caro_chess_server/tournament"
 )
 
 func TestMatchmaking(t *testing.T) {
-	repo := db.NewFileUserRepository("test_mm.json")
-	defer os.Remove("test_mm.json")
+	repo := db.NewMemoryUserRepository()
 	
 	mm := newMatchmaker(repo)
 	go mm.run()
 
-	c1 := &Client{send: make(chan []byte, 10)}
-	c2 := &Client{send: make(chan []byte, 10)}
+	c1 := &Client{send: make(chan *wireMessage, 10)}
+	c2 := &Client{send: make(chan *wireMessage, 10)}
 
 	mm.addClient <- c1
 	mm.addClient <- c2
@@ -36,4 +37,131 @@ func TestMatchmaking(t *testing.T) {
 	default:
 		t.Error("Client 2 did not receive match message")
 	}
-}
\ No newline at end of file
+}
+func TestArenaMatchmakingSkipsLastOpponent(t *testing.T) {
+	repo := db.NewMemoryUserRepository()
+
+	arenas := tournament.NewArenaManager(nil, nil)
+	a, _ := arenas.Create("alice", "Blitz", time.Hour, tournament.Settings{})
+	for _, id := range []string{"p1", "p2", "p3"} {
+		arenas.Join(a.ID, id, 1200)
+	}
+	arenas.Start(a.ID)
+
+	mm := newMatchmaker(repo)
+	mm.arenas = arenas
+	go mm.run()
+
+	c1 := &Client{ID: "p1", ArenaID: a.ID, send: make(chan *wireMessage, 10)}
+	c2 := &Client{ID: "p2", ArenaID: a.ID, send: make(chan *wireMessage, 10)}
+	c3 := &Client{ID: "p3", ArenaID: a.ID, send: make(chan *wireMessage, 10)}
+
+	mm.addClient <- c1
+	mm.addClient <- c2
+	time.Sleep(50 * time.Millisecond)
+	if len(c1.send) == 0 || len(c2.send) == 0 {
+		t.Fatalf("expected p1 and p2 to be paired")
+	}
+
+	// p1 and p2 finish; p1 requeues first, then p2, then p3 arrives.
+	mm.endGame(c1.session(), c1)
+	time.Sleep(50 * time.Millisecond)
+	for _, c := range []*Client{c1, c2} {
+		for len(c.send) > 0 {
+			<-c.send
+		}
+	}
+
+	mm.addClient <- c3
+	time.Sleep(50 * time.Millisecond)
+
+	if c3.session() == nil {
+		t.Fatalf("expected p3 to be paired")
+	}
+	if s1 := c1.session(); s1 == c2.session() && s1 != nil {
+		t.Errorf("expected p1 and p2 not to be re-paired immediately")
+	}
+}
+
+func TestBerserkMidTurnKeepsTimeUsed(t *testing.T) {
+	x := &Client{ID: "p1", send: make(chan *wireMessage, 10)}
+	o := &Client{ID: "p2", send: make(chan *wireMessage, 10)}
+	session := newGameSession(x, o, 2*time.Second, 0, time.Minute, engine.RuleStandard)
+	timedOut := make(chan string, 1)
+	session.TimeoutCallback = func(winner string) { timedOut <- winner }
+	session.StartGame()
+	defer session.StopGame()
+
+	// X thinks for 600ms of a 2s bank, then berserks down to 1s: only
+	// 400ms should be left on the clock, not a fresh second.
+	time.Sleep(600 * time.Millisecond)
+	if _, ok := session.Berserk(x); !ok {
+		t.Fatalf("expected X to be allowed to berserk")
+	}
+	select {
+	case winner := <-timedOut:
+		if winner != "O" {
+			t.Errorf("expected O to win on X's timeout, got %q", winner)
+		}
+	case <-time.After(800 * time.Millisecond):
+		t.Fatalf("X's clock did not account for the time used before berserking")
+	}
+}
+
+func TestTurnTimeoutEndsGame(t *testing.T) {
+	repo := db.NewMemoryUserRepository()
+
+	mm := newMatchmaker(repo)
+	c1 := &Client{ID: "p1", send: make(chan *wireMessage, 10)}
+	c2 := &Client{ID: "p2", send: make(chan *wireMessage, 10)}
+	session := newGameSession(c1, c2, time.Minute, 0, 20*time.Millisecond, engine.RuleStandard)
+	mm.RegisterSession(session)
+	session.StartGame()
+
+	// X never moves; the timeout must end the game rather than deadlock
+	// on the session lock.
+	deadline := time.After(2 * time.Second)
+	for c1.session() != nil || c2.session() != nil {
+		select {
+		case <-deadline:
+			t.Fatalf("game did not end on timeout")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	if u, _ := repo.GetUser("p2"); u == nil || u.Wins != 1 {
+		t.Errorf("expected O to be credited with the win, got %+v", u)
+	}
+	if _, result := session.lastEvent(); result == nil || result.Winner != "O" || result.Reason != "timeout" {
+		t.Errorf("expected GAME_OVER for O on timeout, got %+v", result)
+	}
+}
+
+func TestGuestRatingsStayApart(t *testing.T) {
+	repo := db.NewMemoryUserRepository()
+
+	mm := newMatchmaker(repo)
+	guest := auth.NewGuestID()
+	c1 := &Client{ID: guest, send: make(chan *wireMessage, 10)}
+	c2 := &Client{ID: "p2", send: make(chan *wireMessage, 10)}
+	session := newGameSession(c1, c2, time.Minute, 0, 20*time.Millisecond, engine.RuleStandard)
+	mm.RegisterSession(session)
+	session.StartGame()
+
+	deadline := time.After(2 * time.Second)
+	for c1.session() != nil || c2.session() != nil {
+		select {
+		case <-deadline:
+			t.Fatalf("game did not end on timeout")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	if matches, _ := repo.GetMatchesByUserID(guest, 10); len(matches) != 1 {
+		t.Errorf("expected the guest's game to be recorded, got %d", len(matches))
+	}
+	if u, _ := repo.GetUser(guest); u.ELO >= 1200 || u.Losses != 1 || u.Coins != 5000 {
+		t.Errorf("expected the guest to lose rating and earn coins, got %+v", u)
+	}
+	if u, _ := repo.GetUser("p2"); u.ELO != 1200 || u.Wins != 1 || u.Coins != 10000 {
+		t.Errorf("expected the registered player's rating untouched by a guest, got %+v", u)
+	}
+}
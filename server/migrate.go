@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+// runMigrations lists the pending migrations for "status" or applies them
+// for "up".
+func runMigrations(store Store, command string) error {
+	switch command {
+	case "status":
+		version, err := store.Version()
+		if err != nil {
+			return err
+		}
+		pending, err := store.Pending()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Schema version %d, %d pending\n", version, len(pending))
+		for _, m := range pending {
+			fmt.Printf("  %04d_%s\n", m.Version, m.Name)
+		}
+		return nil
+	case "up":
+		applied, err := store.Migrate()
+		for _, m := range applied {
+			fmt.Printf("Applied %04d_%s\n", m.Version, m.Name)
+		}
+		if err == nil && len(applied) == 0 {
+			fmt.Println("Nothing to apply")
+		}
+		return err
+	default:
+		return fmt.Errorf("unknown -migrate command %q; use status or up", command)
+	}
+}
+
+// checkSchema makes sure the database is up to date before serving. A new,
+// empty database is set up; an existing one with pending migrations is left
+// for the operator to migrate, since they may want a backup first.
+func checkSchema(store Store) error {
+	pending, err := store.Pending()
+	if err != nil {
+		return err
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+	empty, err := store.Empty()
+	if err != nil {
+		return err
+	}
+	if !empty {
+		return fmt.Errorf("database has %d pending migrations; back it up and run with -migrate=up", len(pending))
+	}
+	applied, err := store.Migrate()
+	if err != nil {
+		return err
+	}
+	log.Printf("Created the database schema at version %d", applied[len(applied)-1].Version)
+	return nil
+}
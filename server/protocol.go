@@ -0,0 +1,504 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"caro_chess_server/api"
+	"caro_chess_server/engine"
+	"caro_chess_server/tournament"
+)
+
+// ProtocolVersion is the WebSocket protocol version spoken by this server.
+// Clients announce theirs with HELLO; clients that skip the handshake are
+// assumed to speak version 1.
+const ProtocolVersion = 1
+
+// Client message types.
+const (
+	MsgHello            = "HELLO"
+	MsgFindMatch        = "FIND_MATCH"
+	MsgCreateRoom       = "CREATE_ROOM"
+	MsgJoinRoom         = "JOIN_ROOM"
+	MsgLeaveRoom        = "LEAVE_ROOM"
+	MsgMove             = "MOVE"
+	MsgWinClaim         = "WIN_CLAIM"
+	MsgChat             = "CHAT_MESSAGE"
+	MsgArenaJoin        = "ARENA_JOIN"
+	MsgBerserk          = "BERSERK"
+	MsgChallenge        = "CHALLENGE"
+	MsgChallengeAccept  = "CHALLENGE_ACCEPT"
+	MsgChallengeDecline = "CHALLENGE_DECLINE"
+	MsgChallengeCancel  = "CHALLENGE_CANCEL"
+	MsgResume           = "RESUME"
+	MsgLobbySubscribe   = "LOBBY_SUBSCRIBE"
+	MsgLobbyUnsubscribe = "LOBBY_UNSUBSCRIBE"
+	MsgUpdateRoom       = "UPDATE_ROOM"
+	MsgKickSpectator    = "KICK_SPECTATOR"
+	MsgCloseRoom        = "CLOSE_ROOM"
+)
+
+// Server message types.
+const (
+	MsgWelcome            = "WELCOME"
+	MsgConnected          = "CONNECTED" // First event on /events
+	MsgAck                = "ACK"
+	MsgError              = "ERROR"
+	MsgRoomCreated        = "ROOM_CREATED"
+	MsgRoomUpdated        = "ROOM_UPDATED"
+	MsgRoomClosed         = "ROOM_CLOSED"
+	MsgKicked             = "KICKED"
+	MsgMatchFound         = "MATCH_FOUND"
+	MsgGameSync           = "GAME_SYNC"
+	MsgMoveMade           = "MOVE_MADE"
+	MsgGameOver           = "GAME_OVER"
+	MsgUpdateRank         = "UPDATE_RANK"
+	MsgSpectatorJoined    = "SPECTATOR_JOINED"
+	MsgSpectatorLeft      = "SPECTATOR_LEFT"
+	MsgSpectatorCount     = "SPECTATOR_COUNT"
+	MsgLobbyRooms         = "LOBBY_ROOMS"
+	MsgLobbyRoom          = "LOBBY_ROOM"
+	MsgLobbyRoomRemoved   = "LOBBY_ROOM_REMOVED"
+	MsgChallengeSent      = "CHALLENGE_SENT"
+	MsgIncomingChallenge  = "INCOMING_CHALLENGE"
+	MsgChallengeAccepted  = "CHALLENGE_ACCEPTED"
+	MsgChallengeDeclined  = "CHALLENGE_DECLINED"
+	MsgChallengeCancelled = "CHALLENGE_CANCELLED"
+	MsgChallengeExpired   = "CHALLENGE_EXPIRED"
+	MsgResumed            = "RESUMED"
+)
+
+// Error codes carried by ERROR messages.
+const (
+	CodeBadRequest         = "BAD_REQUEST"
+	CodeUnknownType        = "UNKNOWN_TYPE"
+	CodeUnsupportedVersion = "UNSUPPORTED_VERSION"
+	CodeNotInGame          = "NOT_IN_GAME"
+	CodeNotYourTurn        = "NOT_YOUR_TURN"
+	CodeCellOccupied       = "CELL_OCCUPIED"
+	CodeInvalidMove        = "INVALID_MOVE"
+	CodeGameFinished       = "GAME_FINISHED"
+	CodeRoomNotFound       = "ROOM_NOT_FOUND"
+	CodeRoomFull           = "ROOM_FULL"
+	CodeWrongPassword      = "WRONG_PASSWORD"
+	CodeGameStarted        = "GAME_STARTED"
+	CodeNotFound           = "NOT_FOUND"
+	CodeUserOffline        = "USER_OFFLINE"
+	CodeRateLimited        = "RATE_LIMITED"
+	CodeNotAllowed         = "NOT_ALLOWED"
+	CodeBanned             = "BANNED"
+	CodeSuspended          = "SUSPENDED"
+	CodeMuted              = "MUTED"
+)
+
+var (
+	errBadRequest         = errors.New("malformed message")
+	errUnknownType        = errors.New("unknown message type")
+	errUnsupportedVersion = errors.New("unsupported protocol version")
+	errNotInGame          = errors.New("not in a game")
+	errNotAPlayer         = errors.New("spectators cannot play moves")
+	errNotYourTurn        = errors.New("not your turn")
+	errBerserkNotAllowed  = errors.New("berserk is only allowed before your first move")
+	errNoWin              = errors.New("the game has not been won")
+)
+
+// errorCodes maps known errors to the code sent to clients. Anything else
+// is reported as NOT_ALLOWED.
+var errorCodes = []struct {
+	err  error
+	code string
+}{
+	{errBadRequest, CodeBadRequest},
+	{errChatTooLong, CodeBadRequest},
+	{errRateLimited, CodeRateLimited},
+	{errUnknownType, CodeUnknownType},
+	{errUnsupportedVersion, CodeUnsupportedVersion},
+	{errNotInGame, CodeNotInGame},
+	{errNotYourTurn, CodeNotYourTurn},
+	{engine.ErrCellOccupied, CodeCellOccupied},
+	{engine.ErrOutOfBounds, CodeInvalidMove},
+	{engine.ErrGameOver, CodeGameFinished},
+	{errRoomNotFound, CodeRoomNotFound},
+	{errRoomFull, CodeRoomFull},
+	{errWrongPassword, CodeWrongPassword},
+	{errRoomStarted, CodeGameStarted},
+	{errSpectatorNotFound, CodeNotFound},
+	{errChallengeNotFound, CodeNotFound},
+	{errTargetOffline, CodeUserOffline},
+	{errChallengerOffline, CodeUserOffline},
+	{tournament.ErrNotFound, CodeNotFound},
+	{errBanned, CodeBanned},
+	{errSuspended, CodeSuspended},
+	{errMuted, CodeMuted},
+}
+
+func errorCode(err error) string {
+	for _, e := range errorCodes {
+		if errors.Is(err, e.err) {
+			return e.code
+		}
+	}
+	return CodeNotAllowed
+}
+
+// Envelope holds the fields shared by every client message. The rest of the
+// message sits next to them at the top level.
+type Envelope struct {
+	Type      string `json:"type" msgpack:"type"`
+	Version   int    `json:"v,omitempty" msgpack:"v,omitempty"`
+	RequestID string `json:"request_id,omitempty" msgpack:"request_id,omitempty"`
+}
+
+// request is a decoded envelope plus the raw message for typed decoding.
+type request struct {
+	Envelope
+	raw     []byte
+	replied bool
+}
+
+// decode unmarshals the full message into v.
+func (r *request) decode(v interface{}) error {
+	if err := json.Unmarshal(r.raw, v); err != nil {
+		return errBadRequest
+	}
+	return nil
+}
+
+type HelloRequest struct {
+	Version int `json:"version" msgpack:"version"`
+}
+
+type FindMatchRequest struct {
+	Rule engine.GameRule `json:"rule" msgpack:"rule"`
+}
+
+// GameSettings is the rule and time control of CREATE_ROOM and CHALLENGE.
+// Times are in seconds.
+type GameSettings struct {
+	Rule      engine.GameRule `json:"rule" msgpack:"rule"`
+	TotalTime *float64        `json:"total_time" msgpack:"total_time"`
+	Increment *float64        `json:"increment" msgpack:"increment"`
+	TurnLimit *float64        `json:"turn_limit" msgpack:"turn_limit"`
+}
+
+// resolve fills in defaults: 5+5 with a 30s move limit, standard rule.
+func (s GameSettings) resolve() (totalTime, increment, turnLimit time.Duration, rule engine.GameRule) {
+	seconds := func(v *float64, fallback time.Duration) time.Duration {
+		if v == nil {
+			return fallback
+		}
+		return time.Duration(*v) * time.Second
+	}
+	rule = s.Rule
+	if rule == "" {
+		rule = engine.RuleStandard
+	}
+	return seconds(s.TotalTime, 5*time.Minute), seconds(s.Increment, 5*time.Second), seconds(s.TurnLimit, 30*time.Second), rule
+}
+
+// Room visibility for CREATE_ROOM. Only public rooms are listed in the
+// lobby; private rooms are found by code.
+const (
+	VisibilityPrivate = "private"
+	VisibilityPublic  = "public"
+)
+
+type CreateRoomRequest struct {
+	GameSettings
+	Visibility          string  `json:"visibility" msgpack:"visibility"`
+	Password            string  `json:"password" msgpack:"password"`               // Private rooms only
+	SpectatorDelay      float64 `json:"spectator_delay" msgpack:"spectator_delay"` // seconds
+	SpectatorDelayMoves int     `json:"spectator_delay_moves" msgpack:"spectator_delay_moves"`
+}
+
+// Room roles for JOIN_ROOM. An empty role takes a free seat or spectates.
+const (
+	RolePlayer    = "player"
+	RoleSpectator = "spectator"
+)
+
+type JoinRoomRequest struct {
+	Code     string `json:"code" msgpack:"code"`
+	Role     string `json:"role" msgpack:"role"`
+	Password string `json:"password" msgpack:"password"`
+}
+
+// UpdateRoomRequest changes the settings of a room before the game starts.
+// Fields left out keep their current value; an empty password removes it.
+type UpdateRoomRequest struct {
+	GameSettings
+	Visibility          string   `json:"visibility" msgpack:"visibility"`
+	Password            *string  `json:"password" msgpack:"password"`
+	SpectatorDelay      *float64 `json:"spectator_delay" msgpack:"spectator_delay"`
+	SpectatorDelayMoves *int     `json:"spectator_delay_moves" msgpack:"spectator_delay_moves"`
+}
+
+type KickSpectatorRequest struct {
+	UserID string `json:"user_id" msgpack:"user_id"`
+}
+
+type MoveRequest struct {
+	X *int `json:"x" msgpack:"x"`
+	Y *int `json:"y" msgpack:"y"`
+}
+
+// ChatRequest sends text to a room, the lobby or one user. Channel may be
+// left out when room_id or to makes it clear.
+type ChatRequest struct {
+	Text    string `json:"text" msgpack:"text"`
+	Channel string `json:"channel" msgpack:"channel"`
+	RoomID  string `json:"room_id" msgpack:"room_id"`
+	To      string `json:"to" msgpack:"to"`
+}
+
+type ArenaJoinRequest struct {
+	ArenaID string `json:"arena_id" msgpack:"arena_id"`
+}
+
+type ChallengeRequest struct {
+	GameSettings
+	TargetID string `json:"target_id" msgpack:"target_id"`
+	Store    bool   `json:"store" msgpack:"store"`
+}
+
+// ResumeRequest asks for the events of a room missed since last_seq. Without
+// last_seq the client gets a full snapshot.
+type ResumeRequest struct {
+	Room     string  `json:"room" msgpack:"room"`
+	LastSeq  *uint64 `json:"last_seq" msgpack:"last_seq"`
+	Password string  `json:"password" msgpack:"password"` // Only needed to start watching
+}
+
+// ChallengeAnswerRequest is used by CHALLENGE_ACCEPT, CHALLENGE_DECLINE and
+// CHALLENGE_CANCEL.
+type ChallengeAnswerRequest struct {
+	ChallengeID string `json:"challenge_id" msgpack:"challenge_id"`
+}
+
+// replier is implemented by responses that echo the request ID.
+type replier interface {
+	setRequestID(id string)
+}
+
+// replyTo is embedded by responses to a specific request.
+type replyTo struct {
+	RequestID string `json:"request_id,omitempty" msgpack:"request_id,omitempty"`
+}
+
+func (r *replyTo) setRequestID(id string) { r.RequestID = id }
+
+type WelcomeMessage struct {
+	Type    string `json:"type" msgpack:"type"`
+	Version int    `json:"version" msgpack:"version"`
+	replyTo
+}
+
+// ConnectedMessage gives an event stream client the ID to post its
+// actions with.
+type ConnectedMessage struct {
+	Type         string `json:"type" msgpack:"type"`
+	ConnectionID string `json:"connection_id" msgpack:"connection_id"`
+}
+
+type AckMessage struct {
+	Type string `json:"type" msgpack:"type"`
+	replyTo
+}
+
+type ErrorMessage struct {
+	Type    string `json:"type" msgpack:"type"`
+	Code    string `json:"code" msgpack:"code"`
+	Message string `json:"message" msgpack:"message"`
+	replyTo
+}
+
+// RoomCreatedMessage describes a room's settings. It is also sent as
+// ROOM_UPDATED when the host changes them.
+type RoomCreatedMessage struct {
+	Type      string          `json:"type" msgpack:"type"`
+	Code      string          `json:"code" msgpack:"code"`
+	Rule      engine.GameRule `json:"rule" msgpack:"rule"`
+	TotalTime float64         `json:"total_time" msgpack:"total_time"`
+	Increment float64         `json:"increment" msgpack:"increment"`
+	TurnLimit float64         `json:"turn_limit" msgpack:"turn_limit"`
+
+	Visibility          string  `json:"visibility" msgpack:"visibility"`
+	HasPassword         bool    `json:"has_password,omitempty" msgpack:"has_password,omitempty"`
+	SpectatorDelay      float64 `json:"spectator_delay,omitempty" msgpack:"spectator_delay,omitempty"`
+	SpectatorDelayMoves int     `json:"spectator_delay_moves,omitempty" msgpack:"spectator_delay_moves,omitempty"`
+	replyTo
+}
+
+type MatchFoundMessage struct {
+	Type      string  `json:"type" msgpack:"type"`
+	Color     string  `json:"color" msgpack:"color"`
+	TotalTime float64 `json:"total_time" msgpack:"total_time"`
+	TurnLimit float64 `json:"turn_limit" msgpack:"turn_limit"`
+	ArenaID   string  `json:"arena_id,omitempty" msgpack:"arena_id,omitempty"`
+}
+
+// GameSyncMessage is a full snapshot of a game. seq is the latest event it
+// includes; result is set once the game is over.
+type GameSyncMessage struct {
+	Type      string            `json:"type" msgpack:"type"`
+	Color     string            `json:"color" msgpack:"color"`
+	PlayerX   string            `json:"player_x" msgpack:"player_x"`
+	PlayerO   string            `json:"player_o" msgpack:"player_o"`
+	History   []engine.Position `json:"history" msgpack:"history"`
+	Turn      engine.Player     `json:"turn" msgpack:"turn"`
+	TurnLimit float64           `json:"turn_limit" msgpack:"turn_limit"`
+	TimeX     float64           `json:"time_x" msgpack:"time_x"`
+	TimeO     float64           `json:"time_o" msgpack:"time_o"`
+	Seq       uint64            `json:"seq" msgpack:"seq"`
+	Result    *GameOverMessage  `json:"result,omitempty" msgpack:"result,omitempty"`
+	replyTo
+}
+
+// ResumedMessage follows the replayed events of a RESUME.
+type ResumedMessage struct {
+	Type     string  `json:"type" msgpack:"type"`
+	Room     string  `json:"room" msgpack:"room"`
+	Seq      uint64  `json:"seq" msgpack:"seq"`
+	Replayed int     `json:"replayed" msgpack:"replayed"`
+	TimeX    float64 `json:"time_x" msgpack:"time_x"`
+	TimeO    float64 `json:"time_o" msgpack:"time_o"`
+	replyTo
+}
+
+type MoveMadeMessage struct {
+	Type  string  `json:"type" msgpack:"type"`
+	X     int     `json:"x" msgpack:"x"`
+	Y     int     `json:"y" msgpack:"y"`
+	TimeX float64 `json:"time_x" msgpack:"time_x"`
+	TimeO float64 `json:"time_o" msgpack:"time_o"`
+	seqNo
+	replyTo
+}
+
+type GameOverMessage struct {
+	Type        string            `json:"type" msgpack:"type"`
+	Winner      string            `json:"winner" msgpack:"winner"`
+	WinningLine []engine.Position `json:"winningLine" msgpack:"winningLine"`
+	Reason      string            `json:"reason,omitempty" msgpack:"reason,omitempty"`
+	seqNo
+}
+
+// ChatMessage is a chat line as delivered; the sender is set by the server.
+type ChatMessage struct {
+	Type      string    `json:"type" msgpack:"type"`
+	Channel   string    `json:"channel" msgpack:"channel"`
+	SenderID  string    `json:"sender_id" msgpack:"sender_id"`
+	Text      string    `json:"text" msgpack:"text"`
+	RoomID    string    `json:"room_id,omitempty" msgpack:"room_id,omitempty"`
+	Timestamp time.Time `json:"timestamp" msgpack:"timestamp"`
+	seqNo
+}
+
+type UpdateRankMessage struct {
+	Type  string `json:"type" msgpack:"type"`
+	ELO   int    `json:"elo" msgpack:"elo"`
+	Coins int    `json:"coins" msgpack:"coins"`
+}
+
+type BerserkMessage struct {
+	Type  string  `json:"type" msgpack:"type"`
+	Color string  `json:"color" msgpack:"color"`
+	TimeX float64 `json:"time_x" msgpack:"time_x"`
+	TimeO float64 `json:"time_o" msgpack:"time_o"`
+	seqNo
+}
+
+// SpectatorJoinedMessage is the snapshot a new spectator starts from.
+type SpectatorJoinedMessage struct {
+	Type       string            `json:"type" msgpack:"type"`
+	History    []engine.Position `json:"history" msgpack:"history"`
+	PlayerX    string            `json:"player_x" msgpack:"player_x"`
+	PlayerO    string            `json:"player_o" msgpack:"player_o"`
+	Turn       engine.Player     `json:"turn" msgpack:"turn"`
+	TimeX      float64           `json:"time_x" msgpack:"time_x"`
+	TimeO      float64           `json:"time_o" msgpack:"time_o"`
+	Seq        uint64            `json:"seq" msgpack:"seq"`
+	Result     *GameOverMessage  `json:"result,omitempty" msgpack:"result,omitempty"`
+	Spectators int               `json:"spectators" msgpack:"spectators"`
+	replyTo
+}
+
+// RoomClosedMessage tells everyone in a room that it has been closed.
+type RoomClosedMessage struct {
+	Type   string `json:"type" msgpack:"type"`
+	Code   string `json:"code" msgpack:"code"`
+	Reason string `json:"reason" msgpack:"reason"`
+}
+
+// KickedMessage tells a spectator the host has removed them from the room.
+type KickedMessage struct {
+	Type string `json:"type" msgpack:"type"`
+	Code string `json:"code" msgpack:"code"`
+}
+
+// LobbyRoomsMessage is the lobby listing sent on LOBBY_SUBSCRIBE.
+type LobbyRoomsMessage struct {
+	Type  string         `json:"type" msgpack:"type"`
+	Rooms []api.RoomInfo `json:"rooms" msgpack:"rooms"`
+	replyTo
+}
+
+// LobbyRoomMessage announces a new or changed public room.
+type LobbyRoomMessage struct {
+	Type string       `json:"type" msgpack:"type"`
+	Room api.RoomInfo `json:"room" msgpack:"room"`
+}
+
+// LobbyRoomRemovedMessage announces a room has left the lobby, e.g. because
+// the game is over.
+type LobbyRoomRemovedMessage struct {
+	Type string `json:"type" msgpack:"type"`
+	Code string `json:"code" msgpack:"code"`
+}
+
+// SpectatorCountMessage tells the players how many people are watching.
+type SpectatorCountMessage struct {
+	Type       string `json:"type" msgpack:"type"`
+	Spectators int    `json:"spectators" msgpack:"spectators"`
+}
+
+type SpectatorLeftMessage struct {
+	Type       string `json:"type" msgpack:"type"`
+	UserID     string `json:"user_id" msgpack:"user_id"`
+	Spectators int    `json:"spectators" msgpack:"spectators"`
+}
+
+type ChallengeSentMessage struct {
+	Type        string    `json:"type" msgpack:"type"`
+	ChallengeID string    `json:"challenge_id" msgpack:"challenge_id"`
+	TargetID    string    `json:"target_id" msgpack:"target_id"`
+	ExpiresAt   time.Time `json:"expires_at" msgpack:"expires_at"`
+	replyTo
+}
+
+type IncomingChallengeMessage struct {
+	Type        string          `json:"type" msgpack:"type"`
+	ChallengeID string          `json:"challenge_id" msgpack:"challenge_id"`
+	From        string          `json:"from" msgpack:"from"`
+	Rule        engine.GameRule `json:"rule" msgpack:"rule"`
+	TotalTime   float64         `json:"total_time" msgpack:"total_time"`
+	Increment   float64         `json:"increment" msgpack:"increment"`
+	TurnLimit   float64         `json:"turn_limit" msgpack:"turn_limit"`
+	ExpiresAt   time.Time       `json:"expires_at" msgpack:"expires_at"`
+}
+
+type ChallengeAcceptedMessage struct {
+	Type        string `json:"type" msgpack:"type"`
+	ChallengeID string `json:"challenge_id" msgpack:"challenge_id"`
+	RoomCode    string `json:"room_code" msgpack:"room_code"`
+	Color       string `json:"color" msgpack:"color"`
+	Opponent    string `json:"opponent" msgpack:"opponent"`
+}
+
+// ChallengeEventMessage is used for CHALLENGE_DECLINED, CHALLENGE_CANCELLED
+// and CHALLENGE_EXPIRED.
+type ChallengeEventMessage struct {
+	Type        string `json:"type" msgpack:"type"`
+	ChallengeID string `json:"challenge_id" msgpack:"challenge_id"`
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"caro_chess_server/engine"
+
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+func TestProtocolHandshakeAndErrors(t *testing.T) {
+	u, cleanup := newTestServer()
+	defer cleanup()
+
+	c := dialAs(t, u, "p1")
+	defer c.Close()
+
+	sendJSON(t, c, map[string]interface{}{"type": "HELLO", "version": ProtocolVersion, "request_id": "r1"})
+	if resp := readType(t, c, "WELCOME"); resp["request_id"] != "r1" || resp["version"] != float64(ProtocolVersion) {
+		t.Errorf("unexpected WELCOME %v", resp)
+	}
+
+	sendJSON(t, c, map[string]interface{}{"type": "HELLO", "version": ProtocolVersion + 1})
+	if resp := readType(t, c, "ERROR"); resp["code"] != CodeUnsupportedVersion {
+		t.Errorf("expected %s, got %v", CodeUnsupportedVersion, resp)
+	}
+
+	// JOIN_ROOM without a code used to panic the read loop.
+	sendJSON(t, c, map[string]interface{}{"type": "JOIN_ROOM", "request_id": "r2"})
+	if resp := readType(t, c, "ERROR"); resp["code"] != CodeBadRequest || resp["request_id"] != "r2" {
+		t.Errorf("expected %s for r2, got %v", CodeBadRequest, resp)
+	}
+
+	sendJSON(t, c, map[string]interface{}{"type": "SHOUT", "text": "hi"})
+	if resp := readType(t, c, "ERROR"); resp["code"] != CodeUnknownType {
+		t.Errorf("expected %s, got %v", CodeUnknownType, resp)
+	}
+
+	sendJSON(t, c, map[string]interface{}{"type": "MOVE", "x": 1, "y": 1})
+	if resp := readType(t, c, "ERROR"); resp["code"] != CodeNotInGame {
+		t.Errorf("expected %s, got %v", CodeNotInGame, resp)
+	}
+
+	sendJSON(t, c, map[string]interface{}{"type": "JOIN_ROOM", "code": "ZZZZ"})
+	if resp := readType(t, c, "ERROR"); resp["code"] != CodeRoomNotFound {
+		t.Errorf("expected %s, got %v", CodeRoomNotFound, resp)
+	}
+}
+
+func TestProtocolMoveErrors(t *testing.T) {
+	u, cleanup := newTestServer()
+	defer cleanup()
+
+	host := dialAs(t, u, "p1")
+	defer host.Close()
+	guest := dialAs(t, u, "p2")
+	defer guest.Close()
+	late := dialAs(t, u, "p3")
+	defer late.Close()
+	time.Sleep(20 * time.Millisecond)
+
+	sendJSON(t, host, map[string]interface{}{"type": "CREATE_ROOM", "request_id": "create"})
+	created := readType(t, host, "ROOM_CREATED")
+	if created["request_id"] != "create" {
+		t.Errorf("expected request_id echoed, got %v", created)
+	}
+	code := created["code"]
+
+	sendJSON(t, guest, map[string]interface{}{"type": "JOIN_ROOM", "code": code})
+	readType(t, host, "MATCH_FOUND")
+	readType(t, guest, "MATCH_FOUND")
+
+	sendJSON(t, late, map[string]interface{}{"type": "JOIN_ROOM", "code": code, "role": "player"})
+	if resp := readType(t, late, "ERROR"); resp["code"] != CodeRoomFull {
+		t.Errorf("expected %s, got %v", CodeRoomFull, resp)
+	}
+
+	sendJSON(t, guest, map[string]interface{}{"type": "MOVE", "x": 7, "y": 7})
+	if resp := readType(t, guest, "ERROR"); resp["code"] != CodeNotYourTurn {
+		t.Errorf("expected %s, got %v", CodeNotYourTurn, resp)
+	}
+
+	sendJSON(t, host, map[string]interface{}{"type": "MOVE", "x": 7, "y": 7, "request_id": "m1"})
+	if resp := readType(t, host, "MOVE_MADE"); resp["request_id"] != "m1" {
+		t.Errorf("expected request_id on mover's MOVE_MADE, got %v", resp)
+	}
+	if resp := readType(t, guest, "MOVE_MADE"); resp["request_id"] != nil {
+		t.Errorf("expected no request_id for the opponent, got %v", resp)
+	}
+
+	sendJSON(t, guest, map[string]interface{}{"type": "MOVE", "x": 7, "y": 7})
+	if resp := readType(t, guest, "ERROR"); resp["code"] != CodeCellOccupied {
+		t.Errorf("expected %s, got %v", CodeCellOccupied, resp)
+	}
+}
+
+func TestProtocolMsgpack(t *testing.T) {
+	u, cleanup := newTestServer()
+	defer cleanup()
+
+	dialer := websocket.Dialer{Subprotocols: []string{SubprotocolMsgpack}}
+	host, resp, err := dialer.Dial(u+"?id=p1", nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer host.Close()
+	if got := resp.Header.Get("Sec-WebSocket-Protocol"); got != SubprotocolMsgpack {
+		t.Fatalf("expected %s to be negotiated, got %q", SubprotocolMsgpack, got)
+	}
+	guest := dialAs(t, u, "p2") // JSON clients share games with msgpack ones
+	defer guest.Close()
+	time.Sleep(20 * time.Millisecond)
+
+	send := func(msg map[string]interface{}) {
+		data, _ := msgpack.Marshal(msg)
+		if err := host.WriteMessage(websocket.BinaryMessage, data); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	read := func(typ string) map[string]interface{} {
+		host.SetReadDeadline(time.Now().Add(2 * time.Second))
+		defer host.SetReadDeadline(time.Time{})
+		for {
+			frameType, data, err := host.ReadMessage()
+			if err != nil {
+				t.Fatalf("waiting for %s: %v", typ, err)
+			}
+			if frameType != websocket.BinaryMessage {
+				t.Fatalf("expected a binary frame, got %d", frameType)
+			}
+			// Numbers are sent in their smallest form; read them all as
+			// int64 or float64.
+			dec := msgpack.NewDecoder(bytes.NewReader(data))
+			dec.UseLooseInterfaceDecoding(true)
+			var msg map[string]interface{}
+			if err := dec.Decode(&msg); err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			if msg["type"] == typ {
+				return msg
+			}
+		}
+	}
+
+	send(map[string]interface{}{"type": "HELLO", "version": ProtocolVersion, "request_id": "r1"})
+	if msg := read("WELCOME"); msg["request_id"] != "r1" || msg["version"] != int64(ProtocolVersion) {
+		t.Errorf("unexpected WELCOME %v", msg)
+	}
+
+	send(map[string]interface{}{"type": "CREATE_ROOM", "spectator_delay": 1.5})
+	created := read("ROOM_CREATED")
+	if created["spectator_delay"] != 1.5 {
+		t.Errorf("expected fractional times to survive, got %v", created)
+	}
+	sendJSON(t, guest, map[string]interface{}{"type": "JOIN_ROOM", "code": created["code"]})
+	read("MATCH_FOUND")
+
+	send(map[string]interface{}{"type": "MOVE", "x": 7, "y": 7})
+	if moved := readType(t, guest, "MOVE_MADE"); moved["x"] != float64(7) {
+		t.Errorf("expected the JSON client to see the move, got %v", moved)
+	}
+
+	if err := host.WriteMessage(websocket.BinaryMessage, []byte{0xc1}); err != nil { // Never valid
+		t.Fatalf("write: %v", err)
+	}
+	if msg := read("ERROR"); msg["code"] != CodeBadRequest {
+		t.Errorf("expected %s for a malformed frame, got %v", CodeBadRequest, msg)
+	}
+}
+
+func TestEncodingsAgree(t *testing.T) {
+	for _, msg := range []interface{}{
+		&GameSyncMessage{
+			Type:    MsgGameSync,
+			History: []engine.Position{{X: 7, Y: 7}},
+			Turn:    engine.PlayerO,
+			TimeX:   299.5,
+			TimeO:   300,
+			Seq:     2,
+			Result:  &GameOverMessage{Type: MsgGameOver, Winner: "O"},
+			replyTo: replyTo{RequestID: "r1"},
+		},
+		&ChatMessage{Type: MsgChat, Channel: ChannelRoom, Text: "gg", Timestamp: time.Date(2024, 5, 1, 12, 0, 0, 5, time.UTC), seqNo: seqNo{Seq: 3}},
+		map[string]interface{}{"type": "TOURNAMENT_BYE", "round": 2},
+	} {
+		wire := encode(msg)
+		var fromJSON, fromMsgpack interface{}
+		if err := json.Unmarshal(wire.jsonBytes(), &fromJSON); err != nil {
+			t.Fatalf("decode JSON: %v", err)
+		}
+		// Compare as JSON, which has only one kind of number.
+		var packed interface{}
+		if err := msgpack.Unmarshal(wire.msgpackBytes(), &packed); err != nil {
+			t.Fatalf("decode msgpack: %v", err)
+		}
+		data, _ := json.Marshal(packed)
+		json.Unmarshal(data, &fromMsgpack)
+		if !reflect.DeepEqual(fromJSON, fromMsgpack) {
+			t.Errorf("encodings differ:\n json    %s\n msgpack %s", wire.jsonBytes(), data)
+		}
+		if m, ok := packed.(map[string]interface{}); ok && m["timestamp"] != nil {
+			if _, ok := m["timestamp"].(string); !ok {
+				t.Errorf("expected times to be sent as strings, got %T", m["timestamp"])
+			}
+		}
+	}
+}
+
+func TestLongestChatFitsInAFrame(t *testing.T) {
+	frame := `{"type":"CHAT","channel":"room","request_id":"0123456789abcdef","text":"` +
+		strings.Repeat(`\ud83d\ude00`, maxChatLength) + `"}`
+	if len(frame) > maxMessageSize {
+		t.Errorf("a %d-character chat message escaped in JSON takes %d bytes, over the %d limit", maxChatLength, len(frame), maxMessageSize)
+	}
+}
+
+func TestEncodeIsLazy(t *testing.T) {
+	msg := &AckMessage{Type: MsgAck}
+	wire := encode(msg)
+	msg.setRequestID("r1") // As when a published event is then a reply
+	if data := string(wire.jsonBytes()); strings.Contains(data, "r1") {
+		t.Errorf("expected the message as it was when encoded, got %s", data)
+	}
+	if wire.msgpack != nil {
+		t.Errorf("expected no msgpack until a client needs it")
+	}
+}
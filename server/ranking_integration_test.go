@@ -4,7 +4,6 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
-	"os"
 	"strings"
 	"testing"
 
@@ -13,8 +12,7 @@ import (
 )
 
 func TestRankingUpdate(t *testing.T) {
-	repo := db.NewFileUserRepository("test_ranking.json")
-	defer os.Remove("test_ranking.json")
+	repo := db.NewMemoryUserRepository()
 	
 	repo.SaveUser(&db.User{ID: "p1", ELO: 1200})
 	repo.SaveUser(&db.User{ID: "p2", ELO: 1200})
@@ -48,16 +46,33 @@ func TestRankingUpdate(t *testing.T) {
 	c2.WriteMessage(websocket.TextMessage, []byte(`{"type":"FIND_MATCH"}`))
 
 	// Consume match found
-	c1.ReadMessage()
-	c2.ReadMessage()
+	x, o := c1, c2
+	if readType(t, c1, "MATCH_FOUND")["color"] != "X" {
+		x, o = c2, c1
+	}
+	readType(t, c2, "MATCH_FOUND")
+
+	// Claiming a win that hasn't happened is refused
+	sendJSON(t, x, map[string]interface{}{"type": "WIN_CLAIM"})
+	if e := readType(t, x, "ERROR"); e["code"] != CodeNotAllowed {
+		t.Errorf("expected a premature WIN_CLAIM to be refused, got %v", e)
+	}
 
-	// P1 (X) claims win
-	winMsg, _ := json.Marshal(map[string]string{"type": "WIN_CLAIM"})
-	c1.WriteMessage(websocket.TextMessage, winMsg)
+	// X wins with five in a row. Both sides see each move before the next.
+	move := func(c *websocket.Conn, x, y int) {
+		sendJSON(t, c, map[string]interface{}{"type": "MOVE", "x": x, "y": y})
+		readType(t, c1, "MOVE_MADE")
+		readType(t, c2, "MOVE_MADE")
+	}
+	for i := 5; i < 9; i++ {
+		move(x, i, 7)
+		move(o, i, 0)
+	}
+	sendJSON(t, x, map[string]interface{}{"type": "MOVE", "x": 9, "y": 7})
 
 	// Expect UPDATE_RANK
-	checkForRankUpdate(t, c1, 1216)
-	checkForRankUpdate(t, c2, 1184)
+	checkForRankUpdate(t, x, 1216)
+	checkForRankUpdate(t, o, 1184)
 }
 
 func checkForRankUpdate(t *testing.T, c *websocket.Conn, expectedElo int) {
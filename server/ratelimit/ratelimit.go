@@ -0,0 +1,75 @@
+// Package ratelimit limits how often each of many keys, such as users or
+// client addresses, may do something.
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Limiter is a token bucket per key. A bucket left alone long enough to
+// refill is the same as a new one, so such buckets are dropped as the
+// limiter is used and it holds only the keys seen recently.
+type Limiter struct {
+	mu       sync.Mutex
+	burst    float64
+	interval time.Duration
+	buckets  map[string]*bucket
+	swept    time.Time // Last time full buckets were dropped
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// New returns a Limiter allowing burst actions at once per key, then one
+// more every interval.
+func New(burst int, interval time.Duration) *Limiter {
+	return &Limiter{
+		burst:    float64(burst),
+		interval: interval,
+		buckets:  make(map[string]*bucket),
+		swept:    time.Now(),
+	}
+}
+
+// Allow takes a token from key's bucket, reporting false if it is empty.
+func (l *Limiter) Allow(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.evict(now)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens += float64(now.Sub(b.last)) / float64(l.interval)
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// evict drops the buckets that have refilled, at most once per refill time
+// so that the cost is spread over many calls. Callers hold l.mu.
+func (l *Limiter) evict(now time.Time) {
+	refill := time.Duration(l.burst * float64(l.interval))
+	if now.Sub(l.swept) < refill {
+		return
+	}
+	l.swept = now
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= refill {
+			delete(l.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	l := New(2, 20*time.Millisecond)
+	if !l.Allow("a") || !l.Allow("a") {
+		t.Fatal("expected a burst of 2")
+	}
+	if l.Allow("a") {
+		t.Error("expected the third action to be refused")
+	}
+	if !l.Allow("b") {
+		t.Error("expected keys to have buckets of their own")
+	}
+
+	time.Sleep(25 * time.Millisecond)
+	if !l.Allow("a") {
+		t.Error("expected a token back after an interval")
+	}
+}
+
+func TestLimiterForgetsIdleKeys(t *testing.T) {
+	l := New(2, 5*time.Millisecond)
+	for _, key := range []string{"a", "b", "c"} {
+		l.Allow(key)
+	}
+	time.Sleep(15 * time.Millisecond)
+	l.Allow("d")
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.buckets) != 1 {
+		t.Errorf("expected only the new key's bucket to be kept, got %d", len(l.buckets))
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"log"
+
+	"caro_chess_server/db"
+	"caro_chess_server/elo"
+)
+
+// replayRatings recomputes the before/after ratings of every match, in the
+// order given, starting all players from elo.DefaultRating. It updates the
+// matches in place and returns each player's final rating.
+func replayRatings(matches []*db.Match) map[string]int {
+	ratings := make(map[string]int)
+	rating := func(id string) int {
+		if r, ok := ratings[id]; ok {
+			return r
+		}
+		return elo.DefaultRating
+	}
+
+	for _, m := range matches {
+		scoreX := 0.5
+		if m.WinnerID != nil {
+			if *m.WinnerID == m.PlayerXID {
+				scoreX = 1.0
+			} else {
+				scoreX = 0.0
+			}
+		}
+
+		xBefore, oBefore := rating(m.PlayerXID), rating(m.PlayerOID)
+		xAfter, oAfter := elo.CalculateRatings(xBefore, oBefore, scoreX)
+
+		m.PlayerXRatingBefore, m.PlayerXRatingAfter = xBefore, xAfter
+		m.PlayerORatingBefore, m.PlayerORatingAfter = oBefore, oAfter
+		ratings[m.PlayerXID] = xAfter
+		ratings[m.PlayerOID] = oAfter
+	}
+	return ratings
+}
+
+// rebuildRatings replays the whole matches table in chronological order and
+// rewrites the per-match rating deltas and every player's current rating.
+func rebuildRatings(repo db.UserRepository) error {
+	matches, err := repo.GetAllMatches()
+	if err != nil {
+		return err
+	}
+
+	ratings := replayRatings(matches)
+
+	for _, m := range matches {
+		if err := repo.UpdateMatchRatings(m); err != nil {
+			return err
+		}
+	}
+
+	for id, r := range ratings {
+		u, err := repo.GetUser(id)
+		if err != nil {
+			return err
+		}
+		u.ELO = r
+		if err := repo.SaveUser(u); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("Rebuilt ratings for %d players from %d matches", len(ratings), len(matches))
+	return nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"caro_chess_server/db"
+)
+
+func TestReplayRatings(t *testing.T) {
+	p1 := "p1"
+	now := time.Now()
+	matches := []*db.Match{
+		{ID: "m1", PlayerXID: "p1", PlayerOID: "p2", WinnerID: &p1, Timestamp: now},
+		{ID: "m2", PlayerXID: "p2", PlayerOID: "p1", WinnerID: nil, Timestamp: now.Add(time.Minute)},
+	}
+
+	ratings := replayRatings(matches)
+
+	if matches[0].PlayerXRatingBefore != 1200 || matches[0].PlayerXRatingAfter != 1216 {
+		t.Errorf("m1 X: expected 1200 -> 1216, got %d -> %d", matches[0].PlayerXRatingBefore, matches[0].PlayerXRatingAfter)
+	}
+	if matches[0].PlayerORatingAfter != 1184 {
+		t.Errorf("m1 O: expected 1184, got %d", matches[0].PlayerORatingAfter)
+	}
+
+	// Second game starts from the ratings produced by the first.
+	if matches[1].PlayerXRatingBefore != 1184 || matches[1].PlayerORatingBefore != 1216 {
+		t.Errorf("m2: expected before 1184/1216, got %d/%d", matches[1].PlayerXRatingBefore, matches[1].PlayerORatingBefore)
+	}
+	if ratings["p1"] != matches[1].PlayerORatingAfter || ratings["p2"] != matches[1].PlayerXRatingAfter {
+		t.Errorf("final ratings mismatch: %v", ratings)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"caro_chess_server/engine"
+)
+
+func TestEventLogBounds(t *testing.T) {
+	gs := &GameSession{}
+	for i := 0; i < maxSessionEvents+10; i++ {
+		gs.record(&ChatMessage{Type: MsgChat, Text: "hi"})
+	}
+
+	if _, _, ok := gs.eventsSince(5); ok {
+		t.Errorf("expected events dropped from the log to need a snapshot")
+	}
+	last := uint64(maxSessionEvents + 10)
+	events, seq, ok := gs.eventsSince(last - 3)
+	if !ok || len(events) != 3 || seq != last {
+		t.Errorf("expected the last 3 events up to %d, got %d events up to %d (ok=%v)", last, len(events), seq, ok)
+	}
+	if _, _, ok := gs.eventsSince(last + 1); ok {
+		t.Errorf("expected a sequence number from the future to need a snapshot")
+	}
+}
+
+func TestResumeReplaysMissedEvents(t *testing.T) {
+	u, cleanup := newTestServer()
+	defer cleanup()
+
+	host := dialAs(t, u, "p1")
+	defer host.Close()
+	guest := dialAs(t, u, "p2")
+
+	sendJSON(t, host, map[string]interface{}{"type": "CREATE_ROOM", "rule": string(engine.RuleFreeStyle)})
+	code := readType(t, host, "ROOM_CREATED")["code"]
+	sendJSON(t, guest, map[string]interface{}{"type": "JOIN_ROOM", "code": code})
+	readType(t, guest, "MATCH_FOUND")
+
+	sendJSON(t, host, map[string]interface{}{"type": "MOVE", "x": 7, "y": 7})
+	if made := readType(t, guest, "MOVE_MADE"); made["seq"] != 1.0 {
+		t.Fatalf("expected first event to be seq 1, got %v", made)
+	}
+	guest.Close()
+	time.Sleep(20 * time.Millisecond)
+
+	// Sent while the guest is away.
+	sendJSON(t, host, map[string]interface{}{"type": "CHAT_MESSAGE", "room_id": code, "text": "still there?"})
+	readType(t, host, "CHAT_MESSAGE")
+
+	guest = dialAs(t, u, "p2")
+	defer guest.Close()
+	sendJSON(t, guest, map[string]interface{}{"type": "RESUME", "room": code, "last_seq": 1, "request_id": "r"})
+	if chat := readType(t, guest, "CHAT_MESSAGE"); chat["seq"] != 2.0 || chat["text"] != "still there?" {
+		t.Errorf("expected the missed chat as seq 2, got %v", chat)
+	}
+	resumed := readType(t, guest, "RESUMED")
+	if resumed["seq"] != 2.0 || resumed["replayed"] != 1.0 || resumed["request_id"] != "r" {
+		t.Errorf("unexpected RESUMED %v", resumed)
+	}
+	if timeO, _ := resumed["time_o"].(float64); timeO <= 0 || timeO > 300 {
+		t.Errorf("expected O's running clock, got %v", resumed["time_o"])
+	}
+
+	// The guest is seated again and can play on.
+	sendJSON(t, guest, map[string]interface{}{"type": "MOVE", "x": 8, "y": 8})
+	if made := readType(t, host, "MOVE_MADE"); made["seq"] != 3.0 {
+		t.Errorf("expected seq 3, got %v", made)
+	}
+
+	// Without last_seq the client gets a snapshot.
+	sendJSON(t, guest, map[string]interface{}{"type": "RESUME", "room": code})
+	sync := readType(t, guest, "GAME_SYNC")
+	if history, _ := sync["history"].([]interface{}); len(history) != 2 || sync["seq"] != 3.0 || sync["color"] != "O" {
+		t.Errorf("unexpected snapshot %v", sync)
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
-	"os"
 	"strings"
 	"testing"
 
@@ -13,8 +12,7 @@ import (
 )
 
 func TestRoomFlow(t *testing.T) {
-	repo := db.NewFileUserRepository("test_room_flow.json")
-	defer os.Remove("test_room_flow.json")
+	repo := db.NewMemoryUserRepository()
 	
 	hub := newHub()
 	go hub.run()
@@ -23,7 +21,8 @@ func TestRoomFlow(t *testing.T) {
 	rm := newRoomManager()
 
 	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		serveWs(hub, mm, rm, w, r, "test_user")
+		id := r.URL.Query().Get("id")
+		serveWs(hub, mm, rm, w, r, id)
 	}))
 	defer s.Close()
 
@@ -61,3 +60,51 @@ func TestRoomFlow(t *testing.T) {
 		t.Errorf("match failed")
 	}
 }
+
+func TestRoomHostControls(t *testing.T) {
+	u, cleanup := newTestServer()
+	defer cleanup()
+
+	host := dialAs(t, u, "p1")
+	defer host.Close()
+	sendJSON(t, host, map[string]interface{}{"type": "CREATE_ROOM", "password": "secret"})
+	code := readType(t, host, "ROOM_CREATED")["code"]
+
+	watcher := dialAs(t, u, "watcher")
+	defer watcher.Close()
+	sendJSON(t, watcher, map[string]interface{}{"type": "JOIN_ROOM", "code": code, "role": "spectator", "password": "guess"})
+	if e := readType(t, watcher, "ERROR"); e["code"] != CodeWrongPassword {
+		t.Errorf("expected WRONG_PASSWORD, got %v", e)
+	}
+	sendJSON(t, watcher, map[string]interface{}{"type": "JOIN_ROOM", "code": code, "role": "spectator", "password": "secret"})
+	readType(t, watcher, "SPECTATOR_JOINED")
+
+	// Settings can change before the game starts; spectators hear about it.
+	sendJSON(t, host, map[string]interface{}{"type": "UPDATE_ROOM", "total_time": 60, "rule": "caro"})
+	if updated := readType(t, host, "ROOM_UPDATED"); updated["total_time"] != 60.0 || updated["rule"] != "caro" || updated["has_password"] != true {
+		t.Errorf("unexpected ROOM_UPDATED %v", updated)
+	}
+	readType(t, watcher, "ROOM_UPDATED")
+
+	sendJSON(t, watcher, map[string]interface{}{"type": "CLOSE_ROOM"})
+	if e := readType(t, watcher, "ERROR"); e["code"] != CodeNotAllowed {
+		t.Errorf("expected only the host to close the room, got %v", e)
+	}
+
+	sendJSON(t, host, map[string]interface{}{"type": "KICK_SPECTATOR", "user_id": "watcher"})
+	if kicked := readType(t, watcher, "KICKED"); kicked["code"] != code {
+		t.Errorf("unexpected KICKED %v", kicked)
+	}
+	sendJSON(t, watcher, map[string]interface{}{"type": "JOIN_ROOM", "code": code, "password": "secret"})
+	if e := readType(t, watcher, "ERROR"); e["code"] != CodeNotAllowed {
+		t.Errorf("expected a kicked user to stay out, got %v", e)
+	}
+
+	sendJSON(t, host, map[string]interface{}{"type": "CLOSE_ROOM", "request_id": "close"})
+	readType(t, host, "ROOM_CLOSED")
+	readType(t, host, "ACK")
+	sendJSON(t, watcher, map[string]interface{}{"type": "JOIN_ROOM", "code": code, "password": "secret"})
+	if e := readType(t, watcher, "ERROR"); e["code"] != CodeRoomNotFound {
+		t.Errorf("expected the closed room to be gone, got %v", e)
+	}
+}
@@ -1,38 +1,61 @@
 package main
 
 import (
-	"encoding/json"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"errors"
-	"math/rand"
+	"log"
+	"math/big"
 	"sync"
 	"time"
 
+	"caro_chess_server/api"
 	"caro_chess_server/engine"
 )
 
+// Room states. Rooms are removed once closed, and a little while after the
+// game is finished so players can still fetch the result.
+const (
+	RoomWaiting  = api.RoomWaiting
+	RoomPlaying  = api.RoomPlaying
+	RoomFinished = api.RoomFinished
+	RoomClosed   = api.RoomClosed
+)
+
+const (
+	roomIdleTimeout   = 10 * time.Minute // Waiting rooms, and games nobody is connected to
+	finishedRoomTTL   = 2 * time.Minute
+	roomSweepInterval = 30 * time.Second
+)
+
+// Reasons sent with ROOM_CLOSED.
+const (
+	closeExpired   = "expired"
+	closeAbandoned = "abandoned"
+	closeByHost    = "closed_by_host"
+	closeHostLeft  = "host_left"
+)
+
 type RoomManager struct {
 	rooms map[string]*GameSession
 	mu    sync.RWMutex
+	lobby *Lobby      // Optional; enables public rooms
+	mm    *Matchmaker // Optional; ends abandoned games so they report a result
 }
 
 func newRoomManager() *RoomManager {
-	rand.Seed(time.Now().UnixNano())
 	return &RoomManager{
 		rooms: make(map[string]*GameSession),
 	}
 }
 
 func (rm *RoomManager) createRoom(host *Client, totalTime, increment, moveLimit time.Duration, rule engine.GameRule) (string, error) {
+	rating := rm.rating(host.ID)
 	rm.mu.Lock()
 	defer rm.mu.Unlock()
 
-	code := rm.generateCode()
-	for {
-		if _, exists := rm.rooms[code]; !exists {
-			break
-		}
-		code = rm.generateCode()
-	}
+	code := rm.uniqueCode()
 
 	session := &GameSession{
 		ClientX:       host,
@@ -44,68 +67,143 @@ func (rm *RoomManager) createRoom(host *Client, totalTime, increment, moveLimit
 		TotalTimeO:    totalTime,
 		Increment:     increment,
 		MoveTimeLimit: moveLimit,
+		InitialTime:   totalTime,
 		LastMoveTime:  time.Now(),
+		Code:          code,
+		HostID:        host.ID,
+		lobby:         rm.lobby,
+		ratingX:       rating,
+		active:        time.Now(),
 	}
 
 	rm.rooms[code] = session
-	host.Session = session
+	host.setSession(session)
 	return code, nil
 }
 
+// createReservedRoom creates a room whose seats are already assigned, e.g. for
+// tournament games. The game starts once both players have joined.
+func (rm *RoomManager) createReservedRoom(playerXID, playerOID string, totalTime, increment, moveLimit time.Duration, rule engine.GameRule) (string, *GameSession) {
+	ratingX, ratingO := rm.rating(playerXID), rm.rating(playerOID)
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	code := rm.uniqueCode()
+	session := &GameSession{
+		PlayerXID:     playerXID,
+		PlayerOID:     playerOID,
+		Turn:          "X",
+		Engine:        engine.NewGameEngine(15, 15, rule),
+		Spectators:    make(map[*Client]bool),
+		TotalTimeX:    totalTime,
+		TotalTimeO:    totalTime,
+		Increment:     increment,
+		MoveTimeLimit: moveLimit,
+		InitialTime:   totalTime,
+		LastMoveTime:  time.Now(),
+		Code:          code,
+		lobby:         rm.lobby,
+		ratingX:       ratingX,
+		ratingO:       ratingO,
+		active:        time.Now(),
+	}
+
+	rm.rooms[code] = session
+	return code, session
+}
+
+var (
+	errRoomNotFound      = errors.New("room not found")
+	errRoomFull          = errors.New("room is full")
+	errWrongPassword     = errors.New("wrong room password")
+	errKicked            = errors.New("removed from this room by the host")
+	errNotHost           = errors.New("only the host can do that")
+	errRoomStarted       = errors.New("the game has already started")
+	errSpectatorNotFound = errors.New("no such spectator")
+)
+
 func (rm *RoomManager) joinRoom(code string, guest *Client) error {
+	_, _, err := rm.joinRoomAs(code, guest, "", "")
+	return err
+}
+
+// joinRoomAs seats guest in a room, or adds them as a spectator. role is
+// RolePlayer, RoleSpectator or "" to take a free seat if there is one.
+// Players with a reserved seat always get it back; everyone else needs the
+// password if the room has one.
+func (rm *RoomManager) joinRoomAs(code string, guest *Client, role, password string) (*GameSession, bool, error) {
+	rating := rm.rating(guest.ID) // In case they take a seat
 	rm.mu.Lock()
 	defer rm.mu.Unlock()
 
 	session, exists := rm.rooms[code]
 	if !exists {
-		return errors.New("room not found")
+		return nil, false, errRoomNotFound
 	}
 
+	spectator, joined, err := session.seat(guest, role, password, rating)
+	if err != nil {
+		return nil, false, err
+	}
+	guest.setSession(session)
+	if spectator {
+		session.addSpectator(guest)
+	} else if joined {
+		session.listingChanged()
+	}
+	return session, spectator, nil
+}
+
+// seat gives guest their reserved seat back or the free O seat, in which
+// case joined is set and rating is shown for them in the lobby, or, if the
+// room is full or they asked to watch, reports that they are a spectator.
+func (gs *GameSession) seat(guest *Client, role, password string, rating int) (spectator, joined bool, err error) {
+	gs.Lock()
+	defer gs.Unlock()
+
 	// Check for Reconnect
-	if session.PlayerXID == guest.ID {
+	if gs.PlayerXID == guest.ID {
 		// Reconnect as Host
-		session.StopDisconnectTimer(true)
-		session.ClientX = guest
-		guest.Session = session
-		return nil
+		gs.stopDisconnectTimer(true)
+		gs.ClientX = guest
+		return false, false, nil
 	}
-	if session.PlayerOID == guest.ID {
+	if gs.PlayerOID == guest.ID {
 		// Reconnect as Guest
-		session.StopDisconnectTimer(false)
-		session.ClientO = guest
-		guest.Session = session
-		return nil
+		gs.stopDisconnectTimer(false)
+		gs.ClientO = guest
+		return false, false, nil
 	}
 
-	if session.ClientO != nil {
-		// Room full, add as spectator
-		if session.Spectators == nil {
-			session.Spectators = make(map[*Client]bool)
-		}
-		session.Spectators[guest] = true
-		guest.Session = session
-
-		// Send initial state to spectator
-		initialState := map[string]interface{}{
-			"type":     "SPECTATOR_JOINED",
-			"history":  session.Engine.History,
-			"player_x": session.PlayerXID,
-			"player_o": session.PlayerOID,
-		}
-
-		msg, err := json.Marshal(initialState)
-		if err == nil {
-			guest.send <- msg
-		}
+	if gs.kicked[guest.ID] {
+		return false, false, errKicked
+	}
+	if !gs.checkPassword(password) {
+		return false, false, errWrongPassword
+	}
+	gs.touch()
 
-		return nil
+	full := gs.ClientO != nil || gs.PlayerOID != ""
+	if full && role == RolePlayer {
+		return false, false, errRoomFull
+	}
+	if full || role == RoleSpectator {
+		return true, false, nil
 	}
 
-	session.ClientO = guest
-	session.PlayerOID = guest.ID
-	guest.Session = session
+	gs.ClientO = guest
+	gs.PlayerOID = guest.ID
+	gs.ratingO = rating
+	return false, true, nil
+}
 
-	return nil
+// rating reads a player's rating for the lobby. It reads the database, so
+// callers must not hold rm.mu.
+func (rm *RoomManager) rating(userID string) int {
+	if rm.lobby == nil {
+		return 0
+	}
+	return rm.lobby.rating(userID)
 }
 
 func (rm *RoomManager) getRoom(code string) (*GameSession, bool) {
@@ -115,31 +213,212 @@ func (rm *RoomManager) getRoom(code string) (*GameSession, bool) {
 	return s, ok
 }
 
-func (rm *RoomManager) generateCode() string {
-	const letters = "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+// uniqueCode returns a code not used by any room. Callers must hold rm.mu.
+func (rm *RoomManager) uniqueCode() string {
+	code := generateCode()
+	for {
+		if _, exists := rm.rooms[code]; !exists {
+			return code
+		}
+		code = generateCode()
+	}
+}
+
+// codeAlphabet leaves out characters that are easily confused when a code
+// is read out or typed: 0/O, 1/I/L.
+const codeAlphabet = "ABCDEFGHJKMNPQRSTUVWXYZ23456789"
+
+func generateCode() string {
 	b := make([]byte, 4)
 	for i := range b {
-		b[i] = letters[rand.Intn(len(letters))]
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(codeAlphabet))))
+		if err != nil {
+			panic(err) // crypto/rand never fails on supported platforms
+		}
+		b[i] = codeAlphabet[n.Int64()]
 	}
 	return string(b)
 }
 
-func (rm *RoomManager) broadcast(code string, msg []byte) {
+// run removes expired rooms until the process exits.
+func (rm *RoomManager) run() {
+	ticker := time.NewTicker(roomSweepInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		rm.sweep(now)
+	}
+}
+
+// sweep removes finished rooms once their result has been available for a
+// while, and closes waiting rooms and abandoned games that have been idle
+// for too long.
+func (rm *RoomManager) sweep(now time.Time) {
+	// Abandoned games end first, outside rm.mu, so that tournaments hear of
+	// them; abort updates the lobby.
+	for _, session := range rm.abandoned(now) {
+		if rm.mm != nil {
+			rm.mm.abort(session, closeAbandoned)
+		}
+		rm.mu.Lock()
+		if rm.rooms[session.Code] == session {
+			rm.closeRoom(session, closeAbandoned)
+		}
+		rm.mu.Unlock()
+	}
+
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	for code, session := range rm.rooms {
+		idle := now.Sub(session.lastActive())
+		switch session.roomState() {
+		case RoomFinished:
+			if idle >= finishedRoomTTL {
+				delete(rm.rooms, code)
+			}
+		case RoomClosed:
+			delete(rm.rooms, code)
+		case RoomWaiting:
+			if idle >= roomIdleTimeout {
+				rm.closeRoom(session, closeExpired)
+			}
+		}
+	}
+}
+
+// abandoned returns the games in play that both players have left and that
+// have been idle for too long.
+func (rm *RoomManager) abandoned(now time.Time) []*GameSession {
 	rm.mu.RLock()
 	defer rm.mu.RUnlock()
-	if session, ok := rm.rooms[code]; ok {
-		if session.ClientX != nil {
-			session.ClientX.send <- msg
+
+	var sessions []*GameSession
+	for _, session := range rm.rooms {
+		if session.roomState() != RoomPlaying || now.Sub(session.lastActive()) < roomIdleTimeout {
+			continue
 		}
-		if session.ClientO != nil {
-			session.ClientO.send <- msg
+		if x, o := session.players(); x == nil && o == nil {
+			sessions = append(sessions, session)
 		}
-		for client := range session.Spectators {
-			select {
-			case client.send <- msg:
-			default:
-				// Drop message if buffer full
-			}
+	}
+	return sessions
+}
+
+// closeRoom stops the room's game, tells everyone in it and removes it.
+// Callers must hold rm.mu.
+func (rm *RoomManager) closeRoom(session *GameSession, reason string) {
+	log.Printf("Closing room %s: %s", session.Code, reason)
+	session.StopGame()
+	session.logMu.Lock()
+	session.closed = true
+	session.logMu.Unlock()
+	delete(rm.rooms, session.Code)
+
+	msg := encode(RoomClosedMessage{Type: MsgRoomClosed, Code: session.Code, Reason: reason})
+	x, o := session.players()
+	clients := []*Client{x, o}
+	session.spectatorsMu.Lock()
+	for c := range session.Spectators {
+		clients = append(clients, c)
+	}
+	session.Spectators = make(map[*Client]bool)
+	session.spectatorsMu.Unlock()
+	for _, c := range clients {
+		if c == nil {
+			continue
+		}
+		c.leaveSession(session)
+		c.enqueue(msg, dropIfFull)
+	}
+	session.listingChanged()
+}
+
+// hostedRoom returns the room c is hosting.
+func (c *Client) hostedRoom() (*GameSession, error) {
+	session := c.session()
+	if session == nil || session.Code == "" {
+		return nil, errNotInRoom
+	}
+	if x, _ := session.players(); session.HostID == "" || session.HostID != c.ID || x != c {
+		return nil, errNotHost
+	}
+	return session, nil
+}
+
+// close closes the room hosted by c. Games in progress can't be closed.
+func (rm *RoomManager) close(c *Client) error {
+	session, err := c.hostedRoom()
+	if err != nil {
+		return err
+	}
+	if session.roomState() == RoomPlaying {
+		return errRoomStarted
+	}
+	rm.remove(session, closeByHost)
+	return nil
+}
+
+// remove closes session if it is still open.
+func (rm *RoomManager) remove(session *GameSession, reason string) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	if rm.rooms[session.Code] == session {
+		rm.closeRoom(session, reason)
+	}
+}
+
+// kick removes every connection of userID from the spectators of the room
+// hosted by c, and keeps them out for the rest of its life.
+func (rm *RoomManager) kick(c *Client, userID string) error {
+	session, err := c.hostedRoom()
+	if err != nil {
+		return err
+	}
+
+	var kicked []*Client
+	session.spectatorsMu.Lock()
+	for spectator := range session.Spectators {
+		if spectator.ID == userID {
+			kicked = append(kicked, spectator)
 		}
 	}
+	session.spectatorsMu.Unlock()
+	if len(kicked) == 0 {
+		return errSpectatorNotFound
+	}
+
+	session.Lock()
+	if session.kicked == nil {
+		session.kicked = make(map[string]bool)
+	}
+	session.kicked[userID] = true
+	session.Unlock()
+
+	msg := encode(KickedMessage{Type: MsgKicked, Code: session.Code})
+	for _, spectator := range kicked {
+		spectator.stopWatching()
+		spectator.enqueue(msg, closeIfFull)
+	}
+	return nil
+}
+
+// setPassword sets the room's password, or removes it if password is empty.
+// Callers must hold the session lock.
+func (gs *GameSession) setPassword(password string) {
+	if password == "" {
+		gs.passwordHash = nil
+		return
+	}
+	sum := sha256.Sum256([]byte(password))
+	gs.passwordHash = sum[:]
+}
+
+// checkPassword reports whether password opens the room. Callers must hold
+// the session lock.
+func (gs *GameSession) checkPassword(password string) bool {
+	if gs.passwordHash == nil {
+		return true
+	}
+	sum := sha256.Sum256([]byte(password))
+	return subtle.ConstantTimeCompare(sum[:], gs.passwordHash) == 1
 }
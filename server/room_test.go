@@ -1,15 +1,20 @@
 package main
 
 import (
+	"strings"
 	"testing"
+	"time"
+
+	"caro_chess_server/db"
+	"caro_chess_server/engine"
 )
 
 func TestRoomCreation(t *testing.T) {
 	rm := newRoomManager()
 	
-	c1 := &Client{ID: "p1", send: make(chan []byte, 10)}
+	c1 := &Client{ID: "p1", send: make(chan *wireMessage, 10)}
 	
-	code, err := rm.createRoom(c1)
+	code, err := rm.createRoom(c1, 5*time.Minute, 5*time.Second, 30*time.Second, engine.RuleStandard)
 	if err != nil {
 		t.Fatalf("createRoom failed: %v", err)
 	}
@@ -26,7 +31,7 @@ func TestRoomCreation(t *testing.T) {
 		t.Errorf("expected p1 as host")
 	}
 	
-	c2 := &Client{ID: "p2", send: make(chan []byte, 10)}
+	c2 := &Client{ID: "p2", send: make(chan *wireMessage, 10)}
 	if err := rm.joinRoom(code, c2); err != nil {
 		t.Fatalf("joinRoom failed: %v", err)
 	}
@@ -35,8 +40,99 @@ func TestRoomCreation(t *testing.T) {
 		t.Errorf("expected p2 as guest")
 	}
 	
-	c3 := &Client{ID: "p3", send: make(chan []byte, 10)}
-	if err := rm.joinRoom(code, c3); err == nil {
-		t.Errorf("expected error joining full room")
+	c3 := &Client{ID: "p3", send: make(chan *wireMessage, 10)}
+	if err := rm.joinRoom(code, c3); err != nil {
+		t.Fatalf("joinRoom as spectator failed: %v", err)
+	}
+	if !session.Spectators[c3] {
+		t.Errorf("expected p3 to join full room as spectator")
+	}
+}
+
+func TestReservedRoomSeats(t *testing.T) {
+	rm := newRoomManager()
+
+	code, session := rm.createReservedRoom("p1", "p2", 5*time.Minute, 5*time.Second, 30*time.Second, engine.RuleStandard)
+
+	stranger := &Client{ID: "p3", send: make(chan *wireMessage, 10)}
+	if err := rm.joinRoom(code, stranger); err != nil {
+		t.Fatalf("joinRoom failed: %v", err)
+	}
+	if session.ClientO == stranger || !session.Spectators[stranger] {
+		t.Errorf("expected stranger to spectate a reserved room")
+	}
+
+	c2 := &Client{ID: "p2", send: make(chan *wireMessage, 10)}
+	if err := rm.joinRoom(code, c2); err != nil {
+		t.Fatalf("joinRoom failed: %v", err)
+	}
+	if session.ClientO != c2 {
+		t.Errorf("expected p2 in the O seat")
+	}
+
+	c1 := &Client{ID: "p1", send: make(chan *wireMessage, 10)}
+	if err := rm.joinRoom(code, c1); err != nil {
+		t.Fatalf("joinRoom failed: %v", err)
+	}
+	if session.ClientX != c1 {
+		t.Errorf("expected p1 in the X seat")
+	}
+}
+
+func TestRoomCodes(t *testing.T) {
+	for i := 0; i < 200; i++ {
+		code := generateCode()
+		if len(code) != 4 || strings.ContainsAny(code, "01IOL") {
+			t.Fatalf("unexpected code %q", code)
+		}
+	}
+}
+
+func TestRoomSweep(t *testing.T) {
+	rm := newRoomManager()
+	host := &Client{ID: "p1", send: make(chan *wireMessage, 10)}
+	waiting, _ := rm.createRoom(host, 5*time.Minute, 5*time.Second, 30*time.Second, engine.RuleStandard)
+	finished, session := rm.createReservedRoom("p2", "p3", 5*time.Minute, 5*time.Second, 30*time.Second, engine.RuleStandard)
+	session.record(&GameOverMessage{Type: MsgGameOver, Winner: "X"})
+
+	rm.sweep(time.Now().Add(finishedRoomTTL))
+	if _, ok := rm.getRoom(finished); ok {
+		t.Errorf("expected the finished room to be removed")
+	}
+	if _, ok := rm.getRoom(waiting); !ok {
+		t.Fatalf("expected the waiting room to stay until it expires")
+	}
+
+	rm.sweep(time.Now().Add(roomIdleTimeout))
+	if _, ok := rm.getRoom(waiting); ok {
+		t.Errorf("expected the idle room to expire")
+	}
+	if host.session() != nil || !strings.Contains(string((<-host.send).jsonBytes()), `"reason":"expired"`) {
+		t.Errorf("expected the host to be told the room expired")
+	}
+}
+
+func TestRoomSweepEndsAbandonedGames(t *testing.T) {
+	rm := newRoomManager()
+	rm.mm = newMatchmaker(db.NewMemoryUserRepository())
+	code, session := rm.createReservedRoom("p1", "p2", 5*time.Minute, 5*time.Second, 30*time.Second, engine.RuleStandard)
+	ended := make(chan string, 1)
+	session.OnGameEnd = func(winnerID string) { ended <- winnerID }
+	rm.mm.RegisterSession(session)
+
+	rm.sweep(time.Now().Add(roomIdleTimeout))
+	select {
+	case winner := <-ended:
+		if winner != "" {
+			t.Errorf("expected no winner, got %q", winner)
+		}
+	default:
+		t.Fatalf("expected the abandoned game to report its end")
+	}
+	if _, ok := rm.getRoom(code); ok {
+		t.Errorf("expected the abandoned room to be removed")
+	}
+	if _, ok := rm.mm.liveGame(session.ID); ok {
+		t.Errorf("expected the game to leave the live games")
 	}
 }
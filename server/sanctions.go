@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+
+	"caro_chess_server/auth"
+	"caro_chess_server/db"
+)
+
+var (
+	errBanned    = errors.New("banned")
+	errSuspended = errors.New("suspended from matchmaking")
+	errMuted     = errors.New("muted")
+)
+
+var sanctionErrors = map[db.SanctionKind]error{
+	db.SanctionBan:     errBanned,
+	db.SanctionSuspend: errSuspended,
+	db.SanctionMute:    errMuted,
+}
+
+// sanctionError tells a user what they are kept from doing, for how long
+// and why. It matches errBanned, errSuspended or errMuted.
+type sanctionError struct {
+	sanction *db.Sanction
+}
+
+func (e *sanctionError) Error() string {
+	msg := e.Unwrap().Error()
+	if !e.sanction.ExpiresAt.IsZero() {
+		msg += " until " + e.sanction.ExpiresAt.UTC().Format(time.RFC3339)
+	}
+	if e.sanction.Reason != "" {
+		msg += ": " + e.sanction.Reason
+	}
+	return msg
+}
+
+func (e *sanctionError) Unwrap() error {
+	return sanctionErrors[e.sanction.Kind]
+}
+
+// Sanctions enforces bans, suspensions and mutes. Each check reads the
+// user's sanctions in force, so new, lifted and expired ones apply from
+// the next action; Enforce makes a new one apply to live connections at
+// once.
+type Sanctions struct {
+	store db.AdminRepository
+	hub   *Hub
+	mm    *Matchmaker
+}
+
+func newSanctions(store db.AdminRepository, hub *Hub, mm *Matchmaker) *Sanctions {
+	return &Sanctions{store: store, hub: hub, mm: mm}
+}
+
+// check returns a sanctionError if userID is under a sanction of one of
+// kinds. A nil Sanctions checks nothing.
+func (s *Sanctions) check(userID string, kinds ...db.SanctionKind) error {
+	if s == nil {
+		return nil
+	}
+	active, err := s.store.ActiveSanctions(userID)
+	if err != nil {
+		// Better to let a sanctioned user through than lock everyone out.
+		log.Printf("Sanctions of %s unavailable: %v", userID, err)
+		return nil
+	}
+	for _, sanction := range active {
+		if slices.Contains(kinds, sanction.Kind) {
+			return &sanctionError{sanction}
+		}
+	}
+	return nil
+}
+
+// Enforce applies a new sanction to its user's connections: banned users
+// are told and disconnected, suspended ones are taken out of the queue and
+// muted ones are told.
+func (s *Sanctions) Enforce(sanction *db.Sanction) {
+	msg := newErrorMessage(&sanctionError{sanction})
+	for _, c := range s.hub.userClients(sanction.UserID) {
+		switch sanction.Kind {
+		case db.SanctionBan:
+			c.kick(msg)
+		case db.SanctionSuspend:
+			s.mm.removeClient <- c
+			c.sendMessage(msg)
+		default:
+			c.sendMessage(msg)
+		}
+	}
+}
+
+// Block refuses requests from banned and suspended users; a mute only
+// stops chat. It goes inside auth.RequireUser.
+func (s *Sanctions) Block(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, _ := auth.UserID(r.Context())
+		if err := s.check(userID, db.SanctionBan, db.SanctionSuspend); err != nil {
+			http.Error(w, "Forbidden: "+err.Error(), http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
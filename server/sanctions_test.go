@@ -0,0 +1,195 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"caro_chess_server/auth"
+	"caro_chess_server/db"
+	"caro_chess_server/db/sqlite"
+	"caro_chess_server/tournament"
+	"github.com/gorilla/websocket"
+)
+
+// newSanctionsServer returns a WebSocket URL for a server enforcing the
+// sanctions in its store.
+func newSanctionsServer(t *testing.T) (string, *sqlite.SQLiteStore, *Sanctions) {
+	store, err := sqlite.NewSQLiteStore(filepath.Join(t.TempDir(), "sanctions.db"))
+	if err != nil {
+		t.Fatalf("NewSQLiteStore: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	hub := newHub()
+	go hub.run()
+	mm := newMatchmaker(store)
+	go mm.run()
+	rm := newRoomManager()
+	go rm.run()
+	mm.sanctions = newSanctions(store, hub, mm)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveWs(hub, mm, rm, w, r, r.URL.Query().Get("id"))
+	}))
+	t.Cleanup(s.Close)
+	return "ws" + strings.TrimPrefix(s.URL, "http"), store, mm.sanctions
+}
+
+func sanction(t *testing.T, store *sqlite.SQLiteStore, userID string, kind db.SanctionKind, expiresAt time.Time) *db.Sanction {
+	s := &db.Sanction{UserID: userID, Kind: kind, Reason: "testing", IssuedBy: "mod", ExpiresAt: expiresAt}
+	if err := store.CreateSanction(s); err != nil {
+		t.Fatalf("CreateSanction: %v", err)
+	}
+	return s
+}
+
+// expectClosed fails unless the server closes c.
+func expectClosed(t *testing.T, c *websocket.Conn) {
+	t.Helper()
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		if _, _, err := c.ReadMessage(); err != nil {
+			if _, ok := err.(*websocket.CloseError); !ok {
+				t.Errorf("Connection not closed by the server: %v", err)
+			}
+			return
+		}
+	}
+}
+
+func TestBannedUserRefused(t *testing.T) {
+	u, store, _ := newSanctionsServer(t)
+	sanction(t, store, "mallory", db.SanctionBan, time.Time{})
+
+	c := dialAs(t, u, "mallory")
+	defer c.Close()
+	if e := readType(t, c, MsgError); e["code"] != CodeBanned || !strings.Contains(e["message"].(string), "testing") {
+		t.Errorf("ERROR = %v, want BANNED with the reason", e)
+	}
+	expectClosed(t, c)
+}
+
+func TestMutedAndSuspendedUsers(t *testing.T) {
+	u, store, _ := newSanctionsServer(t)
+	sanction(t, store, "mallory", db.SanctionMute, time.Now().Add(time.Hour))
+	sanction(t, store, "mallory", db.SanctionSuspend, time.Now().Add(time.Hour))
+	sanction(t, store, "trent", db.SanctionSuspend, time.Now().Add(-time.Minute)) // Expired
+
+	mallory := dialAs(t, u, "mallory")
+	defer mallory.Close()
+	sendJSON(t, mallory, map[string]interface{}{"type": "CHAT_MESSAGE", "channel": "lobby", "text": "hi"})
+	if e := readType(t, mallory, MsgError); e["code"] != CodeMuted || !strings.Contains(e["message"].(string), "until") {
+		t.Errorf("Chat while muted = %v, want MUTED until a time", e)
+	}
+	sendJSON(t, mallory, map[string]interface{}{"type": "FIND_MATCH"})
+	if e := readType(t, mallory, MsgError); e["code"] != CodeSuspended {
+		t.Errorf("FIND_MATCH while suspended = %v, want SUSPENDED", e)
+	}
+
+	// An expired suspension doesn't stop anyone.
+	trent, alice := dialAs(t, u, "trent"), dialAs(t, u, "alice")
+	defer trent.Close()
+	defer alice.Close()
+	sendJSON(t, trent, map[string]interface{}{"type": "FIND_MATCH"})
+	sendJSON(t, alice, map[string]interface{}{"type": "FIND_MATCH"})
+	readType(t, trent, MsgMatchFound)
+}
+
+func TestLiveSanctions(t *testing.T) {
+	u, store, sanctions := newSanctionsServer(t)
+
+	mallory := dialAs(t, u, "mallory")
+	defer mallory.Close()
+	sendJSON(t, mallory, map[string]interface{}{"type": "FIND_MATCH", "request_id": "1"})
+	readType(t, mallory, MsgAck)
+
+	// Suspending takes mallory out of the queue at once.
+	sanctions.Enforce(sanction(t, store, "mallory", db.SanctionSuspend, time.Time{}))
+	if e := readType(t, mallory, MsgError); e["code"] != CodeSuspended {
+		t.Errorf("ERROR = %v, want SUSPENDED", e)
+	}
+	alice, bob := dialAs(t, u, "alice"), dialAs(t, u, "bob")
+	defer alice.Close()
+	defer bob.Close()
+	sendJSON(t, alice, map[string]interface{}{"type": "FIND_MATCH"})
+	sendJSON(t, bob, map[string]interface{}{"type": "FIND_MATCH"})
+	readType(t, alice, MsgMatchFound)
+	readType(t, bob, MsgMatchFound)
+
+	// Banning disconnects every connection of mallory.
+	second := dialAs(t, u, "mallory")
+	defer second.Close()
+	sendJSON(t, second, map[string]interface{}{"type": "HELLO", "version": 1})
+	readType(t, second, MsgWelcome)
+	sanctions.Enforce(sanction(t, store, "mallory", db.SanctionBan, time.Time{}))
+	for _, c := range []*websocket.Conn{mallory, second} {
+		if e := readType(t, c, MsgError); e["code"] != CodeBanned {
+			t.Errorf("ERROR = %v, want BANNED", e)
+		}
+		expectClosed(t, c)
+	}
+}
+
+func TestSanctionsBlock(t *testing.T) {
+	_, store, sanctions := newSanctionsServer(t)
+	suspended := sanction(t, store, "mallory", db.SanctionSuspend, time.Time{})
+	sanction(t, store, "chatty", db.SanctionMute, time.Time{})
+
+	handler := sanctions.Block(func(w http.ResponseWriter, r *http.Request) {})
+	serve := func(userID string) int {
+		req := httptest.NewRequest(http.MethodPost, "/shop/buy", nil)
+		req = req.WithContext(auth.WithUserID(req.Context(), userID))
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec.Code
+	}
+	if code := serve("mallory"); code != http.StatusForbidden {
+		t.Errorf("Sanctioned user = %d, want 403", code)
+	}
+	if code := serve("alice"); code != http.StatusOK {
+		t.Errorf("Other user = %d, want 200", code)
+	}
+	if code := serve("chatty"); code != http.StatusOK {
+		t.Errorf("Muted user = %d, want 200: a mute only stops chat", code)
+	}
+	store.LiftSanction(suspended.ID, "mod")
+	if code := serve("mallory"); code != http.StatusOK {
+		t.Errorf("After lifting = %d, want 200", code)
+	}
+}
+
+func TestArenaDoesNotRequeueSuspendedPlayers(t *testing.T) {
+	_, store, sanctions := newSanctionsServer(t)
+	arenas := tournament.NewArenaManager(nil, nil)
+	a, _ := arenas.Create("alice", "Blitz", time.Hour, tournament.Settings{})
+	for _, id := range []string{"p1", "p2"} {
+		arenas.Join(a.ID, id, 1200)
+	}
+	arenas.Start(a.ID)
+
+	mm := sanctions.mm
+	mm.arenas = arenas
+	c1 := &Client{ID: "p1", ArenaID: a.ID, send: make(chan *wireMessage, 10)}
+	c2 := &Client{ID: "p2", ArenaID: a.ID, send: make(chan *wireMessage, 10)}
+	mm.addClient <- c1
+	mm.addClient <- c2
+	time.Sleep(50 * time.Millisecond)
+	if c1.session() == nil {
+		t.Fatalf("expected p1 and p2 to be paired")
+	}
+
+	// p1 is suspended mid-game.
+	sanction(t, store, "p1", db.SanctionSuspend, time.Time{})
+	mm.endGame(c1.session(), c2)
+	time.Sleep(50 * time.Millisecond)
+	if _, arenaID := c1.queue(); arenaID != "" {
+		t.Errorf("expected the suspended player to leave the arena queue")
+	}
+	if _, arenaID := c2.queue(); arenaID != a.ID {
+		t.Errorf("expected the other player to be requeued")
+	}
+}
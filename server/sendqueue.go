@@ -0,0 +1,116 @@
+package main
+
+import (
+	"expvar"
+	"log"
+)
+
+// sendBufferSize is how many messages a client may fall behind by before
+// the send policies below kick in.
+const sendBufferSize = 256
+
+// sendPolicy says what to do with a message for a client whose send buffer
+// is full. Sending never blocks, so one stalled connection can't hold up
+// the game, the matchmaker or the hub.
+type sendPolicy int
+
+const (
+	// dropIfFull loses the message. For chat, lobby updates and presence
+	// notices, which the next one supersedes anyway.
+	dropIfFull sendPolicy = iota
+	// closeIfFull disconnects the client. For replies and notices that
+	// can't be recovered otherwise; the client catches up when it
+	// reconnects.
+	closeIfFull
+)
+
+// Slow-consumer metrics, published under /debug/vars.
+var slowConsumers = expvar.NewMap("slow_consumers")
+
+const (
+	metricDropped      = "dropped"      // Messages lost under dropIfFull
+	metricDisconnected = "disconnected" // Clients closed under closeIfFull
+	metricCoalesced    = "coalesced"    // Game events folded into a snapshot
+	metricResynced     = "resynced"     // Snapshots sent in their place
+)
+
+// enqueue queues msg for the client without waiting, applying policy if
+// the buffer is full. It reports whether msg was queued.
+func (c *Client) enqueue(msg *wireMessage, policy sendPolicy) bool {
+	if msg == nil || c.closed() {
+		return false
+	}
+	select {
+	case c.send <- msg:
+		return true
+	default:
+	}
+
+	switch policy {
+	case closeIfFull:
+		c.disconnectSlow()
+	default:
+		slowConsumers.Add(metricDropped, 1)
+	}
+	return false
+}
+
+// sendEvent queues a game event of session. If the client can't keep up,
+// the event and any that follow are coalesced into one GAME_SYNC snapshot,
+// which is sent once the client has worked through its buffer. Events are
+// sequenced, so clients skip the ones the snapshot already covers.
+func (c *Client) sendEvent(session *GameSession, msg *wireMessage) {
+	if msg == nil || c.closed() {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.resync == session {
+		slowConsumers.Add(metricCoalesced, 1) // Covered by the snapshot
+		return
+	}
+	select {
+	case c.send <- msg:
+		return
+	default:
+	}
+
+	if c.resync != nil {
+		// Behind on two games at once; give up on this connection.
+		c.disconnectSlow()
+		return
+	}
+	log.Printf("Client %s can't keep up; resyncing it with a snapshot", c.ID)
+	c.resync = session
+	slowConsumers.Add(metricCoalesced, 1)
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// takeResync returns the snapshot owed to the client, if any.
+func (c *Client) takeResync() *wireMessage {
+	c.mu.Lock()
+	session := c.resync
+	c.resync = nil
+	c.mu.Unlock()
+	if session == nil {
+		return nil
+	}
+	slowConsumers.Add(metricResynced, 1)
+	return encode(gameSync(c, session))
+}
+
+// disconnectSlow closes the connection of a client that has fallen too far
+// behind. Its transport then cleans up as for any other disconnect.
+func (c *Client) disconnectSlow() {
+	c.slowOnce.Do(func() {
+		log.Printf("Client %s can't keep up; disconnecting", c.ID)
+		slowConsumers.Add(metricDisconnected, 1)
+		if c.conn != nil {
+			c.conn.close()
+		}
+	})
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"testing"
+	"time"
+
+	"caro_chess_server/engine"
+)
+
+func slowConsumerMetric(key string) int64 {
+	if v, ok := slowConsumers.Get(key).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestSendPolicies(t *testing.T) {
+	c := &Client{ID: "p1", send: make(chan *wireMessage, 1)}
+
+	dropped := slowConsumerMetric(metricDropped)
+	if !c.enqueue(&wireMessage{json: []byte("a")}, dropIfFull) {
+		t.Fatalf("expected the first message to be queued")
+	}
+	if c.enqueue(&wireMessage{json: []byte("b")}, dropIfFull) {
+		t.Errorf("expected the second message to be dropped")
+	}
+	if got := slowConsumerMetric(metricDropped) - dropped; got != 1 {
+		t.Errorf("expected 1 dropped message, got %d", got)
+	}
+
+	disconnected := slowConsumerMetric(metricDisconnected)
+	c.enqueue(&wireMessage{json: []byte("c")}, closeIfFull)
+	c.enqueue(&wireMessage{json: []byte("d")}, closeIfFull)
+	if got := slowConsumerMetric(metricDisconnected) - disconnected; got != 1 {
+		t.Errorf("expected the client to be disconnected once, got %d", got)
+	}
+}
+
+func TestSlowClientResync(t *testing.T) {
+	x := &Client{ID: "p1", send: make(chan *wireMessage, 2)}
+	o := &Client{ID: "p2", send: make(chan *wireMessage, 10)}
+	session := newGameSession(x, o, time.Minute, 0, time.Minute, engine.RuleStandard)
+
+	// X stops reading; publishing must not block on it.
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 5; i++ {
+			session.publish(&MoveMadeMessage{Type: MsgMoveMade, X: i, Y: 0})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("publishing blocked on a slow client")
+	}
+	if len(o.send) != 5 {
+		t.Errorf("expected O to get all 5 events, got %d", len(o.send))
+	}
+
+	// X gets what fit in its buffer, then one snapshot for the rest.
+	for want := uint64(1); want <= 2; want++ {
+		var msg struct{ Seq uint64 }
+		json.Unmarshal((<-x.send).jsonBytes(), &msg)
+		if msg.Seq != want {
+			t.Errorf("expected event %d, got %d", want, msg.Seq)
+		}
+	}
+	var sync GameSyncMessage
+	if err := json.Unmarshal(x.takeResync().jsonBytes(), &sync); err != nil || sync.Type != MsgGameSync {
+		t.Fatalf("expected a GAME_SYNC snapshot, got %+v (%v)", sync, err)
+	}
+	if sync.Seq != 5 || sync.Color != "X" {
+		t.Errorf("expected a snapshot for X up to event 5, got %+v", sync)
+	}
+	if x.takeResync() != nil {
+		t.Errorf("expected only one snapshot")
+	}
+
+	// Once resynced, X gets events again.
+	session.publish(&MoveMadeMessage{Type: MsgMoveMade, X: 5, Y: 0})
+	if len(x.send) != 1 {
+		t.Errorf("expected X to get new events after the snapshot")
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"caro_chess_server/engine"
+)
+
+func TestSpectatorLiveEvents(t *testing.T) {
+	u, cleanup := newTestServer()
+	defer cleanup()
+
+	host := dialAs(t, u, "p1")
+	defer host.Close()
+	guest := dialAs(t, u, "p2")
+	defer guest.Close()
+
+	sendJSON(t, host, map[string]interface{}{"type": "CREATE_ROOM", "rule": string(engine.RuleFreeStyle)})
+	code := readType(t, host, "ROOM_CREATED")["code"]
+	sendJSON(t, guest, map[string]interface{}{"type": "JOIN_ROOM", "code": code})
+	readType(t, guest, "MATCH_FOUND")
+	sendJSON(t, host, map[string]interface{}{"type": "MOVE", "x": 7, "y": 7})
+	readType(t, guest, "MOVE_MADE")
+
+	watcher := dialAs(t, u, "watcher")
+	sendJSON(t, watcher, map[string]interface{}{"type": "JOIN_ROOM", "code": code, "role": "spectator"})
+	joined := readType(t, watcher, "SPECTATOR_JOINED")
+	if history, _ := joined["history"].([]interface{}); len(history) != 1 || joined["seq"] != 1.0 || joined["spectators"] != 1.0 {
+		t.Errorf("unexpected snapshot %v", joined)
+	}
+	if count := readType(t, host, "SPECTATOR_COUNT"); count["spectators"] != 1.0 {
+		t.Errorf("expected 1 spectator, got %v", count)
+	}
+
+	sendJSON(t, guest, map[string]interface{}{"type": "MOVE", "x": 8, "y": 8})
+	if made := readType(t, watcher, "MOVE_MADE"); made["seq"] != 2.0 || made["x"] != 8.0 {
+		t.Errorf("expected the spectator to see O's move, got %v", made)
+	}
+
+	// A spectator going away doesn't affect the game.
+	watcher.Close()
+	if left := readType(t, guest, "SPECTATOR_LEFT"); left["user_id"] != "watcher" || left["spectators"] != 0.0 {
+		t.Errorf("unexpected SPECTATOR_LEFT %v", left)
+	}
+	sendJSON(t, host, map[string]interface{}{"type": "MOVE", "x": 9, "y": 9})
+	readType(t, guest, "MOVE_MADE")
+
+	watcher = dialAs(t, u, "watcher")
+	defer watcher.Close()
+	sendJSON(t, watcher, map[string]interface{}{"type": "JOIN_ROOM", "code": code, "role": "spectator"})
+	readType(t, watcher, "SPECTATOR_JOINED")
+
+	sendJSON(t, host, map[string]interface{}{"type": "LEAVE_ROOM"})
+	if over := readType(t, watcher, "GAME_OVER"); over["winner"] != "O" || over["reason"] != "opponent_left" {
+		t.Errorf("expected the spectator to see the game end, got %v", over)
+	}
+}
+
+func TestSpectatorDelay(t *testing.T) {
+	player := &Client{ID: "p1", send: make(chan *wireMessage, 16)}
+	watcher := &Client{ID: "watcher", send: make(chan *wireMessage, 16)}
+	gs := newGameSession(player, &Client{ID: "p2", send: make(chan *wireMessage, 16)}, time.Minute, 0, 0, engine.RuleFreeStyle)
+	gs.SpectatorDelayMoves = 1
+	gs.addSpectator(watcher)
+
+	move := func(x int) {
+		gs.Engine.PlacePiece(engine.Position{X: x, Y: 0})
+		gs.publish(&MoveMadeMessage{Type: MsgMoveMade, X: x})
+	}
+	move(0)
+	if len(player.send) != 1 || len(watcher.send) != 0 {
+		t.Fatalf("expected only the players to see the first move, got %d and %d", len(player.send), len(watcher.send))
+	}
+	move(1)
+	if len(watcher.send) != 1 {
+		t.Fatalf("expected the spectator to be one move behind, got %d events", len(watcher.send))
+	}
+	if history, turn, seq, _ := gs.spectatorSnapshot(); len(history) != 1 || turn != engine.PlayerO || seq != 1 {
+		t.Errorf("expected a snapshot after the first move, got %v %s %d", history, turn, seq)
+	}
+
+	gs.publish(&GameOverMessage{Type: MsgGameOver, Winner: "X"})
+	if len(watcher.send) != 3 {
+		t.Errorf("expected the game over to release every event, got %d", len(watcher.send))
+	}
+	if _, _, seq, result := gs.spectatorSnapshot(); seq != 3 || result == nil {
+		t.Errorf("expected the final snapshot, got seq %d result %v", seq, result)
+	}
+
+	timed := newGameSession(player, watcher, time.Minute, 0, 0, engine.RuleFreeStyle)
+	timed.SpectatorDelay = 50 * time.Millisecond
+	other := &Client{ID: "other", send: make(chan *wireMessage, 16)}
+	timed.addSpectator(other)
+	timed.publish(&ChatMessage{Type: MsgChat, Text: "hi"})
+	if len(other.send) != 0 {
+		t.Fatalf("expected the chat to be delayed")
+	}
+	time.Sleep(150 * time.Millisecond)
+	if len(other.send) != 1 {
+		t.Errorf("expected the chat after the delay, got %d events", len(other.send))
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"time"
+
+	"caro_chess_server/engine"
+)
+
+// addSpectator lets c watch the game and returns the new spectator count.
+func (gs *GameSession) addSpectator(c *Client) int {
+	gs.spectatorsMu.Lock()
+	if gs.Spectators == nil {
+		gs.Spectators = make(map[*Client]bool)
+	}
+	gs.Spectators[c] = true
+	count := len(gs.Spectators)
+	gs.spectatorsMu.Unlock()
+
+	gs.listingChanged()
+	return count
+}
+
+// removeSpectator stops c watching. It reports whether c was a spectator and
+// the remaining count.
+func (gs *GameSession) removeSpectator(c *Client) (bool, int) {
+	gs.spectatorsMu.Lock()
+	if !gs.Spectators[c] {
+		defer gs.spectatorsMu.Unlock()
+		return false, len(gs.Spectators)
+	}
+	delete(gs.Spectators, c)
+	count := len(gs.Spectators)
+	gs.spectatorsMu.Unlock()
+
+	gs.listingChanged()
+	return true, count
+}
+
+func (gs *GameSession) isSpectator(c *Client) bool {
+	gs.spectatorsMu.Lock()
+	defer gs.spectatorsMu.Unlock()
+	return gs.Spectators[c]
+}
+
+func (gs *GameSession) spectatorCount() int {
+	gs.spectatorsMu.Lock()
+	defer gs.spectatorsMu.Unlock()
+	return len(gs.Spectators)
+}
+
+// broadcast delivers an event to the players, except skip, and passes it on
+// to the spectators.
+func (gs *GameSession) broadcast(event sessionEvent, skip *Client) {
+	x, o := gs.players()
+	if x != nil && x != skip {
+		x.sendEvent(gs, event.data)
+	}
+	if o != nil && o != skip {
+		o.sendEvent(gs, event.data)
+	}
+
+	gs.spectatorsMu.Lock()
+	defer gs.spectatorsMu.Unlock()
+	gs.delayed = append(gs.delayed, delayedEvent{sessionEvent: event, at: time.Now()})
+	gs.releaseDelayed()
+}
+
+// delayedEvent is an event the spectators haven't seen yet.
+type delayedEvent struct {
+	sessionEvent
+	at time.Time
+}
+
+// releaseDelayed sends the spectators every event that is old enough, and
+// everything once the game is over. Callers hold spectatorsMu.
+func (gs *GameSession) releaseDelayed() {
+	if len(gs.delayed) == 0 {
+		return
+	}
+	latest := gs.delayed[len(gs.delayed)-1]
+	now := time.Now()
+	for len(gs.delayed) > 0 {
+		event := gs.delayed[0]
+		wait := gs.SpectatorDelay - now.Sub(event.at)
+		if !latest.final && (wait > 0 || latest.moves-event.moves < gs.SpectatorDelayMoves) {
+			if wait > 0 && gs.delayTimer == nil {
+				gs.delayTimer = time.AfterFunc(wait, func() {
+					gs.spectatorsMu.Lock()
+					defer gs.spectatorsMu.Unlock()
+					gs.delayTimer = nil
+					gs.releaseDelayed()
+				})
+			}
+			return
+		}
+
+		for client := range gs.Spectators {
+			client.sendEvent(gs, event.data)
+		}
+		gs.shownSeq, gs.shownMoves = event.seq, event.moves
+		gs.delayed = gs.delayed[1:]
+	}
+}
+
+// spectatorDelay returns how far behind the spectators are kept.
+func (gs *GameSession) spectatorDelay() (time.Duration, int) {
+	gs.spectatorsMu.Lock()
+	defer gs.spectatorsMu.Unlock()
+	return gs.SpectatorDelay, gs.SpectatorDelayMoves
+}
+
+func (gs *GameSession) setSpectatorDelay(delay time.Duration, moves int) {
+	gs.spectatorsMu.Lock()
+	defer gs.spectatorsMu.Unlock()
+	gs.SpectatorDelay, gs.SpectatorDelayMoves = delay, moves
+}
+
+// spectatorView returns the latest event and number of moves the spectators
+// have seen.
+func (gs *GameSession) spectatorView() (seq uint64, moves int) {
+	gs.spectatorsMu.Lock()
+	defer gs.spectatorsMu.Unlock()
+	return gs.shownSeq, gs.shownMoves
+}
+
+// spectatorSnapshot is the game as the spectators have seen it so far.
+func (gs *GameSession) spectatorSnapshot() (history []engine.Position, turn engine.Player, seq uint64, result *GameOverMessage) {
+	seq, moves := gs.spectatorView()
+	latest, result := gs.lastEvent()
+	st := gs.state()
+	history, turn = st.History, st.Turn
+	if moves < len(history) {
+		history = history[:moves]
+		turn = engine.PlayerX
+		if moves%2 == 1 {
+			turn = engine.PlayerO
+		}
+	}
+	if seq < latest {
+		result = nil // Spectators haven't seen the end yet
+	}
+	return history, turn, seq, result
+}
+
+// sendSpectators delivers msg to the spectators straight away. It is meant
+// for room notices rather than game events, which go through broadcast.
+func (gs *GameSession) sendSpectators(msg *wireMessage) {
+	gs.spectatorsMu.Lock()
+	defer gs.spectatorsMu.Unlock()
+	for client := range gs.Spectators {
+		client.enqueue(msg, dropIfFull)
+	}
+}
+
+// stopWatching removes c from the game it is spectating, if any, and tells
+// the players.
+func (c *Client) stopWatching() {
+	session := c.session()
+	if session == nil {
+		return
+	}
+	removed, count := session.removeSpectator(c)
+	if !removed {
+		return
+	}
+	c.leaveSession(session)
+	session.sendPlayers(encode(SpectatorLeftMessage{
+		Type:       MsgSpectatorLeft,
+		UserID:     c.ID,
+		Spectators: count,
+	}))
+}
+
+// startWatching tells the players about a new spectator and sends the
+// spectator the state of the game.
+func (c *Client) startWatching(req *request, session *GameSession) {
+	count := session.spectatorCount()
+	session.sendPlayers(encode(SpectatorCountMessage{Type: MsgSpectatorCount, Spectators: count}))
+
+	history, turn, seq, result := session.spectatorSnapshot()
+	playerX, playerO := session.playerIDs()
+	timeX, timeO := session.clocks()
+	c.reply(req, &SpectatorJoinedMessage{
+		Type:       MsgSpectatorJoined,
+		History:    history,
+		PlayerX:    playerX,
+		PlayerO:    playerO,
+		Turn:       turn,
+		TimeX:      timeX.Seconds(),
+		TimeO:      timeO.Seconds(),
+		Seq:        seq,
+		Result:     result,
+		Spectators: count,
+	})
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"caro_chess_server/auth"
+	"caro_chess_server/db"
+
+	"github.com/google/uuid"
+)
+
+// sseKeepAlive is how often an idle event stream gets a comment, so proxies
+// don't time it out.
+const sseKeepAlive = 25 * time.Second
+
+// EventStreams is the transport for clients that can't open a WebSocket,
+// e.g. on networks that block them. The client receives its messages as
+// Server-Sent Events from GET /events and sends its own with POST /actions.
+// Messages are the same JSON as on a WebSocket and go through the same
+// handlers.
+type EventStreams struct {
+	hub *Hub
+	mm  *Matchmaker
+	rm  *RoomManager
+
+	mu    sync.Mutex
+	conns map[string]*sseTransport // By connection ID
+}
+
+func newEventStreams(hub *Hub, mm *Matchmaker, rm *RoomManager) *EventStreams {
+	return &EventStreams{
+		hub:   hub,
+		mm:    mm,
+		rm:    rm,
+		conns: make(map[string]*sseTransport),
+	}
+}
+
+// sseTransport connects a client through an event stream.
+type sseTransport struct {
+	id       string
+	client   *Client
+	owner    string // Authenticated user who opened it; "" if anonymous
+	addr     string
+	cancel   context.CancelFunc
+	dispatch sync.Mutex // Actions are handled one at a time, as on a WebSocket
+}
+
+func (t *sseTransport) remoteAddr() string { return t.addr }
+func (t *sseTransport) close()             { t.cancel() }
+
+// Events streams the messages for user id until the client goes away. The
+// first event is CONNECTED with the ID to post actions with.
+func (s *EventStreams) Events(w http.ResponseWriter, r *http.Request, id string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	owner, _ := auth.UserID(r.Context())
+	t := &sseTransport{id: uuid.New().String(), owner: owner, addr: r.RemoteAddr, cancel: cancel}
+	t.client = newClient(id, s.hub, s.mm, s.rm, t)
+
+	header := w.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("X-Accel-Buffering", "no") // Stop nginx buffering the stream
+	w.WriteHeader(http.StatusOK)
+
+	// JSON has no raw newlines, so every message fits on one data line.
+	write := func(msg *wireMessage) error {
+		data := msg.jsonBytes()
+		if data == nil {
+			return nil // Failed to encode; logged already
+		}
+		if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+	keepAlive := func() error {
+		if _, err := io.WriteString(w, ": keep-alive\n\n"); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+	if err := s.mm.sanctions.check(id, db.SanctionBan); err != nil {
+		write(encode(newErrorMessage(err)))
+		return
+	}
+	if err := write(encode(ConnectedMessage{Type: MsgConnected, ConnectionID: t.id})); err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.conns[t.id] = t
+	s.mu.Unlock()
+	t.client.connect()
+	go func() {
+		<-ctx.Done()
+		s.mu.Lock()
+		delete(s.conns, t.id)
+		s.mu.Unlock()
+		t.client.disconnect()
+	}()
+
+	t.client.pump(write, keepAlive, sseKeepAlive)
+}
+
+// Actions handles one client message posted for the stream named by the
+// conn query parameter. Replies arrive on the stream, not in the response.
+// Only the user who opened the stream may post to it; an anonymous stream
+// takes actions from whoever knows its connection ID.
+func (s *EventStreams) Actions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.mu.Lock()
+	t := s.conns[r.URL.Query().Get("conn")]
+	s.mu.Unlock()
+	if t == nil {
+		http.Error(w, "Unknown connection", http.StatusNotFound)
+		return
+	}
+	if userID, _ := auth.UserID(r.Context()); userID != t.owner {
+		http.Error(w, "Not your connection", http.StatusForbidden)
+		return
+	}
+	message, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxMessageSize))
+	if err != nil {
+		http.Error(w, "Message too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	t.dispatch.Lock()
+	t.client.handleMessage(message)
+	t.dispatch.Unlock()
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"caro_chess_server/auth"
+	"caro_chess_server/db"
+)
+
+// sseClient reads an event stream line by line.
+type sseClient struct {
+	t     *testing.T
+	base  string
+	conn  string
+	lines chan string
+	body  io.ReadCloser
+}
+
+func dialSSE(t *testing.T, u, id string) *sseClient {
+	base := "http" + strings.TrimPrefix(u, "ws")
+	resp, err := http.Get(base + "/events?id=" + id)
+	if err != nil {
+		t.Fatalf("events %s: %v", id, err)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("expected an event stream, got %q", ct)
+	}
+	c := &sseClient{t: t, base: base, lines: make(chan string, 64), body: resp.Body}
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			c.lines <- scanner.Text()
+		}
+		close(c.lines)
+	}()
+	c.conn, _ = c.read("CONNECTED")["connection_id"].(string)
+	return c
+}
+
+// read returns the next message of the given type.
+func (c *sseClient) read(typ string) map[string]interface{} {
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case line, ok := <-c.lines:
+			if !ok {
+				c.t.Fatalf("stream closed waiting for %s", typ)
+			}
+			if !strings.HasPrefix(line, "data: ") {
+				continue
+			}
+			var msg map[string]interface{}
+			json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &msg)
+			if msg["type"] == typ {
+				return msg
+			}
+		case <-timeout:
+			c.t.Fatalf("waiting for %s", typ)
+		}
+	}
+}
+
+func (c *sseClient) post(msg map[string]interface{}) int {
+	data, _ := json.Marshal(msg)
+	resp, err := http.Post(c.base+"/actions?conn="+c.conn, "application/json", bytes.NewReader(data))
+	if err != nil {
+		c.t.Fatalf("post: %v", err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestEventStreamTransport(t *testing.T) {
+	u, cleanup := newTestServer()
+	defer cleanup()
+
+	host := dialSSE(t, u, "p1")
+	defer host.body.Close()
+	if host.conn == "" {
+		t.Fatalf("expected a connection ID")
+	}
+
+	if status := host.post(map[string]interface{}{"type": "HELLO", "version": ProtocolVersion, "request_id": "r1"}); status != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d", status)
+	}
+	if msg := host.read("WELCOME"); msg["request_id"] != "r1" {
+		t.Errorf("unexpected WELCOME %v", msg)
+	}
+
+	// Event stream and WebSocket players share games.
+	host.post(map[string]interface{}{"type": "CREATE_ROOM"})
+	code := host.read("ROOM_CREATED")["code"]
+	guest := dialAs(t, u, "p2")
+	defer guest.Close()
+	sendJSON(t, guest, map[string]interface{}{"type": "JOIN_ROOM", "code": code})
+	if msg := host.read("MATCH_FOUND"); msg["color"] != "X" {
+		t.Errorf("expected the host to play X, got %v", msg)
+	}
+	readType(t, guest, "MATCH_FOUND")
+
+	host.post(map[string]interface{}{"type": "MOVE", "x": 7, "y": 7})
+	host.read("MOVE_MADE")
+	if msg := readType(t, guest, "MOVE_MADE"); msg["x"] != float64(7) {
+		t.Errorf("expected the guest to see the move, got %v", msg)
+	}
+
+	host.post(map[string]interface{}{"type": "MOVE", "x": 8, "y": 8})
+	if msg := host.read("ERROR"); msg["code"] != CodeNotYourTurn {
+		t.Errorf("expected %s, got %v", CodeNotYourTurn, msg)
+	}
+
+	// Actions need a live stream.
+	unknown := &sseClient{t: t, base: host.base, conn: "nope"}
+	if status := unknown.post(map[string]interface{}{"type": "HELLO"}); status != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown connection, got %d", status)
+	}
+	// The server notices the stream is gone when its read of the
+	// connection fails, which can take a moment.
+	host.body.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for status := 0; status != http.StatusNotFound; {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected 404 once the stream is closed, got %d", status)
+		}
+		time.Sleep(20 * time.Millisecond)
+		status = host.post(map[string]interface{}{"type": "HELLO"})
+	}
+}
+
+func TestEventStreamActionsNeedTheOwner(t *testing.T) {
+	hub := newHub()
+	go hub.run()
+	mm := newMatchmaker(db.NewMemoryUserRepository())
+	go mm.run()
+	streams := newEventStreams(hub, mm, newRoomManager())
+
+	stream := &sseTransport{id: "c1", owner: "alice", cancel: func() {}}
+	stream.client = newClient("alice", hub, mm, streams.rm, stream)
+	streams.conns[stream.id] = stream
+
+	post := func(userID string) int {
+		r := httptest.NewRequest(http.MethodPost, "/actions?conn=c1", strings.NewReader(`{"type":"HELLO"}`))
+		if userID != "" {
+			r = r.WithContext(auth.WithUserID(r.Context(), userID))
+		}
+		w := httptest.NewRecorder()
+		streams.Actions(w, r)
+		return w.Code
+	}
+	if status := post(""); status != http.StatusForbidden {
+		t.Errorf("expected 403 without a token, got %d", status)
+	}
+	if status := post("mallory"); status != http.StatusForbidden {
+		t.Errorf("expected 403 for another user, got %d", status)
+	}
+	if status := post("alice"); status != http.StatusAccepted {
+		t.Errorf("expected the owner's action to be accepted, got %d", status)
+	}
+	if len(stream.client.send) != 1 {
+		t.Errorf("expected only the owner's HELLO to be answered, got %d replies", len(stream.client.send))
+	}
+}
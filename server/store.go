@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+
+	"caro_chess_server/config"
+	"caro_chess_server/db"
+	"caro_chess_server/db/migrate"
+	"caro_chess_server/db/postgres"
+	"caro_chess_server/db/sqlite"
+)
+
+// Store is the database of the server, whichever driver it uses.
+type Store interface {
+	db.UserRepository
+	db.CredentialRepository
+	db.SessionRepository
+	db.AdminRepository
+
+	Version() (int, error)
+	Pending() ([]migrate.Migration, error)
+	Migrate() ([]migrate.Migration, error)
+	Empty() (bool, error)
+	Close() error
+}
+
+// openStore connects to the configured database without migrating it.
+func openStore(cfg *config.Config) (Store, error) {
+	switch cfg.DBDriver {
+	case config.DriverSQLite:
+		store, err := sqlite.Open(cfg.DBDSN)
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+	case config.DriverPostgres:
+		store, err := postgres.Open(cfg.DBDSN)
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+	default:
+		return nil, fmt.Errorf("unknown database driver %q; use %s or %s", cfg.DBDriver, config.DriverSQLite, config.DriverPostgres)
+	}
+}
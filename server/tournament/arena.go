@@ -0,0 +1,455 @@
+package tournament
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"caro_chess_server/db"
+)
+
+var (
+	ErrArenaClosed     = errors.New("arena is not running")
+	ErrNotParticipant  = errors.New("player has not joined the arena")
+	ErrGameNotFound    = errors.New("arena game not found")
+	ErrAlreadyBerserk  = errors.New("already berserked")
+	ErrInvalidDuration = errors.New("arena duration must be positive")
+)
+
+// Arena scoring: a win is worth 2 points and a draw 1. After two wins in a
+// row a player is "on fire" and scores double until they fail to win.
+// Berserking halves the player's clock and adds a point if they win.
+const (
+	arenaWinPoints     = 2
+	arenaDrawPoints    = 1
+	arenaFireStreak    = 2
+	arenaBerserkBonus  = 1
+	arenaResultsFormat = "arena"
+)
+
+type ArenaPlayer struct {
+	ID       string `json:"id"`
+	Rating   int    `json:"rating"`
+	Score    int    `json:"score"`
+	Streak   int    `json:"streak"` // consecutive wins
+	Games    int    `json:"games"`
+	Wins     int    `json:"wins"`
+	Berserks int    `json:"berserks"`
+	Sheet    []int  `json:"sheet"` // points scored per game
+
+	colors       int // games as X minus games as O
+	lastOpponent string
+}
+
+func (p *ArenaPlayer) OnFire() bool {
+	return p.Streak >= arenaFireStreak
+}
+
+type ArenaGame struct {
+	ID       string `json:"id"`
+	PlayerX  string `json:"player_x"`
+	PlayerO  string `json:"player_o"`
+	BerserkX bool   `json:"berserk_x"`
+	BerserkO bool   `json:"berserk_o"`
+	Result   Result `json:"result"`
+}
+
+type Arena struct {
+	ID        string                  `json:"id"`
+	Name      string                  `json:"name"`
+	Status    Status                  `json:"status"`
+	Settings  Settings                `json:"settings"`
+	Duration  int                     `json:"duration"` // seconds
+	StartedAt time.Time               `json:"started_at"`
+	EndsAt    time.Time               `json:"ends_at"`
+	Players   map[string]*ArenaPlayer `json:"-"`
+	Games     map[string]*ArenaGame   `json:"-"`
+	CreatedBy string                  `json:"created_by"` // May start it, as may moderators
+	CreatedAt time.Time               `json:"created_at"`
+}
+
+// ArenaStanding is a row of the live arena leaderboard.
+type ArenaStanding struct {
+	Rank     int    `json:"rank"`
+	PlayerID string `json:"player_id"`
+	Rating   int    `json:"rating"`
+	Score    int    `json:"score"`
+	Games    int    `json:"games"`
+	Wins     int    `json:"wins"`
+	OnFire   bool   `json:"on_fire"`
+	Berserks int    `json:"berserks"`
+	Sheet    []int  `json:"sheet"`
+}
+
+// Leaderboard ranks players by score, then wins, then rating.
+func (a *Arena) Leaderboard() []ArenaStanding {
+	board := make([]ArenaStanding, 0, len(a.Players))
+	for _, p := range a.Players {
+		board = append(board, ArenaStanding{
+			PlayerID: p.ID,
+			Rating:   p.Rating,
+			Score:    p.Score,
+			Games:    p.Games,
+			Wins:     p.Wins,
+			OnFire:   p.OnFire(),
+			Berserks: p.Berserks,
+			Sheet:    append([]int{}, p.Sheet...),
+		})
+	}
+	sort.Slice(board, func(i, j int) bool {
+		a, b := board[i], board[j]
+		if a.Score != b.Score {
+			return a.Score > b.Score
+		}
+		if a.Wins != b.Wins {
+			return a.Wins > b.Wins
+		}
+		if a.Rating != b.Rating {
+			return a.Rating > b.Rating
+		}
+		return a.PlayerID < b.PlayerID
+	})
+	for i := range board {
+		board[i].Rank = i + 1
+	}
+	return board
+}
+
+// ArenaView is an arena together with its leaderboard, safe to serialize.
+type ArenaView struct {
+	*Arena
+	Leaderboard []ArenaStanding `json:"leaderboard"`
+}
+
+func (a *Arena) view() *ArenaView {
+	c := *a
+	c.Players = nil
+	c.Games = nil
+	return &ArenaView{Arena: &c, Leaderboard: a.Leaderboard()}
+}
+
+// ResultStore persists final tournament standings.
+type ResultStore interface {
+	SaveTournamentResults(results []*db.TournamentResult) error
+}
+
+// ArenaManager runs arena events. Pairing itself is done by the caller's
+// matchmaker; the manager keeps the score and decides colors.
+type ArenaManager struct {
+	mu       sync.Mutex
+	arenas   map[string]*Arena
+	notifier Notifier
+	store    ResultStore
+}
+
+func NewArenaManager(notifier Notifier, store ResultStore) *ArenaManager {
+	return &ArenaManager{
+		arenas:   make(map[string]*Arena),
+		notifier: notifier,
+		store:    store,
+	}
+}
+
+func (m *ArenaManager) Create(createdBy, name string, duration time.Duration, settings Settings) (*ArenaView, error) {
+	if duration <= 0 {
+		return nil, ErrInvalidDuration
+	}
+	a := &Arena{
+		ID:        uuid.New().String(),
+		Name:      name,
+		Status:    StatusRegistering,
+		Settings:  settings,
+		Duration:  int(duration.Seconds()),
+		Players:   make(map[string]*ArenaPlayer),
+		Games:     make(map[string]*ArenaGame),
+		CreatedBy: createdBy,
+		CreatedAt: time.Now(),
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.arenas[a.ID] = a
+	return a.view(), nil
+}
+
+func (m *ArenaManager) Get(id string) (*ArenaView, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	a, ok := m.arenas[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return a.view(), nil
+}
+
+// List returns all arenas, newest first.
+func (m *ArenaManager) List() []*ArenaView {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	list := make([]*ArenaView, 0, len(m.arenas))
+	for _, a := range m.arenas {
+		list = append(list, a.view())
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.After(list[j].CreatedAt) })
+	return list
+}
+
+// Join adds a player. Players may join before or during the event.
+func (m *ArenaManager) Join(id, userID string, rating int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	a, ok := m.arenas[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if a.Status == StatusFinished {
+		return ErrArenaClosed
+	}
+	if _, ok := a.Players[userID]; ok {
+		return ErrAlreadyRegistered
+	}
+	a.Players[userID] = &ArenaPlayer{ID: userID, Rating: rating, Sheet: []int{}}
+	m.pushLeaderboard(a)
+	return nil
+}
+
+// Start opens pairing for the configured duration.
+func (m *ArenaManager) Start(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	a, ok := m.arenas[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if a.Status != StatusRegistering {
+		return ErrAlreadyStarted
+	}
+
+	a.Status = StatusRunning
+	a.StartedAt = time.Now()
+	a.EndsAt = a.StartedAt.Add(time.Duration(a.Duration) * time.Second)
+	time.AfterFunc(time.Until(a.EndsAt), func() { m.finish(id) })
+	m.pushLeaderboard(a)
+	return nil
+}
+
+// CanPair reports whether userID may be queued for a game in the arena.
+func (m *ArenaManager) CanPair(id, userID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	a, ok := m.arenas[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if a.Status != StatusRunning {
+		return ErrArenaClosed
+	}
+	if _, ok := a.Players[userID]; !ok {
+		return ErrNotParticipant
+	}
+	return nil
+}
+
+// AvoidOpponent returns the player userID should not be paired with next:
+// their last opponent, unless nobody else is in the arena.
+func (m *ArenaManager) AvoidOpponent(id, userID string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	a, ok := m.arenas[id]
+	if !ok || len(a.Players) <= 2 {
+		return ""
+	}
+	if p, ok := a.Players[userID]; ok {
+		return p.lastOpponent
+	}
+	return ""
+}
+
+// Pair records a new game between two participants and returns it with the
+// game settings. X goes to the player who has had it less.
+func (m *ArenaManager) Pair(id, a, b string) (*ArenaGame, Settings, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	arena, ok := m.arenas[id]
+	if !ok {
+		return nil, Settings{}, ErrNotFound
+	}
+	if arena.Status != StatusRunning {
+		return nil, Settings{}, ErrArenaClosed
+	}
+	pa, okA := arena.Players[a]
+	pb, okB := arena.Players[b]
+	if !okA || !okB {
+		return nil, Settings{}, ErrNotParticipant
+	}
+
+	if pb.colors < pa.colors {
+		pa, pb = pb, pa
+	}
+	game := &ArenaGame{ID: uuid.New().String(), PlayerX: pa.ID, PlayerO: pb.ID}
+	arena.Games[game.ID] = game
+	pa.colors++
+	pb.colors--
+	pa.lastOpponent = pb.ID
+	pb.lastOpponent = pa.ID
+
+	g := *game
+	return &g, arena.Settings, nil
+}
+
+// Berserk marks userID as berserking in a game. The caller halves the clock.
+func (m *ArenaManager) Berserk(id, gameID, userID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	a, ok := m.arenas[id]
+	if !ok {
+		return ErrNotFound
+	}
+	g, ok := a.Games[gameID]
+	if !ok || g.Result != ResultPending {
+		return ErrGameNotFound
+	}
+	switch userID {
+	case g.PlayerX:
+		if g.BerserkX {
+			return ErrAlreadyBerserk
+		}
+		g.BerserkX = true
+	case g.PlayerO:
+		if g.BerserkO {
+			return ErrAlreadyBerserk
+		}
+		g.BerserkO = true
+	default:
+		return ErrNotParticipant
+	}
+	return nil
+}
+
+// ReportResult scores a finished game. winnerID is "" for a draw. Games that
+// were still running when the arena ended are counted.
+func (m *ArenaManager) ReportResult(id, gameID, winnerID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	a, ok := m.arenas[id]
+	if !ok {
+		return ErrNotFound
+	}
+	g, ok := a.Games[gameID]
+	if !ok {
+		return ErrGameNotFound
+	}
+	if g.Result != ResultPending {
+		return ErrResultAlreadyKnown
+	}
+
+	switch winnerID {
+	case g.PlayerX:
+		g.Result = ResultXWins
+	case g.PlayerO:
+		g.Result = ResultOWins
+	default:
+		g.Result = ResultDraw
+	}
+
+	x, o := (&Pairing{Result: g.Result}).points()
+	scoreArenaGame(a.Players[g.PlayerX], x, g.BerserkX)
+	scoreArenaGame(a.Players[g.PlayerO], o, g.BerserkO)
+
+	m.pushLeaderboard(a)
+	return nil
+}
+
+// scoreArenaGame applies one game result (1, 0.5 or 0) to a player.
+func scoreArenaGame(p *ArenaPlayer, result float64, berserk bool) {
+	if p == nil {
+		return
+	}
+	points := 0
+	switch result {
+	case 1:
+		points = arenaWinPoints
+	case 0.5:
+		points = arenaDrawPoints
+	}
+	if p.OnFire() {
+		points *= 2
+	}
+	if berserk && result == 1 {
+		points += arenaBerserkBonus
+	}
+
+	if result == 1 {
+		p.Streak++
+		p.Wins++
+	} else {
+		p.Streak = 0
+	}
+	if berserk {
+		p.Berserks++
+	}
+	p.Games++
+	p.Score += points
+	p.Sheet = append(p.Sheet, points)
+}
+
+// finish closes the arena and persists the final leaderboard.
+func (m *ArenaManager) finish(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	a, ok := m.arenas[id]
+	if !ok || a.Status != StatusRunning {
+		return
+	}
+	a.Status = StatusFinished
+	m.pushLeaderboard(a)
+
+	if m.store == nil {
+		return
+	}
+	now := time.Now()
+	var results []*db.TournamentResult
+	for _, s := range a.Leaderboard() {
+		results = append(results, &db.TournamentResult{
+			TournamentID: a.ID,
+			Name:         a.Name,
+			Format:       arenaResultsFormat,
+			UserID:       s.PlayerID,
+			Rank:         s.Rank,
+			Score:        float64(s.Score),
+			Games:        s.Games,
+			FinishedAt:   now,
+		})
+	}
+	if err := m.store.SaveTournamentResults(results); err != nil {
+		log.Printf("Arena %s: failed to persist results: %v", a.ID, err)
+	}
+}
+
+func (m *ArenaManager) pushLeaderboard(a *Arena) {
+	if m.notifier == nil {
+		return
+	}
+	msg := map[string]interface{}{
+		"type":        "ARENA_STANDINGS",
+		"arena_id":    a.ID,
+		"status":      a.Status,
+		"ends_at":     a.EndsAt,
+		"leaderboard": a.Leaderboard(),
+	}
+	for id := range a.Players {
+		m.notifier.SendToUser(id, msg)
+	}
+}
@@ -0,0 +1,87 @@
+package tournament
+
+import (
+	"testing"
+	"time"
+
+	"caro_chess_server/db"
+)
+
+type fakeResultStore struct {
+	results []*db.TournamentResult
+}
+
+func (f *fakeResultStore) SaveTournamentResults(results []*db.TournamentResult) error {
+	f.results = append(f.results, results...)
+	return nil
+}
+
+func TestArenaStreakAndBerserkScoring(t *testing.T) {
+	store := &fakeResultStore{}
+	m := NewArenaManager(nil, store)
+	a, _ := m.Create("alice", "Blitz", time.Hour, Settings{})
+	m.Join(a.ID, "p1", 1200)
+	m.Join(a.ID, "p2", 1200)
+	if err := m.Start(a.ID); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+
+	// p1 wins three in a row, berserking in the third.
+	for i := 0; i < 3; i++ {
+		g, _, err := m.Pair(a.ID, "p1", "p2")
+		if err != nil {
+			t.Fatalf("Pair failed: %v", err)
+		}
+		if i == 2 {
+			if err := m.Berserk(a.ID, g.ID, "p1"); err != nil {
+				t.Fatalf("Berserk failed: %v", err)
+			}
+		}
+		if err := m.ReportResult(a.ID, g.ID, "p1"); err != nil {
+			t.Fatalf("ReportResult failed: %v", err)
+		}
+	}
+
+	view, _ := m.Get(a.ID)
+	top := view.Leaderboard[0]
+	// 2 + 2, then on fire: 4, plus 1 for the berserk win.
+	if top.PlayerID != "p1" || top.Score != 9 {
+		t.Errorf("expected p1 with 9 points, got %+v", top)
+	}
+	if !top.OnFire {
+		t.Errorf("expected p1 to be on fire")
+	}
+
+	// A draw ends the streak and is not doubled afterwards.
+	g, _, _ := m.Pair(a.ID, "p1", "p2")
+	m.ReportResult(a.ID, g.ID, "")
+	g, _, _ = m.Pair(a.ID, "p1", "p2")
+	m.ReportResult(a.ID, g.ID, "p1")
+
+	view, _ = m.Get(a.ID)
+	if got := view.Leaderboard[0].Sheet; len(got) != 5 || got[3] != 2 || got[4] != 2 {
+		t.Errorf("unexpected sheet %v", got)
+	}
+
+	m.finish(a.ID)
+	if len(store.results) != 2 || store.results[0].UserID != "p1" || store.results[0].Rank != 1 {
+		t.Errorf("expected persisted results with p1 first, got %+v", store.results)
+	}
+	if _, _, err := m.Pair(a.ID, "p1", "p2"); err != ErrArenaClosed {
+		t.Errorf("expected no pairing after finish, got %v", err)
+	}
+}
+
+func TestArenaColorBalance(t *testing.T) {
+	m := NewArenaManager(nil, nil)
+	a, _ := m.Create("alice", "Blitz", time.Hour, Settings{})
+	m.Join(a.ID, "p1", 1200)
+	m.Join(a.ID, "p2", 1200)
+	m.Start(a.ID)
+
+	g1, _, _ := m.Pair(a.ID, "p1", "p2")
+	g2, _, _ := m.Pair(a.ID, "p1", "p2")
+	if g1.PlayerX == g2.PlayerX {
+		t.Errorf("expected colors to alternate, X was %s twice", g1.PlayerX)
+	}
+}
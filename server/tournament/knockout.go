@@ -0,0 +1,540 @@
+package tournament
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type BracketFormat string
+
+const (
+	SingleElimination BracketFormat = "single_elimination"
+	DoubleElimination BracketFormat = "double_elimination"
+)
+
+// TieBreak decides a best-of-N series that ends level.
+type TieBreak string
+
+const (
+	// TieBreakArmageddon plays one game where X has more time but must win;
+	// a draw sends O through.
+	TieBreakArmageddon TieBreak = "armageddon"
+	// TieBreakSuddenDeath plays single games until one is decisive.
+	TieBreakSuddenDeath TieBreak = "sudden_death"
+)
+
+type GameKind string
+
+const (
+	GameRegular     GameKind = "regular"
+	GameArmageddon  GameKind = "armageddon"
+	GameSuddenDeath GameKind = "sudden_death"
+)
+
+var (
+	ErrInvalidBestOf   = errors.New("best_of must be at least 1")
+	ErrUnknownTieBreak = errors.New("unknown tie break")
+)
+
+type SeriesGame struct {
+	PlayerX  string   `json:"player_x"`
+	PlayerO  string   `json:"player_o"`
+	Kind     GameKind `json:"kind"`
+	Result   Result   `json:"result"`
+	RoomCode string   `json:"room_code,omitempty"`
+}
+
+// slotRef points at one side of a later series.
+type slotRef struct {
+	series string
+	slot   int
+}
+
+// Series is a best-of-N mini-match between two players. Players[0] is the
+// higher seed, except in the finals where it is the winners-bracket
+// champion. An empty player in a ready slot is a bye.
+type Series struct {
+	ID      string        `json:"id"`
+	Bracket string        `json:"bracket"` // "winners", "losers" or "final"
+	Round   int           `json:"round"`
+	Players [2]string     `json:"players"`
+	Score   [2]float64    `json:"score"`
+	Games   []*SeriesGame `json:"games"`
+	Winner  string        `json:"winner,omitempty"`
+	Loser   string        `json:"loser,omitempty"`
+	Done    bool          `json:"done"`
+
+	ready    [2]bool
+	winnerTo *slotRef
+	loserTo  *slotRef
+}
+
+type Bracket struct {
+	ID        string        `json:"id"`
+	Name      string        `json:"name"`
+	Format    BracketFormat `json:"format"`
+	Status    Status        `json:"status"`
+	Settings  Settings      `json:"settings"`
+	BestOf    int           `json:"best_of"`
+	TieBreak  TieBreak      `json:"tie_break"`
+	Players   []*Player     `json:"players"`
+	Series    []*Series     `json:"series"`
+	Champion  string        `json:"champion,omitempty"`
+	CreatedBy string        `json:"created_by"` // May start it, as may moderators
+	CreatedAt time.Time     `json:"created_at"`
+
+	index map[string]*Series
+}
+
+func (b *Bracket) add(s *Series) {
+	b.Series = append(b.Series, s)
+	b.index[s.ID] = s
+}
+
+// seed returns a player's seed, 1 being the highest.
+func (b *Bracket) seed(id string) int {
+	for i, p := range b.Players {
+		if p.ID == id {
+			return i + 1
+		}
+	}
+	return len(b.Players) + 1
+}
+
+func (b *Bracket) clone() *Bracket {
+	c := *b
+	c.index = nil
+	c.Players = make([]*Player, len(b.Players))
+	for i, p := range b.Players {
+		cp := *p
+		c.Players[i] = &cp
+	}
+	c.Series = make([]*Series, len(b.Series))
+	for i, s := range b.Series {
+		cs := *s
+		cs.winnerTo, cs.loserTo = nil, nil
+		cs.Games = make([]*SeriesGame, len(s.Games))
+		for j, g := range s.Games {
+			cg := *g
+			cs.Games[j] = &cg
+		}
+		c.Series[i] = &cs
+	}
+	return &c
+}
+
+// seedOrder returns bracket positions for seeds 1..size so that the top
+// seeds can only meet in the later rounds (1v8, 4v5, 2v7, 3v6 for 8).
+func seedOrder(size int) []int {
+	order := []int{1}
+	for len(order) < size {
+		n := len(order)*2 + 1
+		next := make([]int, 0, len(order)*2)
+		for _, s := range order {
+			next = append(next, s, n-s)
+		}
+		order = next
+	}
+	return order
+}
+
+// buildBracket lays out every series and how winners and losers move on.
+func buildBracket(b *Bracket) {
+	size := 2
+	rounds := 1
+	for size < len(b.Players) {
+		size *= 2
+		rounds++
+	}
+
+	wb := func(r, i int) string { return fmt.Sprintf("W%d-%d", r, i+1) }
+	lb := func(r, i int) string { return fmt.Sprintf("L%d-%d", r, i+1) }
+
+	for r := 1; r <= rounds; r++ {
+		count := size >> r
+		for i := 0; i < count; i++ {
+			s := &Series{ID: wb(r, i), Bracket: "winners", Round: r}
+			if r < rounds {
+				s.winnerTo = &slotRef{wb(r+1, i/2), i % 2}
+			}
+			b.add(s)
+		}
+	}
+
+	if b.Format == DoubleElimination {
+		final := &Series{ID: "GF", Bracket: "final", Round: 1}
+		b.add(final)
+		b.index[wb(rounds, 0)].winnerTo = &slotRef{"GF", 0}
+
+		if rounds == 1 {
+			b.index[wb(1, 0)].loserTo = &slotRef{"GF", 1}
+		} else {
+			// Losers bracket: odd rounds pair survivors, even rounds bring in
+			// the losers of the next winners round (in reverse to avoid rematches).
+			for r := 1; r <= 2*(rounds-1); r++ {
+				count := size >> ((r+1)/2 + 1)
+				for i := 0; i < count; i++ {
+					b.add(&Series{ID: lb(r, i), Bracket: "losers", Round: r})
+				}
+			}
+			for i := 0; i < size/2; i++ {
+				b.index[wb(1, i)].loserTo = &slotRef{lb(1, i/2), i % 2}
+			}
+			for m := 1; m <= rounds-1; m++ {
+				count := size >> (m + 1)
+				for j := 0; j < count; j++ {
+					b.index[lb(2*m-1, j)].winnerTo = &slotRef{lb(2*m, j), 0}
+					b.index[wb(m+1, count-1-j)].loserTo = &slotRef{lb(2*m, j), 1}
+					if m < rounds-1 {
+						b.index[lb(2*m, j)].winnerTo = &slotRef{lb(2*m+1, j/2), j % 2}
+					}
+				}
+			}
+			b.index[lb(2*(rounds-1), 0)].winnerTo = &slotRef{"GF", 1}
+		}
+	}
+
+	// Seat players; positions past the field are byes.
+	order := seedOrder(size)
+	for pos, seed := range order {
+		player := ""
+		if seed <= len(b.Players) {
+			player = b.Players[seed-1].ID
+		}
+		s := b.index[wb(1, pos/2)]
+		s.Players[pos%2] = player
+		s.ready[pos%2] = true
+	}
+}
+
+// KnockoutManager runs single- and double-elimination brackets.
+type KnockoutManager struct {
+	mu       sync.Mutex
+	brackets map[string]*Bracket
+	games    GameStarter
+	notifier Notifier
+}
+
+func NewKnockoutManager(games GameStarter, notifier Notifier) *KnockoutManager {
+	return &KnockoutManager{
+		brackets: make(map[string]*Bracket),
+		games:    games,
+		notifier: notifier,
+	}
+}
+
+func (m *KnockoutManager) Create(createdBy, name string, format BracketFormat, bestOf int, tieBreak TieBreak, settings Settings) (*Bracket, error) {
+	if format != SingleElimination && format != DoubleElimination {
+		return nil, ErrUnknownFormat
+	}
+	if bestOf < 1 {
+		return nil, ErrInvalidBestOf
+	}
+	if tieBreak != TieBreakArmageddon && tieBreak != TieBreakSuddenDeath {
+		return nil, ErrUnknownTieBreak
+	}
+
+	b := &Bracket{
+		ID:        uuid.New().String(),
+		Name:      name,
+		Format:    format,
+		Status:    StatusRegistering,
+		Settings:  settings,
+		BestOf:    bestOf,
+		TieBreak:  tieBreak,
+		Players:   []*Player{},
+		Series:    []*Series{},
+		CreatedBy: createdBy,
+		CreatedAt: time.Now(),
+		index:     make(map[string]*Series),
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.brackets[b.ID] = b
+	return b.clone(), nil
+}
+
+func (m *KnockoutManager) Get(id string) (*Bracket, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b, ok := m.brackets[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return b.clone(), nil
+}
+
+// List returns all brackets, newest first.
+func (m *KnockoutManager) List() []*Bracket {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	list := make([]*Bracket, 0, len(m.brackets))
+	for _, b := range m.brackets {
+		list = append(list, b.clone())
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.After(list[j].CreatedAt) })
+	return list
+}
+
+func (m *KnockoutManager) Register(id, userID string, rating int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	b, ok := m.brackets[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if b.Status != StatusRegistering {
+		return ErrNotRegistering
+	}
+	for _, p := range b.Players {
+		if p.ID == userID {
+			return ErrAlreadyRegistered
+		}
+	}
+	b.Players = append(b.Players, &Player{ID: userID, Rating: rating})
+	return nil
+}
+
+// Start seeds players by rating, builds the bracket and starts round one.
+func (m *KnockoutManager) Start(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	b, ok := m.brackets[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if b.Status != StatusRegistering {
+		return ErrAlreadyStarted
+	}
+	if len(b.Players) < 2 {
+		return ErrNotEnoughPlayers
+	}
+
+	sort.SliceStable(b.Players, func(i, j int) bool { return b.Players[i].Rating > b.Players[j].Rating })
+	buildBracket(b)
+	b.Status = StatusRunning
+
+	for _, s := range append([]*Series{}, b.Series...) {
+		m.tryStart(b, s)
+	}
+	m.pushBracket(b)
+	return nil
+}
+
+// fill seats a player who advanced into a later series.
+func (m *KnockoutManager) fill(b *Bracket, ref *slotRef, player string) {
+	if ref == nil {
+		return
+	}
+	s := b.index[ref.series]
+	s.Players[ref.slot] = player
+	s.ready[ref.slot] = true
+	m.tryStart(b, s)
+}
+
+// tryStart begins a series once both sides are known. Byes walk over.
+func (m *KnockoutManager) tryStart(b *Bracket, s *Series) {
+	if s.Done || len(s.Games) > 0 || !s.ready[0] || !s.ready[1] {
+		return
+	}
+	if s.Players[0] == "" || s.Players[1] == "" {
+		s.Winner = s.Players[0] + s.Players[1]
+		s.Loser = ""
+		m.complete(b, s)
+		return
+	}
+	if s.Bracket != "final" && b.seed(s.Players[1]) < b.seed(s.Players[0]) {
+		s.Players[0], s.Players[1] = s.Players[1], s.Players[0]
+	}
+	m.nextGame(b, s)
+}
+
+// nextGame schedules the next game of a series: regular games alternate
+// colors starting with the higher seed as X; tie breaks follow.
+func (m *KnockoutManager) nextGame(b *Bracket, s *Series) {
+	kind := GameRegular
+	if len(s.Games) >= b.BestOf {
+		kind = GameSuddenDeath
+		if b.TieBreak == TieBreakArmageddon {
+			kind = GameArmageddon
+		}
+	}
+
+	x, o := s.Players[0], s.Players[1]
+	if len(s.Games)%2 == 1 {
+		x, o = o, x
+	}
+	game := &SeriesGame{PlayerX: x, PlayerO: o, Kind: kind}
+	s.Games = append(s.Games, game)
+
+	bid, sid, n := b.ID, s.ID, len(s.Games)-1
+	code, err := m.games.StartGame(Game{
+		TournamentID: b.ID,
+		Round:        s.Round,
+		PlayerX:      x,
+		PlayerO:      o,
+		Settings:     b.Settings,
+		Armageddon:   kind == GameArmageddon,
+	}, func(winnerID string) {
+		go func() {
+			if err := m.ReportResult(bid, sid, n, winnerID); err != nil {
+				log.Printf("Bracket %s: ignoring result for %s game %d: %v", bid, sid, n+1, err)
+			}
+		}()
+	})
+	if err != nil {
+		// Without a room nobody can play; the higher seed advances.
+		log.Printf("Bracket %s: failed to start %s game %d: %v", b.ID, s.ID, n+1, err)
+		s.Winner, s.Loser = s.Players[0], s.Players[1]
+		m.complete(b, s)
+		return
+	}
+	game.RoomCode = code
+
+	for _, side := range []struct{ id, color, opponent string }{
+		{x, "X", o},
+		{o, "O", x},
+	} {
+		m.sendTo(side.id, map[string]interface{}{
+			"type":          "TOURNAMENT_GAME",
+			"tournament_id": b.ID,
+			"series":        s.ID,
+			"game":          n + 1,
+			"kind":          kind,
+			"room_code":     code,
+			"color":         side.color,
+			"opponent":      side.opponent,
+		})
+	}
+}
+
+// ReportResult records a series game. winnerID is "" for a draw.
+func (m *KnockoutManager) ReportResult(id, seriesID string, game int, winnerID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	b, ok := m.brackets[id]
+	if !ok {
+		return ErrNotFound
+	}
+	s, ok := b.index[seriesID]
+	if !ok || game < 0 || game >= len(s.Games) || s.Done {
+		return ErrPairingNotFound
+	}
+	g := s.Games[game]
+	if g.Result != ResultPending {
+		return ErrResultAlreadyKnown
+	}
+
+	switch winnerID {
+	case g.PlayerX:
+		g.Result = ResultXWins
+	case g.PlayerO:
+		g.Result = ResultOWins
+	default:
+		g.Result = ResultDraw
+	}
+
+	m.evaluate(b, s, g)
+	m.pushBracket(b)
+	return nil
+}
+
+// evaluate decides whether the series is over after game g.
+func (m *KnockoutManager) evaluate(b *Bracket, s *Series, g *SeriesGame) {
+	x, o := (&Pairing{Result: g.Result}).points()
+	slotX := 0
+	if g.PlayerX != s.Players[0] {
+		slotX = 1
+	}
+
+	switch g.Kind {
+	case GameRegular:
+		s.Score[slotX] += x
+		s.Score[1-slotX] += o
+
+		half := float64(b.BestOf) / 2
+		switch {
+		case s.Score[0] > half:
+			s.Winner, s.Loser = s.Players[0], s.Players[1]
+		case s.Score[1] > half:
+			s.Winner, s.Loser = s.Players[1], s.Players[0]
+		case len(s.Games) < b.BestOf:
+			m.nextGame(b, s)
+			return
+		case s.Score[0] > s.Score[1]:
+			s.Winner, s.Loser = s.Players[0], s.Players[1]
+		case s.Score[1] > s.Score[0]:
+			s.Winner, s.Loser = s.Players[1], s.Players[0]
+		default:
+			m.nextGame(b, s)
+			return
+		}
+	case GameArmageddon:
+		// X must win; a draw counts for O.
+		if g.Result == ResultXWins {
+			s.Winner, s.Loser = g.PlayerX, g.PlayerO
+		} else {
+			s.Winner, s.Loser = g.PlayerO, g.PlayerX
+		}
+	case GameSuddenDeath:
+		switch g.Result {
+		case ResultXWins:
+			s.Winner, s.Loser = g.PlayerX, g.PlayerO
+		case ResultOWins:
+			s.Winner, s.Loser = g.PlayerO, g.PlayerX
+		default:
+			m.nextGame(b, s)
+			return
+		}
+	}
+	m.complete(b, s)
+}
+
+// complete moves the winner and loser on. After a double-elimination grand
+// final won by the losers-bracket player, a reset final is played.
+func (m *KnockoutManager) complete(b *Bracket, s *Series) {
+	s.Done = true
+
+	if s.winnerTo == nil {
+		if s.ID == "GF" && s.Winner != "" && s.Winner == s.Players[1] && s.Players[0] != "" {
+			reset := &Series{ID: "GF2", Bracket: "final", Round: 2, Players: s.Players}
+			reset.ready = [2]bool{true, true}
+			b.add(reset)
+			m.tryStart(b, reset)
+			return
+		}
+		b.Champion = s.Winner
+		b.Status = StatusFinished
+		return
+	}
+
+	m.fill(b, s.winnerTo, s.Winner)
+	m.fill(b, s.loserTo, s.Loser)
+}
+
+func (m *KnockoutManager) pushBracket(b *Bracket) {
+	msg := map[string]interface{}{
+		"type":    "BRACKET_UPDATE",
+		"bracket": b.clone(),
+	}
+	for _, p := range b.Players {
+		m.sendTo(p.ID, msg)
+	}
+}
+
+func (m *KnockoutManager) sendTo(userID string, payload map[string]interface{}) {
+	if m.notifier == nil {
+		return
+	}
+	m.notifier.SendToUser(userID, payload)
+}
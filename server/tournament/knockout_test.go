@@ -0,0 +1,168 @@
+package tournament
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestSeedOrder(t *testing.T) {
+	want := []int{1, 8, 4, 5, 2, 7, 3, 6}
+	if got := seedOrder(8); !reflect.DeepEqual(got, want) {
+		t.Errorf("seedOrder(8) = %v, want %v", got, want)
+	}
+}
+
+func newTestBracket(t *testing.T, m *KnockoutManager, format BracketFormat, bestOf, players int) string {
+	b, err := m.Create("alice", "Cup", format, bestOf, TieBreakArmageddon, Settings{})
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	for i := 0; i < players; i++ {
+		m.Register(b.ID, fmt.Sprintf("p%d", i), 2000-i*10) // p0 is the top seed
+	}
+	if err := m.Start(b.ID); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	return b.ID
+}
+
+// playBracket reports pending games until the bracket finishes, letting
+// pick choose each game's winner.
+func playBracket(t *testing.T, m *KnockoutManager, id string, pick func(s *Series, g *SeriesGame) string) *Bracket {
+	for i := 0; i < 100; i++ {
+		b, _ := m.Get(id)
+		if b.Status == StatusFinished {
+			return b
+		}
+		progressed := false
+		for _, s := range b.Series {
+			for n, g := range s.Games {
+				if g.Result == ResultPending {
+					if err := m.ReportResult(id, s.ID, n, pick(s, g)); err != nil {
+						t.Fatalf("ReportResult %s game %d: %v", s.ID, n, err)
+					}
+					progressed = true
+				}
+			}
+		}
+		if !progressed {
+			t.Fatalf("bracket stalled: %+v", b.Series)
+		}
+	}
+	t.Fatalf("bracket did not finish")
+	return nil
+}
+
+// higherSeed wins every game.
+func higherSeed(s *Series, g *SeriesGame) string {
+	return s.Players[0]
+}
+
+func TestSingleEliminationWithByes(t *testing.T) {
+	starter := &fakeStarter{}
+	m := NewKnockoutManager(starter, nil)
+	id := newTestBracket(t, m, SingleElimination, 1, 5)
+
+	b := playBracket(t, m, id, higherSeed)
+	if b.Champion != "p0" {
+		t.Errorf("expected top seed to win, got %q", b.Champion)
+	}
+	// Five players need four games; byes are walkovers.
+	if len(starter.games) != 4 {
+		t.Errorf("expected 4 games, got %d", len(starter.games))
+	}
+}
+
+func TestBestOfSeriesAlternatesColors(t *testing.T) {
+	starter := &fakeStarter{}
+	m := NewKnockoutManager(starter, nil)
+	id := newTestBracket(t, m, SingleElimination, 3, 2)
+
+	// Each side wins as X: 1-1 after two games, p0 wins the decider.
+	b := playBracket(t, m, id, func(s *Series, g *SeriesGame) string {
+		if len(s.Games) == 3 {
+			return "p0"
+		}
+		return g.PlayerX
+	})
+	s := b.Series[0]
+	if len(s.Games) != 3 || s.Games[0].PlayerX == s.Games[1].PlayerX {
+		t.Errorf("expected 3 games with alternating colors, got %+v", s.Games)
+	}
+	if b.Champion != "p0" || s.Score != [2]float64{2, 1} {
+		t.Errorf("unexpected result: champion %q score %v", b.Champion, s.Score)
+	}
+}
+
+func TestArmageddonDrawSendsOThrough(t *testing.T) {
+	m := NewKnockoutManager(&fakeStarter{}, nil)
+	id := newTestBracket(t, m, SingleElimination, 2, 2)
+
+	var armageddonO string
+	b := playBracket(t, m, id, func(s *Series, g *SeriesGame) string {
+		if g.Kind == GameArmageddon {
+			armageddonO = g.PlayerO
+			return "" // draw
+		}
+		return g.PlayerX
+	})
+	if len(b.Series[0].Games) != 3 || b.Series[0].Games[2].Kind != GameArmageddon {
+		t.Fatalf("expected a 1-1 series decided by armageddon, got %+v", b.Series[0].Games)
+	}
+	if b.Champion != armageddonO {
+		t.Errorf("expected O (%s) to advance on a draw, got %s", armageddonO, b.Champion)
+	}
+}
+
+func TestDoubleElimination(t *testing.T) {
+	starter := &fakeStarter{}
+	m := NewKnockoutManager(starter, nil)
+	id := newTestBracket(t, m, DoubleElimination, 1, 4)
+
+	b := playBracket(t, m, id, higherSeed)
+	if b.Champion != "p0" {
+		t.Errorf("expected top seed to win, got %q", b.Champion)
+	}
+	// 3 winners-bracket games, 2 losers-bracket games and the grand final.
+	if len(starter.games) != 6 {
+		t.Errorf("expected 6 games, got %d", len(starter.games))
+	}
+
+	// Without a bracket reset everybody but the champion is out after
+	// exactly two losses.
+	losses := make(map[string]int)
+	for _, s := range b.Series {
+		if s.Loser != "" {
+			losses[s.Loser]++
+		}
+	}
+	if losses["p0"] != 0 || losses["p1"] != 2 || losses["p2"] != 2 || losses["p3"] != 2 {
+		t.Errorf("unexpected losses %v", losses)
+	}
+}
+
+func TestDoubleEliminationBracketReset(t *testing.T) {
+	m := NewKnockoutManager(&fakeStarter{}, nil)
+	id := newTestBracket(t, m, DoubleElimination, 1, 4)
+
+	// Higher seed wins everywhere except the finals, won by the lower seed.
+	b := playBracket(t, m, id, func(s *Series, g *SeriesGame) string {
+		if s.Bracket == "final" {
+			return s.Players[1]
+		}
+		return s.Players[0]
+	})
+	var reset *Series
+	for _, s := range b.Series {
+		if s.ID == "GF2" {
+			reset = s
+		}
+	}
+	if reset == nil {
+		t.Fatalf("expected a bracket reset final")
+	}
+	if b.Champion != reset.Players[1] {
+		t.Errorf("expected %s to win the reset final, got %s", reset.Players[1], b.Champion)
+	}
+}
@@ -0,0 +1,311 @@
+package tournament
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	ErrNotFound           = errors.New("tournament not found")
+	ErrNotRegistering     = errors.New("tournament is not open for registration")
+	ErrAlreadyStarted     = errors.New("tournament already started")
+	ErrAlreadyRegistered  = errors.New("player already registered")
+	ErrNotEnoughPlayers   = errors.New("tournament needs at least 2 players")
+	ErrUnknownFormat      = errors.New("unknown tournament format")
+	ErrPairingNotFound    = errors.New("pairing not found")
+	ErrResultAlreadyKnown = errors.New("result already recorded")
+)
+
+// Game describes a tournament game that should be played.
+type Game struct {
+	TournamentID string
+	Round        int
+	PlayerX      string
+	PlayerO      string
+	Settings     Settings
+	Armageddon   bool // X gets more time but a draw counts as a win for O
+}
+
+// GameStarter creates the session for a tournament game. report must be
+// called once with the winner's ID ("" for a draw) when the game ends.
+// It returns the room code players use to join.
+type GameStarter interface {
+	StartGame(g Game, report func(winnerID string)) (string, error)
+}
+
+// Notifier delivers a message to a connected user, if online. The message
+// is marshalled like the server's own.
+type Notifier interface {
+	SendToUser(userID string, msg interface{})
+}
+
+type Manager struct {
+	mu          sync.Mutex
+	tournaments map[string]*Tournament
+	games       GameStarter
+	notifier    Notifier
+}
+
+func NewManager(games GameStarter, notifier Notifier) *Manager {
+	return &Manager{
+		tournaments: make(map[string]*Tournament),
+		games:       games,
+		notifier:    notifier,
+	}
+}
+
+func (m *Manager) Create(createdBy, name string, format Format, rounds int, settings Settings) (*Tournament, error) {
+	if format != FormatSwiss && format != FormatRoundRobin {
+		return nil, ErrUnknownFormat
+	}
+
+	t := &Tournament{
+		ID:          uuid.New().String(),
+		Name:        name,
+		Format:      format,
+		Status:      StatusRegistering,
+		Settings:    settings,
+		TotalRounds: rounds,
+		CreatedBy:   createdBy,
+		Players:     []*Player{},
+		Rounds:      []*Round{},
+		CreatedAt:   time.Now(),
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tournaments[t.ID] = t
+	return t.clone(), nil
+}
+
+// Get returns a copy of the tournament safe to read without the lock.
+func (m *Manager) Get(id string) (*Tournament, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.tournaments[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return t.clone(), nil
+}
+
+// List returns copies of all tournaments, newest first.
+func (m *Manager) List() []*Tournament {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	list := make([]*Tournament, 0, len(m.tournaments))
+	for _, t := range m.tournaments {
+		list = append(list, t.clone())
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.After(list[j].CreatedAt) })
+	return list
+}
+
+func (m *Manager) Register(id, userID string, rating int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, ok := m.tournaments[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if t.Status != StatusRegistering {
+		return ErrNotRegistering
+	}
+	if t.player(userID) != nil {
+		return ErrAlreadyRegistered
+	}
+	t.Players = append(t.Players, &Player{ID: userID, Rating: rating})
+	return nil
+}
+
+// Start closes registration and plays the first round.
+func (m *Manager) Start(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, ok := m.tournaments[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if t.Status != StatusRegistering {
+		return ErrAlreadyStarted
+	}
+	if len(t.Players) < 2 {
+		return ErrNotEnoughPlayers
+	}
+
+	switch t.Format {
+	case FormatSwiss:
+		if t.TotalRounds <= 0 || t.TotalRounds > len(t.Players)-1 {
+			t.TotalRounds = defaultSwissRounds(len(t.Players))
+		}
+	case FormatRoundRobin:
+		// Seed by rating so the schedule is deterministic.
+		sort.SliceStable(t.Players, func(i, j int) bool { return t.Players[i].Rating > t.Players[j].Rating })
+		t.schedule = roundRobinSchedule(t.Players)
+		t.TotalRounds = len(t.schedule)
+	}
+
+	t.Status = StatusRunning
+	err := m.nextRound(t)
+	m.pushStandings(t)
+	return err
+}
+
+// ReportResult records the outcome of a game. winnerID is "" for a draw.
+func (m *Manager) ReportResult(id string, round int, playerX, winnerID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, ok := m.tournaments[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if round < 1 || round > len(t.Rounds) {
+		return ErrPairingNotFound
+	}
+
+	var pairing *Pairing
+	for _, p := range t.Rounds[round-1].Pairings {
+		if p.PlayerX == playerX && p.PlayerO != "" {
+			pairing = p
+			break
+		}
+	}
+	if pairing == nil {
+		return ErrPairingNotFound
+	}
+	if pairing.Result != ResultPending {
+		return ErrResultAlreadyKnown
+	}
+
+	switch winnerID {
+	case pairing.PlayerX:
+		pairing.Result = ResultXWins
+	case pairing.PlayerO:
+		pairing.Result = ResultOWins
+	default:
+		pairing.Result = ResultDraw
+	}
+
+	if round == len(t.Rounds) && t.currentRound().complete() {
+		if err := m.nextRound(t); err != nil {
+			log.Printf("Tournament %s: failed to pair next round: %v", t.ID, err)
+		}
+	}
+	m.pushStandings(t)
+	return nil
+}
+
+// nextRound pairs and starts the next round, or finishes the tournament.
+// Rounds that need no games complete immediately. Callers push standings.
+func (m *Manager) nextRound(t *Tournament) error {
+	for {
+		if len(t.Rounds) >= t.TotalRounds {
+			t.Status = StatusFinished
+			return nil
+		}
+
+		var round *Round
+		switch t.Format {
+		case FormatSwiss:
+			pairings, err := pairSwiss(t)
+			if err != nil {
+				// Nobody can be paired without a rematch; end early.
+				t.Status = StatusFinished
+				return err
+			}
+			round = &Round{Number: len(t.Rounds) + 1, Pairings: pairings}
+		case FormatRoundRobin:
+			round = t.schedule[0]
+			t.schedule = t.schedule[1:]
+		}
+		t.Rounds = append(t.Rounds, round)
+
+		for _, p := range round.Pairings {
+			if p.PlayerO == "" {
+				m.sendTo(p.PlayerX, map[string]interface{}{
+					"type":          "TOURNAMENT_BYE",
+					"tournament_id": t.ID,
+					"round":         round.Number,
+				})
+				continue
+			}
+			m.startGame(t, round.Number, p)
+		}
+
+		if !round.complete() {
+			return nil
+		}
+	}
+}
+
+func (m *Manager) startGame(t *Tournament, round int, p *Pairing) {
+	tid, playerX := t.ID, p.PlayerX
+	code, err := m.games.StartGame(Game{
+		TournamentID: t.ID,
+		Round:        round,
+		PlayerX:      p.PlayerX,
+		PlayerO:      p.PlayerO,
+		Settings:     t.Settings,
+	}, func(winnerID string) {
+		// Reported asynchronously so the game's own locks are released first.
+		go func() {
+			if err := m.ReportResult(tid, round, playerX, winnerID); err != nil {
+				log.Printf("Tournament %s: ignoring result for round %d: %v", tid, round, err)
+			}
+		}()
+	})
+	if err != nil {
+		log.Printf("Tournament %s: failed to start game %s vs %s: %v", t.ID, p.PlayerX, p.PlayerO, err)
+		p.Result = ResultDraw
+		return
+	}
+	p.RoomCode = code
+
+	for _, side := range []struct{ id, color, opponent string }{
+		{p.PlayerX, "X", p.PlayerO},
+		{p.PlayerO, "O", p.PlayerX},
+	} {
+		m.sendTo(side.id, map[string]interface{}{
+			"type":          "TOURNAMENT_GAME",
+			"tournament_id": t.ID,
+			"round":         round,
+			"room_code":     code,
+			"color":         side.color,
+			"opponent":      side.opponent,
+		})
+	}
+}
+
+// pushStandings sends the live table to every participant.
+func (m *Manager) pushStandings(t *Tournament) {
+	round := 0
+	if r := t.currentRound(); r != nil {
+		round = r.Number
+	}
+	msg := map[string]interface{}{
+		"type":          "TOURNAMENT_STANDINGS",
+		"tournament_id": t.ID,
+		"status":        t.Status,
+		"round":         round,
+		"total_rounds":  t.TotalRounds,
+		"standings":     t.Standings(),
+	}
+	for _, p := range t.Players {
+		m.sendTo(p.ID, msg)
+	}
+}
+
+func (m *Manager) sendTo(userID string, payload map[string]interface{}) {
+	if m.notifier == nil {
+		return
+	}
+	m.notifier.SendToUser(userID, payload)
+}
@@ -0,0 +1,212 @@
+package tournament
+
+import (
+	"errors"
+	"sort"
+)
+
+var ErrNoPairing = errors.New("no valid pairing without repeat games")
+
+// history summarises what each player has played so far.
+type history struct {
+	met     map[string]map[string]bool
+	colors  map[string]int    // games as X minus games as O
+	last    map[string]string // last color played, "X" or "O"
+	hadBye  map[string]bool
+	scores  map[string]float64
+	ratings map[string]int
+}
+
+func newHistory(t *Tournament) *history {
+	h := &history{
+		met:     make(map[string]map[string]bool),
+		colors:  make(map[string]int),
+		last:    make(map[string]string),
+		hadBye:  make(map[string]bool),
+		scores:  t.Scores(),
+		ratings: make(map[string]int),
+	}
+	for _, p := range t.Players {
+		h.met[p.ID] = make(map[string]bool)
+		h.ratings[p.ID] = p.Rating
+	}
+	for _, r := range t.Rounds {
+		for _, p := range r.Pairings {
+			if p.PlayerO == "" {
+				h.hadBye[p.PlayerX] = true
+				continue
+			}
+			h.met[p.PlayerX][p.PlayerO] = true
+			h.met[p.PlayerO][p.PlayerX] = true
+			h.colors[p.PlayerX]++
+			h.colors[p.PlayerO]--
+			h.last[p.PlayerX] = "X"
+			h.last[p.PlayerO] = "O"
+		}
+	}
+	return h
+}
+
+// ranked returns player IDs ordered by score, then rating, then ID.
+func (h *history) ranked(players []*Player) []string {
+	ids := make([]string, len(players))
+	for i, p := range players {
+		ids[i] = p.ID
+	}
+	sort.SliceStable(ids, func(i, j int) bool {
+		a, b := ids[i], ids[j]
+		if h.scores[a] != h.scores[b] {
+			return h.scores[a] > h.scores[b]
+		}
+		if h.ratings[a] != h.ratings[b] {
+			return h.ratings[a] > h.ratings[b]
+		}
+		return a < b
+	})
+	return ids
+}
+
+// pairSwiss pairs the next round Dutch-style: players are ranked by score,
+// each score group is split in halves and the top half plays the bottom half
+// in order. Repeat games are never allowed; players that cannot be paired in
+// their group float down to the next one. With an odd number of players the
+// lowest ranked player without a bye gets one.
+func pairSwiss(t *Tournament) ([]*Pairing, error) {
+	h := newHistory(t)
+	ranked := h.ranked(t.Players)
+
+	var pairings []*Pairing
+	if len(ranked)%2 == 1 {
+		bye := -1
+		for i := len(ranked) - 1; i >= 0; i-- {
+			if !h.hadBye[ranked[i]] {
+				bye = i
+				break
+			}
+		}
+		if bye < 0 {
+			bye = len(ranked) - 1
+		}
+		pairings = append(pairings, &Pairing{PlayerX: ranked[bye], Result: ResultBye})
+		ranked = append(ranked[:bye:bye], ranked[bye+1:]...)
+	}
+
+	pairs, ok := h.pairRemaining(ranked)
+	if !ok {
+		return nil, ErrNoPairing
+	}
+	for _, pair := range pairs {
+		x, o := h.assignColors(pair[0], pair[1])
+		pairings = append(pairings, &Pairing{PlayerX: x, PlayerO: o})
+	}
+	return pairings, nil
+}
+
+// pairRemaining pairs the highest ranked remaining player with the best
+// candidate and recurses, backtracking when the rest cannot be paired.
+func (h *history) pairRemaining(ranked []string) ([][2]string, bool) {
+	if len(ranked) == 0 {
+		return nil, true
+	}
+	top := ranked[0]
+	for _, i := range h.candidates(ranked) {
+		opp := ranked[i]
+		if h.met[top][opp] {
+			continue
+		}
+		rest := make([]string, 0, len(ranked)-2)
+		rest = append(rest, ranked[1:i]...)
+		rest = append(rest, ranked[i+1:]...)
+		if pairs, ok := h.pairRemaining(rest); ok {
+			return append([][2]string{{top, opp}}, pairs...), true
+		}
+	}
+	return nil, false
+}
+
+// candidates returns indexes into ranked in the order the top player should
+// try them: the Dutch opponent from the same score group first, then the rest
+// of the bottom half, then the top half, then lower score groups.
+func (h *history) candidates(ranked []string) []int {
+	score := h.scores[ranked[0]]
+	group := 1
+	for group < len(ranked) && h.scores[ranked[group]] == score {
+		group++
+	}
+
+	var order []int
+	half := group / 2
+	if half == 0 {
+		half = 1
+	}
+	for i := half; i < group; i++ {
+		order = append(order, i)
+	}
+	for i := half - 1; i >= 1; i-- {
+		order = append(order, i)
+	}
+	for i := group; i < len(ranked); i++ {
+		order = append(order, i)
+	}
+	return order
+}
+
+// assignColors gives X to the player who has had it less, falling back to
+// alternating from the last game and then to the higher ranked player.
+func (h *history) assignColors(a, b string) (string, string) {
+	if h.colors[a] != h.colors[b] {
+		if h.colors[a] < h.colors[b] {
+			return a, b
+		}
+		return b, a
+	}
+	if h.last[a] == "X" && h.last[b] != "X" {
+		return b, a
+	}
+	if h.last[b] == "X" && h.last[a] != "X" {
+		return a, b
+	}
+	return a, b
+}
+
+// roundRobinSchedule builds every round of a round-robin using the circle
+// method. Colors alternate so each player gets X in about half their games.
+func roundRobinSchedule(players []*Player) []*Round {
+	ids := make([]string, len(players))
+	for i, p := range players {
+		ids[i] = p.ID
+	}
+	if len(ids)%2 == 1 {
+		ids = append(ids, "") // bye
+	}
+	n := len(ids)
+	if n < 2 {
+		return nil
+	}
+
+	rounds := make([]*Round, 0, n-1)
+	for r := 0; r < n-1; r++ {
+		round := &Round{Number: r + 1}
+		for i := 0; i < n/2; i++ {
+			a, b := ids[i], ids[n-1-i]
+			if (i == 0 && r%2 == 1) || (i > 0 && i%2 == 1) {
+				a, b = b, a
+			}
+			switch {
+			case a == "":
+				round.Pairings = append(round.Pairings, &Pairing{PlayerX: b, Result: ResultBye})
+			case b == "":
+				round.Pairings = append(round.Pairings, &Pairing{PlayerX: a, Result: ResultBye})
+			default:
+				round.Pairings = append(round.Pairings, &Pairing{PlayerX: a, PlayerO: b})
+			}
+		}
+		rounds = append(rounds, round)
+
+		// Keep the first player fixed and rotate the rest clockwise.
+		last := ids[n-1]
+		copy(ids[2:], ids[1:n-1])
+		ids[1] = last
+	}
+	return rounds
+}
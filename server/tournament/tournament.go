@@ -0,0 +1,245 @@
+// Package tournament implements structured events (Swiss and round-robin)
+// on top of the server's regular game sessions.
+package tournament
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"caro_chess_server/engine"
+)
+
+type Format string
+
+const (
+	FormatSwiss      Format = "swiss"
+	FormatRoundRobin Format = "round_robin"
+)
+
+type Status string
+
+const (
+	StatusRegistering Status = "registering"
+	StatusRunning     Status = "running"
+	StatusFinished    Status = "finished"
+)
+
+type Result string
+
+const (
+	ResultPending Result = ""
+	ResultXWins   Result = "1-0"
+	ResultOWins   Result = "0-1"
+	ResultDraw    Result = "1/2-1/2"
+	ResultBye     Result = "bye"
+)
+
+// Settings are the game settings used for every game of a tournament.
+type Settings struct {
+	Rule      engine.GameRule `json:"rule"`
+	TotalTime int             `json:"total_time"` // seconds
+	Increment int             `json:"increment"`  // seconds
+	TurnLimit int             `json:"turn_limit"` // seconds
+
+	// Spectators watch games this many seconds and/or moves behind.
+	SpectatorDelay      int `json:"spectator_delay,omitempty"`
+	SpectatorDelayMoves int `json:"spectator_delay_moves,omitempty"`
+}
+
+type Player struct {
+	ID     string `json:"id"`
+	Rating int    `json:"rating"`
+}
+
+// Pairing is one game of a round. PlayerO is empty for a bye.
+type Pairing struct {
+	PlayerX  string `json:"player_x"`
+	PlayerO  string `json:"player_o,omitempty"`
+	Result   Result `json:"result"`
+	RoomCode string `json:"room_code,omitempty"`
+}
+
+type Round struct {
+	Number   int        `json:"number"`
+	Pairings []*Pairing `json:"pairings"`
+}
+
+type Tournament struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	Format      Format    `json:"format"`
+	Status      Status    `json:"status"`
+	Settings    Settings  `json:"settings"`
+	TotalRounds int       `json:"total_rounds"`
+	Players     []*Player `json:"players"`
+	Rounds      []*Round  `json:"rounds"`
+	CreatedBy   string    `json:"created_by"` // May start it, as may moderators
+	CreatedAt   time.Time `json:"created_at"`
+
+	// schedule holds the precomputed round-robin rounds not yet played.
+	schedule []*Round
+}
+
+// Standing is a player's position in the tournament table.
+type Standing struct {
+	Rank            int     `json:"rank"`
+	PlayerID        string  `json:"player_id"`
+	Rating          int     `json:"rating"`
+	Score           float64 `json:"score"`
+	Buchholz        float64 `json:"buchholz"`
+	SonnebornBerger float64 `json:"sonneborn_berger"`
+	Games           int     `json:"games"`
+}
+
+func (t *Tournament) player(id string) *Player {
+	for _, p := range t.Players {
+		if p.ID == id {
+			return p
+		}
+	}
+	return nil
+}
+
+func (t *Tournament) currentRound() *Round {
+	if len(t.Rounds) == 0 {
+		return nil
+	}
+	return t.Rounds[len(t.Rounds)-1]
+}
+
+func (r *Round) complete() bool {
+	for _, p := range r.Pairings {
+		if p.Result == ResultPending {
+			return false
+		}
+	}
+	return true
+}
+
+// points returns the points scored by X and O for a finished pairing.
+func (p *Pairing) points() (float64, float64) {
+	switch p.Result {
+	case ResultXWins, ResultBye:
+		return 1, 0
+	case ResultOWins:
+		return 0, 1
+	case ResultDraw:
+		return 0.5, 0.5
+	}
+	return 0, 0
+}
+
+// Scores returns every player's current score.
+func (t *Tournament) Scores() map[string]float64 {
+	scores := make(map[string]float64, len(t.Players))
+	for _, p := range t.Players {
+		scores[p.ID] = 0
+	}
+	for _, r := range t.Rounds {
+		for _, p := range r.Pairings {
+			x, o := p.points()
+			scores[p.PlayerX] += x
+			if p.PlayerO != "" {
+				scores[p.PlayerO] += o
+			}
+		}
+	}
+	return scores
+}
+
+// Standings ranks players by score, then Buchholz, then Sonneborn-Berger,
+// then rating.
+func (t *Tournament) Standings() []Standing {
+	scores := t.Scores()
+	buchholz := make(map[string]float64)
+	sb := make(map[string]float64)
+	games := make(map[string]int)
+
+	for _, r := range t.Rounds {
+		for _, p := range r.Pairings {
+			if p.Result == ResultPending {
+				continue
+			}
+			games[p.PlayerX]++
+			if p.PlayerO == "" {
+				continue
+			}
+			games[p.PlayerO]++
+
+			// Buchholz: sum of opponents' scores.
+			buchholz[p.PlayerX] += scores[p.PlayerO]
+			buchholz[p.PlayerO] += scores[p.PlayerX]
+
+			// Sonneborn-Berger: opponents' scores weighted by the result against them.
+			x, o := p.points()
+			sb[p.PlayerX] += x * scores[p.PlayerO]
+			sb[p.PlayerO] += o * scores[p.PlayerX]
+		}
+	}
+
+	standings := make([]Standing, 0, len(t.Players))
+	for _, p := range t.Players {
+		standings = append(standings, Standing{
+			PlayerID:        p.ID,
+			Rating:          p.Rating,
+			Score:           scores[p.ID],
+			Buchholz:        buchholz[p.ID],
+			SonnebornBerger: sb[p.ID],
+			Games:           games[p.ID],
+		})
+	}
+
+	sort.SliceStable(standings, func(i, j int) bool {
+		a, b := standings[i], standings[j]
+		if a.Score != b.Score {
+			return a.Score > b.Score
+		}
+		if a.Buchholz != b.Buchholz {
+			return a.Buchholz > b.Buchholz
+		}
+		if a.SonnebornBerger != b.SonnebornBerger {
+			return a.SonnebornBerger > b.SonnebornBerger
+		}
+		if a.Rating != b.Rating {
+			return a.Rating > b.Rating
+		}
+		return a.PlayerID < b.PlayerID
+	})
+	for i := range standings {
+		standings[i].Rank = i + 1
+	}
+	return standings
+}
+
+// defaultSwissRounds is enough rounds to separate a single winner.
+func defaultSwissRounds(players int) int {
+	if players < 2 {
+		return 0
+	}
+	rounds := int(math.Ceil(math.Log2(float64(players))))
+	if rounds > players-1 {
+		rounds = players - 1
+	}
+	return rounds
+}
+
+func (t *Tournament) clone() *Tournament {
+	c := *t
+	c.schedule = nil
+	c.Players = make([]*Player, len(t.Players))
+	for i, p := range t.Players {
+		cp := *p
+		c.Players[i] = &cp
+	}
+	c.Rounds = make([]*Round, len(t.Rounds))
+	for i, r := range t.Rounds {
+		cr := &Round{Number: r.Number, Pairings: make([]*Pairing, len(r.Pairings))}
+		for j, p := range r.Pairings {
+			cp := *p
+			cr.Pairings[j] = &cp
+		}
+		c.Rounds[i] = cr
+	}
+	return &c
+}
@@ -0,0 +1,178 @@
+package tournament
+
+import (
+	"fmt"
+	"testing"
+)
+
+type fakeStarter struct {
+	games []Game
+}
+
+func (f *fakeStarter) StartGame(g Game, report func(winnerID string)) (string, error) {
+	f.games = append(f.games, g)
+	return fmt.Sprintf("R%03d", len(f.games)), nil
+}
+
+func newTestTournament(t *testing.T, m *Manager, format Format, rounds, players int) string {
+	tour, err := m.Create("alice", "Test", format, rounds, Settings{})
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	for i := 0; i < players; i++ {
+		if err := m.Register(tour.ID, fmt.Sprintf("p%d", i), 1200+i*10); err != nil {
+			t.Fatalf("Register failed: %v", err)
+		}
+	}
+	return tour.ID
+}
+
+// playOut reports every pending game of the current round, X always winning.
+func playOut(t *testing.T, m *Manager, id string) {
+	tour, _ := m.Get(id)
+	round := tour.Rounds[len(tour.Rounds)-1]
+	for _, p := range round.Pairings {
+		if p.Result == ResultPending {
+			if err := m.ReportResult(id, round.Number, p.PlayerX, p.PlayerX); err != nil {
+				t.Fatalf("ReportResult failed: %v", err)
+			}
+		}
+	}
+}
+
+func TestSwissNoRepeatPairings(t *testing.T) {
+	m := NewManager(&fakeStarter{}, nil)
+	id := newTestTournament(t, m, FormatSwiss, 4, 7)
+
+	if err := m.Start(id); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	for i := 0; i < 4; i++ {
+		playOut(t, m, id)
+	}
+
+	tour, _ := m.Get(id)
+	if tour.Status != StatusFinished {
+		t.Fatalf("expected finished, got %s after %d rounds", tour.Status, len(tour.Rounds))
+	}
+
+	met := make(map[string]bool)
+	byes := make(map[string]bool)
+	colors := make(map[string]int)
+	for _, r := range tour.Rounds {
+		for _, p := range r.Pairings {
+			if p.PlayerO == "" {
+				if byes[p.PlayerX] {
+					t.Errorf("%s received two byes", p.PlayerX)
+				}
+				byes[p.PlayerX] = true
+				continue
+			}
+			key := p.PlayerX + "-" + p.PlayerO
+			if p.PlayerO < p.PlayerX {
+				key = p.PlayerO + "-" + p.PlayerX
+			}
+			if met[key] {
+				t.Errorf("repeat pairing %s in round %d", key, r.Number)
+			}
+			met[key] = true
+			colors[p.PlayerX]++
+			colors[p.PlayerO]--
+		}
+	}
+	for id, diff := range colors {
+		if diff > 2 || diff < -2 {
+			t.Errorf("%s color imbalance %d", id, diff)
+		}
+	}
+}
+
+func TestSwissFirstRoundDutchPairing(t *testing.T) {
+	m := NewManager(&fakeStarter{}, nil)
+	id := newTestTournament(t, m, FormatSwiss, 3, 4)
+	m.Start(id)
+
+	tour, _ := m.Get(id)
+	// Seeds by rating: p3, p2, p1, p0. Top half plays bottom half in order.
+	want := map[string]string{"p3": "p1", "p2": "p0"}
+	for _, p := range tour.Rounds[0].Pairings {
+		a, b := p.PlayerX, p.PlayerO
+		if want[a] != b && want[b] != a {
+			t.Errorf("unexpected pairing %s vs %s", a, b)
+		}
+	}
+}
+
+func TestRoundRobinEveryoneMeetsOnce(t *testing.T) {
+	starter := &fakeStarter{}
+	m := NewManager(starter, nil)
+	id := newTestTournament(t, m, FormatRoundRobin, 0, 5)
+
+	if err := m.Start(id); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	tour, _ := m.Get(id)
+	for i := 0; i < tour.TotalRounds; i++ {
+		playOut(t, m, id)
+	}
+
+	tour, _ = m.Get(id)
+	if tour.Status != StatusFinished {
+		t.Fatalf("expected finished, got %s", tour.Status)
+	}
+	if len(starter.games) != 10 {
+		t.Errorf("expected 10 games for 5 players, got %d", len(starter.games))
+	}
+	met := make(map[string]int)
+	for _, g := range starter.games {
+		a, b := g.PlayerX, g.PlayerO
+		if b < a {
+			a, b = b, a
+		}
+		met[a+"-"+b]++
+	}
+	for key, n := range met {
+		if n != 1 {
+			t.Errorf("%s met %d times", key, n)
+		}
+	}
+}
+
+func TestTiebreaks(t *testing.T) {
+	tour := &Tournament{
+		Players: []*Player{{ID: "a"}, {ID: "b"}, {ID: "c"}, {ID: "d"}},
+		Rounds: []*Round{
+			{Number: 1, Pairings: []*Pairing{
+				{PlayerX: "a", PlayerO: "b", Result: ResultXWins},
+				{PlayerX: "c", PlayerO: "d", Result: ResultDraw},
+			}},
+			{Number: 2, Pairings: []*Pairing{
+				{PlayerX: "a", PlayerO: "c", Result: ResultDraw},
+				{PlayerX: "d", PlayerO: "b", Result: ResultOWins},
+			}},
+		},
+	}
+
+	// Scores: a 1.5, b 1, c 1, d 0.5
+	byID := make(map[string]Standing)
+	for _, s := range tour.Standings() {
+		byID[s.PlayerID] = s
+	}
+
+	if byID["a"].Score != 1.5 || byID["a"].Rank != 1 {
+		t.Errorf("a: unexpected standing %+v", byID["a"])
+	}
+	// a played b (1) and c (1).
+	if byID["a"].Buchholz != 2 {
+		t.Errorf("a: expected Buchholz 2, got %v", byID["a"].Buchholz)
+	}
+	// a beat b (1) and drew c (0.5 * 1).
+	if byID["a"].SonnebornBerger != 1.5 {
+		t.Errorf("a: expected SB 1.5, got %v", byID["a"].SonnebornBerger)
+	}
+	// b and c tie on score and Buchholz (both 2), so Sonneborn-Berger
+	// decides: c drew a and d (0.75 + 0.25), b only beat d (0.5).
+	if byID["c"].Rank >= byID["b"].Rank {
+		t.Errorf("expected c ahead of b, got c=%d b=%d", byID["c"].Rank, byID["b"].Rank)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"time"
+
+	"caro_chess_server/engine"
+	"caro_chess_server/tournament"
+)
+
+// noShowTimeout is how long a tournament player has to join their game
+// before forfeiting it.
+const noShowTimeout = 2 * time.Minute
+
+// roomGameStarter plays tournament games in reserved rooms. Players receive
+// the room code and join it like any other room.
+type roomGameStarter struct {
+	rm *RoomManager
+	mm *Matchmaker
+}
+
+func (s *roomGameStarter) StartGame(g tournament.Game, report func(winnerID string)) (string, error) {
+	rule := g.Settings.Rule
+	if rule == "" {
+		rule = engine.RuleStandard
+	}
+	totalTime := secondsOr(g.Settings.TotalTime, 5*time.Minute)
+	increment := secondsOr(g.Settings.Increment, 5*time.Second)
+	turnLimit := secondsOr(g.Settings.TurnLimit, 30*time.Second)
+
+	code, session := s.rm.createReservedRoom(g.PlayerX, g.PlayerO, totalTime, increment, turnLimit, rule)
+	session.Lock()
+	if g.Armageddon {
+		session.TotalTimeO = totalTime * 4 / 5
+	}
+	session.OnGameEnd = report
+	session.Unlock()
+	session.setSpectatorDelay(time.Duration(g.Settings.SpectatorDelay)*time.Second, g.Settings.SpectatorDelayMoves)
+
+	// Seats are empty until players join; joining stops their timer.
+	for _, isX := range []bool{true, false} {
+		isX := isX
+		session.StartDisconnectTimer(isX, noShowTimeout, func() {
+			s.noShow(session, isX)
+		})
+	}
+	return code, nil
+}
+
+// noShow forfeits the game of the player who didn't join in time, or ends
+// it with no winner if the other seat is empty too.
+func (s *roomGameStarter) noShow(session *GameSession, isX bool) {
+	x, o := session.players()
+	if (isX && o == nil) || (!isX && x == nil) {
+		s.mm.abort(session, "no_show")
+		return
+	}
+	s.mm.forfeit(session, isX, "no_show")
+}
+
+func secondsOr(seconds int, fallback time.Duration) time.Duration {
+	if seconds <= 0 {
+		return fallback
+	}
+	return time.Duration(seconds) * time.Second
+}
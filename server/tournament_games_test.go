@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"caro_chess_server/db"
+	"caro_chess_server/tournament"
+)
+
+func TestTournamentNoShow(t *testing.T) {
+	repo := db.NewMemoryUserRepository()
+	starter := &roomGameStarter{rm: newRoomManager(), mm: newMatchmaker(repo)}
+
+	start := func(playerX, playerO string) (*GameSession, chan string) {
+		reported := make(chan string, 2)
+		code, err := starter.StartGame(tournament.Game{PlayerX: playerX, PlayerO: playerO}, func(winnerID string) { reported <- winnerID })
+		if err != nil {
+			t.Fatalf("StartGame failed: %v", err)
+		}
+		session, _ := starter.rm.getRoom(code)
+		t.Cleanup(session.StopGame)
+		return session, reported
+	}
+
+	// Only O turned up: X forfeits.
+	session, reported := start("p1", "p2")
+	if err := starter.rm.joinRoom(session.Code, &Client{ID: "p2", send: make(chan *wireMessage, 10)}); err != nil {
+		t.Fatalf("joinRoom failed: %v", err)
+	}
+	starter.noShow(session, true)
+	select {
+	case winnerID := <-reported:
+		if winnerID != "p2" {
+			t.Errorf("expected p2 to win by forfeit, got %q", winnerID)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("forfeit was not reported")
+	}
+
+	// Nobody turned up: nobody wins and nothing is rated.
+	session, reported = start("p3", "p4")
+	starter.noShow(session, true)
+	starter.noShow(session, false)
+	select {
+	case winnerID := <-reported:
+		if winnerID != "" {
+			t.Errorf("expected no winner when neither player joined, got %q", winnerID)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("double forfeit was not reported")
+	}
+	if len(reported) != 0 {
+		t.Errorf("expected the result to be reported once")
+	}
+	if _, result := session.lastEvent(); result == nil || result.Winner != "" || result.Reason != "no_show" {
+		t.Errorf("expected GAME_OVER with no winner, got %+v", result)
+	}
+	if u, _ := repo.GetUser("p3"); u.GamesPlayed != 0 {
+		t.Errorf("expected a double no-show not to be rated, got %+v", u)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"caro_chess_server/db"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	writeWait  = 10 * time.Second
+	pongWait   = 60 * time.Second
+	pingPeriod = (pongWait * 9) / 10
+	// maxMessageSize fits the longest chat message, maxChatLength
+	// characters, even with each escaped in JSON as a surrogate pair (12
+	// bytes), with room for the rest of the message. Every other client
+	// message is far smaller.
+	maxMessageSize = 4096
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	CheckOrigin:     func(r *http.Request) bool { return true },
+	Subprotocols:    subprotocols,
+}
+
+// wsTransport connects a client through a WebSocket.
+type wsTransport struct {
+	conn  *websocket.Conn
+	codec codec // Wire encoding; client messages are JSON everywhere else
+}
+
+func (t *wsTransport) remoteAddr() string { return t.conn.RemoteAddr().String() }
+func (t *wsTransport) close()             { t.conn.Close() }
+
+func serveWs(hub *Hub, mm *Matchmaker, rm *RoomManager, w http.ResponseWriter, r *http.Request, id string) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	t := &wsTransport{conn: conn, codec: codecFor(conn.Subprotocol())}
+	// Refused after the upgrade rather than before, since browsers hide
+	// why a handshake failed.
+	if err := mm.sanctions.check(id, db.SanctionBan); err != nil {
+		t.write(encode(newErrorMessage(err)))
+		t.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, ""))
+		conn.Close()
+		return
+	}
+	client := newClient(id, hub, mm, rm, t)
+	client.connect()
+
+	go t.writePump(client)
+	go t.readPump(client)
+}
+
+func (t *wsTransport) readPump(c *Client) {
+	defer c.disconnect()
+	t.conn.SetReadLimit(maxMessageSize)
+	t.conn.SetReadDeadline(time.Now().Add(pongWait))
+	t.conn.SetPongHandler(func(string) error { t.conn.SetReadDeadline(time.Now().Add(pongWait)); return nil })
+	for {
+		_, frame, err := t.conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+				log.Printf("error: %v", err)
+			}
+			break
+		}
+		message, err := t.codec.decode(frame)
+		if err != nil {
+			c.sendError(&request{}, errBadRequest)
+			continue
+		}
+
+		c.handleMessage(message)
+	}
+}
+
+func (t *wsTransport) writePump(c *Client) {
+	defer t.conn.Close()
+	c.pump(t.write, t.ping, pingPeriod)
+
+	t.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	t.conn.WriteMessage(websocket.CloseMessage, []byte{})
+}
+
+// write sends one message in the client's encoding.
+func (t *wsTransport) write(message *wireMessage) error {
+	frame := t.codec.frame(message)
+	if frame == nil {
+		return nil // Failed to encode; logged already
+	}
+	t.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	w, err := t.conn.NextWriter(t.codec.frameType())
+	if err != nil {
+		return err
+	}
+	w.Write(frame)
+	return w.Close()
+}
+
+func (t *wsTransport) ping() error {
+	t.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return t.conn.WriteMessage(websocket.PingMessage, nil)
+}